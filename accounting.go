@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Accounts used in exports. Paid sats are a liability until they're spent:
+// they only become income once an event or service is charged against them.
+const (
+	AccountLightning        = "Assets:Lightning"
+	AccountCustomerBalances = "Liabilities:CustomerBalances"
+	AccountEventIncome      = "Income:Events"
+	AccountServiceIncome    = "Income:Services"
+	AccountPromotions       = "Expenses:Promotions"
+)
+
+// LedgerEntry is one double-entry movement: AmountMsat goes into Debit and
+// out of Credit.
+type LedgerEntry struct {
+	Time        time.Time
+	ID          string
+	PubKey      string
+	Category    string
+	Debit       string
+	Credit      string
+	AmountMsat  int64
+	Description string
+}
+
+// GetLedgerEntries collects every ledger movement between from and until in
+// chronological order. Events stored before per-event charges are booked as
+// one-sat charges at the time they were created.
+func GetLedgerEntries(from time.Time, until time.Time, db Database) ([]LedgerEntry, error) {
+	queries := []struct {
+		category    string
+		debit       string
+		credit      string
+		description string
+		query       string
+	}{
+		{"payment", AccountLightning, AccountCustomerBalances, "Zap payment",
+			`SELECT id, pubkey, amount_msat, created_at FROM zap_credit WHERE created_at >= ? AND created_at < ?`},
+		{"refund", AccountCustomerBalances, AccountLightning, "Revoked zap payment",
+			`SELECT r.id, c.pubkey, c.amount_msat, r.revoked_at FROM zap_revocation r JOIN zap_credit c ON c.id = r.id WHERE r.revoked_at >= ? AND r.revoked_at < ?`},
+		{"trial", AccountPromotions, AccountCustomerBalances, "Trial credits",
+			`SELECT 'trial:' || pubkey, pubkey, amount_msat, granted_at FROM trial_credit WHERE granted_at >= ? AND granted_at < ?`},
+		{"bonus", AccountPromotions, AccountCustomerBalances, "Bonus credits",
+			`SELECT id, pubkey, amount_msat, created_at FROM bonus_credit WHERE created_at >= ? AND created_at < ?`},
+		{"event", AccountCustomerBalances, AccountEventIncome, "Event charge",
+			`SELECT id, pubkey, amount_msat, created_at FROM debit WHERE id LIKE 'event:%' AND amount_msat > 0 AND created_at >= ? AND created_at < ?`},
+		{"event", AccountCustomerBalances, AccountEventIncome, "Event charge",
+			`SELECT 'event:' || id, pubkey, 1000, created_at FROM event WHERE created_at >= ? AND created_at < ? AND NOT EXISTS (SELECT 1 FROM debit WHERE debit.id = 'event:' || event.id)`},
+		{"refund", AccountCustomerBalances, AccountLightning, "Refunded balance",
+			`SELECT id, pubkey, amount_msat, created_at FROM debit WHERE id LIKE 'refund:%' AND created_at >= ? AND created_at < ?`},
+		{"refund", AccountEventIncome, AccountCustomerBalances, "Refunded charge of a removed event",
+			`SELECT id, pubkey, -amount_msat, created_at FROM debit WHERE id LIKE 'escrow:%' AND created_at >= ? AND created_at < ?`},
+		{"service", AccountCustomerBalances, AccountServiceIncome, "Service charge",
+			`SELECT id, pubkey, amount_msat, created_at FROM debit WHERE id NOT LIKE 'event:%' AND id NOT LIKE 'refund:%' AND id NOT LIKE 'escrow:%' AND created_at >= ? AND created_at < ?`},
+	}
+
+	var entries []LedgerEntry
+	for _, q := range queries {
+		rows, err := db.DB.Query(q.query, from.Unix(), until.Unix())
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			entry := LedgerEntry{Category: q.category, Debit: q.debit, Credit: q.credit, Description: q.description}
+			var createdAt int64
+			if err := rows.Scan(&entry.ID, &entry.PubKey, &entry.AmountMsat, &createdAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			entry.Time = time.Unix(createdAt, 0).UTC()
+			entries = append(entries, entry)
+		}
+		rows.Close()
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, nil
+}
+
+func formatSats(msat int64) string {
+	sign := ""
+	if msat < 0 {
+		sign = "-"
+		msat = -msat
+	}
+	return fmt.Sprintf("%s%d.%03d", sign, msat/1000, msat%1000)
+}
+
+// WriteLedgerEntries writes entries as "csv", "beancount" or "ledger"
+// (ledger-cli). Amounts are in sats with millisat precision.
+func WriteLedgerEntries(w io.Writer, format string, entries []LedgerEntry) error {
+	switch format {
+	case "csv":
+		out := csv.NewWriter(w)
+		out.Write([]string{"date", "id", "pubkey", "category", "debit", "credit", "amount_sats", "description"})
+		for _, e := range entries {
+			out.Write([]string{e.Time.Format(time.RFC3339), e.ID, e.PubKey, e.Category, e.Debit, e.Credit, formatSats(e.AmountMsat), e.Description})
+		}
+		out.Flush()
+		return out.Error()
+	case "beancount":
+		if len(entries) > 0 {
+			opened := entries[0].Time.Format("2006-01-02")
+			for _, account := range []string{AccountLightning, AccountCustomerBalances, AccountEventIncome, AccountServiceIncome, AccountPromotions} {
+				fmt.Fprintf(w, "%s open %s SATS\n", opened, account)
+			}
+			fmt.Fprintln(w)
+		}
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s * %q %q\n  pubkey: %q\n  %s  %s SATS\n  %s  %s SATS\n\n",
+				e.Time.Format("2006-01-02"), e.Description, e.ID, e.PubKey,
+				e.Debit, formatSats(e.AmountMsat), e.Credit, formatSats(-e.AmountMsat))
+		}
+		return nil
+	case "ledger":
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s %s %s\n    ; pubkey: %s\n    %s  %s SATS\n    %s\n\n",
+				e.Time.Format("2006/01/02"), e.Description, e.ID, e.PubKey, e.Debit, formatSats(e.AmountMsat), e.Credit)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %s", format)
+}
+
+var exportContentTypes = map[string]string{"csv": "text/csv", "beancount": "text/plain", "ledger": "text/plain"}
+
+// HandleAdminExport serves /admin/export?format=csv|beancount|ledger&since=YYYY-MM-DD&until=YYYY-MM-DD.
+func HandleAdminExport(w http.ResponseWriter, r *http.Request, db Database) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		WriteJSONError(w, http.StatusBadRequest, "format must be csv, beancount or ledger")
+		return
+	}
+
+	from, until, err := parseExportRange(r.URL.Query().Get("since"), r.URL.Query().Get("until"))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := GetLedgerEntries(from, until, db)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	WriteLedgerEntries(w, format, entries)
+}
+
+func parseExportRange(since string, until string) (time.Time, time.Time, error) {
+	from := time.Unix(0, 0).UTC()
+	to := Now().UTC()
+	if since != "" {
+		parsed, err := time.Parse("2006-01-02", since)
+		if err != nil {
+			return from, to, fmt.Errorf("since must be YYYY-MM-DD")
+		}
+		from = parsed
+	}
+	if until != "" {
+		parsed, err := time.Parse("2006-01-02", until)
+		if err != nil {
+			return from, to, fmt.Errorf("until must be YYYY-MM-DD")
+		}
+		to = parsed
+	}
+	return from, to, nil
+}
+
+func RunExport(args []string, db Database) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "csv", "csv, beancount or ledger")
+	since := flags.String("since", "", "first day to export (YYYY-MM-DD), inclusive")
+	until := flags.String("until", "", "last day to export (YYYY-MM-DD), exclusive")
+	flags.Parse(args)
+
+	from, to, err := parseExportRange(*since, *until)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := GetLedgerEntries(from, to, db)
+	if err != nil {
+		log.Fatalf("Failed to read ledger: %v", err)
+	}
+	if err := WriteLedgerEntries(os.Stdout, strings.ToLower(*format), entries); err != nil {
+		log.Fatal(err)
+	}
+}
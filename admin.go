@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// RegisterAdminRoutes mounts the operator API under /admin/. It is only
+// enabled when ADMIN_TOKEN is set; requests must send it as a bearer token.
+func RegisterAdminRoutes(mux *http.ServeMux, db Database) {
+	token := GetEnvDefault("ADMIN_TOKEN", "")
+	if token == "" {
+		return
+	}
+
+	mux.HandleFunc("/admin/usage", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminUsage(w, r, db)
+	}))
+	mux.HandleFunc("/admin/clients", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminClients(w, r, db)
+	}))
+	mux.HandleFunc("/admin/storage", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminStorage(w, r, db)
+	}))
+	mux.HandleFunc("/admin/backup", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminBackup(w, r, db)
+	}))
+	mux.HandleFunc("/admin/purge", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminPurge(w, r, db)
+	}))
+	mux.HandleFunc("/admin/backfill", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminBackfill(w, r, db)
+	}))
+	mux.HandleFunc("/admin/shadowban", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminShadowBan(w, r, db)
+	}))
+	mux.HandleFunc("/admin/exemptions", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminExemptions(w, r, db)
+	}))
+	mux.HandleFunc("/admin/reputation", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminReputation(w, r, db)
+	}))
+	mux.HandleFunc("/admin/revenue", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminRevenue(w, r, db)
+	}))
+	mux.HandleFunc("/admin/teams", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminTeams(w, r, db)
+	}))
+	mux.HandleFunc("/admin/escrow", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminEscrow(w, r, db)
+	}))
+	mux.HandleFunc("/admin/export", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminExport(w, r, db)
+	}))
+	mux.HandleFunc("/admin/account-export", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminAccountExport(w, r, db)
+	}))
+	mux.HandleFunc("/admin/bots", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminBots(w, r, db)
+	}))
+	mux.HandleFunc("/admin/spam", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminSpam(w, r, db)
+	}))
+	mux.HandleFunc("/admin/erasure", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminErasure(w, r, db)
+	}))
+}
+
+func AdminOnly(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			WriteJSONError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func WriteJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func WriteJSONError(w http.ResponseWriter, status int, message string) {
+	WriteJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"strconv"
+	"strings"
+)
+
+var allowanceSchema = Schema{
+	Tables: []string{"allowance"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS allowance (
+       pubkey text NOT NULL PRIMARY KEY,
+       owner text NOT NULL,
+       cap_msat bigint NOT NULL,
+       spent_msat bigint NOT NULL,
+       created_at bigint NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS allowanceowneridx ON allowance(owner)`,
+	},
+}
+
+// Allowance lets Owner's balance pay for up to CapMsat of another pubkey's
+// events, e.g. for an automation bot. Once it's used up the pubkey pays for
+// itself again. Prepaid package events aren't shared through allowances.
+type Allowance struct {
+	PubKey    string          `json:"pubkey"`
+	Owner     string          `json:"owner"`
+	CapMsat   int64           `json:"cap_msat"`
+	SpentMsat int64           `json:"spent_msat"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+func (a Allowance) RemainingMsat() int64 {
+	return a.CapMsat - a.SpentMsat
+}
+
+var allowancesGranted = NewCounter("ppe_allowances_granted_total", "Allowances granted or changed.")
+
+// GetAllowance returns pubkey's allowance while it has some left.
+func GetAllowance(pubkey string, db Database) *Allowance {
+	allowance := Allowance{PubKey: pubkey}
+	err := db.DB.QueryRow(
+		`SELECT owner, cap_msat, spent_msat, created_at FROM allowance WHERE pubkey = ? AND spent_msat < cap_msat`, pubkey,
+	).Scan(&allowance.Owner, &allowance.CapMsat, &allowance.SpentMsat, &allowance.CreatedAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			ReportError(err, "allowances", map[string]string{"pubkey": pubkey})
+		}
+		return nil
+	}
+	return &allowance
+}
+
+// GrantAllowance sets pubkey's allowance from owner to capSats, keeping what
+// was already spent under a previous cap from the same owner.
+func GrantAllowance(owner string, pubkey string, capSats int64, db Database) error {
+	if owner == pubkey {
+		return errors.New("you can't give yourself an allowance")
+	}
+	if capSats <= 0 {
+		return errors.New("the allowance must be at least 1 sat")
+	}
+
+	result, err := db.DB.Exec(
+		`INSERT INTO allowance (pubkey, owner, cap_msat, spent_msat, created_at) VALUES (?, ?, ?, 0, ?)
+		 ON CONFLICT (pubkey) DO UPDATE SET cap_msat = excluded.cap_msat WHERE allowance.owner = excluded.owner`,
+		pubkey, owner, capSats*1000, NowTimestamp(),
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("that pubkey already has an allowance from someone else")
+	}
+	allowancesGranted.Inc()
+	return nil
+}
+
+func RevokeAllowance(owner string, pubkey string, db Database) error {
+	result, err := db.DB.Exec(`DELETE FROM allowance WHERE pubkey = ? AND owner = ?`, pubkey, owner)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("you didn't give that pubkey an allowance")
+	}
+	return nil
+}
+
+// SpendAllowance records what an event charged to an allowance cost.
+func SpendAllowance(pubkey string, msat int64, db Database) error {
+	_, err := db.DB.Exec(`UPDATE allowance SET spent_msat = spent_msat + ? WHERE pubkey = ?`, msat, pubkey)
+	return err
+}
+
+func GetAllowancesFrom(owner string, db Database) ([]Allowance, error) {
+	rows, err := db.DB.Query(`SELECT pubkey, owner, cap_msat, spent_msat, created_at FROM allowance WHERE owner = ? ORDER BY created_at`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var allowances []Allowance
+	for rows.Next() {
+		var allowance Allowance
+		if err := rows.Scan(&allowance.PubKey, &allowance.Owner, &allowance.CapMsat, &allowance.SpentMsat, &allowance.CreatedAt); err != nil {
+			return nil, err
+		}
+		allowances = append(allowances, allowance)
+	}
+	return allowances, rows.Err()
+}
+
+// HandleAllowanceCommand answers "allowance" with the allowances pubkey
+// gave, "allowance <npub> <sats>" by granting one and "allowance revoke
+// <npub>" by taking it back.
+func HandleAllowanceCommand(pubkey string, args []string, db Database) string {
+	switch {
+	case len(args) == 0:
+		allowances, err := GetAllowancesFrom(pubkey, db)
+		if err != nil {
+			ReportError(err, "allowances", map[string]string{"pubkey": pubkey})
+			return "Couldn't look up your allowances, try again later."
+		}
+		if len(allowances) == 0 {
+			return "You haven't given anyone an allowance. Use allowance <npub> <sats> to let another key spend part of your balance."
+		}
+		var lines []string
+		for _, allowance := range allowances {
+			npub, _ := nip19.EncodePublicKey(allowance.PubKey)
+			lines = append(lines, fmt.Sprintf("nostr:%s: %s of %s spent", npub, formatSatsShort(allowance.SpentMsat), formatSatsShort(allowance.CapMsat)))
+		}
+		return "Your allowances: " + strings.Join(lines, ", ") + "."
+
+	case len(args) == 2 && strings.EqualFold(args[0], "revoke"):
+		grantee, err := ParsePubKey(strings.TrimPrefix(args[1], "nostr:"))
+		if err != nil {
+			return fmt.Sprintf("Invalid pubkey: %v.", err)
+		}
+		if err := RevokeAllowance(pubkey, grantee, db); err != nil {
+			return fmt.Sprintf("Couldn't revoke the allowance: %v.", err)
+		}
+		return fmt.Sprintf("Revoked the allowance of %s.", args[1])
+
+	case len(args) == 2:
+		grantee, err := ParsePubKey(strings.TrimPrefix(args[0], "nostr:"))
+		if err != nil {
+			return fmt.Sprintf("Invalid pubkey: %v.", err)
+		}
+		sats, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "Usage: allowance <npub> <sats>"
+		}
+		if err := GrantAllowance(pubkey, grantee, sats, db); err != nil {
+			return fmt.Sprintf("Couldn't set the allowance: %v.", err)
+		}
+		return fmt.Sprintf("%s can now spend up to %d sats of your balance. Revoke it any time with allowance revoke <npub>.", args[0], sats)
+	}
+	return "Usage: allowance [<npub> <sats>|revoke <npub>]"
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type APIBalance struct {
+	PubKey      string `json:"pubkey"`
+	BilledTo    string `json:"billed_to"`
+	BalanceMsat int64  `json:"balance_msat"`
+	Paying      bool   `json:"paying"`
+}
+
+type APIPackage struct {
+	Name   string `json:"name"`
+	Events int64  `json:"events"`
+	Sats   int64  `json:"sats"`
+}
+
+type APIPrices struct {
+	Rules           []string     `json:"rules"`
+	Packages        []APIPackage `json:"packages"`
+	NIP05Price      int64        `json:"nip05_price,omitempty"`
+	PinPrice        int64        `json:"pin_price_msat,omitempty"`
+	PinPricePerKB   int64        `json:"pin_price_msat_per_kb,omitempty"`
+	PaymentRequired bool         `json:"payment_required"`
+	Invoices        bool         `json:"invoices"`
+	// QuoteMsat is what an event of the requested kind and size costs a
+	// new account
+	QuoteMsat *int64 `json:"quote_msat,omitempty"`
+}
+
+type APIPaymentStatus struct {
+	Invoice    string           `json:"invoice"`
+	Paid       bool             `json:"paid"`
+	Revoked    bool             `json:"revoked"`
+	PubKey     string           `json:"pubkey,omitempty"`
+	AmountMsat int64            `json:"amount_msat,omitempty"`
+	CreditedAt *nostr.Timestamp `json:"credited_at,omitempty"`
+}
+
+// RegisterAPIRoutes mounts the JSON API clients use to offer topping up and
+// checking a balance without going through the bot. Fields are only ever
+// added to its responses; anything else gets a /api/v2.
+//
+//	GET  /api/v1/balance          the NIP-98 authenticated caller's balance
+//	GET  /api/v1/prices           the price schedule, quoting ?kind=&bytes=
+//	POST /api/v1/invoices         {"pubkey", "amount" or "package", "ref"}
+//	GET  /api/v1/invoices/status  whether ?invoice= was paid and credited
+//	POST /api/v1/pins             {"event"}, pinned for the NIP-98 caller
+//	GET  /api/v1/state-roots      the state roots published, newest first
+//	GET  /api/v1/proofs           proof ?event= is in the latest state root
+//	POST /api/v1/backfill         the NIP-98 caller's events as JSONL, quoted with ?quote=true
+//	GET  /api/v1/backfill/status  the NIP-98 caller's imports, newest first
+func RegisterAPIRoutes(mux *http.ServeMux, pricer Pricer, db Database) {
+	mux.HandleFunc("/api/v1/balance", APIEndpoint(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIBalance(w, r, db)
+	}))
+	mux.HandleFunc("/api/v1/prices", APIEndpoint(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIPrices(w, r, pricer)
+	}))
+	mux.HandleFunc("/api/v1/invoices", APIEndpoint(http.MethodPost, HandleAPIInvoice))
+	mux.HandleFunc("/api/v1/invoices/status", APIEndpoint(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIPaymentStatus(w, r, db)
+	}))
+	mux.HandleFunc("/api/v1/pins", APIEndpoint(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIPin(w, r, db)
+	}))
+	mux.HandleFunc("/api/v1/state-roots", APIEndpoint(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIStateRoots(w, r, db)
+	}))
+	mux.HandleFunc("/api/v1/proofs", APIEndpoint(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIProof(w, r, db)
+	}))
+	mux.HandleFunc("/api/v1/backfill", APIEndpoint(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIBackfill(w, r, db)
+	}))
+	mux.HandleFunc("/api/v1/backfill/status", APIEndpoint(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		HandleAPIBackfillStatus(w, r, db)
+	}))
+}
+
+// APIEndpoint answers CORS preflights, so web clients can send NIP-98
+// Authorization headers, and refuses methods other than method.
+func APIEndpoint(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", method)
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method != method {
+			WriteJSONError(w, http.StatusMethodNotAllowed, "use "+method)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func HandleAPIBalance(w http.ResponseWriter, r *http.Request, db Database) {
+	pubkey, err := VerifyNIP98(r, nil)
+	if err != nil {
+		WriteJSONError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	billedTo := GetBillingPubKey(pubkey, db)
+	WriteJSON(w, http.StatusOK, APIBalance{
+		PubKey:      pubkey,
+		BilledTo:    billedTo,
+		BalanceMsat: GetRemainingUserBalanceMsat(billedTo, db),
+		Paying:      IsPayingCustomer(pubkey, db),
+	})
+}
+
+func HandleAPIPrices(w http.ResponseWriter, r *http.Request, pricer Pricer) {
+	prices := APIPrices{
+		Rules:           DescribePricer(pricer),
+		Packages:        []APIPackage{},
+		PaymentRequired: !dryRun,
+		Invoices:        paymentBackend != nil,
+	}
+	for _, p := range eventPackages {
+		prices.Packages = append(prices.Packages, APIPackage{Name: p.Name, Events: p.Events, Sats: p.Sats})
+	}
+	if nip05Domain != "" {
+		prices.NIP05Price = nip05Price
+	}
+	prices.PinPrice, prices.PinPricePerKB = pinPriceMsat, pinPriceMsatPerKB
+
+	if value := r.URL.Query().Get("kind"); value != "" {
+		kind, err := strconv.Atoi(value)
+		if err != nil || kind < 0 || kind > 65535 {
+			WriteJSONError(w, http.StatusBadRequest, "kind must be a number from 0 to 65535")
+			return
+		}
+		size, _ := strconv.Atoi(r.URL.Query().Get("bytes"))
+		if size < 0 || size > 1<<20 {
+			WriteJSONError(w, http.StatusBadRequest, "bytes must be from 0 to 1048576")
+			return
+		}
+		quote, err := pricer.Price(&nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Content: strings.Repeat(" ", size)}, BillingAccount{})
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		prices.QuoteMsat = &quote
+	}
+	WriteJSON(w, http.StatusOK, prices)
+}
+
+func HandleAPIInvoice(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		PubKey  string `json:"pubkey"`
+		Amount  int64  `json:"amount"`
+		Package string `json:"package"`
+		Ref     string `json:"ref"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&request); err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "invalid json body")
+		return
+	}
+	pubkey, err := ParsePubKey(request.PubKey)
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "pubkey must be an npub or hex public key")
+		return
+	}
+	invoice, status, err := IssueTopUpInvoice(pubkey, request.Amount, request.Package, request.Ref)
+	if err != nil {
+		WriteJSONError(w, status, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, invoice)
+}
+
+// HandleAPIPaymentStatus reports whether an invoice's zap receipt was
+// credited. Receipts are picked up from the upstream relays, so it can take
+// a few seconds after the payment for it to show as paid.
+func HandleAPIPaymentStatus(w http.ResponseWriter, r *http.Request, db Database) {
+	bolt11 := strings.ToLower(strings.TrimPrefix(r.URL.Query().Get("invoice"), "lightning:"))
+	if !strings.HasPrefix(bolt11, "ln") {
+		WriteJSONError(w, http.StatusBadRequest, "invoice must be a bolt11 invoice")
+		return
+	}
+
+	status := APIPaymentStatus{Invoice: bolt11}
+	var id string
+	var creditedAt nostr.Timestamp
+	err := db.DB.QueryRow(`SELECT id, pubkey, amount_msat, credited_at FROM zap_credit WHERE bolt11 = ? LIMIT 1`, bolt11).
+		Scan(&id, &status.PubKey, &status.AmountMsat, &creditedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		WriteJSON(w, http.StatusOK, status)
+		return
+	}
+	if err != nil {
+		ReportError(err, "api", nil)
+		WriteJSONError(w, http.StatusInternalServerError, "couldn't look the invoice up")
+		return
+	}
+
+	status.Paid = true
+	status.CreditedAt = &creditedAt
+	if err := db.DB.Get(&status.Revoked, `SELECT COUNT(*) > 0 FROM zap_revocation WHERE id = ?`, id); err != nil {
+		ReportError(err, "api", nil)
+	}
+	WriteJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var articlePage = template.Must(template.New("article").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} · {{.Relay}}</title>
+<meta name="description" content="{{.Summary}}">
+<meta property="og:type" content="article">
+<meta property="og:site_name" content="{{.Relay}}">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Summary}}">
+<meta property="og:url" content="{{.URL}}">
+{{if .Image}}<meta property="og:image" content="{{.Image}}">
+<meta name="twitter:card" content="summary_large_image">{{else}}<meta name="twitter:card" content="summary">{{end}}
+<meta property="article:published_time" content="{{.Published}}">
+<meta property="article:modified_time" content="{{.Modified}}">
+<meta property="article:author" content="{{.Author}}">
+{{range .Hashtags}}<meta property="article:tag" content="{{.}}">
+{{end}}<link rel="canonical" href="{{.URL}}">
+<link rel="alternate" href="nostr:{{.Naddr}}">
+<link rel="alternate" type="application/atom+xml" title="{{.AuthorShort}} on {{.Relay}}" href="{{.Feed}}">
+<style>body { max-width: 42em; margin: 2em auto; padding: 0 1em; font-family: Georgia, serif; line-height: 1.6 } img { max-width: 100% } pre { overflow-x: auto }</style>
+</head>
+<body>
+<article>
+{{if .Image}}<img src="{{.Image}}" alt="">{{end}}
+<h1>{{.Title}}</h1>
+<p><small>By <a href="https://njump.me/{{.Author}}">{{.AuthorShort}}</a> · {{.PublishedDate}}</small></p>
+{{.Content}}
+</article>
+<hr>
+<p><small>Open in a Nostr client: <a href="nostr:{{.Naddr}}"><code>{{.Naddr}}</code></a>. Hosted on {{.Relay}}.</small></p>
+</body>
+</html>
+`))
+
+// HandleArticle renders /a/<naddr>, a long-form article stored here, as a
+// page to share outside of Nostr. Articles of shadow-banned and
+// follower-only accounts aren't shown.
+func HandleArticle(w http.ResponseWriter, r *http.Request, db Database) {
+	naddr := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/a/"), "nostr:")
+	prefix, value, err := nip19.Decode(naddr)
+	if err != nil || prefix != "naddr" {
+		http.Error(w, "not an naddr", http.StatusBadRequest)
+		return
+	}
+	pointer := value.(nostr.EntityPointer)
+	if pointer.Kind != nostr.KindArticle {
+		http.Error(w, "only long-form articles (kind 30023) are rendered", http.StatusNotFound)
+		return
+	}
+
+	article := GetPublicEvent(nostr.Filter{
+		Kinds:   []int{pointer.Kind},
+		Authors: []string{pointer.PublicKey},
+		Tags:    nostr.TagMap{"d": []string{pointer.Identifier}},
+	}, db)
+	if article == nil {
+		http.Error(w, "article not found", http.StatusNotFound)
+		return
+	}
+
+	title := tagValue(article.Tags, "title")
+	if title == "" {
+		title = "Untitled"
+	}
+	summary := tagValue(article.Tags, "summary")
+	if summary == "" {
+		summary = truncate(MarkdownPlainText(article.Content), 200)
+	}
+	published := article.CreatedAt
+	if value, err := strconv.ParseInt(tagValue(article.Tags, "published_at"), 10, 64); err == nil {
+		published = nostr.Timestamp(value)
+	}
+	author, _ := nip19.EncodePublicKey(article.PubKey)
+	var hashtags []string
+	for _, tag := range article.Tags.GetAll([]string{"t", ""}) {
+		hashtags = append(hashtags, tag[1])
+	}
+	image := tagValue(article.Tags, "image")
+	if !isWebURL(image) {
+		image = ""
+	}
+	// the canonical address names the d tag and relay, not whatever hints
+	// the shared link carried
+	canonical, _ := nip19.EncodeEntity(article.PubKey, article.Kind, pointer.Identifier, []string{strings.Replace(relay.ServiceURL, "http", "ws", 1)})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src https: http:; style-src 'unsafe-inline'")
+	err = articlePage.Execute(w, map[string]any{
+		"Relay":         relay.Info.Name,
+		"Title":         title,
+		"Summary":       summary,
+		"Image":         image,
+		"URL":           relay.ServiceURL + "/a/" + canonical,
+		"Naddr":         canonical,
+		"Author":        author,
+		"AuthorShort":   author[:12] + "…" + author[len(author)-6:],
+		"Hashtags":      hashtags,
+		"Feed":          relay.ServiceURL + "/feed/" + author + ".xml",
+		"Published":     published.Time().UTC().Format(time.RFC3339),
+		"PublishedDate": published.Time().UTC().Format("January 2, 2006"),
+		"Modified":      article.CreatedAt.Time().UTC().Format(time.RFC3339),
+		"Content":       RenderMarkdown(article.Content),
+	})
+	if err != nil {
+		ReportError(err, "articles", map[string]string{"naddr": naddr})
+	}
+}
+
+// GetPublicEvent returns the latest stored event matching filter that
+// anyone may see, or nil: shadow-banned pubkeys' events and those of
+// follower-only accounts are left out, like for an unauthenticated REQ.
+func GetPublicEvent(filter nostr.Filter, db Database) *nostr.Event {
+	events := GetPublicEvents(filter, db)
+	if len(events) == 0 {
+		return nil
+	}
+	return events[0]
+}
+
+// GetPublicEvents is GetPublicEvent for every matching event, newest first.
+func GetPublicEvents(filter nostr.Filter, db Database) []*nostr.Event {
+	return GetVisibleEvents(filter, "", db)
+}
+
+// GetVisibleEvents returns the stored events matching filter that reader,
+// or anyone when it's "", may see, newest first.
+func GetVisibleEvents(filter nostr.Filter, reader string, db Database) []*nostr.Event {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	results, err := DecryptAtRest(coldStorage.Wrap(db.QueryEvents))(ctx, filter)
+	if err != nil {
+		ReportError(err, "web", nil)
+		return nil
+	}
+	var events []*nostr.Event
+	for event := range results {
+		if (event.PubKey != reader && IsShadowBanned(event.PubKey)) || !CanSee(reader, event.PubKey, db) {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events
+}
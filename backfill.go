@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"log"
+	"net/http"
+)
+
+// ZapBackfill is which zap receipts to go looking for upstream: those
+// between Since and Until (default: now), Page at a time.
+type ZapBackfill struct {
+	Since int64 `json:"since"`
+	Until int64 `json:"until"`
+	Page  int   `json:"page"`
+}
+
+type ZapBackfillResult struct {
+	Pages    int `json:"pages"`
+	Scanned  int `json:"scanned"`
+	Credited int `json:"credited"`
+}
+
+// RunBackfill is the backfill command, BackfillZaps from the command line.
+func RunBackfill(args []string, db Database) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	since := flags.Int64("since", 0, "only fetch zaps created at or after this unix timestamp")
+	until := flags.Int64("until", 0, "only fetch zaps created at or before this unix timestamp (default: now)")
+	pageSize := flags.Int("page", 500, "number of zap receipts requested from each relay per page")
+	flags.Parse(args)
+
+	result := BackfillZaps(context.Background(), ZapBackfill{Since: *since, Until: *until, Page: *pageSize}, db)
+	log.Printf("backfill finished: %d receipts scanned, %d credited", result.Scanned, result.Credited)
+}
+
+// BackfillZaps scans the upstream relays for every zap receipt sent to the
+// bot, walking backwards one page at a time, and credits them to the ledger.
+// Each page's until is the oldest created_at of the last, so receipts sharing
+// that second are fetched again rather than skipped, and dropped by id.
+func BackfillZaps(ctx context.Context, options ZapBackfill, db Database) ZapBackfillResult {
+	if options.Page <= 0 {
+		options.Page = 500
+	}
+	cursor := nostr.Now()
+	if options.Until > 0 {
+		cursor = nostr.Timestamp(options.Until)
+	}
+
+	seen := make(map[string]bool)
+	var result ZapBackfillResult
+
+	for ctx.Err() == nil {
+		result.Pages++
+		tags := make(nostr.TagMap)
+		tags["p"] = []string{botPubkey}
+		filter := nostr.Filter{
+			Kinds: []int{nostr.KindZap},
+			Tags:  tags,
+			Until: &cursor,
+			Limit: options.Page,
+		}
+		if options.Since > 0 {
+			sinceTimestamp := nostr.Timestamp(options.Since)
+			filter.Since = &sinceTimestamp
+		}
+
+		returned := 0
+		found := 0
+		credited := 0
+		oldest := cursor
+
+		for event := range pool.SubManyEose(ctx, relays, []nostr.Filter{filter}) {
+			returned++
+			if event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+			}
+			if seen[event.ID] {
+				continue
+			}
+			seen[event.ID] = true
+			found++
+
+			ok, err := CreditZapEvent(event.Event, db)
+			if err != nil {
+				continue
+			} else if ok {
+				credited++
+			}
+		}
+
+		result.Credited += credited
+		fmt.Printf("page %d: %d new receipts, %d credited (until %d)\n", result.Pages, found, credited, cursor)
+
+		// only the end of the relays' history brings nothing at all; a page of
+		// receipts all from the second it started at means more than a page
+		// share it, which can't be paged through, so move on to the one before
+		switch {
+		case returned == 0:
+			result.Scanned = len(seen)
+			return result
+		case oldest < cursor:
+			cursor = oldest
+		case found == 0:
+			cursor--
+		}
+	}
+	result.Scanned = len(seen)
+	return result
+}
+
+// HandleAdminBackfill serves /admin/backfill: POST a ZapBackfill to credit
+// the zap receipts upstream the ledger is missing. It answers once the scan
+// is done, or stops when the request is cancelled.
+func HandleAdminBackfill(w http.ResponseWriter, r *http.Request, db Database) {
+	if r.Method != http.MethodPost {
+		WriteJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var options ZapBackfill
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+			WriteJSONError(w, http.StatusBadRequest, "invalid json body")
+			return
+		}
+	}
+	if options.Since < 0 || options.Until < 0 || options.Page < 0 {
+		WriteJSONError(w, http.StatusBadRequest, "since, until and page can't be negative")
+		return
+	}
+	WriteJSON(w, http.StatusOK, BackfillZaps(r.Context(), options, db))
+}
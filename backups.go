@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// backupStepPages is how many sqlite pages are copied at a time, with a
+	// pause in between for writers to get in.
+	backupStepPages = 256
+	backupStepPause = 20 * time.Millisecond
+	// backupMaxRestarts is how many times a sqlite backup starts over because
+	// of writes before it copies what's left in one step, holding writers off
+	// until it's done.
+	backupMaxRestarts = 3
+)
+
+// Backup is a snapshot of the database being taken or taken already. Done
+// and Total count sqlite pages or, on postgres, tables dumped.
+type Backup struct {
+	Path       string          `json:"path"`
+	Status     string          `json:"status"`
+	Unit       string          `json:"unit"`
+	Done       int64           `json:"done"`
+	Total      int64           `json:"total"`
+	Restarts   int             `json:"restarts,omitempty"`
+	Bytes      int64           `json:"bytes,omitempty"`
+	SHA256     string          `json:"sha256,omitempty"`
+	Events     int64           `json:"events,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	StartedAt  nostr.Timestamp `json:"started_at"`
+	FinishedAt nostr.Timestamp `json:"finished_at,omitempty"`
+}
+
+var (
+	backupMu   sync.Mutex
+	lastBackup *Backup
+
+	backupsTaken      = NewCounterVec("ppe_backups_total", "Database backups taken, by whether they succeeded and verified.", "result")
+	backupLastSuccess = NewGaugeVec("ppe_backup_last_success_timestamp", "When the last verified backup finished, in Unix seconds.", "database")
+	errBackupRunning  = errors.New("a backup is already running")
+)
+
+// StartBackup starts taking a backup of db to path in the background. The
+// relay keeps serving meanwhile: sqlite's online backup API copies the
+// database a few pages at a time, starting over when it's written to so the
+// copy is a consistent snapshot, and postgres is dumped with pg_dump, which
+// reads from a single snapshot.
+//
+// The snapshot is written next to path and only moved there once it passes
+// an integrity check, along with a path.sha256 file sha256sum -c reads.
+func StartBackup(path string, db Database) (Backup, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	if lastBackup != nil && lastBackup.FinishedAt == 0 {
+		return *lastBackup, errBackupRunning
+	}
+	backup := &Backup{Path: path, Status: "copying", StartedAt: nostr.Now()}
+	lastBackup = backup
+
+	go func() {
+		err := backup.take(db)
+		backupMu.Lock()
+		defer backupMu.Unlock()
+		backup.FinishedAt = nostr.Now()
+		if err != nil {
+			backup.Status = "failed"
+			backup.Error = err.Error()
+			backupsTaken.Inc("failed")
+			ReportError(err, "backup", map[string]string{"path": path})
+			return
+		}
+		backup.Status = "done"
+		backupsTaken.Inc("done")
+		backupLastSuccess.Set("main", time.Now().Unix())
+	}()
+	return *backup, nil
+}
+
+// GetLastBackup returns the backup running or the last one taken, if any.
+func GetLastBackup() (Backup, bool) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	if lastBackup == nil {
+		return Backup{}, false
+	}
+	return *lastBackup, true
+}
+
+// DefaultBackupPath is a new file in BACKUP_DIR named after the time.
+func DefaultBackupPath(db Database) string {
+	extension := ".sqlite"
+	if db.DB.DriverName() != "sqlite3" {
+		extension = ".dump"
+	}
+	name := "ppe-" + time.Now().UTC().Format("20060102-150405") + extension
+	return filepath.Join(GetEnvDefault("BACKUP_DIR", "./db/backups"), name)
+}
+
+func (b *Backup) update(fn func(b *Backup)) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	fn(b)
+}
+
+func (b *Backup) take(db Database) error {
+	if err := os.MkdirAll(filepath.Dir(b.Path), 0o700); err != nil {
+		return err
+	}
+	partial := b.Path + ".partial"
+	defer os.Remove(partial)
+
+	var err error
+	if db.DB.DriverName() == "sqlite3" {
+		err = b.copySQLite(partial, db)
+	} else {
+		err = b.dumpPostgres(partial, db)
+	}
+	if err != nil {
+		return err
+	}
+
+	b.update(func(b *Backup) { b.Status = "verifying" })
+	if db.DB.DriverName() == "sqlite3" {
+		var events int64
+		events, err = verifySQLiteSnapshot(partial)
+		b.update(func(b *Backup) { b.Events = events })
+	} else {
+		err = verifyPostgresDump(partial)
+	}
+	if err != nil {
+		return fmt.Errorf("the snapshot didn't verify: %w", err)
+	}
+
+	sum, size, err := hashFile(partial)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(partial, b.Path); err != nil {
+		return err
+	}
+	b.update(func(b *Backup) { b.SHA256, b.Bytes = sum, size })
+	return os.WriteFile(b.Path+".sha256", []byte(sum+"  "+filepath.Base(b.Path)+"\n"), 0o600)
+}
+
+// copySQLite copies db to path with sqlite's online backup API.
+func (b *Backup) copySQLite(path string, db Database) error {
+	ctx := context.Background()
+	destDB, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+	dest, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	src, err := db.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	b.update(func(b *Backup) { b.Unit = "pages" })
+	return dest.Raw(func(destConn any) error {
+		return src.Raw(func(srcConn any) error {
+			backup, err := destConn.(*sqlite3.SQLiteConn).Backup("main", srcConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			defer backup.Close()
+
+			var copied int64
+			restarts := 0
+			for {
+				pages := backupStepPages
+				if restarts >= backupMaxRestarts {
+					pages = -1
+				}
+				done, err := backup.Step(pages)
+				if err != nil {
+					return err
+				}
+				total := int64(backup.PageCount())
+				now := total - int64(backup.Remaining())
+				if now < copied {
+					// written to since the last step
+					restarts++
+				}
+				copied = now
+				b.update(func(b *Backup) { b.Done, b.Total, b.Restarts = now, total, restarts })
+				if done {
+					return backup.Finish()
+				}
+				time.Sleep(backupStepPause)
+			}
+		})
+	})
+}
+
+// verifySQLiteSnapshot runs an integrity check on the sqlite database at
+// path, returning how many events it has.
+func verifySQLiteSnapshot(path string) (int64, error) {
+	snapshot, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Close()
+
+	rows, err := snapshot.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return 0, err
+	}
+	var results []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		results = append(results, result)
+	}
+	rows.Close()
+	if len(results) != 1 || results[0] != "ok" {
+		return 0, fmt.Errorf("integrity check found %d problems: %s", len(results), strings.Join(results, "; "))
+	}
+
+	var events int64
+	err = snapshot.QueryRow(`SELECT COUNT(*) FROM event`).Scan(&events)
+	return events, err
+}
+
+// dumpPostgres runs pg_dump on db into path, counting the tables it dumps
+// from its verbose output.
+func (b *Backup) dumpPostgres(path string, db Database) error {
+	var tables int64
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM pg_tables WHERE schemaname = current_schema()`).Scan(&tables); err != nil {
+		return err
+	}
+	b.update(func(b *Backup) { b.Unit, b.Total = "tables", tables })
+
+	dump := exec.Command("pg_dump", "--format=custom", "--verbose", "--file="+path, "--dbname="+GetEnv("DATABASE_URL"))
+	stderr, err := dump.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := dump.Start(); err != nil {
+		return fmt.Errorf("couldn't run pg_dump: %w", err)
+	}
+	var last string
+	lines := bufio.NewScanner(stderr)
+	for lines.Scan() {
+		last = lines.Text()
+		if strings.Contains(last, "dumping contents of table") {
+			b.update(func(b *Backup) { b.Done++ })
+		}
+	}
+	if err := dump.Wait(); err != nil {
+		return fmt.Errorf("pg_dump failed: %w: %s", err, last)
+	}
+	return nil
+}
+
+// verifyPostgresDump has pg_restore read the dump's table of contents back,
+// which fails on a truncated or corrupt archive, and checks it has the
+// events.
+func verifyPostgresDump(path string) error {
+	list, err := exec.Command("pg_restore", "--list", path).Output()
+	if err != nil {
+		return fmt.Errorf("pg_restore couldn't read it: %w", err)
+	}
+	for _, line := range strings.Split(string(list), "\n") {
+		// like 3456; 0 16390 TABLE DATA public event postgres
+		_, entry, ok := strings.Cut(line, " TABLE DATA ")
+		if fields := strings.Fields(entry); ok && len(fields) >= 2 && fields[1] == "event" {
+			return nil
+		}
+	}
+	return errors.New("it has no event table data")
+}
+
+func hashFile(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// HandleAdminBackup reports on the running or last backup, and starts one
+// into BACKUP_DIR when POSTed to.
+func HandleAdminBackup(w http.ResponseWriter, r *http.Request, db Database) {
+	switch r.Method {
+	case http.MethodGet:
+		backup, ok := GetLastBackup()
+		if !ok {
+			WriteJSONError(w, http.StatusNotFound, "no backup was taken since the relay started")
+			return
+		}
+		WriteJSON(w, http.StatusOK, backup)
+	case http.MethodPost:
+		backup, err := StartBackup(DefaultBackupPath(db), db)
+		if errors.Is(err, errBackupRunning) {
+			WriteJSON(w, http.StatusConflict, backup)
+			return
+		}
+		WriteJSON(w, http.StatusAccepted, backup)
+	default:
+		WriteJSONError(w, http.StatusMethodNotAllowed, "use GET or POST")
+	}
+}
+
+// RunBackup takes a backup, printing its progress, and exits non-zero when
+// it fails or doesn't verify.
+func RunBackup(args []string, db Database) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "", "file to write the backup to (default a new file in BACKUP_DIR)")
+	flags.Parse(args)
+
+	path := *out
+	if path == "" {
+		path = DefaultBackupPath(db)
+	}
+	if _, err := StartBackup(path, db); err != nil {
+		log.Fatalf("Failed to start the backup: %v", err)
+	}
+	for {
+		time.Sleep(time.Second)
+		backup, _ := GetLastBackup()
+		switch {
+		case backup.Status == "failed":
+			log.Fatalf("Backup failed: %s", backup.Error)
+		case backup.Status == "done":
+			fmt.Printf("%s: %s, %d events, sha256 %s\n", backup.Path, formatBytes(backup.Bytes), backup.Events, backup.SHA256)
+			return
+		case backup.Total > 0:
+			fmt.Printf("%s %d/%d %s\n", backup.Status, backup.Done, backup.Total, backup.Unit)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BotCommand is a command addressed to the bot, either right after a
+// nostr:npub/nprofile mention of it (NIP-27), after a legacy #[i] mention, or
+// as a note starting with /command.
+type BotCommand struct {
+	Name string
+	Args []string
+}
+
+// BotCommandHandler describes a command the bot understands. Enabled reports
+// whether the relay is configured to offer it.
+type BotCommandHandler struct {
+	Name    string
+	Usage   string
+	Enabled func() bool
+	Run     func(event *nostr.Event, args []string, db Database) string
+}
+
+var (
+	nostrMentionPattern  = regexp.MustCompile(`nostr:((?:npub|nprofile)1[02-9ac-hj-np-z]+)`)
+	legacyMentionPattern = regexp.MustCompile(`#\[(\d+)\]`)
+
+	botCommandsHandled = NewCounter("ppe_bot_commands_total", "Bot commands answered.")
+	botCommandsUnknown = NewCounter("ppe_bot_commands_unknown_total", "Bot mentions with a command the bot doesn't know.")
+)
+
+func botCommands() []BotCommandHandler {
+	return []BotCommandHandler{
+		{"balance", "balance", func() bool { return true }, func(event *nostr.Event, args []string, db Database) string {
+			owner, allowance := ResolveBilling(event.PubKey, db)
+			if allowance != nil {
+				return fmt.Sprintf("You have %s left of your allowance, and your own balance is %v sats.", formatSatsShort(allowance.RemainingMsat()), GetRemainingUserBalance(event.PubKey, db))
+			} else if isPoolAccount(owner) {
+				return fmt.Sprintf("Your pool's balance is %v sats, and your own is %v sats.", GetRemainingUserBalance(owner, db), GetRemainingUserBalance(event.PubKey, db))
+			} else if owner != event.PubKey {
+				return fmt.Sprintf("Your team's balance is %v sats.", GetRemainingUserBalance(owner, db))
+			}
+			return fmt.Sprintf("Your balance is %v sats.", GetRemainingUserBalance(event.PubKey, db))
+		}},
+		{"price", "price [kind]", func() bool { return true }, func(event *nostr.Event, args []string, db Database) string {
+			return HandlePriceCommand(event.PubKey, args, db)
+		}},
+		{"nip05", "nip05 <name>", func() bool { return nip05Domain != "" }, func(event *nostr.Event, args []string, db Database) string {
+			if len(args) != 1 {
+				return "Usage: nip05 <name>"
+			}
+			name := strings.ToLower(args[0])
+			if current := GetNIP05Name(event.PubKey, db); current != "" && current != name {
+				return StartBotSession(event.PubKey, "nip05", "confirm", map[string]string{"name": name},
+					fmt.Sprintf("This replaces your name %s@%s with %s@%s for %d sats. Reply yes to confirm.", current, nip05Domain, name, nip05Domain, nip05Price), db)
+			}
+			if err := BuyNIP05Name(event.PubKey, args[0], nip05Price, db); err != nil {
+				return fmt.Sprintf("Couldn't register %s: %v.", args[0], err)
+			}
+			return fmt.Sprintf("You're now %s@%s.", strings.ToLower(args[0]), nip05Domain)
+		}},
+		{"package", "package [name]", func() bool { return len(eventPackages) > 0 }, func(event *nostr.Event, args []string, db Database) string {
+			if len(args) == 0 {
+				return StartBotSession(event.PubKey, "package", "choose", nil,
+					fmt.Sprintf("Which package? %s. Reply with its name, or cancel.", packageChoices()), db)
+			}
+			return HandlePackageCommand(event.PubKey, args[0])
+		}},
+		{"refund", "refund", func() bool { return refundsEnabled }, func(event *nostr.Event, args []string, db Database) string {
+			balance := GetRemainingUserBalance(event.PubKey, db)
+			if balance <= 0 {
+				return "You have no balance to refund."
+			}
+			return StartBotSession(event.PubKey, "refund", "invoice", nil,
+				fmt.Sprintf("Reply with a lightning invoice for up to %d sats, or cancel.", balance), db)
+		}},
+		{"referral", "referral", func() bool { return referralConfig.Bonus > 0 }, func(event *nostr.Event, args []string, db Database) string {
+			return HandleReferralCommand(event.PubKey, db)
+		}},
+		{"gift", "gift <sats> to <npub>", func() bool { return true }, func(event *nostr.Event, args []string, db Database) string {
+			return HandleGiftCommand(event, args, db)
+		}},
+		{"pool", "pool [create <name>|add <npub>|remove <npub>|join <name>|leave]", func() bool { return true }, func(event *nostr.Event, args []string, db Database) string {
+			return HandlePoolCommand(event.PubKey, args, db)
+		}},
+		{"allowance", "allowance [<npub> <sats>|revoke <npub>]", func() bool { return true }, func(event *nostr.Event, args []string, db Database) string {
+			return HandleAllowanceCommand(event.PubKey, args, db)
+		}},
+		{"limit", "limit [<n> events|sats per hour|day|week]", func() bool { return true }, func(event *nostr.Event, args []string, db Database) string {
+			return HandleLimitCommand(event.PubKey, args, db)
+		}},
+		{"team", "team [add|remove|join <npub>|leave]", func() bool { return true }, func(event *nostr.Event, args []string, db Database) string {
+			return HandleTeamCommand(event.PubKey, args, db)
+		}},
+		{"private", "private [on|off]", func() bool { return followersOnly }, func(event *nostr.Event, args []string, db Database) string {
+			return HandlePrivateCommand(event.PubKey, args, db)
+		}},
+		{"backfill", "backfill [on|off|import <relay>...]", func() bool { return backfillEnabled() || backfillImports }, func(event *nostr.Event, args []string, db Database) string {
+			return HandleBackfillCommand(event.PubKey, args, db)
+		}},
+		{"notify", "notify [kind on|off]", func() bool { return true }, func(event *nostr.Event, args []string, db Database) string {
+			return HandleNotifyCommand(event.PubKey, args, db)
+		}},
+		{"push", "push [<ntfy topic>|off]", func() bool { return pushEnabled }, func(event *nostr.Event, args []string, db Database) string {
+			return HandlePushCommand(event.PubKey, args, db)
+		}},
+		{"pin", "pin [<note id>]", pinningEnabled, func(event *nostr.Event, args []string, db Database) string {
+			return HandlePinCommand(event.PubKey, args, db)
+		}},
+		{"prove", "prove <note id>", provingEnabled, func(event *nostr.Event, args []string, db Database) string {
+			return HandleProveCommand(args, db)
+		}},
+		{"erase", "erase", func() bool { return true }, func(event *nostr.Event, args []string, db Database) string {
+			return StartErasure(event.PubKey, db)
+		}},
+		{"help", "help", func() bool { return true }, func(event *nostr.Event, args []string, db Database) string {
+			return "Commands: " + botCommandUsage() + "."
+		}},
+	}
+}
+
+func botCommandUsage() string {
+	var usage []string
+	for _, command := range botCommands() {
+		if command.Enabled() {
+			usage = append(usage, command.Usage)
+		}
+	}
+	return strings.Join(usage, ", ")
+}
+
+// ParseBotCommand extracts the command from a note, returning false for
+// notes that merely tag the bot without addressing it.
+func ParseBotCommand(event *nostr.Event) (BotCommand, bool) {
+	text, ok := commandText(event)
+	if !ok {
+		return BotCommand{}, false
+	}
+	if line, _, found := strings.Cut(text, "\n"); found {
+		text = line
+	}
+
+	words := SplitCommandArgs(text)
+	if len(words) == 0 {
+		return BotCommand{Name: "help"}, true
+	}
+	return BotCommand{Name: strings.ToLower(strings.TrimPrefix(words[0], "/")), Args: words[1:]}, true
+}
+
+func commandText(event *nostr.Event) (string, bool) {
+	for _, match := range nostrMentionPattern.FindAllStringSubmatchIndex(event.Content, -1) {
+		if mentionsBot(event.Content[match[2]:match[3]]) {
+			return event.Content[match[1]:], true
+		}
+	}
+
+	for _, match := range legacyMentionPattern.FindAllStringSubmatchIndex(event.Content, -1) {
+		index, _ := strconv.Atoi(event.Content[match[2]:match[3]])
+		if index < len(event.Tags) && len(event.Tags[index]) > 1 && event.Tags[index][0] == "p" && event.Tags[index][1] == botPubkey {
+			return event.Content[match[1]:], true
+		}
+	}
+
+	if content := strings.TrimSpace(event.Content); strings.HasPrefix(content, "/") {
+		return content, true
+	}
+	return "", false
+}
+
+func mentionsBot(entity string) bool {
+	prefix, value, err := nip19.Decode(entity)
+	if err != nil {
+		return false
+	}
+	switch prefix {
+	case "npub":
+		return value.(string) == botPubkey
+	case "nprofile":
+		return value.(nostr.ProfilePointer).PublicKey == botPubkey
+	}
+	return false
+}
+
+// SplitCommandArgs splits on whitespace, keeping "double" or 'single' quoted
+// arguments together.
+func SplitCommandArgs(text string) []string {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, r := range text {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\r':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// RunBotCommand answers a parsed command, suggesting the available commands
+// when it isn't one of them.
+func RunBotCommand(event *nostr.Event, command BotCommand, db Database) string {
+	for _, handler := range botCommands() {
+		if handler.Name == command.Name && handler.Enabled() {
+			botCommandsHandled.Inc()
+			return handler.Run(event, command.Args, db)
+		}
+	}
+	botCommandsUnknown.Inc()
+	return fmt.Sprintf("Unknown command %q. Commands: %s.", command.Name, botCommandUsage())
+}
+
+// ReplyTags threads a reply to event per NIP-10: a marked root (event itself
+// if it isn't a reply), a marked reply, and the author plus everyone else
+// tagged in the event. relayURL is where event was seen.
+func ReplyTags(event *nostr.Event, relayURL string) nostr.Tags {
+	var root nostr.Tag
+	var positional []nostr.Tag
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "e" {
+			continue
+		}
+		if len(tag) >= 4 && tag[3] == "root" {
+			root = tag
+			break
+		}
+		if len(tag) < 4 || tag[3] == "" {
+			positional = append(positional, tag)
+		}
+	}
+	if root == nil && len(positional) > 0 {
+		// deprecated positional scheme: the first e tag is the root
+		root = positional[0]
+	}
+
+	var tags nostr.Tags
+	if root != nil {
+		hint := relayURL
+		if len(root) > 2 && root[2] != "" {
+			hint = root[2]
+		}
+		tags = append(tags, nostr.Tag{"e", root[1], hint, "root"}, nostr.Tag{"e", event.ID, relayURL, "reply"})
+	} else {
+		tags = append(tags, nostr.Tag{"e", event.ID, relayURL, "root"})
+	}
+
+	tags = append(tags, nostr.Tag{"p", event.PubKey})
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && tag[1] != botPubkey && tag[1] != event.PubKey && tags.GetFirst([]string{"p", tag[1]}) == nil {
+			tags = append(tags, nostr.Tag{"p", tag[1]})
+		}
+	}
+	return tags
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var botSchema = Schema{
+	Tables: []string{"bot_suspect"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS bot_suspect (
+       pubkey text NOT NULL PRIMARY KEY,
+       score integer NOT NULL,
+       reasons text NOT NULL,
+       cleared boolean NOT NULL DEFAULT false,
+       flagged_at bigint NOT NULL);`,
+	},
+}
+
+type BotSuspect struct {
+	PubKey    string          `json:"pubkey"`
+	Score     int             `json:"score"`
+	Reasons   []string        `json:"reasons"`
+	Cleared   bool            `json:"cleared"`
+	FlaggedAt nostr.Timestamp `json:"flagged_at"`
+}
+
+const (
+	// botActivityWindow is how long posting times and content are kept
+	botActivityWindow = time.Hour
+
+	// botCadenceSamples is how many posting times are kept per pubkey
+	botCadenceSamples = 20
+
+	// botSharedContentPubKeys is how many pubkeys posting the same text
+	// within the window make it look coordinated
+	botSharedContentPubKeys = 3
+)
+
+var (
+	botFlagScore int
+
+	// botSuspects holds flagged pubkeys, true unless an operator cleared
+	// them, in which case they aren't flagged again
+	botSuspects      = make(map[string]bool)
+	botSuspectsMutex sync.RWMutex
+
+	botPostTimes    = make(map[string][]time.Time)
+	botContent      = make(map[[32]byte]map[string]time.Time)
+	botProfileAges  = make(map[string]botProfileAge)
+	botActivityLock sync.Mutex
+
+	botsFlagged = NewCounter("ppe_bots_flagged_total", "Pubkeys flagged as likely part of a bot network.")
+)
+
+type botProfileAge struct {
+	updatedAt nostr.Timestamp
+	found     bool
+	checkedAt time.Time
+}
+
+func LoadBotSuspects(db Database) error {
+	rows, err := db.DB.Query(`SELECT pubkey, cleared FROM bot_suspect`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	botSuspectsMutex.Lock()
+	defer botSuspectsMutex.Unlock()
+	for rows.Next() {
+		var pubkey string
+		var cleared bool
+		if err := rows.Scan(&pubkey, &cleared); err != nil {
+			return err
+		}
+		botSuspects[pubkey] = !cleared
+	}
+	return rows.Err()
+}
+
+// IsSuspectedBot reports whether pubkey is flagged and wasn't cleared.
+func IsSuspectedBot(pubkey string) bool {
+	botSuspectsMutex.RLock()
+	defer botSuspectsMutex.RUnlock()
+	return botSuspects[pubkey]
+}
+
+// DetectBots is an OnEventSaved hook scoring authors on what bot networks
+// willing to pay for their posts give away: posting like clockwork, the same
+// text as several other pubkeys, a missing or brand new profile and a new
+// account. Authors scoring BOT_FLAG_SCORE or more are flagged for the
+// operator, and priced up by BotPricer when BOT_PRICE_MULTIPLIER is set.
+func DetectBots(db Database) func(ctx context.Context, event *nostr.Event) {
+	return func(ctx context.Context, event *nostr.Event) {
+		author := GetEventAuthor(event)
+		score, reasons := observeBotActivity(author, event)
+		// profiles are fetched from the pool, so only for authors the 25
+		// points a missing profile and a new account add could flag
+		if score == 0 || score+25 < botFlagScore {
+			return
+		}
+
+		botSuspectsMutex.RLock()
+		_, known := botSuspects[author]
+		botSuspectsMutex.RUnlock()
+		if known {
+			return
+		}
+
+		go func() {
+			defer RecoverPanic("bots", map[string]string{"pubkey": author})
+
+			score, reasons := score, reasons
+			profile := getBotProfileAge(author)
+			if !profile.found {
+				score += 15
+				reasons = append(reasons, "no profile")
+			} else if time.Since(profile.updatedAt.Time()) < 24*time.Hour {
+				score += 5
+				reasons = append(reasons, "profile changed in the last day")
+			}
+			if GetAccountAgeDays(author, db) < 2 {
+				score += 10
+				reasons = append(reasons, "account less than 2 days old")
+			}
+			score = min(100, score)
+			if score < botFlagScore {
+				return
+			}
+			if err := FlagBot(author, score, reasons, db); err != nil {
+				ReportError(err, "bots", map[string]string{"pubkey": author})
+			}
+		}()
+	}
+}
+
+// observeBotActivity records event and scores how regular its author's
+// posting is and how many others posted the same text.
+func observeBotActivity(author string, event *nostr.Event) (int, []string) {
+	botActivityLock.Lock()
+	defer botActivityLock.Unlock()
+
+	now := time.Now()
+	times := append(botPostTimes[author], now)
+	if len(times) > botCadenceSamples {
+		times = times[len(times)-botCadenceSamples:]
+	}
+	botPostTimes[author] = times
+
+	score := 0
+	var reasons []string
+	if len(times) == botCadenceSamples {
+		var intervals []float64
+		for i := 1; i < len(times); i++ {
+			intervals = append(intervals, times[i].Sub(times[i-1]).Seconds())
+		}
+		mean, deviation := meanAndDeviation(intervals)
+		if mean > 0 && deviation/mean < 0.1 {
+			score += 35
+			reasons = append(reasons, fmt.Sprintf("posts every %.0fs like clockwork", mean))
+		} else if mean > 0 && deviation/mean < 0.25 {
+			score += 20
+			reasons = append(reasons, fmt.Sprintf("posts every %.0fs quite regularly", mean))
+		}
+		if now.Sub(times[0]) < 20*time.Minute {
+			score += 15
+			reasons = append(reasons, fmt.Sprintf("%d posts in %v", len(times), now.Sub(times[0]).Round(time.Minute)))
+		}
+	}
+
+	if text := strings.TrimSpace(event.Content); len(text) >= 20 && !encryptedKinds[event.Kind] {
+		hash := ContentHash(&nostr.Event{Kind: event.Kind, Content: text})
+		posters := botContent[hash]
+		if posters == nil {
+			posters = make(map[string]time.Time)
+			botContent[hash] = posters
+		}
+		posters[author] = now
+		if len(posters) >= botSharedContentPubKeys {
+			score += 40
+			reasons = append(reasons, fmt.Sprintf("same text as %d other pubkeys", len(posters)-1))
+		}
+	}
+	return score, reasons
+}
+
+func meanAndDeviation(values []float64) (float64, float64) {
+	var sum float64
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+	var squares float64
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(values)))
+}
+
+// getBotProfileAge fetches when pubkey's profile was last updated, caching
+// the answer for the activity window.
+func getBotProfileAge(pubkey string) botProfileAge {
+	botActivityLock.Lock()
+	cached, ok := botProfileAges[pubkey]
+	botActivityLock.Unlock()
+	if ok && time.Since(cached.checkedAt) < botActivityWindow {
+		return cached
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	profile := botProfileAge{checkedAt: time.Now()}
+	for event := range pool.SubManyEose(ctx, relays, []nostr.Filter{{Kinds: []int{0}, Authors: []string{pubkey}, Limit: 1}}) {
+		profile.found = true
+		profile.updatedAt = max(profile.updatedAt, event.CreatedAt)
+	}
+
+	botActivityLock.Lock()
+	botProfileAges[pubkey] = profile
+	botActivityLock.Unlock()
+	return profile
+}
+
+// RunBotActivityPruner forgets posting times, content and profiles older
+// than the activity window.
+func RunBotActivityPruner() {
+	for {
+		time.Sleep(10 * time.Minute)
+		cutoff := time.Now().Add(-botActivityWindow)
+
+		botActivityLock.Lock()
+		for pubkey, times := range botPostTimes {
+			if times[len(times)-1].Before(cutoff) {
+				delete(botPostTimes, pubkey)
+			}
+		}
+		for hash, posters := range botContent {
+			for pubkey, postedAt := range posters {
+				if postedAt.Before(cutoff) {
+					delete(posters, pubkey)
+				}
+			}
+			if len(posters) == 0 {
+				delete(botContent, hash)
+			}
+		}
+		for pubkey, profile := range botProfileAges {
+			if profile.checkedAt.Before(cutoff) {
+				delete(botProfileAges, pubkey)
+			}
+		}
+		botActivityLock.Unlock()
+	}
+}
+
+func FlagBot(pubkey string, score int, reasons []string, db Database) error {
+	encoded, _ := json.Marshal(reasons)
+	result, err := db.DB.Exec(
+		`INSERT INTO bot_suspect (pubkey, score, reasons, cleared, flagged_at) VALUES (?, ?, ?, false, ?) ON CONFLICT DO NOTHING`,
+		pubkey, score, string(encoded), nostr.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil
+	}
+
+	botSuspectsMutex.Lock()
+	botSuspects[pubkey] = true
+	botSuspectsMutex.Unlock()
+	botsFlagged.Inc()
+	fmt.Printf("flagged %s as a likely bot (score %d): %s\n", pubkey, score, strings.Join(reasons, ", "))
+	return nil
+}
+
+// ClearBot marks a flagged pubkey as a false positive, which also keeps it
+// from being flagged again.
+func ClearBot(pubkey string, db Database) error {
+	_, err := db.DB.Exec(
+		`INSERT INTO bot_suspect (pubkey, score, reasons, cleared, flagged_at) VALUES (?, 0, '[]', true, ?)
+		 ON CONFLICT (pubkey) DO UPDATE SET cleared = true`,
+		pubkey, nostr.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	botSuspectsMutex.Lock()
+	botSuspects[pubkey] = false
+	botSuspectsMutex.Unlock()
+	return nil
+}
+
+func GetBotSuspects(db Database) ([]BotSuspect, error) {
+	rows, err := db.DB.Query(`SELECT pubkey, score, reasons, cleared, flagged_at FROM bot_suspect ORDER BY flagged_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suspects := []BotSuspect{}
+	for rows.Next() {
+		var suspect BotSuspect
+		var reasons string
+		if err := rows.Scan(&suspect.PubKey, &suspect.Score, &reasons, &suspect.Cleared, &suspect.FlaggedAt); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(reasons), &suspect.Reasons)
+		suspects = append(suspects, suspect)
+	}
+	return suspects, rows.Err()
+}
+
+// HandleAdminBots lists flagged pubkeys on GET and clears one on DELETE
+// with {"pubkey": "..."}.
+func HandleAdminBots(w http.ResponseWriter, r *http.Request, db Database) {
+	switch r.Method {
+	case http.MethodGet:
+		suspects, err := GetBotSuspects(db)
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		WriteJSON(w, http.StatusOK, suspects)
+	case http.MethodDelete:
+		var request struct {
+			PubKey string `json:"pubkey"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteJSONError(w, http.StatusBadRequest, "invalid json body")
+			return
+		}
+		pubkey, err := ParsePubKey(request.PubKey)
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid pubkey: %v", err))
+			return
+		}
+		if err := ClearBot(pubkey, db); err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]string{"pubkey": pubkey})
+	default:
+		WriteJSONError(w, http.StatusMethodNotAllowed, "use GET or DELETE")
+	}
+}
+
+// BotPricer multiplies Inner's prices for suspected bots.
+type BotPricer struct {
+	Multiplier int64
+	Inner      Pricer
+}
+
+func (p BotPricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	price, err := p.Inner.Price(event, account)
+	if err != nil || !IsSuspectedBot(account.PubKey) {
+		return price, err
+	}
+	return price * p.Multiplier, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+var (
+	relayBanner   string
+	relayIconFile string
+)
+
+// ConfigureBranding fills the NIP-11 document from RELAY_NAME,
+// RELAY_DESCRIPTION, RELAY_CONTACT, RELAY_ICON and RELAY_BANNER. RELAY_ICON
+// is either a URL or a local image, which is then served at /favicon.ico.
+func ConfigureBranding() {
+	relay.Info.Name = GetEnvDefault("RELAY_NAME", relay.Info.Name)
+	relay.Info.Description = GetEnvDefault("RELAY_DESCRIPTION", relay.Info.Description)
+	relay.Info.Contact = GetEnvDefault("RELAY_CONTACT", relay.Info.Contact)
+	relayBanner = GetEnvDefault("RELAY_BANNER", "")
+
+	if icon := GetEnvDefault("RELAY_ICON", ""); strings.HasPrefix(icon, "http://") || strings.HasPrefix(icon, "https://") {
+		relay.Info.Icon = icon
+	} else if icon != "" {
+		relayIconFile = icon
+		relay.Router().HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, relayIconFile)
+		})
+		relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation, func(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+			info.Icon = relay.ServiceURL + "/favicon.ico"
+			return info
+		})
+	}
+
+	relay.Router().HandleFunc("/", HandleLandingPage)
+}
+
+// ServeBranding adds the banner to NIP-11 responses. go-nostr's document has
+// no field for it, so the JSON is patched on the way out.
+func ServeBranding(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if relayBanner == "" || r.Header.Get("Upgrade") == "websocket" || r.Header.Get("Accept") != "application/nostr+json" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+
+		var info map[string]any
+		if err := json.Unmarshal(recorder.Body.Bytes(), &info); err != nil {
+			w.WriteHeader(recorder.Code)
+			w.Write(recorder.Body.Bytes())
+			return
+		}
+		info["banner"] = relayBanner
+		w.WriteHeader(recorder.Code)
+		json.NewEncoder(w).Encode(info)
+	})
+}
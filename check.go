@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"os"
+	"strings"
+	"time"
+)
+
+// errCheckSkipped marks a check that doesn't apply to this configuration.
+var errCheckSkipped = errors.New("skipped")
+
+// RunCheck is the check command: it validates the configuration, opens the
+// database, reaches the payment backend, dials each upstream relay and signs
+// with the bot key, printing a line per check. It exits with status 1 when
+// anything failed, so it can gate a deploy.
+func RunCheck(db Database) {
+	failures := 0
+	check := func(name string, run func() (string, error)) {
+		detail, err := func() (detail string, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%v", r)
+				}
+			}()
+			return run()
+		}()
+		switch {
+		case errors.Is(err, errCheckSkipped):
+			fmt.Printf("skip  %s: %s\n", name, detail)
+		case err != nil:
+			failures++
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+		default:
+			fmt.Printf("ok    %s: %s\n", name, detail)
+		}
+	}
+
+	check("pricing", func() (string, error) {
+		return strings.Join(DescribePricer(GetPricer()), "; "), nil
+	})
+	check("spam classifier", func() (string, error) {
+		switch classifier := GetSpamClassifier().(type) {
+		case nil:
+			return "off", nil
+		case HTTPClassifier:
+			return classifier.URL, nil
+		default:
+			return "heuristic", nil
+		}
+	})
+	check("allow and deny lists", func() (string, error) {
+		allow, err := parseListAddresses(GetEnvList("ALLOW_LISTS", nil))
+		if err != nil {
+			return "", err
+		}
+		deny, err := parseListAddresses(GetEnvList("DENY_LISTS", nil))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d allow lists, %d deny lists", len(allow), len(deny)), nil
+	})
+	check("encryption", func() (string, error) {
+		if err := ConfigureEncryption(); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d encrypted kinds", len(encryptedKinds)), nil
+	})
+	check("client IPs", func() (string, error) {
+		if err := ConfigureClientIP(); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d trusted proxies", len(trustedProxies)), nil
+	})
+	check("hidden services", func() (string, error) {
+		if err := ConfigureHiddenServices(); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d listeners", len(hiddenServiceListeners)), nil
+	})
+	check("redis", func() (string, error) {
+		value := GetEnvDefault("REDIS_URL", "")
+		if value == "" {
+			return "REDIS_URL not set", errCheckSkipped
+		}
+		client, err := NewRedisClient(value)
+		if err != nil {
+			return "", err
+		}
+		if _, err := client.Do("PING"); err != nil {
+			return "", err
+		}
+		return "PING answered", nil
+	})
+
+	check("database", func() (string, error) {
+		if err := db.DB.Ping(); err != nil {
+			return "", err
+		}
+		if db.DB.DriverName() == "sqlite3" {
+			var results []string
+			if err := db.DB.Select(&results, `PRAGMA quick_check`); err != nil {
+				return "", err
+			}
+			if len(results) != 1 || results[0] != "ok" {
+				return "", fmt.Errorf("quick check found %d problems: %s", len(results), strings.Join(results, "; "))
+			}
+		}
+		size, err := DatabaseSizeBytes(db)
+		if err != nil {
+			return "", err
+		}
+		var events int64
+		if err := db.DB.Get(&events, `SELECT COUNT(*) FROM event`); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s, %d MB, %d events", db.DB.DriverName(), size>>20, events), nil
+	})
+
+	if coldStorage != nil {
+		check("cold storage", func() (string, error) {
+			var events int64
+			if err := coldStorage.DB.Get(&events, `SELECT COUNT(*) FROM event`); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s, %d events older than %d months", coldStorage.DB.DriverName(), events, coldStorage.months), nil
+		})
+	}
+
+	check("payment backend", func() (string, error) {
+		address := GetEnvDefault("LIGHTNING_ADDRESS", "")
+		if address == "" {
+			return "LIGHTNING_ADDRESS not set, top-ups only by zapping the bot", errCheckSkipped
+		}
+		params, err := (&LNURLPayBackend{Address: address}).PayParams()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s takes zaps of %d to %d sats", address, params.MinSendable/1000, params.MaxSendable/1000), nil
+	})
+	check("zapper", func() (string, error) {
+		zappers := GetZapperPubkeys()
+		if len(zappers) == 0 {
+			return "", errors.New("no zapper pubkey: set LIGHTNING_ADDRESS, ZAPPER_PUBKEYS or a lud16 on the bot's profile, or no zap is credited")
+		}
+		return "zap receipts signed by " + strings.Join(zappers, ", "), nil
+	})
+
+	for _, url := range relays {
+		check("upstream "+url, func() (string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			started := time.Now()
+			upstream, err := nostr.RelayConnect(ctx, url)
+			if err != nil {
+				return "", err
+			}
+			upstream.Close()
+			return fmt.Sprintf("connected in %v", time.Since(started).Round(time.Millisecond)), nil
+		})
+	}
+
+	check("bot key", func() (string, error) {
+		key := GetEnvDefault("BOT_PRIVATE_KEY", "")
+		event := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: relay.Info.Name + " self-test"}
+		if err := event.Sign(key); err != nil {
+			return "", err
+		}
+		if ok, err := event.CheckSignature(); err != nil || !ok {
+			return "", fmt.Errorf("the signature it made doesn't verify")
+		}
+		npub, _ := nip19.EncodePublicKey(event.PubKey)
+		return "signs as " + npub, nil
+	})
+
+	if failures > 0 {
+		fmt.Printf("%d checks failed\n", failures)
+		os.Exit(1)
+	}
+	fmt.Println("all checks passed")
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	trustedProxies []*net.IPNet
+	proxyProtocol  bool
+)
+
+// proxyProtocolTimeout is how long a trusted proxy gets to send its PROXY
+// header after connecting.
+const proxyProtocolTimeout = 10 * time.Second
+
+// proxyProtocolSignature starts every PROXY protocol v2 header.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ConfigureClientIP reads TRUSTED_PROXIES, the addresses or CIDR ranges of
+// the reverse proxies allowed to say who a client is, by default loopback
+// only, as anyone else on a private network could otherwise pick their own
+// address, and PROXY_PROTOCOL, for proxies that pass the client's address
+// in a PROXY protocol header instead of X-Forwarded-For.
+func ConfigureClientIP() error {
+	trustedProxies = nil
+	for _, value := range GetEnvList("TRUSTED_PROXIES", []string{"127.0.0.0/8", "::1/128"}) {
+		if !strings.Contains(value, "/") {
+			if strings.Contains(value, ":") {
+				value += "/128"
+			} else {
+				value += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q", value)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	proxyProtocol = GetEnvDefault("PROXY_PROTOCOL", "") == "true"
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client behind r. X-Forwarded-For is
+// only believed when the connection comes from a trusted proxy, and is read
+// from the right, skipping the trusted proxies in the chain, since anything
+// further left was written by the client.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// ServeClientIP replaces the request's remote address with ClientIP and
+// drops X-Forwarded-For, so khatru and everything after it see the real
+// client whether or not it came through a proxy.
+func ServeClientIP(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = net.JoinHostPort(ClientIP(r), "0")
+		r.Header.Del("X-Forwarded-For")
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitKey is the address rate limits are counted against: IPv6 clients
+// usually get a whole /64, so its addresses share a bucket.
+func rateLimitKey(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil || ip.To4() != nil {
+		return value
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// Listen opens the relay's listener, reading PROXY protocol headers from
+// trusted proxies when PROXY_PROTOCOL is set.
+func Listen(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil || !proxyProtocol {
+		return listener, err
+	}
+	return proxyProtocolListener{listener}, nil
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn reads the PROXY header on first use rather than in
+// Accept, so a slow proxy only holds up its own connection.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	source net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.source = c.Conn.RemoteAddr()
+		if address, ok := c.source.(*net.TCPAddr); !ok || !isTrustedProxy(address.IP) {
+			return
+		}
+
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		var source net.Addr
+		source, c.err = readProxyHeader(c.reader)
+		if c.err != nil {
+			ReportError(c.err, "clientip", map[string]string{"proxy": c.Conn.RemoteAddr().String()})
+			c.Conn.Close()
+			return
+		}
+		if source != nil {
+			c.source = source
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if c.readHeader(); c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.source
+}
+
+// readProxyHeader parses a PROXY protocol v1 or v2 header, returning the
+// client's address, or nil for health checks (LOCAL, UNKNOWN) and
+// connections without one.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	// every header is longer than the v2 signature, and so is every HTTP
+	// request, so anything shorter is left for the HTTP server to reject
+	start, err := reader.Peek(len(proxyProtocolSignature))
+	if err != nil {
+		return nil, nil
+	}
+
+	switch {
+	case bytes.Equal(start, proxyProtocolSignature):
+		return readProxyHeaderV2(reader)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyHeaderV1(reader)
+	}
+	return nil, nil
+}
+
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header is too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL commands are the proxy's own health checks
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch header[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, errors.New("PROXY v2 header is too short for IPv4")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, errors.New("PROXY v2 header is too short for IPv6")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var clientSchema = Schema{
+	Tables: []string{"client_usage", "client_author"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS client_usage (
+       day text NOT NULL,
+       client text NOT NULL,
+       events bigint NOT NULL,
+       bytes bigint NOT NULL,
+       PRIMARY KEY (day, client));`,
+		`CREATE TABLE IF NOT EXISTS client_author (
+       day text NOT NULL,
+       client text NOT NULL,
+       pubkey text NOT NULL,
+       PRIMARY KEY (day, client, pubkey));`,
+		`CREATE INDEX IF NOT EXISTS clientauthorpubkeyidx ON client_author(pubkey)`,
+	},
+}
+
+// ClientUsage is what was stored from a client app over some days, by the
+// client tag (NIP-89) its events carry. Clients name themselves, so this
+// shows where traffic comes from, not who can be trusted.
+type ClientUsage struct {
+	Client  string `json:"client"`
+	Events  int64  `json:"events"`
+	Bytes   int64  `json:"bytes"`
+	Authors int64  `json:"authors"`
+}
+
+// ClientPricer charges Percent of Inner's price for events from the clients
+// it lists.
+type ClientPricer struct {
+	Percent map[string]int64
+	Inner   Pricer
+}
+
+// GetEventClient is the normalized name in the event's client tag, or "".
+func GetEventClient(event *nostr.Event) string {
+	tag := event.Tags.GetFirst([]string{"client", ""})
+	if tag == nil {
+		return ""
+	}
+	return normalizeClientName((*tag)[1])
+}
+
+func normalizeClientName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+func (p ClientPricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	price, err := p.Inner.Price(event, account)
+	if err != nil {
+		return 0, err
+	}
+	if percent, ok := p.Percent[GetEventClient(event)]; ok {
+		price = price * percent / 100
+	}
+	return price, nil
+}
+
+// ParseClientPricing parses client=percent pairs, like damus=80 for 80% of
+// the price of events from Damus. Events without a client tag are "none".
+func ParseClientPricing(specs []string) (map[string]int64, error) {
+	percent := make(map[string]int64)
+	for _, spec := range specs {
+		name, value, found := strings.Cut(spec, "=")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if !found || err != nil || n < 0 || name == "" {
+			return nil, fmt.Errorf("invalid client price %q, expected client=percent", spec)
+		}
+		if name = normalizeClientName(name); name == "none" {
+			name = ""
+		}
+		percent[name] = n
+	}
+	return percent, nil
+}
+
+// TrackClientUsage counts each event stored towards its client's usage.
+func TrackClientUsage(db Database) func(ctx context.Context, event *nostr.Event) {
+	return func(ctx context.Context, event *nostr.Event) {
+		day := time.Now().UTC().Format(time.DateOnly)
+		client := GetEventClient(event)
+		if _, err := db.DB.Exec(
+			`INSERT INTO client_usage (day, client, events, bytes) VALUES (?, ?, 1, ?)
+			 ON CONFLICT (day, client) DO UPDATE SET events = client_usage.events + 1, bytes = client_usage.bytes + excluded.bytes`,
+			day, client, len(event.String()),
+		); err != nil {
+			ReportError(err, "clients", map[string]string{"client": client})
+			return
+		}
+		if _, err := db.DB.Exec(`INSERT INTO client_author (day, client, pubkey) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, day, client, event.PubKey); err != nil {
+			ReportError(err, "clients", map[string]string{"client": client})
+		}
+	}
+}
+
+// RejectClients rejects events from the client apps listed.
+func RejectClients(blocked []string) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	names := make(map[string]bool)
+	for _, name := range blocked {
+		names[normalizeClientName(name)] = true
+	}
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if client := GetEventClient(event); client != "" && names[client] {
+			return true, fmt.Sprintf("blocked: events from %s aren't accepted here", client)
+		}
+		return false, ""
+	}
+}
+
+// GetClientUsage sums client usage over the last days, busiest client
+// first. Authors counts each author once per day.
+func GetClientUsage(days int, limit int, db Database) ([]ClientUsage, error) {
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Format(time.DateOnly)
+	rows, err := db.DB.Query(
+		`SELECT u.client, SUM(u.events), SUM(u.bytes),
+		   (SELECT COUNT(*) FROM client_author a WHERE a.client = u.client AND a.day >= ?)
+		 FROM client_usage u WHERE u.day >= ? GROUP BY u.client ORDER BY SUM(u.events) DESC LIMIT ?`,
+		since, since, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []ClientUsage{}
+	for rows.Next() {
+		var entry ClientUsage
+		if err := rows.Scan(&entry.Client, &entry.Events, &entry.Bytes, &entry.Authors); err != nil {
+			return nil, err
+		}
+		usage = append(usage, entry)
+	}
+	return usage, rows.Err()
+}
+
+func HandleAdminClients(w http.ResponseWriter, r *http.Request, db Database) {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days < 1 {
+		days = 30
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 50
+	}
+	usage, err := GetClientUsage(days, limit, db)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, usage)
+}
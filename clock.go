@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/nbd-wtf/go-nostr"
+	"io"
+	"swarmstr.com/ppe-relay/ppe"
+	"time"
+)
+
+type Clock = ppe.Clock
+
+// clock is the time billing, expiry, retention, promotions and scheduled
+// jobs go by, and entropy where they get random codes from. Both can be
+// replaced, before the relay starts, to run them deterministically.
+var (
+	clock   Clock     = ppe.SystemClock{}
+	entropy io.Reader = rand.Reader
+)
+
+// Now is the clock's time.
+func Now() time.Time {
+	return clock.Now()
+}
+
+// NowTimestamp is the clock's time as a nostr timestamp, for created_at
+// columns.
+func NowTimestamp() nostr.Timestamp {
+	return nostr.Timestamp(clock.Now().Unix())
+}
+
+// RandomBytes reads n bytes from entropy.
+func RandomBytes(n int) []byte {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(entropy, buf); err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// RandomHex is n random bytes, hex encoded.
+func RandomHex(n int) string {
+	return hex.EncodeToString(RandomBytes(n))
+}
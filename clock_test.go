@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"github.com/nbd-wtf/go-nostr"
+	"strings"
+	"swarmstr.com/ppe-relay/ppe"
+	"testing"
+	"time"
+)
+
+// manualClock replaces the relay's clock with one set to at, until t ends.
+func manualClock(t *testing.T, at time.Time) *ppe.ManualClock {
+	t.Helper()
+	manual := &ppe.ManualClock{}
+	manual.Set(at)
+	previous := clock
+	clock = manual
+	t.Cleanup(func() { clock = previous })
+	return manual
+}
+
+func TestBackfillPermitExpiry(t *testing.T) {
+	h := NewHarness(t)
+	now := manualClock(t, time.Date(2026, 11, 1, 12, 0, 0, 0, time.UTC))
+	maxEventAge, backfillPermitPrice, backfillPermitDuration = 365*24*time.Hour, 0, 24*time.Hour
+	t.Cleanup(func() { maxEventAge, backfillPermitPrice, backfillPermitDuration = 0, 0, 0 })
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	old := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Timestamp(now.Now().AddDate(-2, 0, 0).Unix()), Content: "old"}
+	old.Sign(sk)
+	reject := RejectOldEvents(h.DB)
+
+	if rejected, _ := reject(context.Background(), &old); !rejected {
+		t.Fatal("old event accepted without a permit")
+	}
+	expiresAt, err := BuyBackfillPermit(pubkey, h.DB)
+	if err != nil {
+		t.Fatalf("buying permit: %v", err)
+	}
+	if want := nostr.Timestamp(now.Now().Add(24 * time.Hour).Unix()); expiresAt != want {
+		t.Fatalf("permit expires at %d, expected %d", expiresAt, want)
+	}
+	if rejected, msg := reject(context.Background(), &old); rejected {
+		t.Fatalf("old event rejected with a permit: %s", msg)
+	}
+
+	now.Advance(24*time.Hour - time.Second)
+	if !HasBackfillPermit(pubkey, h.DB) {
+		t.Fatal("permit expired a second early")
+	}
+	now.Advance(time.Second)
+	if HasBackfillPermit(pubkey, h.DB) {
+		t.Fatal("permit outlived its duration")
+	}
+	if rejected, _ := reject(context.Background(), &old); !rejected {
+		t.Fatal("old event accepted once the permit expired")
+	}
+}
+
+func TestErasureConfirmationExpiry(t *testing.T) {
+	now := manualClock(t, time.Date(2026, 11, 1, 12, 0, 0, 0, time.UTC))
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	confirmation := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Timestamp(now.Now().Unix()), Content: "erase 0a1b2c"}
+	confirmation.Sign(sk)
+
+	now.Advance(erasureConfirmationMaxAge)
+	if err := VerifyErasureConfirmation(pubkey, &confirmation); err != nil {
+		t.Fatalf("confirmation rejected at its max age: %v", err)
+	}
+	now.Advance(time.Second)
+	if err := VerifyErasureConfirmation(pubkey, &confirmation); err == nil || !strings.Contains(err.Error(), "too old") {
+		t.Fatalf("confirmation past its max age gave %v", err)
+	}
+}
+
+func TestPromotionSchedules(t *testing.T) {
+	var promotions []Promotion
+	for _, spec := range []string{"weekend:50:sat-sun", "nights:25:daily@22-06", "notes-day:100:2026-11-03/2026-11-03:1"} {
+		promotion, err := ParsePromotion(spec)
+		if err != nil {
+			t.Fatalf("parsing %s: %v", spec, err)
+		}
+		promotions = append(promotions, promotion)
+	}
+	pricer := PromotionPricer{Promotions: promotions, Inner: FlatPricer{Msat: 1000}}
+	now := manualClock(t, time.Date(2026, 10, 31, 12, 0, 0, 0, time.UTC)) // a saturday
+
+	steps := []struct {
+		advance time.Duration
+		kind    int
+		price   int64
+	}{
+		{0, 1, 500},                             // saturday noon, the weekend
+		{11*time.Hour + 59*time.Minute, 1, 500}, // 23:59, the weekend beats the night
+		{24*time.Hour + time.Minute, 1, 750},    // monday 00:00, the night
+		{6 * time.Hour, 1, 1000},                // monday 06:00, nothing
+		{18 * time.Hour, 1, 0},                  // tuesday 00:00, kind 1 free all day
+		{18 * time.Hour, 7, 1000},               // tuesday 18:00, but not kind 7
+		{6 * time.Hour, 1, 750},                 // wednesday 00:00, the notes day over
+	}
+	for _, step := range steps {
+		now.Advance(step.advance)
+		event := nostr.Event{Kind: step.kind}
+		price, err := pricer.Price(&event, BillingAccount{})
+		if err != nil {
+			t.Fatalf("pricing at %v: %v", now.Now(), err)
+		}
+		if price != step.price {
+			t.Errorf("kind %d at %v costs %d msat, expected %d", step.kind, now.Now(), price, step.price)
+		}
+	}
+}
+
+func TestSpendLimitCooldown(t *testing.T) {
+	h := NewHarness(t)
+	now := manualClock(t, time.Date(2026, 11, 1, 12, 0, 0, 0, time.UTC))
+	spendLimitCooldown = 24 * time.Hour
+	t.Cleanup(func() { spendLimitCooldown = 0 })
+	pubkey := nostr.GeneratePrivateKey()
+
+	tight := SpendLimit{Unit: SpendLimitEvents, Max: 10, Window: time.Hour}
+	if effectiveAt, err := SetSpendLimit(pubkey, tight, h.DB); err != nil || effectiveAt != NowTimestamp() {
+		t.Fatalf("tightening took effect at %d (%v), expected now", effectiveAt, err)
+	}
+	now.Advance(time.Minute)
+	loose := SpendLimit{Unit: SpendLimitEvents, Max: 100, Window: time.Hour}
+	if _, err := SetSpendLimit(pubkey, loose, h.DB); err != nil {
+		t.Fatalf("loosening: %v", err)
+	}
+
+	now.Advance(24*time.Hour - time.Second)
+	if limit := GetSpendLimit(pubkey, SpendLimitEvents, h.DB); limit.Max != 10 {
+		t.Fatalf("limit of %d a second before the cooldown ends, expected 10", limit.Max)
+	}
+	now.Advance(time.Second)
+	if limit := GetSpendLimit(pubkey, SpendLimitEvents, h.DB); limit.Max != 100 {
+		t.Fatalf("limit of %d once the cooldown ends, expected 100", limit.Max)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"time"
+)
+
+// coldStorageBatch is how many events are moved to cold storage at a time.
+const coldStorageBatch = 500
+
+// ColdStorage is a second database, typically a sqlite file on a cheaper
+// disk, that events older than a number of months are moved to so the main
+// one stays small and fast. Queries reaching back that far search both and
+// merge the results, a little slower.
+//
+// Only regular events already charged for are moved: replaceable ones get
+// replaced, and the ledger counts the uncharged events it finds in the main
+// database. Events are moved as they're stored, so encrypted ones stay
+// encrypted.
+type ColdStorage struct {
+	Database
+	months int
+}
+
+var (
+	coldStorage *ColdStorage
+
+	eventsMovedCold = NewCounter("ppe_cold_storage_moved_total", "Events moved from the database to cold storage.")
+	coldQueries     = NewCounter("ppe_cold_storage_queries_total", "Queries that also searched cold storage.")
+)
+
+// ConfigureColdStorage opens COLD_STORAGE_URL, a sqlite path or postgres
+// url like DATABASE_URL, to move events older than COLD_STORAGE_AFTER_MONTHS
+// to.
+func ConfigureColdStorage() error {
+	url := GetEnvDefault("COLD_STORAGE_URL", "")
+	if url == "" {
+		return nil
+	}
+	months := GetEnvInt("COLD_STORAGE_AFTER_MONTHS", 6)
+	if months < 1 {
+		return fmt.Errorf("COLD_STORAGE_AFTER_MONTHS must be at least 1, got %d", months)
+	}
+	db, err := OpenDatabase(url, GetEnvInt("MAX_FILTER_LIMIT", 500))
+	if err != nil {
+		return fmt.Errorf("couldn't open cold storage: %w", err)
+	}
+	coldStorage = &ColdStorage{Database: db, months: months}
+	return nil
+}
+
+// EventDatabases are the databases holding events: db, and cold storage
+// when there is one.
+func EventDatabases(db Database) []Database {
+	if coldStorage == nil {
+		return []Database{db}
+	}
+	return []Database{db, coldStorage.Database}
+}
+
+// QueryStoredEvents runs query, selecting id, pubkey, created_at, kind,
+// tags, content and sig from the event table, on every database holding
+// events and returns what they found.
+func QueryStoredEvents(query string, args []any, db Database) ([]*nostr.Event, error) {
+	var events []*nostr.Event
+	for _, store := range EventDatabases(db) {
+		found, err := scanStoredEvents(store, query, args)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, found...)
+	}
+	return events, nil
+}
+
+func scanStoredEvents(db Database, query string, args []any) ([]*nostr.Event, error) {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*nostr.Event
+	for rows.Next() {
+		var event nostr.Event
+		var timestamp int64
+		if err := rows.Scan(&event.ID, &event.PubKey, &timestamp, &event.Kind, &event.Tags, &event.Content, &event.Sig); err != nil {
+			return nil, err
+		}
+		event.CreatedAt = nostr.Timestamp(timestamp)
+		events = append(events, &event)
+	}
+	return events, rows.Err()
+}
+
+// cutoff is the created_at events are moved to cold storage before: cold
+// storage has nothing newer.
+func (c *ColdStorage) cutoff() nostr.Timestamp {
+	return nostr.Timestamp(Now().AddDate(0, -c.months, 0).Unix())
+}
+
+// Wrap returns a QueryEvents handler also searching cold storage when the
+// filter reaches back past the cutoff, merging both newest first. A nil
+// ColdStorage leaves query as it is.
+func (c *ColdStorage) Wrap(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	if c == nil {
+		return query
+	}
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		hot, err := query(ctx, filter)
+		if err != nil || (filter.Since != nil && *filter.Since >= c.cutoff()) {
+			return hot, err
+		}
+		coldQueries.Inc()
+		cold, err := c.QueryEvents(ctx, filter)
+		if err != nil {
+			ReportError(err, "cold storage", map[string]string{"filter": filter.String()})
+			return hot, nil
+		}
+		return mergeNewestFirst(ctx, filter.Limit, hot, cold), nil
+	}
+}
+
+// WrapDelete returns a DeleteEvent handler deleting the event from cold
+// storage too. A nil ColdStorage leaves del as it is.
+func (c *ColdStorage) WrapDelete(del func(ctx context.Context, event *nostr.Event) error) func(ctx context.Context, event *nostr.Event) error {
+	if c == nil {
+		return del
+	}
+	return func(ctx context.Context, event *nostr.Event) error {
+		if err := del(ctx, event); err != nil {
+			return err
+		}
+		return c.DeleteEvent(ctx, event)
+	}
+}
+
+// mergeNewestFirst merges two channels of events sorted newest first into
+// one, stopping after limit events when it's set. An event found in both,
+// being moved, is sent once.
+func mergeNewestFirst(ctx context.Context, limit int, a chan *nostr.Event, b chan *nostr.Event) chan *nostr.Event {
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer func() {
+			for range a {
+			}
+			for range b {
+			}
+		}()
+		defer close(ch)
+
+		sent := make(map[string]bool)
+		nextA, okA := <-a
+		nextB, okB := <-b
+		for (okA || okB) && (limit <= 0 || len(sent) < limit) {
+			var event *nostr.Event
+			if okA && (!okB || nextA.CreatedAt >= nextB.CreatedAt) {
+				event = nextA
+				nextA, okA = <-a
+			} else {
+				event = nextB
+				nextB, okB = <-b
+			}
+			if sent[event.ID] {
+				continue
+			}
+			sent[event.ID] = true
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func RunColdStorageMover(db Database) {
+	for {
+		moved, err := MoveToColdStorage(db)
+		if err != nil {
+			ReportError(err, "cold storage", nil)
+		}
+		if moved < coldStorageBatch {
+			time.Sleep(time.Hour)
+		}
+	}
+}
+
+// MoveToColdStorage moves a batch of the events due to cold storage,
+// returning how many it moved. Each is saved there before it's deleted
+// here, so a crash in between leaves it in both until the next batch.
+func MoveToColdStorage(db Database) (int, error) {
+	events, err := scanStoredEvents(db,
+		`SELECT id, pubkey, created_at, kind, tags, content, sig FROM event
+		 WHERE created_at < ? AND kind NOT IN (0, 3) AND NOT (kind >= 10000 AND kind < 40000)
+		 AND EXISTS (SELECT 1 FROM debit WHERE debit.id = 'event:' || event.id)
+		 ORDER BY created_at LIMIT ?`,
+		[]any{coldStorage.cutoff(), coldStorageBatch},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	moved := 0
+	for _, event := range events {
+		if err := coldStorage.SaveEvent(ctx, event); err != nil && !errors.Is(err, eventstore.ErrDupEvent) {
+			return moved, err
+		}
+		if err := db.DeleteEvent(ctx, event); err != nil {
+			return moved, err
+		}
+		moved++
+		eventsMovedCold.Inc()
+	}
+	return moved, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// stringList is a flag that can be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func RunCommand(name string, args []string, db Database) {
+	switch name {
+	case "backfill":
+		RunBackfill(args, db)
+	case "purge":
+		RunPurge(args, db)
+	case "shadowban":
+		RunShadowBan(args, db)
+	case "unshadowban":
+		RunLiftShadowBan(args, db)
+	case "rollup":
+		RunRollup(args, db)
+	case "migrate-storage":
+		RunMigrateStorage(args, db)
+	case "verify":
+		VerifyZapCredits(db)
+	case "stale":
+		RunListStaleCredits(db)
+	case "clawback":
+		RunClawback(args, db)
+	case "revenue":
+		RunRevenue(args, db)
+	case "export":
+		RunExport(args, db)
+	case "export-account":
+		RunExportAccount(args, db)
+	case "check":
+		RunCheck(db)
+	case "storage":
+		RunStorageUsage(args, db)
+	case "backup":
+		RunBackup(args, db)
+	case "restore":
+		RunRestore(args, db)
+	case "state-root":
+		RunStateRoot(args, db)
+	case "prove":
+		RunProve(args, db)
+	case "geoip":
+		RunGeoIPLookup(args)
+	case "loadtest":
+		RunLoadTest(args)
+	default:
+		log.Fatalf("Unknown command %s", name)
+	}
+}
+
+func RunListStaleCredits(db Database) {
+	credits, err := GetStaleCredits(db)
+	if err != nil {
+		log.Fatalf("Failed to list stale credits: %v", err)
+	}
+
+	for _, credit := range credits {
+		fmt.Printf("%s  %s  %d sats  %s\n", credit.ID, credit.PubKey, credit.AmountMsat/1000, credit.Problem)
+	}
+	fmt.Printf("%d stale credits\n", len(credits))
+}
+
+func RunClawback(args []string, db Database) {
+	flags := flag.NewFlagSet("clawback", flag.ExitOnError)
+	reason := flags.String("reason", "zap receipt could not be verified", "reason recorded with the revocation")
+	allStale := flags.Bool("stale", false, "claw back every credit currently flagged as stale")
+	flags.Parse(args)
+
+	ids := flags.Args()
+	if *allStale {
+		credits, err := GetStaleCredits(db)
+		if err != nil {
+			log.Fatalf("Failed to list stale credits: %v", err)
+		}
+		for _, credit := range credits {
+			ids = append(ids, credit.ID)
+		}
+	}
+
+	for _, id := range ids {
+		if err := RevokeZapCredit(id, *reason, db); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("revoked %s\n", id)
+	}
+}
+
+func RunPurge(args []string, db Database) {
+	var ids, authors, kinds stringList
+
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	flags.Var(&ids, "id", "event id to delete (repeatable)")
+	flags.Var(&authors, "author", "delete events by this npub or hex pubkey (repeatable)")
+	flags.Var(&kinds, "kind", "delete events of this kind (repeatable)")
+	content := flags.String("content", "", "delete events whose content matches this regex")
+	dryRun := flags.Bool("dry-run", false, "only report what would be deleted")
+	flags.Parse(args)
+
+	criteria := PurgeCriteria{IDs: ids, Authors: authors, Content: *content, DryRun: *dryRun}
+	for _, kind := range kinds {
+		number, err := strconv.Atoi(kind)
+		if err != nil {
+			log.Fatalf("Invalid kind %s", kind)
+		}
+		criteria.Kinds = append(criteria.Kinds, number)
+	}
+
+	result, err := PurgeEvents(criteria, db, TrackStorageDeletes(coldStorage.WrapDelete(db.DeleteEvent), db))
+	if err != nil {
+		log.Fatalf("Failed to purge events: %v", err)
+	}
+
+	for _, id := range result.IDs {
+		fmt.Println(id)
+	}
+	if *dryRun {
+		fmt.Printf("%d events would be deleted\n", result.Matched)
+	} else {
+		fmt.Printf("%d events matched, %d deleted\n", result.Matched, result.Deleted)
+	}
+}
+
+func RunShadowBan(args []string, db Database) {
+	flags := flag.NewFlagSet("shadowban", flag.ExitOnError)
+	reason := flags.String("reason", "", "reason recorded with the shadow ban")
+	flags.Parse(args)
+
+	for _, value := range flags.Args() {
+		pubkey, err := ParsePubKey(value)
+		if err != nil {
+			fmt.Printf("%s: %v\n", value, err)
+			continue
+		}
+		if err := ShadowBanPubKey(pubkey, *reason, db); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("shadow-banned %s\n", pubkey)
+	}
+}
+
+func RunLiftShadowBan(args []string, db Database) {
+	for _, value := range args {
+		pubkey, err := ParsePubKey(value)
+		if err != nil {
+			fmt.Printf("%s: %v\n", value, err)
+			continue
+		}
+		if err := LiftShadowBan(pubkey, db); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("lifted shadow ban on %s\n", pubkey)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+	"reflect"
+	"unsafe"
+)
+
+// ConfigureCompression negotiates permessage-deflate with the clients that
+// offer it when WEBSOCKET_COMPRESSION=true, compressing what's sent at
+// WEBSOCKET_COMPRESSION_LEVEL, from 1 (fastest, the default) to 9
+// (smallest), which saves mobile clients syncing long-form content a good
+// part of their bandwidth.
+//
+// It's off by default because go-nostr clients up to at least v0.35 offer
+// permessage-deflate but fail to send anything once it's negotiated: bots
+// and services built on them can't publish to a relay that compresses.
+//
+// khatru keeps its upgrader and connections unexported, so they're reached
+// by reflection. A khatru upgrade renaming them panics here at startup
+// rather than quietly turning compression off.
+//
+// Connections to upstream relays are go-nostr's, which always offer
+// permessage-deflate; there's nothing to configure on them.
+func ConfigureCompression() error {
+	if GetEnvDefault("WEBSOCKET_COMPRESSION", "") != "true" {
+		return nil
+	}
+	level := GetEnvInt("WEBSOCKET_COMPRESSION_LEVEL", 1)
+	if level < 1 || level > 9 {
+		return fmt.Errorf("WEBSOCKET_COMPRESSION_LEVEL must be from 1 to 9, got %d", level)
+	}
+
+	unexportedField[websocket.Upgrader](relay, "upgrader").EnableCompression = true
+	if level != 1 {
+		relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+			if ws := khatru.GetConnection(ctx); ws != nil {
+				// only applies when the client negotiated compression
+				(*unexportedField[*websocket.Conn](ws, "conn")).SetCompressionLevel(level)
+			}
+		})
+	}
+	return nil
+}
+
+// unexportedField returns a pointer to the field called name of the struct
+// value points to, which must be of type T.
+func unexportedField[T any](value any, name string) *T {
+	field := reflect.ValueOf(value).Elem().FieldByName(name)
+	if !field.IsValid() || field.Type() != reflect.TypeFor[T]() {
+		panic(fmt.Sprintf("%T has no %s field of type %v", value, name, reflect.TypeFor[T]()))
+	}
+	return (*T)(unsafe.Pointer(field.UnsafeAddr()))
+}
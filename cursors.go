@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"sync"
+	"time"
+)
+
+var cursorSchema = Schema{
+	Tables: []string{"subscription_cursor"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS subscription_cursor (
+       name text NOT NULL PRIMARY KEY,
+       since bigint NOT NULL,
+       updated_at bigint NOT NULL);`,
+	},
+}
+
+// cursorFlushInterval throttles cursor writes: a busy subscription only
+// touches the database this often, and a crash loses at most this much
+// progress (which the overlap covers anyway).
+const cursorFlushInterval = 10 * time.Second
+
+var cursorOverlap time.Duration
+
+// SubscriptionCursor remembers the newest created_at a long-lived upstream
+// subscription has processed, so it resumes from there after a restart
+// instead of replaying everything. Resuming goes back SUBSCRIPTION_CURSOR_OVERLAP
+// to catch events that were published late; consumers must already cope
+// with seeing an event twice.
+type SubscriptionCursor struct {
+	Name string
+
+	db      Database
+	mutex   sync.Mutex
+	since   nostr.Timestamp
+	dirty   bool
+	pending bool
+	saved   time.Time
+}
+
+// NewSubscriptionCursor loads the cursor stored under name, starting at
+// fallback the first time. A zero fallback means no since at all.
+func NewSubscriptionCursor(name string, fallback nostr.Timestamp, db Database) *SubscriptionCursor {
+	cursor := &SubscriptionCursor{Name: name, db: db, since: fallback, saved: time.Now()}
+	db.DB.QueryRow(`SELECT since FROM subscription_cursor WHERE name = ?`, name).Scan(&cursor.since)
+	return cursor
+}
+
+// Since is the value to put in the subscription's filter.
+func (c *SubscriptionCursor) Since() *nostr.Timestamp {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.since == 0 {
+		return nil
+	}
+	since := c.since - nostr.Timestamp(cursorOverlap.Seconds())
+	return &since
+}
+
+// Advance records that an event created at createdAt was processed. Events
+// dated in the future don't move the cursor, or a single one could make the
+// subscription skip everything published until then.
+func (c *SubscriptionCursor) Advance(createdAt nostr.Timestamp) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if createdAt <= c.since || createdAt > nostr.Now() {
+		return
+	}
+	c.since = createdAt
+	c.dirty = true
+	if time.Since(c.saved) >= cursorFlushInterval {
+		c.flush()
+	} else if !c.pending {
+		// make sure the last events before a quiet period get saved too
+		c.pending = true
+		time.AfterFunc(cursorFlushInterval, c.Flush)
+	}
+}
+
+func (c *SubscriptionCursor) Flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.flush()
+}
+
+func (c *SubscriptionCursor) flush() {
+	c.pending = false
+	if !c.dirty {
+		return
+	}
+	_, err := c.db.DB.Exec(
+		`INSERT INTO subscription_cursor (name, since, updated_at) VALUES (?, ?, ?)
+		 ON CONFLICT (name) DO UPDATE SET since = excluded.since, updated_at = excluded.updated_at`,
+		c.Name, c.since, nostr.Now(),
+	)
+	if err != nil {
+		ReportError(err, "cursors", map[string]string{"cursor": c.Name})
+		return
+	}
+	c.dirty = false
+	c.saved = time.Now()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/postgresql"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"strings"
+)
+
+type EventStore interface {
+	eventstore.Store
+	eventstore.Counter
+}
+
+// Database is the event store the relay saves events in together with a
+// handle on the same database for the ledger and everything else in
+// schemas.
+type Database struct {
+	EventStore
+	DB *sqlx.DB
+}
+
+// OpenDatabase opens DATABASE_URL. postgres:// urls use the postgres
+// backend, which several relay instances behind a load balancer can share;
+// anything else is the path of a sqlite database only one instance can use.
+//
+// Crediting and debiting are keyed by zap and event IDs, so instances
+// indexing the same receipt or storing the same event don't count it twice.
+// Shadow bans and follower-only accounts are loaded at startup, though, and
+// changes made through one instance only reach the others when they restart.
+//
+// The ledger's queries are written with ? placeholders, which sqlite takes
+// as they are and the postgres handle rewrites.
+func OpenDatabase(url string, queryLimit int) (Database, error) {
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		store := &postgresql.PostgresBackend{DatabaseURL: url, QueryLimit: queryLimit, KeepRecentEvents: true}
+		if err := store.Init(); err != nil {
+			return Database{}, err
+		}
+		db, err := sqlx.Open("ppe-postgres", url)
+		if err != nil {
+			store.Close()
+			return Database{}, err
+		}
+		return Database{EventStore: store, DB: db}, nil
+	}
+
+	store := &sqlite3.SQLite3Backend{DatabaseURL: strings.TrimPrefix(url, "sqlite://"), QueryLimit: queryLimit}
+	if err := store.Init(); err != nil {
+		return Database{}, err
+	}
+	return Database{EventStore: store, DB: store.DB}, nil
+}
+
+func init() {
+	sql.Register("ppe-postgres", rebindDriver{&pq.Driver{}})
+}
+
+// rebindDriver is lib/pq with ? placeholders turned into postgres' $1, $2...
+type rebindDriver struct {
+	driver.Driver
+}
+
+func (d rebindDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return rebindConn{conn}, nil
+}
+
+type rebindConn struct {
+	driver.Conn
+}
+
+func (c rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(sqlx.Rebind(sqlx.DOLLAR, query))
+}
+
+func (c rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, sqlx.Rebind(sqlx.DOLLAR, query))
+}
+
+func (c rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, sqlx.Rebind(sqlx.DOLLAR, query), args)
+}
+
+func (c rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, sqlx.Rebind(sqlx.DOLLAR, query), args)
+}
+
+func (c rebindConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+// instanceID tells this process apart from other instances sharing the
+// database when they compete for leases.
+var instanceID = func() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}()
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/nbd-wtf/go-nostr"
+	"time"
+)
+
+var (
+	// dedupWindow is how far apart two identical events from the same
+	// author can be for the later one to go uncharged; 0 charges both
+	dedupWindow time.Duration
+
+	duplicatesNotCharged = NewCounter("ppe_duplicate_content_not_charged_total", "Events not charged for because they repeat one the author just posted.")
+	storedDuplicates     = NewCounter("ppe_stored_duplicates_total", "Events acknowledged as duplicate: before any other policy because they were already stored.")
+)
+
+// ContentHash identifies what an event says regardless of when it was
+// signed: its author, kind, tags and content.
+func ContentHash(event *nostr.Event) [32]byte {
+	serialized, _ := json.Marshal([]any{event.PubKey, event.Kind, event.Tags, event.Content})
+	return sha256.Sum256(serialized)
+}
+
+// DuplicateOf returns the ID of a stored event byte-identical to event but
+// for its created_at and signed within DEDUP_WINDOW of it, or "". A client
+// retrying a publish it thinks failed often re-signs the same note, getting
+// a new ID the relay can't tell from a new event.
+//
+// Only an event that was already charged for counts as the original, so
+// of two identical events stored at the same moment neither goes free, and
+// only one retry goes free: once a copy was let off as a duplicate, further
+// copies are charged like new events.
+func DuplicateOf(event *nostr.Event, db Database) string {
+	if dedupWindow <= 0 {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	since := event.CreatedAt - nostr.Timestamp(dedupWindow.Seconds())
+	until := event.CreatedAt + nostr.Timestamp(dedupWindow.Seconds())
+	events, err := DecryptAtRest(db.QueryEvents)(ctx, nostr.Filter{
+		Authors: []string{event.PubKey},
+		Kinds:   []int{event.Kind},
+		Since:   &since,
+		Until:   &until,
+		Limit:   100,
+	})
+	if err != nil {
+		ReportError(err, "dedup", map[string]string{"event": event.ID})
+		return ""
+	}
+
+	hash := ContentHash(event)
+	original, waived := "", false
+	for stored := range events {
+		if stored.ID == event.ID || ContentHash(stored) != hash {
+			continue
+		}
+		var reason string
+		if err := db.DB.Get(&reason, `SELECT reason FROM debit WHERE id = ?`, "event:"+stored.ID); err != nil {
+			continue
+		}
+		if reason == "duplicate" {
+			waived = true
+		} else if original == "" {
+			original = stored.ID
+		}
+	}
+	if waived {
+		return ""
+	}
+	return original
+}
+
+// SkipStoredDuplicates runs the RejectEvent policies unless the event is
+// already stored. Clients re-send events whose OK they didn't see, and
+// khatru only notices it has them after every policy has run, so a retry
+// could be rate limited or refused for a balance it already paid. A stored
+// event is let through untouched instead: khatru finds it and acknowledges
+// it with OK true, as NIP-01 has relays do for duplicates, its message set
+// to "duplicate:".
+//
+// The lookup goes to the database, and cold storage, so an event stored
+// through any instance sharing them counts. Ephemeral events are never
+// stored and are left alone.
+func SkipStoredDuplicates(policies []func(ctx context.Context, event *nostr.Event) (reject bool, msg string), db Database) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if event.Kind < 20000 || event.Kind >= 30000 {
+			stored, err := IsEventStored(event.ID, db)
+			if err != nil {
+				ReportError(err, "dedup", map[string]string{"event": event.ID})
+			} else if stored {
+				storedDuplicates.Inc()
+				SetOKMessage(ctx, event, RejectDuplicate+": already have this event")
+				return false, ""
+			}
+		}
+		for _, policy := range policies {
+			if reject, msg := policy(ctx, event); reject {
+				return reject, msg
+			}
+		}
+		return false, ""
+	}
+}
+
+// IsEventStored reports whether the event with id is in db or its cold
+// storage.
+func IsEventStored(id string, db Database) (bool, error) {
+	for _, store := range EventDatabases(db) {
+		var stored bool
+		if err := store.DB.Get(&stored, `SELECT COUNT(*) > 0 FROM event WHERE id = ?`, id); err != nil {
+			return false, err
+		}
+		if stored {
+			return true, nil
+		}
+	}
+	return false, nil
+}
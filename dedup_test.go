@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"strings"
+	"testing"
+)
+
+func TestStoredDuplicateAcknowledged(t *testing.T) {
+	h := NewHarness(t)
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	if err := h.TopUp(pubkey, 1); err != nil {
+		t.Fatalf("topping up: %v", err)
+	}
+
+	event := nostr.Event{CreatedAt: nostr.Now(), Kind: nostr.KindTextNote, Content: "once"}
+	event.Sign(sk)
+	if ok, err := h.Send(event); err != nil || !ok.OK {
+		t.Fatalf("publishing: %v %v", ok, err)
+	}
+	// the balance is spent, so only skipping the policies lets this through
+	ok, err := h.Send(event)
+	if err != nil {
+		t.Fatalf("publishing again: %v", err)
+	}
+	if !ok.OK || !strings.HasPrefix(ok.Reason, "duplicate:") {
+		t.Fatalf("re-sent event answered with %v", ok)
+	}
+	if balance := GetLedgerBalanceMsat(pubkey, h.DB); balance != 0 {
+		t.Fatalf("balance is %d msat after one paid event, expected 0", balance)
+	}
+}
+
+func TestOnlyOneResignedCopyFree(t *testing.T) {
+	h := NewHarness(t)
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	if err := h.TopUp(pubkey, 2); err != nil {
+		t.Fatalf("topping up: %v", err)
+	}
+
+	// the same note re-signed a second later each time, as a retrying
+	// client does: the first retry is free, the next one is charged
+	createdAt := nostr.Now()
+	for i, expected := range []int64{1000, 1000, 0} {
+		event := nostr.Event{CreatedAt: createdAt + nostr.Timestamp(i), Kind: nostr.KindTextNote, Content: "again"}
+		event.Sign(sk)
+		if ok, err := h.Send(event); err != nil || !ok.OK {
+			t.Fatalf("publishing copy %d: %v %v", i, ok, err)
+		}
+		if balance := GetLedgerBalanceMsat(pubkey, h.DB); balance != expected {
+			t.Fatalf("balance is %d msat after copy %d, expected %d", balance, i, expected)
+		}
+	}
+
+	event := nostr.Event{CreatedAt: createdAt + 3, Kind: nostr.KindTextNote, Content: "again"}
+	event.Sign(sk)
+	if ok, err := h.Send(event); err != nil || ok.OK {
+		t.Fatalf("a fourth copy with nothing left was answered with %v %v", ok, err)
+	}
+}
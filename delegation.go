@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"strings"
+)
+
+var delegatedEvents = NewCounter("ppe_delegated_events_total", "Events received with a valid NIP-26 delegation.")
+
+// GetDelegator returns the delegator of an event carrying a NIP-26
+// "delegation" tag, or "" if it has none. The token must be signed by the
+// delegator for this event's pubkey and the event must meet its conditions.
+func GetDelegator(event *nostr.Event) (string, error) {
+	tag := event.Tags.GetFirst([]string{"delegation", ""})
+	if tag == nil {
+		return "", nil
+	}
+	if len(*tag) != 4 {
+		return "", errors.New("delegation tag must have a pubkey, conditions and a token")
+	}
+	delegator, conditions, token := (*tag)[1], (*tag)[2], (*tag)[3]
+
+	pubkey, err := hex.DecodeString(delegator)
+	if err != nil || len(pubkey) != 32 {
+		return "", errors.New("invalid delegator pubkey")
+	}
+	key, err := schnorr.ParsePubKey(pubkey)
+	if err != nil {
+		return "", errors.New("invalid delegator pubkey")
+	}
+	raw, err := hex.DecodeString(token)
+	if err != nil {
+		return "", errors.New("invalid delegation token")
+	}
+	signature, err := schnorr.ParseSignature(raw)
+	if err != nil {
+		return "", errors.New("invalid delegation token")
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("nostr:delegation:%s:%s", event.PubKey, conditions)))
+	if !signature.Verify(hash[:], key) {
+		return "", errors.New("delegation token signature is invalid")
+	}
+
+	if err := checkDelegationConditions(event, conditions); err != nil {
+		return "", err
+	}
+	return delegator, nil
+}
+
+// checkDelegationConditions checks the event against conditions like
+// "kind=1&created_at>1674834236&created_at<1677426236". Several kind
+// conditions allow any of those kinds.
+func checkDelegationConditions(event *nostr.Event, conditions string) error {
+	var kinds []int
+	for _, condition := range strings.Split(conditions, "&") {
+		if condition == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(condition, "kind="):
+			kind, err := strconv.Atoi(strings.TrimPrefix(condition, "kind="))
+			if err != nil {
+				return fmt.Errorf("invalid delegation condition %q", condition)
+			}
+			kinds = append(kinds, kind)
+		case strings.HasPrefix(condition, "created_at>"):
+			after, err := strconv.ParseInt(strings.TrimPrefix(condition, "created_at>"), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid delegation condition %q", condition)
+			}
+			if int64(event.CreatedAt) <= after {
+				return errors.New("event predates its delegation")
+			}
+		case strings.HasPrefix(condition, "created_at<"):
+			before, err := strconv.ParseInt(strings.TrimPrefix(condition, "created_at<"), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid delegation condition %q", condition)
+			}
+			if int64(event.CreatedAt) >= before {
+				return errors.New("delegation expired")
+			}
+		default:
+			return fmt.Errorf("unsupported delegation condition %q", condition)
+		}
+	}
+
+	if len(kinds) == 0 {
+		return nil
+	}
+	for _, kind := range kinds {
+		if kind == event.Kind {
+			return nil
+		}
+	}
+	return fmt.Errorf("delegation doesn't cover kind %d", event.Kind)
+}
+
+// GetEventAuthor is who an event is billed and counted against: its
+// delegator when it's posted under a valid delegation, its author otherwise.
+func GetEventAuthor(event *nostr.Event) string {
+	if delegator, err := GetDelegator(event); err == nil && delegator != "" {
+		return delegator
+	}
+	return event.PubKey
+}
+
+// RejectInvalidDelegation is a RejectEvent policy for events whose
+// delegation doesn't verify, so nobody can make the relay bill a delegator
+// that never signed off on it.
+func RejectInvalidDelegation(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	delegator, err := GetDelegator(event)
+	if err != nil {
+		return true, "invalid: " + err.Error()
+	}
+	if delegator != "" {
+		delegatedEvents.Inc()
+	}
+	return false, ""
+}
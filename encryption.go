@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"strings"
+)
+
+// Encrypted content is stored as a prefix naming the key it was sealed with
+// followed by base64 of the nonce and the AES-GCM ciphertext. The event ID is
+// the additional data, so content can't be moved between rows.
+const (
+	encryptedPrefix        = "ppe-enc:1:"
+	encryptedPerUserPrefix = "ppe-enc:2:"
+)
+
+var (
+	encryptionKey     []byte
+	encryptionPerUser bool
+	encryptedKinds    = make(map[int]bool)
+
+	eventsEncrypted = NewCounter("ppe_events_encrypted_total", "Events whose content was encrypted before being stored.")
+	encryptedHidden = NewCounter("ppe_encrypted_hidden_total", "Encrypted events withheld from connections not allowed to read them.")
+)
+
+// ConfigureEncryption reads ENCRYPTION_KEY (32 bytes of hex) and
+// ENCRYPTED_KINDS. With ENCRYPTION_PER_USER=true each author's content is
+// sealed with a key derived from theirs, so one leaked key only exposes one
+// account. Events sealed either way stay readable after switching.
+func ConfigureEncryption() error {
+	kinds := GetEnvList("ENCRYPTED_KINDS", nil)
+	if len(kinds) == 0 {
+		return nil
+	}
+	for _, value := range kinds {
+		kind, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid encrypted kind %q", value)
+		}
+		encryptedKinds[kind] = true
+	}
+
+	key, err := hex.DecodeString(GetEnv("ENCRYPTION_KEY"))
+	if err != nil || len(key) != 32 {
+		return errors.New("ENCRYPTION_KEY must be 32 bytes of hex")
+	}
+	encryptionKey = key
+	encryptionPerUser = GetEnvDefault("ENCRYPTION_PER_USER", "") == "true"
+	return nil
+}
+
+func contentCipher(prefix string, pubkey string) (cipher.AEAD, error) {
+	key := encryptionKey
+	if prefix == encryptedPerUserPrefix {
+		mac := hmac.New(sha256.New, encryptionKey)
+		mac.Write([]byte(pubkey))
+		key = mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func EncryptContent(event *nostr.Event) (string, error) {
+	prefix := encryptedPrefix
+	if encryptionPerUser {
+		prefix = encryptedPerUserPrefix
+	}
+	aead, err := contentCipher(prefix, event.PubKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(event.Content), []byte(event.ID))
+	return prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptContent returns the original content of a stored event, which is
+// its content as is unless it was encrypted.
+func DecryptContent(event *nostr.Event) (string, error) {
+	prefix := encryptedPrefix
+	if !strings.HasPrefix(event.Content, prefix) {
+		prefix = encryptedPerUserPrefix
+		if !strings.HasPrefix(event.Content, prefix) {
+			return event.Content, nil
+		}
+	}
+	if encryptionKey == nil {
+		return "", errors.New("event is encrypted but ENCRYPTION_KEY isn't set")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(event.Content, prefix))
+	if err != nil {
+		return "", err
+	}
+	aead, err := contentCipher(prefix, event.PubKey)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted content is too short")
+	}
+	content, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(event.ID))
+	return string(content), err
+}
+
+// CanReadProtected reports whether reader may see an event of an encrypted
+// kind: its author, the pubkeys it's addressed to and the operator can.
+func CanReadProtected(reader string, event *nostr.Event) bool {
+	if !encryptedKinds[event.Kind] {
+		return true
+	}
+	if reader == "" {
+		return false
+	}
+	return reader == event.PubKey || reader == relay.Info.PubKey || event.Tags.GetFirst([]string{"p", reader}) != nil
+}
+
+// EncryptAtRest wraps a StoreEvent handler so events of ENCRYPTED_KINDS are
+// stored with their content encrypted.
+func EncryptAtRest(store func(ctx context.Context, event *nostr.Event) error) func(ctx context.Context, event *nostr.Event) error {
+	return func(ctx context.Context, event *nostr.Event) error {
+		if !encryptedKinds[event.Kind] {
+			return store(ctx, event)
+		}
+		content, err := EncryptContent(event)
+		if err != nil {
+			ReportError(err, "encryption", map[string]string{"event": event.ID})
+			return errors.New("error: couldn't encrypt the event")
+		}
+		sealed := *event
+		sealed.Content = content
+		if err := store(ctx, &sealed); err != nil {
+			return err
+		}
+		eventsEncrypted.Inc()
+		return nil
+	}
+}
+
+// DecryptAtRest wraps a QueryEvents handler to decrypt what EncryptAtRest
+// stored. Events of encrypted kinds are only sent to connections that
+// CanReadProtected; khatru's own lookups while storing get everything.
+func DecryptAtRest(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		results, err := query(ctx, filter)
+		if err != nil {
+			return results, err
+		}
+
+		authed := khatru.GetAuthed(ctx)
+		request := IsRequest(ctx)
+
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+			challenged := false
+			for event := range results {
+				if request && !CanReadProtected(authed, event) {
+					encryptedHidden.Inc()
+					if authed == "" && !challenged {
+						khatru.RequestAuth(ctx)
+						challenged = true
+					}
+					continue
+				}
+
+				content, err := DecryptContent(event)
+				if err != nil {
+					ReportError(err, "encryption", map[string]string{"event": event.ID})
+					continue
+				}
+				if content != event.Content {
+					// the stored event may be shared, e.g. by the query cache
+					decrypted := *event
+					decrypted.Content = content
+					event = &decrypted
+				}
+
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					for range results {
+					}
+					return
+				}
+			}
+		}()
+		return ch, nil
+	}
+}
+
+func PreventProtectedBroadcast(ws *khatru.WebSocket, event *nostr.Event) bool {
+	return !CanReadProtected(ws.AuthedPublicKey, event)
+}
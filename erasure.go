@@ -0,0 +1,433 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+var erasureSchema = Schema{
+	Tables: []string{"erasure", "erased_zap"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS erasure (
+       pubkey text NOT NULL PRIMARY KEY,
+       confirmation text NOT NULL,
+       events bigint NOT NULL,
+       records bigint NOT NULL,
+       erased_at bigint NOT NULL);`,
+		`CREATE TABLE IF NOT EXISTS erased_zap (
+       bolt11_hash text NOT NULL PRIMARY KEY,
+       pubkey_hash text NOT NULL,
+       erased_at bigint NOT NULL);`,
+	},
+}
+
+// accountRecords are the rows that belong to a pubkey, by table and the
+// condition selecting them. Export and erasure both go through this list so
+// neither misses a table the other covers; zap checks and revocations go
+// before the credits they're keyed on, and pool members before the pools.
+//
+// The replication log goes first, and only loses the events and row
+// upserts it holds: the deletes logged while erasing, this erasure's
+// included, stay for followers to erase the account too, until they're
+// pruned.
+var accountRecords = []struct {
+	Table string
+	Where string
+}{
+	{"replication_log", `(change = 'save' OR event LIKE '%"upsert"%') AND event LIKE '%' || ? || '%'`},
+	{"zap_check", "id IN (SELECT id FROM zap_credit WHERE pubkey = ?)"},
+	{"zap_revocation", "id IN (SELECT id FROM zap_credit WHERE pubkey = ?)"},
+	{"zap_credit", "pubkey = ?"},
+	{"debit_author", "author = ? OR id IN (SELECT id FROM debit WHERE pubkey = ?)"},
+	{"debit", "pubkey = ?"},
+	{"bonus_credit", "pubkey = ?"},
+	{"trial_credit", "pubkey = ?"},
+	{"package_credit", "pubkey = ?"},
+	{"read_usage", "pubkey = ?"},
+	{"event_rejection", "pubkey = ?"},
+	{"nip05_name", "pubkey = ?"},
+	{"referral_code", "pubkey = ?"},
+	{"referral", "referee = ? OR referrer = ?"},
+	{"shadow_ban", "pubkey = ?"},
+	{"bot_session", "pubkey = ?"},
+	{"notification_preference", "pubkey = ?"},
+	{"team_member", "pubkey = ? OR owner = ?"},
+	{"allowance", "pubkey = ? OR owner = ?"},
+	{"pool_member", "pubkey = ? OR pool IN (SELECT name FROM balance_pool WHERE admin = ?)"},
+	{"balance_pool", "admin = ?"},
+	{"client_author", "pubkey = ?"},
+	{"spend_limit", "pubkey = ?"},
+	{"escrow", "pubkey = ?"},
+	{"private_account", "pubkey = ?"},
+	{"push_subscription", "pubkey = ?"},
+	{"spam_score", "pubkey = ?"},
+	{"bot_suspect", "pubkey = ?"},
+	{"pin", "pubkey = ?"},
+	{"storage_usage", "pubkey = ?"},
+	{"billing_exemption", "pubkey = ?"},
+	{"backfill_permit", "pubkey = ?"},
+	{"backfill_import", "pubkey = ?"},
+	{"outbound_event", "event LIKE '%' || ? || '%'"},
+}
+
+// keptRecords are the accountRecords exported but not erased: they're what
+// stops an account from being erased to shed a ban or claim a trial or
+// referral again.
+var keptRecords = []string{"trial_credit", "referral", "shadow_ban", "spam_score", "bot_suspect"}
+
+// erasureConfirmationMaxAge is how old a signed erasure confirmation can be.
+const erasureConfirmationMaxAge = 24 * time.Hour
+
+type Erasure struct {
+	PubKey       string          `json:"pubkey"`
+	Confirmation nostr.Event     `json:"confirmation"`
+	Events       int64           `json:"events"`
+	Records      int64           `json:"records"`
+	ErasedAt     nostr.Timestamp `json:"erased_at"`
+}
+
+type AccountExport struct {
+	PubKey      string                      `json:"pubkey"`
+	ExportedAt  nostr.Timestamp             `json:"exported_at"`
+	BalanceMsat int64                       `json:"balance_msat"`
+	Events      []nostr.Event               `json:"events"`
+	Records     map[string][]map[string]any `json:"records"`
+}
+
+var accountsErased = NewCounter("ppe_accounts_erased_total", "Accounts erased at their owner's signed request.")
+
+func whereArgs(where string, pubkey string) []any {
+	args := make([]any, strings.Count(where, "?"))
+	for i := range args {
+		args[i] = pubkey
+	}
+	return args
+}
+
+func getAuthoredEvents(pubkey string, db Database) ([]nostr.Event, error) {
+	stored, err := QueryStoredEvents(`SELECT id, pubkey, created_at, kind, tags, content, sig FROM event WHERE pubkey = ? ORDER BY created_at`, []any{pubkey}, db)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]nostr.Event, len(stored))
+	for i, event := range stored {
+		events[i] = *event
+	}
+	// cold storage's are older
+	slices.SortStableFunc(events, func(a, b nostr.Event) int { return cmp.Compare(a.CreatedAt, b.CreatedAt) })
+	return events, nil
+}
+
+// ExportAccount gathers everything stored about pubkey: its events, with
+// encrypted content decrypted, and its rows in every other table.
+func ExportAccount(pubkey string, db Database) (AccountExport, error) {
+	export := AccountExport{
+		PubKey:      pubkey,
+		ExportedAt:  nostr.Now(),
+		BalanceMsat: GetLedgerBalanceMsat(pubkey, db),
+		Records:     make(map[string][]map[string]any),
+	}
+
+	events, err := getAuthoredEvents(pubkey, db)
+	if err != nil {
+		return export, err
+	}
+	for i := range events {
+		if events[i].Content, err = DecryptContent(&events[i]); err != nil {
+			return export, err
+		}
+	}
+	export.Events = events
+
+	for _, records := range accountRecords {
+		rows, err := db.DB.Queryx(`SELECT * FROM `+records.Table+` WHERE `+records.Where, whereArgs(records.Where, pubkey)...)
+		if err != nil {
+			return export, err
+		}
+		for rows.Next() {
+			row := make(map[string]any)
+			if err := rows.MapScan(row); err != nil {
+				rows.Close()
+				return export, err
+			}
+			for column, value := range row {
+				if raw, ok := value.([]byte); ok {
+					row[column] = string(raw)
+				}
+			}
+			export.Records[records.Table] = append(export.Records[records.Table], row)
+		}
+		rows.Close()
+	}
+	return export, nil
+}
+
+// VerifyErasureConfirmation checks that confirmation is a recent event
+// signed by pubkey saying "erase", e.g. the note answering the bot's erase
+// question or one an operator got by other means.
+func VerifyErasureConfirmation(pubkey string, confirmation *nostr.Event) error {
+	if confirmation.PubKey != pubkey {
+		return errors.New("the confirmation must be signed by the account being erased")
+	}
+	if ok, err := confirmation.CheckSignature(); err != nil || !ok {
+		return errors.New("the confirmation's signature is invalid")
+	}
+	if Now().Sub(confirmation.CreatedAt.Time()) > erasureConfirmationMaxAge {
+		return errors.New("the confirmation is too old")
+	}
+	if !strings.HasPrefix(strings.ToLower(sessionAnswer(confirmation)), "erase") {
+		return errors.New(`the confirmation must say "erase"`)
+	}
+	return nil
+}
+
+// EraseAccount deletes pubkey's events and every row about it but the kept
+// ones, leaving an audit record holding the signed confirmation. Ledger rows
+// go too, so revenue reports for past months change, and the zaps credited
+// are tombstoned by hash in erased_zap so they aren't credited all over again
+// the next time the account's receipts are looked up. Trial credits are
+// zeroed rather than deleted, for the balance to start from nothing.
+//
+// Backups taken before still hold the account until they're deleted, but
+// restoring one erases it again, see RestoreSnapshot.
+func EraseAccount(pubkey string, confirmation *nostr.Event, db Database) (Erasure, error) {
+	if err := VerifyErasureConfirmation(pubkey, confirmation); err != nil {
+		return Erasure{PubKey: pubkey, Confirmation: *confirmation}, err
+	}
+	return eraseAccount(pubkey, confirmation, db, func(ctx context.Context, event *nostr.Event) error {
+		for _, del := range relay.DeleteEvent {
+			if err := del(ctx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReapplyErasures erases the accounts of erasures again, with the
+// confirmations they were erased with, after a restore brought them back.
+// Events are deleted from the database and cold storage directly, as the
+// relay isn't running.
+func ReapplyErasures(erasures []Erasure, db Database) error {
+	for _, erasure := range erasures {
+		if _, err := eraseAccount(erasure.PubKey, &erasure.Confirmation, db, coldStorage.WrapDelete(db.DeleteEvent)); err != nil {
+			return fmt.Errorf("erasing %s again: %w", erasure.PubKey, err)
+		}
+	}
+	return nil
+}
+
+func eraseAccount(pubkey string, confirmation *nostr.Event, db Database, deleteEvent func(context.Context, *nostr.Event) error) (Erasure, error) {
+	erasure := Erasure{PubKey: pubkey, Confirmation: *confirmation}
+
+	// events first: deleting them can still write to the ledger
+	purged, err := PurgeEvents(PurgeCriteria{Authors: []string{pubkey}}, db, deleteEvent)
+	if err != nil {
+		return erasure, err
+	}
+	erasure.Events = int64(purged.Deleted)
+
+	raw, _ := json.Marshal(confirmation)
+	erasure.ErasedAt = nostr.Now()
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return erasure, err
+	}
+	defer tx.Rollback()
+	var zaps []string
+	if err := tx.Select(&zaps, `SELECT bolt11 FROM zap_credit WHERE pubkey = ?`, pubkey); err != nil {
+		return erasure, err
+	}
+	for _, bolt11 := range zaps {
+		if _, err := tx.Exec(
+			`INSERT INTO erased_zap (bolt11_hash, pubkey_hash, erased_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+			erasureHash(bolt11), erasureHash(pubkey), erasure.ErasedAt,
+		); err != nil {
+			return erasure, err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE trial_credit SET amount_msat = 0 WHERE pubkey = ?`, pubkey); err != nil {
+		return erasure, err
+	}
+	for _, records := range accountRecords {
+		if slices.Contains(keptRecords, records.Table) {
+			continue
+		}
+		result, err := tx.Exec(`DELETE FROM `+records.Table+` WHERE `+records.Where, whereArgs(records.Where, pubkey)...)
+		if err != nil {
+			return erasure, err
+		}
+		rows, _ := result.RowsAffected()
+		erasure.Records += rows
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO erasure (pubkey, confirmation, events, records, erased_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (pubkey) DO UPDATE SET confirmation = excluded.confirmation, events = erasure.events + excluded.events, records = erasure.records + excluded.records, erased_at = excluded.erased_at`,
+		pubkey, string(raw), erasure.Events, erasure.Records, erasure.ErasedAt,
+	); err != nil {
+		return erasure, err
+	}
+	if err := tx.Commit(); err != nil {
+		return erasure, err
+	}
+
+	privateAccountsMutex.Lock()
+	delete(privateAccounts, pubkey)
+	privateAccountsMutex.Unlock()
+	followListsMutex.Lock()
+	delete(followLists, pubkey)
+	followListsMutex.Unlock()
+	notificationPreferencesMutex.Lock()
+	delete(notificationPreferences, pubkey)
+	notificationPreferencesMutex.Unlock()
+	pushSubscriptionsMutex.Lock()
+	delete(pushSubscriptions, pubkey)
+	pushSubscriptionsMutex.Unlock()
+	readAccessMutex.Lock()
+	delete(readAccessCache, pubkey)
+	readAccessMutex.Unlock()
+	billingExemptMutex.Lock()
+	if !configuredExemptions[pubkey] {
+		delete(billingExempt, pubkey)
+	}
+	billingExemptMutex.Unlock()
+	SharedDelete("read:" + pubkey)
+
+	accountsErased.Inc()
+	return erasure, nil
+}
+
+// erasureHash is what erased_zap keeps instead of an invoice or pubkey.
+func erasureHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsErasedZap reports whether bolt11 was credited to an account since
+// erased.
+func IsErasedZap(bolt11 string, db Database) bool {
+	var erased bool
+	db.DB.QueryRow(`SELECT COUNT(*) > 0 FROM erased_zap WHERE bolt11_hash = ?`, erasureHash(bolt11)).Scan(&erased)
+	return erased
+}
+
+func GetErasures(db Database) ([]Erasure, error) {
+	rows, err := db.DB.Query(`SELECT pubkey, confirmation, events, records, erased_at FROM erasure ORDER BY erased_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var erasures []Erasure
+	for rows.Next() {
+		var erasure Erasure
+		var confirmation string
+		if err := rows.Scan(&erasure.PubKey, &confirmation, &erasure.Events, &erasure.Records, &erasure.ErasedAt); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(confirmation), &erasure.Confirmation)
+		erasures = append(erasures, erasure)
+	}
+	return erasures, rows.Err()
+}
+
+// erasureFlow confirms an "erase" command: the user has to repeat the code
+// the bot gave them, and their signed answer is kept as the confirmation.
+func erasureFlow(event *nostr.Event, session *BotSession, answer string, db Database) string {
+	session.Step = ""
+	if !strings.EqualFold(strings.Join(strings.Fields(answer), " "), "erase "+session.Data["code"]) {
+		return "That's not the code I asked for, so nothing was deleted."
+	}
+
+	erasure, err := EraseAccount(event.PubKey, event, db)
+	if err != nil {
+		ReportError(err, "erasure", map[string]string{"pubkey": event.PubKey})
+		return fmt.Sprintf("Couldn't erase your account: %v.", err)
+	}
+	return fmt.Sprintf("Done: deleted %d events and %d other records. This relay keeps nothing else about you but any ban or trial on record.", erasure.Events, erasure.Records)
+}
+
+func StartErasure(pubkey string, db Database) string {
+	code := RandomHex(3)
+	return StartBotSession(pubkey, "erase", "confirm", map[string]string{"code": code},
+		fmt.Sprintf("This deletes all your events, your balance of %v sats and everything else this relay knows about you, and can't be undone. Reply with erase %s to confirm.",
+			GetRemainingUserBalance(pubkey, db), code), db)
+}
+
+// HandleAdminAccountExport serves /admin/account-export?pubkey=...
+func HandleAdminAccountExport(w http.ResponseWriter, r *http.Request, db Database) {
+	pubkey, err := ParsePubKey(r.URL.Query().Get("pubkey"))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "pubkey must be an npub or hex public key")
+		return
+	}
+	export, err := ExportAccount(pubkey, db)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, export)
+}
+
+// HandleAdminErasure serves /admin/erasure: GET lists past erasures, POST
+// {"confirmation": <signed event>} erases the account that signed it.
+func HandleAdminErasure(w http.ResponseWriter, r *http.Request, db Database) {
+	switch r.Method {
+	case http.MethodGet:
+		erasures, err := GetErasures(db)
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		WriteJSON(w, http.StatusOK, erasures)
+	case http.MethodPost:
+		var request struct {
+			Confirmation *nostr.Event `json:"confirmation"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Confirmation == nil {
+			WriteJSONError(w, http.StatusBadRequest, "invalid json body")
+			return
+		}
+		erasure, err := EraseAccount(request.Confirmation.PubKey, request.Confirmation, db)
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		WriteJSON(w, http.StatusOK, erasure)
+	default:
+		WriteJSONError(w, http.StatusMethodNotAllowed, "use GET or POST")
+	}
+}
+
+// RunExportAccount prints everything stored about a pubkey as JSON.
+func RunExportAccount(args []string, db Database) {
+	if len(args) != 1 {
+		fmt.Println("Usage: export-account <npub or hex pubkey>")
+		os.Exit(1)
+	}
+	pubkey, err := ParsePubKey(args[0])
+	if err != nil {
+		fmt.Printf("Invalid pubkey: %v\n", err)
+		os.Exit(1)
+	}
+	export, err := ExportAccount(pubkey, db)
+	if err != nil {
+		fmt.Printf("Export failed: %v\n", err)
+		os.Exit(1)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(export)
+}
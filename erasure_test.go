@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAccountRecordsCoverEveryTable fails for tables keeping a pubkey that
+// export and erasure don't know about, or only know about by one of its
+// pubkey columns.
+func TestAccountRecordsCoverEveryTable(t *testing.T) {
+	h := NewHarness(t)
+	accountColumns := []string{"pubkey", "author", "owner", "admin", "referee", "referrer"}
+	// the audit record an erasure leaves
+	notAccountRecords := []string{"erasure"}
+
+	for _, table := range SchemaTables() {
+		if slices.Contains(notAccountRecords, table) {
+			continue
+		}
+		var columns []string
+		if err := h.DB.DB.Select(&columns, `SELECT name FROM pragma_table_info(?)`, table); err != nil {
+			t.Fatal(err)
+		}
+		index := slices.IndexFunc(accountRecords, func(records struct{ Table, Where string }) bool { return records.Table == table })
+		for _, column := range columns {
+			switch {
+			case !slices.Contains(accountColumns, column):
+			case index < 0:
+				t.Errorf("%s.%s holds pubkeys but %s isn't in accountRecords", table, column, table)
+			case !strings.Contains(accountRecords[index].Where, column):
+				t.Errorf("accountRecords selects %s rows without looking at %s", table, column)
+			}
+		}
+	}
+}
+
+func TestRestoreErasesAgain(t *testing.T) {
+	h := NewHarness(t)
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	if err := h.TopUp(pubkey, 5); err != nil {
+		t.Fatalf("topping up: %v", err)
+	}
+	if err := h.Publish(sk, "soon forgotten"); err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+
+	snapshot := filepath.Join(h.Dir, "snapshot.sqlite")
+	if _, err := StartBackup(snapshot, h.DB); err != nil {
+		t.Fatalf("backing up: %v", err)
+	}
+	for backup, _ := GetLastBackup(); backup.FinishedAt == 0; backup, _ = GetLastBackup() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if backup, _ := GetLastBackup(); backup.Status != "done" {
+		t.Fatalf("backup %s: %s", backup.Status, backup.Error)
+	}
+
+	confirmation := nostr.Event{CreatedAt: nostr.Now(), Kind: nostr.KindTextNote, Content: "erase"}
+	confirmation.Sign(sk)
+	if _, err := EraseAccount(pubkey, &confirmation, h.DB); err != nil {
+		t.Fatalf("erasing: %v", err)
+	}
+
+	report, err := RestoreSnapshot(snapshot, "", h.DB)
+	if err != nil {
+		t.Fatalf("restoring: %v", err)
+	}
+	if report.Erasures != 1 {
+		t.Fatalf("%d erasures applied again, expected 1", report.Erasures)
+	}
+	for _, table := range []string{"event", "zap_credit", "debit"} {
+		var count int
+		h.DB.DB.Get(&count, `SELECT COUNT(*) FROM `+table+` WHERE pubkey = ?`, pubkey)
+		if count != 0 {
+			t.Errorf("%d %s rows of the erased account are back", count, table)
+		}
+	}
+}
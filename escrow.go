@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+)
+
+var escrowSchema = Schema{
+	Tables: []string{"escrow"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS escrow (
+       event_id text NOT NULL PRIMARY KEY,
+       pubkey text NOT NULL,
+       amount_msat bigint NOT NULL,
+       state text NOT NULL,
+       reason text NOT NULL,
+       created_at bigint NOT NULL,
+       resolved_at bigint);`,
+		`CREATE INDEX IF NOT EXISTS escrowstateidx ON escrow(state)`,
+	},
+}
+
+// Escrow states. While an event's charge is held it isn't counted as income;
+// resolving the dispute either releases it (the event stays), refunds it to
+// the payer or forfeits it (the event is taken down either way).
+const (
+	EscrowHeld      = "held"
+	EscrowReleased  = "released"
+	EscrowRefunded  = "refunded"
+	EscrowForfeited = "forfeited"
+)
+
+type Escrow struct {
+	EventID    string           `json:"event_id"`
+	PubKey     string           `json:"pubkey"`
+	AmountMsat int64            `json:"amount_msat"`
+	State      string           `json:"state"`
+	Reason     string           `json:"reason"`
+	CreatedAt  nostr.Timestamp  `json:"created_at"`
+	ResolvedAt *nostr.Timestamp `json:"resolved_at,omitempty"`
+}
+
+var (
+	escrowRefundOnTakedown bool
+
+	escrowsOpened = NewCounter("ppe_escrows_opened_total", "Event charges frozen while a report is reviewed.")
+)
+
+// HoldEscrow freezes the charge of a reported event until it's reviewed.
+// Reporting an event twice keeps the first report.
+func HoldEscrow(eventID string, reason string, db Database) error {
+	var pubkey string
+	var amount int64
+	err := db.DB.QueryRow(`SELECT pubkey, amount_msat FROM debit WHERE id = ?`, "event:"+eventID).Scan(&pubkey, &amount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("that event wasn't charged here")
+	} else if err != nil {
+		return err
+	}
+
+	result, err := db.DB.Exec(
+		`INSERT INTO escrow (event_id, pubkey, amount_msat, state, reason, created_at) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (event_id) DO NOTHING`,
+		eventID, pubkey, amount, EscrowHeld, reason, NowTimestamp(),
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		escrowsOpened.Inc()
+		FireWebhook(WebhookEscrowHeld, map[string]any{"event_id": eventID, "pubkey": pubkey, "reason": reason})
+	}
+	return nil
+}
+
+// ResolveEscrow ends the review of a held event. With takedown set the event
+// is deleted and, if ESCROW_REFUND_ON_TAKEDOWN is on, its charge credited
+// back to whoever paid it.
+func ResolveEscrow(eventID string, takedown bool, db Database) (Escrow, error) {
+	escrow, err := GetEscrow(eventID, db)
+	if err != nil {
+		return escrow, err
+	}
+	if escrow.State != EscrowHeld {
+		return escrow, fmt.Errorf("escrow is already %s", escrow.State)
+	}
+
+	state := EscrowReleased
+	if takedown {
+		state = EscrowForfeited
+		if escrowRefundOnTakedown {
+			state = EscrowRefunded
+		}
+		_, err := PurgeEvents(PurgeCriteria{IDs: []string{eventID}}, db, func(ctx context.Context, event *nostr.Event) error {
+			for _, del := range relay.DeleteEvent {
+				if err := del(ctx, event); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return escrow, err
+		}
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return escrow, err
+	}
+	defer tx.Rollback()
+
+	now := NowTimestamp()
+	if _, err := tx.Exec(`UPDATE escrow SET state = ?, resolved_at = ? WHERE event_id = ?`, state, now, eventID); err != nil {
+		return escrow, err
+	}
+	if state == EscrowRefunded && escrow.AmountMsat > 0 {
+		// a negative debit gives the charge back without touching the
+		// original one, so the ledger keeps both
+		if _, err := tx.Exec(
+			`INSERT INTO debit (id, pubkey, amount_msat, reason, created_at) VALUES (?, ?, ?, ?, ?)`,
+			"escrow:"+eventID, escrow.PubKey, -escrow.AmountMsat, "refund for removed event", now,
+		); err != nil {
+			return escrow, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return escrow, err
+	}
+
+	escrow.State = state
+	escrow.ResolvedAt = &now
+	return escrow, nil
+}
+
+func GetEscrow(eventID string, db Database) (Escrow, error) {
+	escrow := Escrow{EventID: eventID}
+	var resolvedAt sql.NullInt64
+	err := db.DB.QueryRow(
+		`SELECT pubkey, amount_msat, state, reason, created_at, resolved_at FROM escrow WHERE event_id = ?`, eventID,
+	).Scan(&escrow.PubKey, &escrow.AmountMsat, &escrow.State, &escrow.Reason, &escrow.CreatedAt, &resolvedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return escrow, errors.New("that event isn't in escrow")
+	}
+	if resolvedAt.Valid {
+		timestamp := nostr.Timestamp(resolvedAt.Int64)
+		escrow.ResolvedAt = &timestamp
+	}
+	return escrow, err
+}
+
+func GetEscrows(state string, db Database) ([]Escrow, error) {
+	rows, err := db.DB.Query(
+		`SELECT event_id, pubkey, amount_msat, state, reason, created_at, resolved_at FROM escrow WHERE state = ? ORDER BY created_at`, state,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var escrows []Escrow
+	for rows.Next() {
+		var escrow Escrow
+		var resolvedAt sql.NullInt64
+		if err := rows.Scan(&escrow.EventID, &escrow.PubKey, &escrow.AmountMsat, &escrow.State, &escrow.Reason, &escrow.CreatedAt, &resolvedAt); err != nil {
+			return nil, err
+		}
+		if resolvedAt.Valid {
+			timestamp := nostr.Timestamp(resolvedAt.Int64)
+			escrow.ResolvedAt = &timestamp
+		}
+		escrows = append(escrows, escrow)
+	}
+	return escrows, rows.Err()
+}
+
+// HoldReportedEvents is an OnEventSaved hook that puts the events a NIP-56
+// report (kind 1984) points at in escrow.
+func HoldReportedEvents(db Database) func(ctx context.Context, event *nostr.Event) {
+	return func(ctx context.Context, event *nostr.Event) {
+		if event.Kind != 1984 {
+			return
+		}
+		for _, tag := range event.Tags {
+			if len(tag) < 2 || tag[0] != "e" {
+				continue
+			}
+			reason := "reported"
+			if len(tag) > 2 && tag[2] != "" {
+				reason = "reported as " + tag[2]
+			}
+			// reports for events we don't have are simply ignored
+			HoldEscrow(tag[1], reason+" by "+event.PubKey, db)
+		}
+	}
+}
+
+// HandleAdminEscrow serves /admin/escrow: GET ?state=held lists escrows, POST
+// {"event_id", "reason"} holds an event's charge and POST {"event_id",
+// "action": "keep"|"takedown"} resolves it.
+func HandleAdminEscrow(w http.ResponseWriter, r *http.Request, db Database) {
+	switch r.Method {
+	case http.MethodGet:
+		state := r.URL.Query().Get("state")
+		if state == "" {
+			state = EscrowHeld
+		}
+		escrows, err := GetEscrows(state, db)
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		WriteJSON(w, http.StatusOK, escrows)
+	case http.MethodPost:
+		var request struct {
+			EventID string `json:"event_id"`
+			Reason  string `json:"reason"`
+			Action  string `json:"action"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.EventID == "" {
+			WriteJSONError(w, http.StatusBadRequest, "invalid json body")
+			return
+		}
+
+		switch request.Action {
+		case "":
+			if request.Reason == "" {
+				request.Reason = "held by operator"
+			}
+			if err := HoldEscrow(request.EventID, request.Reason, db); err != nil {
+				WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			escrow, _ := GetEscrow(request.EventID, db)
+			WriteJSON(w, http.StatusOK, escrow)
+		case "keep", "takedown":
+			escrow, err := ResolveEscrow(request.EventID, request.Action == "takedown", db)
+			if err != nil {
+				WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			WriteJSON(w, http.StatusOK, escrow)
+		default:
+			WriteJSONError(w, http.StatusBadRequest, "action must be keep or takedown")
+		}
+	default:
+		WriteJSONError(w, http.StatusMethodNotAllowed, "use GET or POST")
+	}
+}
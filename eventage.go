@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strings"
+	"time"
+)
+
+var backfillSchema = Schema{
+	Tables: []string{"backfill_permit"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS backfill_permit (
+       pubkey text NOT NULL PRIMARY KEY,
+       granted_at bigint NOT NULL,
+       expires_at bigint NOT NULL);`,
+	},
+}
+
+// maxEventAge is how old an event's created_at can be, EVENT_MAX_AGE, so
+// nobody imports years of history at today's prices by accident; how far
+// ahead it can be is EVENT_FUTURE_SKEW, see EventValidation. Importing older
+// events is deliberate: a backfill permit, bought from the bot for
+// backfillPermitPrice sats, lifts the limit for backfillPermitDuration.
+var (
+	maxEventAge            time.Duration
+	backfillPermitPrice    int64
+	backfillPermitDuration time.Duration
+
+	oldEventsRejected = NewCounter("ppe_old_events_rejected_total", "Events rejected for a created_at older than EVENT_MAX_AGE.")
+	backfillPermits   = NewCounter("ppe_backfill_permits_total", "Backfill permits bought.")
+)
+
+func backfillEnabled() bool {
+	return maxEventAge > 0
+}
+
+// RejectOldEvents is a RejectEvent policy for events older than maxEventAge
+// whose author has no backfill permit, outside of backfill imports.
+// Replaceable events are exempt, there being only one of each to import,
+// and an old profile or follow list being what clients republish to a relay
+// they start using.
+func RejectOldEvents(db Database) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if event.CreatedAt >= NowTimestamp()-nostr.Timestamp(maxEventAge.Seconds()) || event.Kind == 0 || event.Kind == 3 || (event.Kind >= 10000 && event.Kind < 20000) {
+			return false, ""
+		}
+		if BackfillImportID(ctx) != "" || HasBackfillPermit(GetEventAuthor(event), db) {
+			return false, ""
+		}
+		oldEventsRejected.Inc()
+		return true, fmt.Sprintf("%s: created_at is more than %s ago; send the bot \"backfill on\" to import older events", RejectInvalid, formatAge(maxEventAge))
+	}
+}
+
+// HasBackfillPermit reports whether pubkey can publish events older than
+// maxEventAge right now.
+func HasBackfillPermit(pubkey string, db Database) bool {
+	return GetBackfillPermitExpiry(pubkey, db) > NowTimestamp()
+}
+
+// GetBackfillPermitExpiry returns when pubkey's last backfill permit
+// expires, 0 if it never had one.
+func GetBackfillPermitExpiry(pubkey string, db Database) nostr.Timestamp {
+	var expiresAt nostr.Timestamp
+	db.DB.QueryRow(`SELECT expires_at FROM backfill_permit WHERE pubkey = ?`, pubkey).Scan(&expiresAt)
+	return expiresAt
+}
+
+// BuyBackfillPermit charges pubkey backfillPermitPrice sats for a permit
+// lasting backfillPermitDuration from now, replacing any it has.
+func BuyBackfillPermit(pubkey string, db Database) (nostr.Timestamp, error) {
+	defer LockBalance(pubkey)()
+	if balance := GetSpendableBalanceMsat(pubkey, db) / 1000; balance < backfillPermitPrice {
+		return 0, fmt.Errorf("a backfill permit costs %d sats and your balance is %d sats", backfillPermitPrice, balance)
+	}
+
+	now := NowTimestamp()
+	expiresAt := now + nostr.Timestamp(backfillPermitDuration.Seconds())
+	if backfillPermitPrice > 0 {
+		if _, err := RecordDebit(fmt.Sprintf("backfill:%s:%d", pubkey, now), pubkey, backfillPermitPrice, "backfill permit", db); err != nil {
+			return 0, err
+		}
+	}
+	_, err := db.DB.Exec(
+		`INSERT INTO backfill_permit (pubkey, granted_at, expires_at) VALUES (?, ?, ?)
+		 ON CONFLICT (pubkey) DO UPDATE SET granted_at = excluded.granted_at, expires_at = excluded.expires_at`,
+		pubkey, now, expiresAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	backfillPermits.Inc()
+	return expiresAt, nil
+}
+
+// EndBackfillPermit expires pubkey's permit early. What it paid isn't
+// refunded.
+func EndBackfillPermit(pubkey string, db Database) error {
+	_, err := db.DB.Exec(`UPDATE backfill_permit SET expires_at = ? WHERE pubkey = ? AND expires_at > ?`, NowTimestamp(), pubkey, NowTimestamp())
+	return err
+}
+
+// HandleBackfillCommand answers "backfill" with whether the user can import
+// old events, "backfill on" by asking them to confirm buying a permit,
+// "backfill off" by ending theirs and "backfill import" with
+// HandleBackfillImportCommand.
+func HandleBackfillCommand(pubkey string, args []string, db Database) string {
+	if len(args) > 0 && strings.ToLower(args[0]) == "import" {
+		return HandleBackfillImportCommand(pubkey, args[1:], db)
+	}
+	if !backfillEnabled() {
+		return "Events of any age are accepted. Use backfill import <relay> to import yours from other relays."
+	}
+	expiresAt := GetBackfillPermitExpiry(pubkey, db)
+	until := expiresAt.Time().UTC().Format("2006-01-02 15:04 UTC")
+	if len(args) == 0 {
+		if expiresAt > NowTimestamp() {
+			return fmt.Sprintf("You can import events of any age until %s. Use backfill off to stop early.", until)
+		}
+		return fmt.Sprintf("Events more than %s old are rejected. Use backfill on to import older ones, a permit costs %s.", formatAge(maxEventAge), describeBackfillPermit())
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "on":
+		if expiresAt > NowTimestamp() {
+			return fmt.Sprintf("You can already import events of any age until %s.", until)
+		}
+		return StartBotSession(pubkey, "backfill", "confirm", nil,
+			fmt.Sprintf("Importing events of any age costs %s, on top of what they cost to store. Reply yes to confirm.", describeBackfillPermit()), db)
+	case "off":
+		if err := EndBackfillPermit(pubkey, db); err != nil {
+			ReportError(err, "backfill", map[string]string{"pubkey": pubkey})
+			return "Couldn't end your permit, try again later."
+		}
+		return fmt.Sprintf("Events more than %s old are rejected again.", formatAge(maxEventAge))
+	}
+	return "Usage: backfill [on|off]"
+}
+
+// backfillFlow buys the permit the user confirmed, or starts the import.
+func backfillFlow(event *nostr.Event, session *BotSession, answer string, db Database) string {
+	if session.Step == "import" {
+		return backfillImportFlow(event, session, answer, db)
+	}
+	session.Step = ""
+	if !isYes(answer) {
+		return "Ok, old events stay rejected."
+	}
+	expiresAt, err := BuyBackfillPermit(event.PubKey, db)
+	if err != nil {
+		return fmt.Sprintf("Couldn't get you a permit: %v.", err)
+	}
+	return fmt.Sprintf("You can import events of any age until %s.", expiresAt.Time().UTC().Format("2006-01-02 15:04 UTC"))
+}
+
+func describeBackfillPermit() string {
+	return fmt.Sprintf("%d sats for %s", backfillPermitPrice, formatAge(backfillPermitDuration))
+}
+
+// formatAge writes durations of whole days in days, as "8760h0m0s" reads
+// poorly in a rejection.
+func formatAge(d time.Duration) string {
+	day := 24 * time.Hour
+	switch {
+	case d == day:
+		return "1 day"
+	case d%day == 0:
+		return fmt.Sprintf("%d days", d/day)
+	}
+	return d.String()
+}
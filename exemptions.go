@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+	"sync"
+)
+
+var exemptionSchema = Schema{
+	Tables: []string{"billing_exemption"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS billing_exemption (
+       pubkey text NOT NULL PRIMARY KEY,
+       reason text NOT NULL,
+       created_at bigint NOT NULL);`,
+	},
+}
+
+// BillingExemption is a pubkey whose events and reads are never paid for:
+// the operator's, partner services'. They're still rate limited like anyone.
+type BillingExemption struct {
+	PubKey    string          `json:"pubkey"`
+	Reason    string          `json:"reason"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+var (
+	billingExempt      = make(map[string]bool)
+	billingExemptMutex sync.RWMutex
+
+	// configuredExemptions come from BILLING_EXEMPT and can't be lifted
+	// through the admin API
+	configuredExemptions = make(map[string]bool)
+
+	errConfiguredExemption = errors.New("exempt through BILLING_EXEMPT, remove it there")
+
+	exemptEvents = NewCounter("ppe_billing_exempt_events_total", "Events stored without charge because their author is exempt from billing.")
+)
+
+// LoadBillingExemptions reads BILLING_EXEMPT, pubkeys (hex or npub) exempt
+// from billing on top of the ones added through the admin API.
+func LoadBillingExemptions(db Database) error {
+	configured := make(map[string]bool)
+	for _, value := range GetEnvList("BILLING_EXEMPT", nil) {
+		pubkey, err := ParsePubKey(value)
+		if err != nil {
+			return fmt.Errorf("BILLING_EXEMPT: invalid pubkey %q: %w", value, err)
+		}
+		configured[pubkey] = true
+	}
+
+	var pubkeys []string
+	if err := db.DB.Select(&pubkeys, `SELECT pubkey FROM billing_exemption`); err != nil {
+		return err
+	}
+
+	billingExemptMutex.Lock()
+	defer billingExemptMutex.Unlock()
+	configuredExemptions = configured
+	for pubkey := range configured {
+		billingExempt[pubkey] = true
+	}
+	for _, pubkey := range pubkeys {
+		billingExempt[pubkey] = true
+	}
+	return nil
+}
+
+// IsBillingExempt reports whether pubkey doesn't pay for its events or
+// reads. The relay's own pubkey and the bot's always are.
+func IsBillingExempt(pubkey string) bool {
+	if pubkey == "" {
+		return false
+	}
+	if pubkey == relay.Info.PubKey || pubkey == botPubkey {
+		return true
+	}
+	billingExemptMutex.RLock()
+	defer billingExemptMutex.RUnlock()
+	return billingExempt[pubkey]
+}
+
+func ExemptFromBilling(pubkey string, reason string, db Database) error {
+	_, err := db.DB.Exec(
+		`INSERT INTO billing_exemption (pubkey, reason, created_at) VALUES (?, ?, ?) ON CONFLICT(pubkey) DO UPDATE SET reason = excluded.reason`,
+		pubkey, reason, NowTimestamp(),
+	)
+	if err != nil {
+		return err
+	}
+
+	billingExemptMutex.Lock()
+	billingExempt[pubkey] = true
+	billingExemptMutex.Unlock()
+	return nil
+}
+
+func LiftBillingExemption(pubkey string, db Database) error {
+	billingExemptMutex.RLock()
+	configured := configuredExemptions[pubkey]
+	billingExemptMutex.RUnlock()
+	if configured {
+		return errConfiguredExemption
+	}
+
+	if _, err := db.DB.Exec(`DELETE FROM billing_exemption WHERE pubkey = ?`, pubkey); err != nil {
+		return err
+	}
+
+	billingExemptMutex.Lock()
+	delete(billingExempt, pubkey)
+	billingExemptMutex.Unlock()
+	return nil
+}
+
+// GetBillingExemptions lists the exemptions added through the admin API
+// followed by the configured ones, which have the reason "config".
+func GetBillingExemptions(db Database) ([]BillingExemption, error) {
+	var exemptions []BillingExemption
+	rows, err := db.DB.Query(`SELECT pubkey, reason, created_at FROM billing_exemption ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	listed := make(map[string]bool)
+	for rows.Next() {
+		var exemption BillingExemption
+		if err := rows.Scan(&exemption.PubKey, &exemption.Reason, &exemption.CreatedAt); err != nil {
+			return nil, err
+		}
+		listed[exemption.PubKey] = true
+		exemptions = append(exemptions, exemption)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	billingExemptMutex.RLock()
+	defer billingExemptMutex.RUnlock()
+	for pubkey := range configuredExemptions {
+		if !listed[pubkey] {
+			exemptions = append(exemptions, BillingExemption{PubKey: pubkey, Reason: "config"})
+		}
+	}
+	return exemptions, nil
+}
+
+func HandleAdminExemptions(w http.ResponseWriter, r *http.Request, db Database) {
+	switch r.Method {
+	case http.MethodGet:
+		exemptions, err := GetBillingExemptions(db)
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		WriteJSON(w, http.StatusOK, exemptions)
+	case http.MethodPost, http.MethodDelete:
+		var request struct {
+			PubKey string `json:"pubkey"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteJSONError(w, http.StatusBadRequest, "invalid json body")
+			return
+		}
+		pubkey, err := ParsePubKey(request.PubKey)
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid pubkey: %v", err))
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			err = ExemptFromBilling(pubkey, request.Reason, db)
+		} else {
+			err = LiftBillingExemption(pubkey, db)
+		}
+		if errors.Is(err, errConfiguredExemption) {
+			WriteJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]string{"pubkey": pubkey})
+	default:
+		WriteJSONError(w, http.StatusMethodNotAllowed, "use GET, POST or DELETE")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/xml"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// feedEntries is how many of an author's latest notes and articles a feed
+// has.
+const feedEntries = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Links      []atomLink     `xml:"link"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    atomText       `xml:"content"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// HandleFeed serves /feed/<npub>.xml, an Atom feed of a paying user's
+// latest notes and long-form articles stored here, so they can be followed
+// from any feed reader.
+func HandleFeed(w http.ResponseWriter, r *http.Request, db Database) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/feed/"), ".xml")
+	pubkey, err := ParsePubKey(name)
+	if err != nil {
+		http.Error(w, "feeds are at /feed/<npub>.xml", http.StatusBadRequest)
+		return
+	}
+	if !IsPayingCustomer(pubkey, db) {
+		http.Error(w, "feeds are for this relay's paying users", http.StatusNotFound)
+		return
+	}
+
+	events := GetPublicEvents(nostr.Filter{
+		Kinds:   []int{nostr.KindTextNote, nostr.KindArticle},
+		Authors: []string{pubkey},
+		Limit:   feedEntries,
+	}, db)
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	self := relay.ServiceURL + "/feed/" + npub + ".xml"
+
+	feed := atomFeed{
+		ID:      self,
+		Title:   npub[:12] + "… on " + relay.Info.Name,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: npub, URI: "https://njump.me/" + npub},
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: self},
+			{Rel: "alternate", Href: "https://njump.me/" + npub},
+		},
+	}
+	if len(events) > 0 {
+		feed.Updated = events[0].CreatedAt.Time().UTC().Format(time.RFC3339)
+	}
+	for _, event := range events {
+		feed.Entries = append(feed.Entries, newFeedEntry(event))
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		ReportError(err, "feeds", map[string]string{"pubkey": pubkey})
+	}
+}
+
+func newFeedEntry(event *nostr.Event) atomEntry {
+	entry := atomEntry{
+		Updated:   event.CreatedAt.Time().UTC().Format(time.RFC3339),
+		Published: event.CreatedAt.Time().UTC().Format(time.RFC3339),
+	}
+	for _, tag := range event.Tags.GetAll([]string{"t", ""}) {
+		entry.Categories = append(entry.Categories, atomCategory{Term: tag[1]})
+	}
+
+	if event.Kind == nostr.KindArticle {
+		d := tagValue(event.Tags, "d")
+		naddr, _ := nip19.EncodeEntity(event.PubKey, event.Kind, d, nil)
+		entry.ID = "nostr:" + naddr
+		entry.Title = tagValue(event.Tags, "title")
+		if entry.Title == "" {
+			entry.Title = "Untitled"
+		}
+		entry.Links = []atomLink{{Rel: "alternate", Type: "text/html", Href: relay.ServiceURL + "/a/" + naddr}}
+		if summary := tagValue(event.Tags, "summary"); summary != "" {
+			entry.Summary = &atomText{Type: "text", Body: summary}
+		}
+		entry.Content = atomText{Type: "html", Body: string(RenderMarkdown(event.Content))}
+		return entry
+	}
+
+	nevent, _ := nip19.EncodeEvent(event.ID, nil, event.PubKey)
+	entry.ID = "nostr:" + nevent
+	entry.Title = truncate(strings.Join(strings.Fields(event.Content), " "), 80)
+	entry.Links = []atomLink{{Rel: "alternate", Type: "text/html", Href: "https://njump.me/" + nevent}}
+	entry.Content = atomText{Type: "text", Body: event.Content}
+	return entry
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"github.com/nbd-wtf/go-nostr"
+	"slices"
+	"time"
+)
+
+// FilterRewriter normalizes filters before they reach the database, so the
+// same question always takes the same, cheapest, shape:
+//
+//   - duplicate ids, authors, kinds and tag values are dropped and the rest
+//     sorted, which also lets equivalent filters share a query cache entry
+//   - filters without a limit get defaultLimit, and those naming ids can't
+//     ask for more events than ids
+//   - filters that can't match anything, like a since after their until,
+//     don't query at all
+//   - limited ranges with a since wider than window are queried a window at
+//     a time, newest first and doubling the window each time, until the
+//     limit is reached, instead of making the database sort the whole range
+type FilterRewriter struct {
+	defaultLimit int
+	window       time.Duration
+}
+
+var filterWindows = NewCounter("ppe_filter_windows_total", "Queries made for the time windows broad filters are split into.")
+
+func NewFilterRewriter(defaultLimit int, window time.Duration) *FilterRewriter {
+	return &FilterRewriter{defaultLimit: defaultLimit, window: window}
+}
+
+// Wrap returns a QueryEvents handler rewriting filters before passing them
+// on to query.
+func (f *FilterRewriter) Wrap(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		filter, ok := f.Rewrite(filter)
+		if !ok {
+			ch := make(chan *nostr.Event)
+			close(ch)
+			return ch, nil
+		}
+		if f.window <= 0 || filter.Since == nil || filter.Limit == 0 || len(filter.IDs) > 0 {
+			return query(ctx, filter)
+		}
+		until := nostr.Now()
+		if filter.Until != nil {
+			until = *filter.Until
+		}
+		if until.Time().Sub(filter.Since.Time()) <= 2*f.window {
+			return query(ctx, filter)
+		}
+		return f.queryWindows(ctx, filter, until, query)
+	}
+}
+
+// Rewrite returns filter normalized, and false when it can't match any
+// event. The filter's slices are copied, not sorted in place: khatru keeps
+// matching live events against the original.
+func (f *FilterRewriter) Rewrite(filter nostr.Filter) (nostr.Filter, bool) {
+	filter.IDs = sortedUnique(filter.IDs)
+	filter.Authors = sortedUnique(filter.Authors)
+	filter.Kinds = sortedUnique(filter.Kinds)
+	if filter.Tags != nil {
+		tags := make(nostr.TagMap, len(filter.Tags))
+		for name, values := range filter.Tags {
+			tags[name] = sortedUnique(values)
+		}
+		filter.Tags = tags
+	}
+
+	if filter.Since != nil && filter.Until != nil && *filter.Since > *filter.Until {
+		return filter, false
+	}
+	if filter.Limit == 0 {
+		filter.Limit = f.defaultLimit
+	}
+	if len(filter.IDs) > 0 && (filter.Limit == 0 || filter.Limit > len(filter.IDs)) {
+		filter.Limit = len(filter.IDs)
+	}
+	return filter, true
+}
+
+// queryWindows answers filter from successively older and wider windows
+// ending at until, stopping at its since or once its limit is reached.
+func (f *FilterRewriter) queryWindows(ctx context.Context, filter nostr.Filter, until nostr.Timestamp, query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) (chan *nostr.Event, error) {
+	since := *filter.Since
+	window := nostr.Timestamp(f.window.Seconds())
+	start := max(until-window, since)
+
+	windowFilter := filter
+	windowFilter.Since, windowFilter.Until = &start, &until
+	filterWindows.Inc()
+	results, err := query(ctx, windowFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+
+		sent := 0
+		for {
+			for event := range results {
+				select {
+				case ch <- event:
+					sent++
+				case <-ctx.Done():
+					for range results {
+					}
+					return
+				}
+			}
+			if sent >= filter.Limit || *windowFilter.Since == since || ctx.Err() != nil {
+				return
+			}
+
+			end := *windowFilter.Since - 1
+			window *= 2
+			start := max(end-window, since)
+			windowFilter.Since, windowFilter.Until = &start, &end
+			windowFilter.Limit = filter.Limit - sent
+			filterWindows.Inc()
+			if results, err = query(ctx, windowFilter); err != nil {
+				ReportError(err, "filters", map[string]string{"filter": filter.String()})
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func sortedUnique[T string | int](values []T) []T {
+	if len(values) == 0 {
+		return values
+	}
+	values = slices.Clone(values)
+	slices.Sort(values)
+	return slices.Compact(values)
+}
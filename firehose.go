@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type firehoseSubscriber struct {
+	kinds  []int
+	events chan *nostr.Event
+}
+
+var (
+	firehoseSubscribers      = make(map[*firehoseSubscriber]struct{})
+	firehoseSubscribersMutex sync.RWMutex
+
+	firehoseDropped = NewCounter("ppe_firehose_dropped_total", "Events dropped because a firehose consumer fell behind.")
+)
+
+// BroadcastToFirehose hands an accepted event to every firehose consumer
+// interested in its kind. Consumers that can't keep up lose events rather
+// than slowing down the relay.
+func BroadcastToFirehose(ctx context.Context, event *nostr.Event) {
+	firehoseSubscribersMutex.RLock()
+	defer firehoseSubscribersMutex.RUnlock()
+
+	for subscriber := range firehoseSubscribers {
+		if len(subscriber.kinds) > 0 && !slices.Contains(subscriber.kinds, event.Kind) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			firehoseDropped.Inc()
+		}
+	}
+}
+
+// HandleFirehose streams accepted events as server-sent events, optionally
+// restricted with ?kinds=1,30023.
+func HandleFirehose(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteJSONError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	subscriber := &firehoseSubscriber{events: make(chan *nostr.Event, 256)}
+	if kinds := r.URL.Query().Get("kinds"); kinds != "" {
+		for _, value := range strings.Split(kinds, ",") {
+			kind, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid kind %s", value))
+				return
+			}
+			subscriber.kinds = append(subscriber.kinds, kind)
+		}
+	}
+
+	firehoseSubscribersMutex.Lock()
+	firehoseSubscribers[subscriber] = struct{}{}
+	firehoseSubscribersMutex.Unlock()
+
+	defer func() {
+		firehoseSubscribersMutex.Lock()
+		delete(firehoseSubscribers, subscriber)
+		firehoseSubscribersMutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-subscriber.events:
+			fmt.Fprintf(w, "id: %s\nevent: event\ndata: %s\n\n", event.ID, event.String())
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/nbd-wtf/go-nostr"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// interestingDescriptions and interestingInvoices are odd in the ways
+// parsers tend to trip over.
+var interestingDescriptions = []string{
+	``, `null`, `{}`, `[]`, `"x"`, `{"kind":9734}`, `{"kind":9734,"pubkey":""}`,
+	`{"kind":9734,"tags":[[]]}`, `{"kind":9734,"tags":[["credit"]]}`, `{"kind":9734,"tags":null}`,
+	`{"kind":9734,"created_at":-1}`, `{"kind":1e400}`, `{"kind":9734,"pubkey":"` + strings.Repeat("0", 64) + `"}`,
+}
+
+var interestingInvoices = []string{
+	``, `lnbc`, `lnbc1`, `lnbc1p`, `LNBC10N1`, `lntb1`, `lnbc1000000000000000000000000000000n1`,
+	`lnbc10n1pjqqqqqpp5`, strings.Repeat("q", 2000),
+}
+
+var (
+	receiptsDuration = flag.Duration("receipts.duration", 2*time.Second, "how long TestZapReceiptMutations mutates receipts for")
+	receiptsSeed     = flag.Int64("receipts.seed", 0, "random seed for TestZapReceiptMutations, 0 for a new one")
+)
+
+func zapReceipt(tags nostr.Tags) *nostr.Event {
+	return &nostr.Event{Kind: nostr.KindZap, CreatedAt: nostr.Now(), Tags: tags}
+}
+
+// FuzzZapDescription parses a receipt's description as a zap request. It
+// mustn't panic, and whatever it accepts must be a zap request from a
+// valid pubkey that credits one.
+func FuzzZapDescription(f *testing.F) {
+	for _, description := range interestingDescriptions {
+		f.Add(description)
+	}
+	zapRequest := nostr.Event{Kind: nostr.KindZapRequest, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"p", strings.Repeat("0", 64)}, {"amount", "21000"}}}
+	zapRequest.Sign(nostr.GeneratePrivateKey())
+	f.Add(zapRequest.String())
+
+	f.Fuzz(func(t *testing.T, description string) {
+		parsed, err := GetZapRequestFromZapEvent(zapReceipt(nostr.Tags{{"description", description}}))
+		if err != nil {
+			return
+		}
+		if parsed.Kind != nostr.KindZapRequest || !nostr.IsValidPublicKey(parsed.PubKey) {
+			t.Fatalf("accepted a kind %d description from %q", parsed.Kind, parsed.PubKey)
+		}
+		if beneficiary := GetZapBeneficiary(parsed); !nostr.IsValidPublicKey(beneficiary) {
+			t.Fatalf("credits invalid pubkey %q", beneficiary)
+		}
+	})
+}
+
+// FuzzBolt11 decodes invoices as found in receipts, which mustn't panic
+// however they're mangled.
+func FuzzBolt11(f *testing.F) {
+	for _, invoice := range interestingInvoices {
+		f.Add(invoice)
+	}
+
+	f.Fuzz(func(t *testing.T, bolt11 string) {
+		first, err := DecodeInvoice(bolt11)
+		if err != nil {
+			return
+		}
+		// the second comes from the cache
+		if second, err := DecodeInvoice(bolt11); err != nil || second.MSatoshi != first.MSatoshi || second.PaymentHash != first.PaymentHash {
+			t.Fatalf("decoded %q differently the second time", bolt11)
+		}
+	})
+}
+
+// FuzzValueFromTag looks a key up in tags given as JSON: it must find the
+// value of the first tag with that key and at least one value, or nothing
+// if there's none.
+func FuzzValueFromTag(f *testing.F) {
+	for _, invoice := range interestingInvoices {
+		tags, _ := json.Marshal(nostr.Tags{{"bolt11", invoice}})
+		f.Add(string(tags), "bolt11")
+	}
+	for _, description := range interestingDescriptions {
+		tags, _ := json.Marshal(nostr.Tags{{"description"}, {"description", description}, {"preimage", "00"}})
+		f.Add(string(tags), "description")
+	}
+	f.Add(`[[],[""],["bolt11"],["bolt11",""]]`, "bolt11")
+
+	f.Fuzz(func(t *testing.T, raw string, key string) {
+		var tags nostr.Tags
+		if json.Unmarshal([]byte(raw), &tags) != nil {
+			return
+		}
+		var expected *string
+		for _, tag := range tags {
+			if len(tag) >= 2 && tag[0] == key {
+				expected = &tag[1]
+				break
+			}
+		}
+
+		value, err := ValueFromTag(zapReceipt(tags), key)
+		switch {
+		case expected == nil && err == nil:
+			t.Fatalf("found %q for %q in %s", *value, key, raw)
+		case expected != nil && (err != nil || *value != *expected):
+			t.Fatalf("didn't find %q for %q in %s", *expected, key, raw)
+		}
+	})
+}
+
+// TestZapReceiptMutations throws mutated zap receipts at the code crediting
+// them for -receipts.duration: dropped and truncated tags, corrupted
+// descriptions and invoices, invoices and zap requests swapped between
+// receipts, re-signed by the zapper, by someone else or not at all. Nothing
+// may panic, no receipt the zapper didn't sign may be credited, and however
+// the receipts are mangled, the harness ledger must end up with each invoice
+// credited at most once, for its amount, to whoever paid it.
+//
+// Failures print the receipt and the -receipts.seed that reproduces them.
+func TestZapReceiptMutations(t *testing.T) {
+	seed := *receiptsSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	h := NewHarness(t)
+
+	type seedReceipt struct {
+		receipt *nostr.Event
+		bolt11  string
+		pubkey  string
+		msat    int64
+	}
+	var seeds []seedReceipt
+	for _, sats := range []int64{21, 1000} {
+		pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+		bolt11, err := h.Payments.CreateInvoice(pubkey, sats*1000)
+		if err != nil {
+			t.Fatalf("creating invoice: %v", err)
+		}
+		receipt, err := h.Payments.Receipt(bolt11)
+		if err != nil {
+			t.Fatalf("creating receipt: %v", err)
+		}
+		seeds = append(seeds, seedReceipt{receipt: receipt, bolt11: bolt11, pubkey: pubkey, msat: sats * 1000})
+	}
+
+	zapper, _ := nostr.GetPublicKey(h.Payments.walletKey)
+	random := rand.New(rand.NewSource(seed))
+	fail := func(receipt *nostr.Event, format string, args ...any) {
+		t.Helper()
+		t.Fatalf(format+"\nreceipt: %s\nreproduce with -receipts.seed %d", append(args, receipt, seed)...)
+	}
+
+	// a receipt that's right in every way but who signed it, as anyone can
+	// make with a node of their own
+	forger, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	bolt11, err := h.Payments.CreateInvoice(forger, 1000000)
+	if err != nil {
+		t.Fatalf("creating invoice: %v", err)
+	}
+	forged, err := h.Payments.Receipt(bolt11)
+	if err != nil {
+		t.Fatalf("creating receipt: %v", err)
+	}
+	forged.Sign(nostr.GeneratePrivateKey())
+	if ok, _ := CreditZapEvent(forged, h.DB); ok {
+		fail(forged, "credited a receipt signed by the wrong key")
+	}
+
+	var runs, parsed, credited int
+	deadline := time.Now().Add(*receiptsDuration)
+	for time.Now().Before(deadline) {
+		original := seeds[random.Intn(len(seeds))].receipt
+		other := seeds[random.Intn(len(seeds))].receipt
+		receipt := mutateReceipt(random, original, other)
+		switch random.Intn(10) {
+		case 0:
+			receipt.Sign(nostr.GeneratePrivateKey())
+		case 1:
+			// the zapper's pubkey with a signature that no longer matches
+		default:
+			receipt.Sign(h.Payments.walletKey)
+		}
+		runs++
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					fail(receipt, "panic: %v", r)
+				}
+			}()
+			ValueFromTag(receipt, "bolt11")
+			ValueFromTag(receipt, "preimage")
+			if zapRequest, err := GetZapRequestFromZapEvent(receipt); err == nil {
+				parsed++
+				GetZapBeneficiary(zapRequest)
+			}
+			if bolt11, err := ValueFromTag(receipt, "bolt11"); err == nil {
+				DecodeInvoice(*bolt11)
+			}
+			GetZapVerifier().Verify(receipt)
+			if ok, _ := CreditZapEvent(receipt, h.DB); ok {
+				if valid, _ := receipt.CheckSignature(); receipt.PubKey != zapper || !valid {
+					fail(receipt, "credited a receipt the zapper didn't sign")
+				}
+				credited++
+			}
+		}()
+	}
+
+	for _, s := range seeds {
+		var count, msat int64
+		var pubkey string
+		err := h.DB.DB.QueryRow(
+			`SELECT COUNT(*), COALESCE(MAX(pubkey), ''), COALESCE(SUM(amount_msat), 0) FROM zap_credit WHERE bolt11 = ?`, s.bolt11,
+		).Scan(&count, &pubkey, &msat)
+		if err != nil {
+			t.Fatalf("reading credits: %v", err)
+		}
+		if count > 1 {
+			fail(s.receipt, "invoice credited %d times", count)
+		}
+		if count == 1 && (pubkey != s.pubkey || msat != s.msat) {
+			fail(s.receipt, "credited %d msat to %s, paid %d msat by %s", msat, pubkey, s.msat, s.pubkey)
+		}
+	}
+	var strays int
+	h.DB.DB.Get(&strays, `SELECT COUNT(*) FROM zap_credit WHERE bolt11 NOT IN (?, ?)`, seeds[0].bolt11, seeds[1].bolt11)
+	if strays > 0 {
+		fail(seeds[0].receipt, "%d credits for invoices nobody paid", strays)
+	}
+
+	t.Logf("%d receipts, %d with a parseable zap request, %d credited (seed %d)", runs, parsed, credited, seed)
+}
+
+// mutateReceipt copies receipt with one to three things wrong with it, some
+// taken from other. The copy keeps receipt's pubkey and signature, which no
+// longer match it, and gets the id it would have if it were signed anew.
+func mutateReceipt(random *rand.Rand, receipt *nostr.Event, other *nostr.Event) *nostr.Event {
+	mutated := *receipt
+	mutated.Tags = make(nostr.Tags, len(receipt.Tags))
+	for i, tag := range receipt.Tags {
+		mutated.Tags[i] = append(nostr.Tag{}, tag...)
+	}
+
+	pick := func() int { return random.Intn(len(mutated.Tags)) }
+	for n := 1 + random.Intn(3); n > 0 && len(mutated.Tags) > 0; n-- {
+		switch random.Intn(10) {
+		case 0:
+			i := pick()
+			mutated.Tags = append(mutated.Tags[:i], mutated.Tags[i+1:]...)
+		case 1:
+			i := pick()
+			mutated.Tags[i] = mutated.Tags[i][:random.Intn(len(mutated.Tags[i])+1)]
+		case 2:
+			mutated.Tags = append(nostr.Tags{{[]string{"description", "bolt11", "preimage"}[random.Intn(3)]}}, mutated.Tags...)
+		case 3:
+			setTag(&mutated, "description", corrupt(random, tagOr(&mutated, "description")))
+		case 4:
+			setTag(&mutated, "bolt11", corrupt(random, tagOr(&mutated, "bolt11")))
+		case 5:
+			setTag(&mutated, "description", interestingDescriptions[random.Intn(len(interestingDescriptions))])
+		case 6:
+			setTag(&mutated, "bolt11", interestingInvoices[random.Intn(len(interestingInvoices))])
+		case 7:
+			setTag(&mutated, []string{"description", "bolt11", "preimage"}[random.Intn(3)], tagOr(other, []string{"description", "bolt11", "preimage"}[random.Intn(3)]))
+		case 8:
+			setTag(&mutated, "description", retagZapRequest(random, tagOr(&mutated, "description")))
+		case 9:
+			mutated.Kind = []int{nostr.KindZap, nostr.KindZapRequest, nostr.KindTextNote}[random.Intn(3)]
+		}
+	}
+	mutated.ID = mutated.GetID()
+	return &mutated
+}
+
+func tagOr(event *nostr.Event, key string) string {
+	if value, err := ValueFromTag(event, key); err == nil {
+		return *value
+	}
+	return ""
+}
+
+func setTag(event *nostr.Event, key string, value string) {
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == key {
+			tag[1] = value
+			return
+		}
+	}
+	event.Tags = append(event.Tags, nostr.Tag{key, value})
+}
+
+// corrupt flips, inserts, deletes or truncates at a random byte.
+func corrupt(random *rand.Rand, value string) string {
+	if value == "" {
+		return string(rune(random.Intn(128)))
+	}
+	b := []byte(value)
+	i := random.Intn(len(b))
+	switch random.Intn(4) {
+	case 0:
+		b[i] ^= byte(1 << random.Intn(8))
+	case 1:
+		b = append(b[:i], append([]byte{byte(random.Intn(256))}, b[i:]...)...)
+	case 2:
+		b = append(b[:i], b[i+1:]...)
+	case 3:
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// retagZapRequest changes who a zap request says sent or is to be credited
+// for it, keeping its signature, which no longer matches.
+func retagZapRequest(random *rand.Rand, description string) string {
+	var zapRequest nostr.Event
+	if err := json.Unmarshal([]byte(description), &zapRequest); err != nil {
+		return description
+	}
+	impostor, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if random.Intn(2) == 0 {
+		zapRequest.PubKey = impostor
+	} else {
+		zapRequest.Tags = append(nostr.Tags{{"credit", impostor}}, zapRequest.Tags...)
+	}
+	return zapRequest.String()
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/fiatjaf/khatru"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unknownCountry is what addresses the database doesn't know are counted
+// as: private networks, hidden service connections and gaps in the data.
+// Listing it in GEOIP_DENY refuses them too.
+const unknownCountry = "XX"
+
+var (
+	geoIP *GeoIPDatabase
+
+	geoIPConnections = NewCounterVec("ppe_connections_by_country_total", "Websocket connections by the client's country.", "country")
+	geoIPRejections  = NewCounterVec("ppe_geoip_rejections_total", "Websocket connections refused by the GeoIP policy, by country.", "country")
+)
+
+// GeoIPPolicy decides which countries the relay serves: with Allow set only
+// those, otherwise all but Deny. Countries in RateLimits get their own,
+// usually tighter, connection rate limit per address on top of the usual
+// one.
+type GeoIPPolicy struct {
+	Allow      map[string]bool
+	Deny       map[string]bool
+	RateLimits map[string]func(ip string) bool
+}
+
+// ConfigureGeoIP reads GEOIP_DATABASE, a local MaxMind DB file (GeoLite2
+// Country or City, or a compatible one) that connections are looked up in,
+// GEOIP_ALLOW and GEOIP_DENY, country codes to serve exclusively or refuse,
+// and GEOIP_RATE_LIMITS, country=n pairs allowing n connections a minute
+// per address from those countries. Without a database none of it applies.
+func ConfigureGeoIP() (*GeoIPPolicy, error) {
+	path := GetEnvDefault("GEOIP_DATABASE", "")
+	if path == "" {
+		geoIP = nil
+		return nil, nil
+	}
+	database, err := OpenGeoIPDatabase(path)
+	if err != nil {
+		return nil, fmt.Errorf("GEOIP_DATABASE: %w", err)
+	}
+	geoIP = database
+
+	policy := &GeoIPPolicy{Allow: make(map[string]bool), Deny: make(map[string]bool), RateLimits: make(map[string]func(ip string) bool)}
+	for _, country := range GetEnvList("GEOIP_ALLOW", nil) {
+		policy.Allow[strings.ToUpper(country)] = true
+	}
+	for _, country := range GetEnvList("GEOIP_DENY", nil) {
+		policy.Deny[strings.ToUpper(country)] = true
+	}
+	for _, spec := range GetEnvList("GEOIP_RATE_LIMITS", nil) {
+		country, value, ok := strings.Cut(spec, "=")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil || n < 1 {
+			return nil, fmt.Errorf("GEOIP_RATE_LIMITS: %q isn't country=connections per minute", spec)
+		}
+		country = strings.ToUpper(strings.TrimSpace(country))
+		policy.RateLimits[country] = hashedIPRateLimiter("geoip:"+country, n, time.Minute, n)
+	}
+	return policy, nil
+}
+
+// Country is the ISO code of the country ip is in, or unknownCountry.
+func Country(ip string) string {
+	if geoIP == nil {
+		return unknownCountry
+	}
+	country, err := geoIP.Country(net.ParseIP(ip))
+	if err != nil {
+		ReportError(err, "geoip", nil)
+	}
+	if country == "" {
+		return unknownCountry
+	}
+	return country
+}
+
+// RejectConnection is a RejectConnection policy counting connections by
+// country and refusing the ones the policy doesn't serve or that go over
+// their country's rate limit. It only covers the relay's websocket, not the
+// landing page or the HTTP API.
+func (p *GeoIPPolicy) RejectConnection(r *http.Request) bool {
+	ip := khatru.GetIPFromRequest(r)
+	country := Country(ip)
+	geoIPConnections.Inc(country)
+
+	if (len(p.Allow) > 0 && !p.Allow[country]) || p.Deny[country] {
+		geoIPRejections.Inc(country)
+		return true
+	}
+	if limited, ok := p.RateLimits[country]; ok && limited(ip) {
+		geoIPRejections.Inc(country)
+		return true
+	}
+	return false
+}
+
+// RunGeoIPLookup prints the country a database puts each address in, to
+// check GEOIP_DATABASE and the lists before turning them on.
+func RunGeoIPLookup(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: geoip <ip> [<ip>...]")
+	}
+	if _, err := ConfigureGeoIP(); err != nil {
+		log.Fatal(err)
+	}
+	if geoIP == nil {
+		log.Fatal("GEOIP_DATABASE isn't set")
+	}
+	for _, ip := range args {
+		fmt.Printf("%s  %s\n", ip, Country(ip))
+	}
+}
+
+// GeoIPDatabase reads the MaxMind DB format, just far enough to find an
+// address's country. The whole file is kept in memory.
+type GeoIPDatabase struct {
+	data       []byte
+	dataStart  int
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+
+	// the node IPv4 addresses start from in an IPv6 tree
+	ipv4Start uint64
+}
+
+var geoIPMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func OpenGeoIPDatabase(path string) (*GeoIPDatabase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	marker := bytes.LastIndex(data, geoIPMetadataMarker)
+	if marker < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+
+	database := &GeoIPDatabase{data: data}
+	metadata, _, err := database.decode(data[marker+len(geoIPMetadataMarker):], 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	fields, ok := metadata.(map[string]any)
+	if !ok {
+		return nil, errors.New("malformed metadata")
+	}
+	database.nodeCount, _ = fields["node_count"].(uint64)
+	database.recordSize, _ = fields["record_size"].(uint64)
+	database.ipVersion, _ = fields["ip_version"].(uint64)
+	if database.recordSize != 24 && database.recordSize != 28 && database.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", database.recordSize)
+	}
+
+	treeSize := int(database.nodeCount * database.recordSize / 4)
+	database.dataStart = treeSize + 16
+	if database.dataStart > marker {
+		return nil, errors.New("search tree runs past the end of the file")
+	}
+
+	if database.ipVersion == 6 {
+		for i := 0; i < 96 && database.ipv4Start < database.nodeCount; i++ {
+			database.ipv4Start = database.record(database.ipv4Start, 0)
+		}
+	}
+	return database, nil
+}
+
+// Country returns ip's ISO country code, falling back to the country its
+// block is registered in, or "" when the database doesn't have it.
+func (d *GeoIPDatabase) Country(ip net.IP) (string, error) {
+	if ip == nil {
+		return "", nil
+	}
+	record, err := d.lookup(ip)
+	if err != nil || record == nil {
+		return "", err
+	}
+	fields, _ := record.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := fields[key].(map[string]any)
+		if code, ok := country["iso_code"].(string); ok {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+func (d *GeoIPDatabase) lookup(ip net.IP) (any, error) {
+	node := uint64(0)
+	bits := ip.To16()
+	if ipv4 := ip.To4(); ipv4 != nil {
+		node, bits = d.ipv4Start, ipv4
+	} else if d.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(bits)*8 && node < d.nodeCount; i++ {
+		node = d.record(node, int(bits[i/8]>>(7-i%8))&1)
+	}
+	if node == d.nodeCount {
+		return nil, nil
+	}
+	if node < d.nodeCount {
+		return nil, errors.New("search tree is deeper than an address")
+	}
+
+	offset := d.dataStart + int(node-d.nodeCount-16)
+	if offset < d.dataStart || offset >= len(d.data) {
+		return nil, errors.New("search tree points outside the data section")
+	}
+	value, _, err := d.decode(d.data[d.dataStart:], offset-d.dataStart)
+	return value, err
+}
+
+// record reads the left (bit 0) or right (bit 1) record of node.
+func (d *GeoIPDatabase) record(node uint64, bit int) uint64 {
+	size := int(d.recordSize) / 4
+	offset := int(node) * size
+	if offset+size > len(d.data) {
+		return d.nodeCount
+	}
+	b := d.data[offset : offset+size]
+
+	switch d.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		return uint64(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// decode reads the value at offset in section, where pointers are relative
+// to the start of section, returning it and the offset after it.
+func (d *GeoIPDatabase) decode(section []byte, offset int) (any, int, error) {
+	next := func(n int) ([]byte, error) {
+		if n < 0 || offset+n > len(section) {
+			return nil, errors.New("value runs past the end of the data section")
+		}
+		b := section[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	uintValue := func(b []byte) uint64 {
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n
+	}
+
+	control, err := next(1)
+	if err != nil {
+		return nil, offset, err
+	}
+	kind := int(control[0] >> 5)
+
+	if kind == 1 {
+		extra := int(control[0]>>3) & 3
+		b, err := next(extra + 1)
+		if err != nil {
+			return nil, offset, err
+		}
+		pointer := uintValue(b)
+		switch extra {
+		case 0, 1, 2:
+			pointer |= uint64(control[0]&7) << (8 * (extra + 1))
+			pointer += []uint64{0, 2048, 526336}[extra]
+		}
+		value, _, err := d.decode(section, int(pointer))
+		return value, offset, err
+	}
+
+	if kind == 0 {
+		b, err := next(1)
+		if err != nil {
+			return nil, offset, err
+		}
+		kind = 7 + int(b[0])
+	}
+
+	size := int(control[0] & 0x1f)
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return nil, offset, err
+		}
+		size = []int{29, 285, 65821}[size-29] + int(uintValue(b))
+	}
+
+	switch kind {
+	case 2:
+		b, err := next(size)
+		return string(b), offset, err
+	case 3:
+		b, err := next(8)
+		if err != nil {
+			return nil, offset, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4:
+		b, err := next(size)
+		return b, offset, err
+	case 5, 6, 9, 10:
+		b, err := next(size)
+		if err != nil {
+			return nil, offset, err
+		}
+		if len(b) > 8 {
+			// uint128s don't hold anything a country lookup needs
+			return nil, offset, nil
+		}
+		return uintValue(b), offset, nil
+	case 8:
+		b, err := next(size)
+		if err != nil {
+			return nil, offset, err
+		}
+		return int64(int32(uintValue(b))), offset, nil
+	case 7:
+		fields := make(map[string]any, size)
+		for i := 0; i < size; i++ {
+			key, after, err := d.decode(section, offset)
+			if err != nil {
+				return nil, after, err
+			}
+			value, after, err := d.decode(section, after)
+			if err != nil {
+				return nil, after, err
+			}
+			offset = after
+			if name, ok := key.(string); ok {
+				fields[name] = value
+			}
+		}
+		return fields, offset, nil
+	case 11:
+		values := make([]any, 0, size)
+		for i := 0; i < size; i++ {
+			value, after, err := d.decode(section, offset)
+			if err != nil {
+				return nil, after, err
+			}
+			offset = after
+			values = append(values, value)
+		}
+		return values, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	case 15:
+		b, err := next(4)
+		if err != nil {
+			return nil, offset, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+	return nil, offset, fmt.Errorf("unsupported data type %d", kind)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"strconv"
+	"strings"
+)
+
+var (
+	giftsSent  = NewCounter("ppe_gifts_total", "Balances gifted from one user to another.")
+	giftedMsat = NewCounter("ppe_gifted_msat_total", "Millisats gifted from one user to another.")
+
+	errGiftAlreadySent = errors.New("that gift was already sent")
+)
+
+// GiftBalance moves sats of from's balance to to's, debiting one and
+// crediting the other under ids derived from id, so the same gift is never
+// moved twice. to needs no account: the credit starts one. from's balance is
+// locked meanwhile, so concurrent gifts can't overdraw it.
+func GiftBalance(id string, from string, to string, sats int64, db Database) error {
+	if sats <= 0 {
+		return errors.New("gift at least 1 sat")
+	}
+	if from == to {
+		return errors.New("you can't gift yourself")
+	}
+	defer LockBalance(from)()
+	if balance := GetSpendableBalanceMsat(from, db) / 1000; sats > balance {
+		return fmt.Errorf("your balance is only %d sats", balance)
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(
+		`INSERT INTO debit (id, pubkey, amount_msat, reason, created_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		"gift:"+id, from, sats*1000, "gift to "+to, NowTimestamp(),
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errGiftAlreadySent
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO bonus_credit (id, pubkey, amount_msat, reason, created_at) VALUES (?, ?, ?, ?, ?)`,
+		"gift:"+id, to, sats*1000, "gift from "+from, NowTimestamp(),
+	); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	giftsSent.Inc()
+	giftedMsat.Add(sats * 1000)
+	return nil
+}
+
+// HandleGiftCommand answers the bot's gift command, gifting part of the
+// sender's balance and letting the recipient know by DM.
+func HandleGiftCommand(event *nostr.Event, args []string, db Database) string {
+	if len(args) == 3 && strings.EqualFold(args[1], "to") {
+		args = []string{args[0], args[2]}
+	}
+	if len(args) != 2 {
+		return "Usage: gift <sats> to <npub>"
+	}
+	sats, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return "Usage: gift <sats> to <npub>"
+	}
+	recipient, err := ParsePubKey(strings.TrimPrefix(args[1], "nostr:"))
+	if err != nil {
+		return fmt.Sprintf("Invalid pubkey: %v.", err)
+	}
+
+	if err := GiftBalance(event.ID, event.PubKey, recipient, sats, db); errors.Is(err, errGiftAlreadySent) {
+		return "Already done, that gift was sent."
+	} else if err != nil {
+		return fmt.Sprintf("Couldn't send the gift: %v.", err)
+	}
+
+	if WantsNotification(recipient, NotifyGifts) {
+		npub, _ := nip19.EncodePublicKey(event.PubKey)
+		message := fmt.Sprintf("nostr:%s gifted you %d sats to store your notes on %s. Mention me with \"balance\" to see what you have, or \"notify gifts off\" to stop these messages.",
+			npub, sats, relay.Info.Name)
+		go func() {
+			if err := SendDirectMessage(recipient, message, db); err != nil {
+				ReportError(err, "gifts", map[string]string{"pubkey": recipient})
+			}
+		}()
+	}
+	return fmt.Sprintf("Sent %d sats to %s, your balance is now %d sats.", sats, args[1], GetRemainingUserBalance(event.PubKey, db))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var greylistRefused = NewCounter("ppe_greylist_refused_total", "Subscriptions refused because an unauthenticated connection asked for greylisted kinds.")
+
+// Greylist limits what connections that haven't AUTHed can read: only
+// the kinds listed, and at most limit events per filter. Authenticating
+// lifts both, so anonymous scrapers get little for their load while any
+// client that signs in is served as usual.
+type Greylist struct {
+	kinds []int
+	limit int
+}
+
+// ConfigureGreylist reads GREYLIST_KINDS and GREYLIST_LIMIT, for relays
+// with GREYLIST=true.
+func ConfigureGreylist() (*Greylist, error) {
+	greylist := &Greylist{limit: GetEnvInt("GREYLIST_LIMIT", 20)}
+	if greylist.limit < 1 {
+		return nil, fmt.Errorf("GREYLIST_LIMIT must be at least 1, got %d", greylist.limit)
+	}
+	for _, value := range GetEnvList("GREYLIST_KINDS", []string{"0", "1", "30023"}) {
+		kind, err := strconv.Atoi(value)
+		if err != nil || kind < 0 || kind > 65535 {
+			return nil, fmt.Errorf("GREYLIST_KINDS: %q isn't a kind", value)
+		}
+		greylist.kinds = append(greylist.kinds, kind)
+	}
+	return greylist, nil
+}
+
+// RejectFilter is a RejectFilter and RejectCountFilter policy refusing
+// unauthenticated filters that don't name kinds or name kinds outside of
+// the greylist's. khatru answers them with an AUTH challenge.
+func (g *Greylist) RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if khatru.GetAuthed(ctx) != "" {
+		return false, ""
+	}
+	if len(filter.Kinds) == 0 {
+		greylistRefused.Inc()
+		return true, "auth-required: authenticate to query without kinds, or ask for kinds " + g.describeKinds()
+	}
+	for _, kind := range filter.Kinds {
+		if !slices.Contains(g.kinds, kind) {
+			greylistRefused.Inc()
+			return true, fmt.Sprintf("auth-required: authenticate to read kind %d, only kinds %s are served anonymously", kind, g.describeKinds())
+		}
+	}
+	return false, ""
+}
+
+// Wrap caps the results of unauthenticated REQs at the greylist's limit. A
+// nil Greylist leaves query as it is.
+func (g *Greylist) Wrap(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	if g == nil {
+		return query
+	}
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if IsRequest(ctx) && khatru.GetAuthed(ctx) == "" && (filter.Limit == 0 || filter.Limit > g.limit) {
+			filter.Limit = g.limit
+		}
+		return query(ctx, filter)
+	}
+}
+
+func (g *Greylist) describeKinds() string {
+	kinds := make([]string, len(g.kinds))
+	for i, kind := range g.kinds {
+		kinds[i] = strconv.Itoa(kind)
+	}
+	return strings.Join(kinds, ", ")
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/khatru"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Harness runs the relay end to end in process: a throwaway sqlite DB, a fake
+// upstream relay standing in for the public ones the bot scans for zaps, and
+// a mock payment backend that settles invoices by publishing receipts to it.
+type Harness struct {
+	Dir      string
+	DB       Database
+	Upstream *httptest.Server
+	Relay    *httptest.Server
+	Payments *MockPaymentBackend
+}
+
+// MockPaymentBackend issues real, signed bolt11 invoices from a throwaway
+// node key and "pays" them by publishing the zap receipt a wallet would.
+type MockPaymentBackend struct {
+	Relay string
+
+	nodeKey   *btcec.PrivateKey
+	walletKey string
+	pending   map[string]mockInvoice
+	mutex     sync.Mutex
+}
+
+type mockInvoice struct {
+	zapRequest *nostr.Event
+	preimage   []byte
+}
+
+// NewHarness starts a harness in a temporary directory, closed when t
+// ends. It replaces the global relay, upstream relays, bot key and payment
+// backend with test doubles, so tests using it can't run in parallel.
+func NewHarness(t testing.TB) *Harness {
+	t.Helper()
+	h := &Harness{Dir: t.TempDir()}
+	t.Cleanup(h.Close)
+
+	upstream := khatru.NewRelay()
+	store := &slicestore.SliceStore{}
+	store.Init()
+	upstream.StoreEvent = append(upstream.StoreEvent, store.SaveEvent)
+	upstream.QueryEvents = append(upstream.QueryEvents, store.QueryEvents)
+	upstream.CountEvents = append(upstream.CountEvents, store.CountEvents)
+	upstream.DeleteEvent = append(upstream.DeleteEvent, store.DeleteEvent)
+	h.Upstream = httptest.NewServer(upstream)
+
+	var err error
+	if h.DB, err = OpenDatabase(filepath.Join(h.Dir, "db"), 500); err != nil {
+		t.Fatalf("opening harness database: %v", err)
+	}
+	if err := CreateTables(h.DB.DB); err != nil {
+		t.Fatalf("creating harness tables: %v", err)
+	}
+
+	t.Setenv("BOT_PRIVATE_KEY", nostr.GeneratePrivateKey())
+	botPubkey, _ = nostr.GetPublicKey(GetEnv("BOT_PRIVATE_KEY"))
+	relays = []string{websocketURL(h.Upstream.URL)}
+
+	nodeKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatalf("generating node key: %v", err)
+	}
+	h.Payments = &MockPaymentBackend{
+		Relay:     relays[0],
+		nodeKey:   nodeKey,
+		walletKey: nostr.GeneratePrivateKey(),
+		pending:   make(map[string]mockInvoice),
+	}
+	paymentBackend = h.Payments
+	walletPubkey, _ := nostr.GetPublicKey(h.Payments.walletKey)
+	t.Setenv("ZAPPER_PUBKEYS", walletPubkey)
+
+	t.Setenv("EVENT_JOURNAL", filepath.Join(h.Dir, "journal"))
+	t.Setenv("DISK_WATCH_PATH", h.Dir)
+	relay = khatru.NewRelay()
+	relay.Info.Name = "PPE Relay Harness"
+	ConfigureRelay(h.DB)
+	h.Relay = httptest.NewServer(RecoverHTTP(ServeBranding(relay)))
+
+	return h
+}
+
+func (h *Harness) URL() string {
+	return websocketURL(h.Relay.URL)
+}
+
+func (h *Harness) Close() {
+	if h.Relay != nil {
+		h.Relay.Close()
+	}
+	if h.Upstream != nil {
+		h.Upstream.Close()
+	}
+	if h.DB.DB != nil {
+		h.DB.Close()
+	}
+}
+
+// TopUp requests an invoice for pubkey and settles it straight away.
+func (h *Harness) TopUp(pubkey string, sats int64) error {
+	bolt11, err := h.Payments.CreateInvoice(pubkey, sats*1000)
+	if err != nil {
+		return err
+	}
+	return h.Payments.Settle(bolt11)
+}
+
+// Publish signs a text note with sk and sends it to the relay under test,
+// returning the relay's rejection as an error.
+func (h *Harness) Publish(sk string, content string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	event := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindTextNote,
+		Content:   content,
+	}
+	if err := event.Sign(sk); err != nil {
+		return err
+	}
+
+	client, err := nostr.RelayConnect(ctx, h.URL())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Publish(ctx, event)
+}
+
+// Send publishes event to the relay under test on a fresh connection and
+// returns the OK it's answered with, message included.
+func (h *Harness) Send(event nostr.Event) (nostr.OKEnvelope, error) {
+	var ok nostr.OKEnvelope
+	conn, _, err := websocket.DefaultDialer.Dial(h.URL(), nil)
+	if err != nil {
+		return ok, err
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON([]any{"EVENT", event}); err != nil {
+		return ok, err
+	}
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return ok, err
+	}
+	return ok, ok.UnmarshalJSON(message)
+}
+
+func (b *MockPaymentBackend) CreateInvoice(pubkey string, amountMsat int64, tags ...nostr.Tag) (string, error) {
+	zapRequest, err := NewTopUpZapRequest(pubkey, amountMsat, tags...)
+	if err != nil {
+		return "", err
+	}
+
+	preimage := make([]byte, 32)
+	rand.Read(preimage)
+	paymentHash := sha256.Sum256(preimage)
+	descriptionHash := sha256.Sum256([]byte(zapRequest.String()))
+
+	invoice, err := zpay32.NewInvoice(&chaincfg.MainNetParams, paymentHash, time.Now(),
+		zpay32.Amount(lnwire.MilliSatoshi(amountMsat)),
+		zpay32.DescriptionHash(descriptionHash),
+	)
+	if err != nil {
+		return "", err
+	}
+	bolt11, err := invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			hash := sha256.Sum256(msg)
+			return ecdsa.SignCompact(b.nodeKey, hash[:], true)
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	b.mutex.Lock()
+	b.pending[bolt11] = mockInvoice{zapRequest: zapRequest, preimage: preimage}
+	b.mutex.Unlock()
+	return bolt11, nil
+}
+
+// Settle publishes the zap receipt for an invoice issued by CreateInvoice.
+func (b *MockPaymentBackend) Settle(bolt11 string) error {
+	receipt, err := b.Receipt(bolt11)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	delete(b.pending, bolt11)
+	b.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := nostr.RelayConnect(ctx, b.Relay)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Publish(ctx, *receipt)
+}
+
+// Receipt is the zap receipt a wallet would publish once an invoice issued
+// by CreateInvoice is paid.
+func (b *MockPaymentBackend) Receipt(bolt11 string) (*nostr.Event, error) {
+	b.mutex.Lock()
+	invoice, ok := b.pending[bolt11]
+	b.mutex.Unlock()
+	if !ok {
+		return nil, errors.New("unknown invoice")
+	}
+
+	receipt := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindZap,
+		Tags: nostr.Tags{
+			{"p", botPubkey},
+			{"bolt11", bolt11},
+			{"description", invoice.zapRequest.String()},
+			{"preimage", hex.EncodeToString(invoice.preimage)},
+		},
+	}
+	if err := receipt.Sign(b.walletKey); err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+// TestPaidFlow walks through the paid flow: rejection without balance,
+// top-up, accepted events until the balance runs out, and rejection once
+// exhausted.
+func TestPaidFlow(t *testing.T) {
+	h := NewHarness(t)
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"event rejected without balance", func() error {
+			return expectRejection(h.Publish(sk, "before top-up"), "payment-required: no sufficient balance")
+		}},
+		{"top up 2 sats", func() error {
+			return h.TopUp(pubkey, 2)
+		}},
+		{"balance credited", func() error {
+			return expectBalance(pubkey, 2, h.DB)
+		}},
+		{"first event accepted", func() error {
+			return h.Publish(sk, "first")
+		}},
+		{"second event accepted", func() error {
+			return h.Publish(sk, "second")
+		}},
+		{"balance decremented", func() error {
+			return expectBalance(pubkey, 0, h.DB)
+		}},
+		{"event rejected once exhausted", func() error {
+			return expectRejection(h.Publish(sk, "third"), "payment-required: no sufficient balance")
+		}},
+	}
+
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+	}
+}
+
+func expectRejection(err error, reason string) error {
+	if err == nil {
+		return errors.New("event was accepted")
+	}
+	if !strings.Contains(err.Error(), reason) {
+		return fmt.Errorf("rejected for the wrong reason: %v", err)
+	}
+	return nil
+}
+
+func expectBalance(pubkey string, expected int64, db Database) error {
+	if balance := GetRemainingUserBalance(pubkey, db); balance != expected {
+		return fmt.Errorf("balance is %d, expected %d", balance, expected)
+	}
+	return nil
+}
+
+func websocketURL(httpURL string) string {
+	return "ws" + strings.TrimPrefix(httpURL, "http")
+}
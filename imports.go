@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var backfillImportSchema = Schema{
+	Tables: []string{"backfill_import"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS backfill_import (
+       id text NOT NULL PRIMARY KEY,
+       pubkey text NOT NULL,
+       source text NOT NULL,
+       events bigint NOT NULL,
+       stored bigint NOT NULL,
+       quoted_msat bigint NOT NULL,
+       charged_msat bigint NOT NULL,
+       status text NOT NULL,
+       created_at bigint NOT NULL,
+       finished_at bigint NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS backfillimportpubkeyidx ON backfill_import(pubkey)`,
+	},
+}
+
+// BackfillImport is a batch of a user's past events imported at once, from
+// other relays through the bot or uploaded as JSONL. The whole batch is
+// quoted and debited up front, at BACKFILL_PRICE_PERCENT of what its events
+// cost published one by one, to the importer's own balance rather than a
+// team's or an allowance, and what the events that weren't stored were
+// quoted at is credited back once it's done.
+type BackfillImport struct {
+	ID          string          `json:"id" db:"id"`
+	PubKey      string          `json:"pubkey" db:"pubkey"`
+	Source      string          `json:"source" db:"source"`
+	Events      int64           `json:"events" db:"events"`
+	Stored      int64           `json:"stored" db:"stored"`
+	QuotedMsat  int64           `json:"quoted_msat" db:"quoted_msat"`
+	ChargedMsat int64           `json:"charged_msat" db:"charged_msat"`
+	Status      string          `json:"status" db:"status"`
+	CreatedAt   nostr.Timestamp `json:"created_at" db:"created_at"`
+	FinishedAt  nostr.Timestamp `json:"finished_at,omitempty" db:"finished_at"`
+}
+
+const (
+	BackfillImporting = "importing"
+	BackfillDone      = "done"
+
+	BackfillFromRelays = "relays"
+	BackfillFromUpload = "upload"
+)
+
+// Imports are rate controlled: a user imports one batch at a time, of up to
+// backfillMaxEvents events stored backfillRate a second, and uploads are
+// capped at backfillMaxBytes.
+var (
+	backfillImports      bool
+	backfillPricer       Pricer
+	backfillPricePercent int64
+	backfillMaxEvents    int
+	backfillRate         int
+	backfillMaxBytes     int64
+	backfillFetchTimeout time.Duration
+
+	// pubkeys with an import running
+	backfillImporting sync.Map
+
+	backfillEventsImported = NewCounterVec("ppe_backfill_events_total", "Events in backfill imports, by whether they were stored.", "result")
+	backfillBatches        = NewCounterVec("ppe_backfill_imports_total", "Backfill imports started, by where the events came from.", "source")
+)
+
+// ConfigureBackfillImports reads BACKFILL_IMPORTS, BACKFILL_PRICE_PERCENT,
+// BACKFILL_MAX_EVENTS, BACKFILL_RATE in events per second, BACKFILL_MAX_MB
+// and BACKFILL_FETCH_TIMEOUT, how long the bot looks for a user's events on
+// other relays.
+func ConfigureBackfillImports(pricer Pricer) {
+	backfillImports = GetEnvDefault("BACKFILL_IMPORTS", "") == "true"
+	backfillPricer = pricer
+	backfillPricePercent = int64(GetEnvInt("BACKFILL_PRICE_PERCENT", 200))
+	backfillMaxEvents = GetEnvInt("BACKFILL_MAX_EVENTS", 5000)
+	backfillRate = max(GetEnvInt("BACKFILL_RATE", 20), 1)
+	backfillMaxBytes = int64(GetEnvInt("BACKFILL_MAX_MB", 50)) << 20
+	backfillFetchTimeout = GetEnvDuration("BACKFILL_FETCH_TIMEOUT", 30*time.Second)
+}
+
+type backfillImportKey struct{}
+
+// BackfillImportID is the import ctx stores an event for, "" for events
+// published over a connection. Imports are paid for and rate controlled as
+// a batch, so the per-event balance check, rate limits and age limit let
+// their events through.
+func BackfillImportID(ctx context.Context) string {
+	id, _ := ctx.Value(backfillImportKey{}).(string)
+	return id
+}
+
+// QuoteBackfill prices importing events for pubkey, returning the ones that
+// can be imported with the price of each. Other people's events, ephemeral
+// ones, ones with a bad signature, ones already stored and ones the pricer
+// refuses are left out.
+func QuoteBackfill(pubkey string, events []*nostr.Event, db Database) (importable []*nostr.Event, prices []int64, totalMsat int64) {
+	account := GetRecordedBillingAccount(pubkey, db)
+	seen := make(map[string]bool)
+	for _, event := range events {
+		if event.PubKey != pubkey || seen[event.ID] || (20000 <= event.Kind && event.Kind < 30000) {
+			continue
+		}
+		seen[event.ID] = true
+		if ok, _ := event.CheckSignature(); !ok {
+			continue
+		}
+		if stored, err := IsEventStored(event.ID, db); err != nil || stored {
+			continue
+		}
+		price, err := backfillPricer.Price(event, account)
+		if err != nil {
+			continue
+		}
+		price = price * backfillPricePercent / 100
+		importable = append(importable, event)
+		prices = append(prices, price)
+		totalMsat += price
+	}
+	return importable, prices, totalMsat
+}
+
+// StartBackfillImport debits pubkey for importing events in one go and
+// stores them in the background, as if pubkey had published them, calling
+// done with the finished import. maxMsat, unless it's 0, is the quote the
+// user agreed to, which the import can't cost more than.
+func StartBackfillImport(pubkey string, source string, events []*nostr.Event, maxMsat int64, db Database, done func(BackfillImport)) (BackfillImport, int, error) {
+	batch := BackfillImport{PubKey: pubkey, Source: source, Status: BackfillImporting}
+	if !backfillImports {
+		return batch, http.StatusNotFound, errors.New("this relay doesn't import events")
+	}
+	if len(events) > backfillMaxEvents {
+		return batch, http.StatusRequestEntityTooLarge, fmt.Errorf("imports can have up to %d events", backfillMaxEvents)
+	}
+	if _, running := backfillImporting.LoadOrStore(pubkey, true); running {
+		return batch, http.StatusTooManyRequests, errors.New("you're already importing events, wait for that to finish")
+	}
+	started := false
+	defer func() {
+		if !started {
+			backfillImporting.Delete(pubkey)
+		}
+	}()
+
+	importable, prices, total := QuoteBackfill(pubkey, events, db)
+	if len(importable) == 0 {
+		return batch, http.StatusBadRequest, errors.New("none of the events can be imported: they're stored already, aren't yours or aren't valid")
+	}
+	if maxMsat > 0 && total > maxMsat {
+		return batch, http.StatusConflict, fmt.Errorf("importing them now costs %s, more than you were quoted", formatSatsShort(total))
+	}
+	if err := CheckSpendLimits(pubkey, total, db); err != nil {
+		return batch, http.StatusTooManyRequests, err
+	}
+	defer LockBalance(pubkey)()
+	if balance := GetSpendableBalanceMsat(pubkey, db); balance < total {
+		return batch, http.StatusPaymentRequired, fmt.Errorf("importing %d events costs %s and your balance is %s", len(importable), formatSatsShort(total), formatSatsShort(balance))
+	}
+
+	batch.ID = RandomHex(16)
+	batch.Events = int64(len(importable))
+	batch.QuotedMsat = total
+	batch.CreatedAt = NowTimestamp()
+	_, err := db.DB.Exec(
+		`INSERT INTO backfill_import (id, pubkey, source, events, stored, quoted_msat, charged_msat, status, created_at, finished_at) VALUES (?, ?, ?, ?, 0, ?, 0, ?, ?, 0)`,
+		batch.ID, batch.PubKey, batch.Source, batch.Events, batch.QuotedMsat, batch.Status, batch.CreatedAt,
+	)
+	if err != nil {
+		ReportError(err, "backfill", map[string]string{"pubkey": pubkey})
+		return batch, http.StatusInternalServerError, errors.New("couldn't start the import, try again later")
+	}
+	if _, err := RecordDebitMsat("backfill-import:"+batch.ID, pubkey, total, fmt.Sprintf("import of %d events", batch.Events), db); err != nil {
+		ReportError(err, "backfill", map[string]string{"pubkey": pubkey, "import": batch.ID})
+		db.DB.Exec(`DELETE FROM backfill_import WHERE id = ?`, batch.ID)
+		return batch, http.StatusInternalServerError, errors.New("couldn't start the import, try again later")
+	}
+
+	started = true
+	backfillBatches.Inc(source)
+	go runBackfillImport(batch, importable, prices, db, done)
+	return batch, http.StatusAccepted, nil
+}
+
+func runBackfillImport(batch BackfillImport, events []*nostr.Event, prices []int64, db Database, done func(BackfillImport)) {
+	defer backfillImporting.Delete(batch.PubKey)
+	defer RecoverPanic("backfill", map[string]string{"import": batch.ID})
+
+	ctx := context.WithValue(context.Background(), backfillImportKey{}, batch.ID)
+	ticker := time.NewTicker(time.Second / time.Duration(backfillRate))
+	defer ticker.Stop()
+	for i, event := range events {
+		<-ticker.C
+		// like events published over a connection, nothing but a fresh
+		// save is stored and broadcast
+		if skipBroadcast, err := relay.AddEvent(ctx, event); err != nil || skipBroadcast {
+			backfillEventsImported.Inc("rejected")
+			continue
+		}
+		relay.BroadcastEvent(event)
+		backfillEventsImported.Inc("stored")
+		batch.Stored++
+		batch.ChargedMsat += prices[i]
+	}
+
+	if refund := batch.QuotedMsat - batch.ChargedMsat; refund > 0 {
+		if _, err := RecordBonusCreditMsat("backfill-import-refund:"+batch.ID, batch.PubKey, refund, "events not imported", db); err != nil {
+			ReportError(err, "backfill", map[string]string{"pubkey": batch.PubKey, "import": batch.ID})
+		}
+	}
+	batch.Status = BackfillDone
+	batch.FinishedAt = NowTimestamp()
+	_, err := db.DB.Exec(
+		`UPDATE backfill_import SET stored = ?, charged_msat = ?, status = ?, finished_at = ? WHERE id = ?`,
+		batch.Stored, batch.ChargedMsat, batch.Status, batch.FinishedAt, batch.ID,
+	)
+	if err != nil {
+		ReportError(err, "backfill", map[string]string{"import": batch.ID})
+	}
+	if done != nil {
+		done(batch)
+	}
+}
+
+// GetBackfillImports returns pubkey's imports, newest first.
+func GetBackfillImports(pubkey string, limit int, db Database) ([]BackfillImport, error) {
+	imports := []BackfillImport{}
+	err := db.DB.Select(&imports, `SELECT * FROM backfill_import WHERE pubkey = ? ORDER BY created_at DESC LIMIT ?`, pubkey, limit)
+	return imports, err
+}
+
+// FetchBackfillEvents pages back through pubkey's events on urls, newest
+// first, collecting up to limit of those not stored here yet, until the
+// relays run out of them or ctx is done.
+func FetchBackfillEvents(ctx context.Context, pubkey string, urls []string, limit int, db Database) []*nostr.Event {
+	seen := make(map[string]bool)
+	var events []*nostr.Event
+	cursor := NowTimestamp()
+	for len(events) < limit && ctx.Err() == nil {
+		filter := nostr.Filter{Authors: []string{pubkey}, Until: &cursor, Limit: 500}
+		found := 0
+		oldest := cursor
+		for event := range pool.SubManyEose(ctx, urls, []nostr.Filter{filter}) {
+			if seen[event.ID] || event.PubKey != pubkey {
+				continue
+			}
+			seen[event.ID] = true
+			found++
+			if event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+			}
+			if stored, err := IsEventStored(event.ID, db); err == nil && !stored && len(events) < limit {
+				events = append(events, event.Event)
+			}
+		}
+		if found == 0 {
+			break
+		}
+		cursor = oldest
+	}
+	return events
+}
+
+// HandleBackfillImportCommand finds the user's events on the relays named
+// and quotes importing them, for backfillFlow to import once they confirm.
+func HandleBackfillImportCommand(pubkey string, urls []string, db Database) string {
+	if !backfillImports {
+		return "This relay doesn't import events."
+	}
+	if len(urls) == 0 {
+		return "Usage: backfill import <relay> [<relay>...]"
+	}
+	for i, url := range urls {
+		if urls[i] = nostr.NormalizeURL(url); !nostr.IsValidRelayURL(urls[i]) {
+			return fmt.Sprintf("%s isn't a relay address.", url)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backfillFetchTimeout)
+	defer cancel()
+	events, _, quote := QuoteBackfill(pubkey, FetchBackfillEvents(ctx, pubkey, urls, backfillMaxEvents, db), db)
+	if len(events) == 0 {
+		return "I found none of your events on those relays that aren't stored here already."
+	}
+	more := ""
+	if len(events) == backfillMaxEvents {
+		more = fmt.Sprintf(" Imports are capped at %d events, import again afterwards for older ones.", backfillMaxEvents)
+	}
+	return StartBotSession(pubkey, "backfill", "import", map[string]string{"relays": strings.Join(urls, " "), "quote": strconv.FormatInt(quote, 10)},
+		fmt.Sprintf("I found %d of your events to import, for %s, %d%% of what they'd cost published one by one.%s Reply yes to import them.", len(events), formatSatsShort(quote), backfillPricePercent, more), db)
+}
+
+// backfillImportFlow fetches the events the user was quoted for again and
+// imports them, replying again in the thread once they're stored.
+func backfillImportFlow(event *nostr.Event, session *BotSession, answer string, db Database) string {
+	session.Step = ""
+	if !isYes(answer) {
+		return "Ok, nothing imported."
+	}
+
+	quote, _ := strconv.ParseInt(session.Data["quote"], 10, 64)
+	ctx, cancel := context.WithTimeout(context.Background(), backfillFetchTimeout)
+	defer cancel()
+	events := FetchBackfillEvents(ctx, event.PubKey, strings.Fields(session.Data["relays"]), backfillMaxEvents, db)
+	batch, _, err := StartBackfillImport(event.PubKey, BackfillFromRelays, events, quote, db, func(batch BackfillImport) {
+		PublishCommandResponseEvent(event, "", describeBackfillImport(batch), db)
+	})
+	if err != nil {
+		return fmt.Sprintf("Couldn't import your events: %v.", err)
+	}
+	return fmt.Sprintf("Importing %d events for %s, I'll reply here once they're stored.", batch.Events, formatSatsShort(batch.QuotedMsat))
+}
+
+func describeBackfillImport(batch BackfillImport) string {
+	if batch.Stored == batch.Events {
+		return fmt.Sprintf("Imported all %d events for %s.", batch.Events, formatSatsShort(batch.ChargedMsat))
+	}
+	return fmt.Sprintf("Imported %d of %d events for %s. The rest were rejected, what they were quoted at is back in your balance.",
+		batch.Stored, batch.Events, formatSatsShort(batch.ChargedMsat))
+}
+
+// HandleAPIBackfill imports the NIP-98 authenticated caller's events from a
+// JSONL body, one event a line, answering 202 with the import, or with
+// ?quote=true only what it would cost.
+func HandleAPIBackfill(w http.ResponseWriter, r *http.Request, db Database) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, backfillMaxBytes+1))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "couldn't read the body")
+		return
+	}
+	if int64(len(body)) > backfillMaxBytes {
+		WriteJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("uploads can be up to %s", formatBytes(backfillMaxBytes)))
+		return
+	}
+	pubkey, err := VerifyNIP98(r, body)
+	if err != nil {
+		WriteJSONError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if !backfillImports {
+		WriteJSONError(w, http.StatusNotFound, "this relay doesn't import events")
+		return
+	}
+
+	var events []*nostr.Event
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		event := &nostr.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("line %d isn't an event", line))
+			return
+		}
+		events = append(events, event)
+	}
+
+	if r.URL.Query().Get("quote") == "true" {
+		importable, _, quote := QuoteBackfill(pubkey, events, db)
+		WriteJSON(w, http.StatusOK, map[string]int64{"events": int64(len(importable)), "quoted_msat": quote})
+		return
+	}
+	batch, status, err := StartBackfillImport(pubkey, BackfillFromUpload, events, 0, db, nil)
+	if err != nil {
+		WriteJSONError(w, status, err.Error())
+		return
+	}
+	WriteJSON(w, status, batch)
+}
+
+// HandleAPIBackfillStatus lists the NIP-98 authenticated caller's imports,
+// newest first.
+func HandleAPIBackfillStatus(w http.ResponseWriter, r *http.Request, db Database) {
+	pubkey, err := VerifyNIP98(r, nil)
+	if err != nil {
+		WriteJSONError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	imports, err := GetBackfillImports(pubkey, 20, db)
+	if err != nil {
+		ReportError(err, "backfill", map[string]string{"pubkey": pubkey})
+		WriteJSONError(w, http.StatusInternalServerError, "couldn't look your imports up")
+		return
+	}
+	WriteJSON(w, http.StatusOK, imports)
+}
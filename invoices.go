@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"sync"
+)
+
+// invoiceCache remembers the last invoices decoded, like SeenCache: a
+// fixed ring of bolt11 strings, the oldest forgotten once it's full, as
+// they come from anyone's events. Failures aren't remembered, so junk
+// doesn't push out the invoices of zaps actually credited.
+var (
+	invoiceCache      map[string]decodepay.Bolt11
+	invoiceCacheRing  []string
+	invoiceCacheNext  int
+	invoiceCacheMutex sync.Mutex
+
+	invoiceCacheHits   = NewCounter("ppe_invoice_cache_hits_total", "Bolt11 decodes served from the invoice cache.")
+	invoiceCacheMisses = NewCounter("ppe_invoice_cache_misses_total", "Bolt11 decodes that had to run decodepay.")
+)
+
+// ConfigureInvoiceCache sizes the invoice cache, INVOICE_CACHE_SIZE. It's
+// off until configured.
+func ConfigureInvoiceCache(size int) {
+	invoiceCacheMutex.Lock()
+	defer invoiceCacheMutex.Unlock()
+	if size < 1 {
+		size = 1
+	}
+	invoiceCache = make(map[string]decodepay.Bolt11, size)
+	invoiceCacheRing = make([]string, size)
+	invoiceCacheNext = 0
+}
+
+// DecodeInvoice decodes a bolt11 string, remembering the result so balance
+// computations don't decode the same invoice twice.
+func DecodeInvoice(bolt11 string) (decodepay.Bolt11, error) {
+	invoiceCacheMutex.Lock()
+	cached, ok := invoiceCache[bolt11]
+	invoiceCacheMutex.Unlock()
+
+	if ok {
+		invoiceCacheHits.Inc()
+		return cached, nil
+	}
+	invoiceCacheMisses.Inc()
+
+	invoice, err := decodeInvoice(bolt11)
+	if err != nil {
+		return invoice, err
+	}
+
+	invoiceCacheMutex.Lock()
+	defer invoiceCacheMutex.Unlock()
+	if len(invoiceCacheRing) == 0 {
+		return invoice, nil
+	}
+	if _, ok := invoiceCache[bolt11]; !ok {
+		if oldest := invoiceCacheRing[invoiceCacheNext]; oldest != "" {
+			delete(invoiceCache, oldest)
+		}
+		invoiceCacheRing[invoiceCacheNext] = bolt11
+		invoiceCacheNext = (invoiceCacheNext + 1) % len(invoiceCacheRing)
+		invoiceCache[bolt11] = invoice
+	}
+	return invoice, nil
+}
+
+// decodeInvoice is decodepay.Decodepay, which trusts its input more than
+// invoices from upstream events deserve, turning its panics into errors.
+func decodeInvoice(bolt11 string) (invoice decodepay.Bolt11, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed bolt11: %v", r)
+		}
+	}()
+	return decodepay.Decodepay(bolt11)
+}
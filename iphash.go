@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ipHashSalt  []byte
+	ipRetention time.Duration
+)
+
+// ConfigureIPHashing reads IP_HASH_SALT, which IPs are hashed with before
+// they're used as rate limit keys or recorded with read usage, and
+// IP_RETENTION, after which recorded hashes are dropped altogether. Without
+// a salt a random one is used, so hashes from before a restart stop matching.
+func ConfigureIPHashing() {
+	ipHashSalt = []byte(GetEnvDefault("IP_HASH_SALT", ""))
+	if len(ipHashSalt) == 0 {
+		ipHashSalt = make([]byte, 32)
+		rand.Read(ipHashSalt)
+	}
+	ipRetention = GetEnvDuration("IP_RETENTION", 30*24*time.Hour)
+}
+
+// HashIP returns the salted hash the relay keeps instead of ip.
+func HashIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, ipHashSalt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// hashedIPRateLimiter is a token bucket per hashed IP (or IPv6 /64), like
+// khatru's own limiters but without raw addresses as keys. With Redis the
+// buckets, named after the limiter, are shared by all instances. Buckets
+// that have filled up again are dropped every interval.
+func hashedIPRateLimiter(name string, tokensPerInterval int, interval time.Duration, maxTokens int) func(ip string) (limited bool) {
+	type bucket struct {
+		tokens float64
+		last   time.Time
+	}
+	buckets := make(map[string]*bucket)
+	var mutex sync.Mutex
+
+	refill := func(b *bucket, now time.Time) {
+		b.tokens = math.Min(float64(maxTokens), b.tokens+now.Sub(b.last).Seconds()/interval.Seconds()*float64(tokensPerInterval))
+		b.last = now
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			mutex.Lock()
+			now := Now()
+			for key, b := range buckets {
+				if refill(b, now); b.tokens >= float64(maxTokens) {
+					delete(buckets, key)
+				}
+			}
+			mutex.Unlock()
+		}
+	}()
+
+	return func(ip string) bool {
+		if ip == hiddenServiceIP {
+			return false
+		}
+		key := HashIP(rateLimitKey(ip))
+		if limited, ok := SharedRateLimited(name+":"+key, float64(maxTokens), float64(tokensPerInterval)/interval.Seconds()); ok {
+			return limited
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		now := Now()
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{tokens: float64(maxTokens), last: now}
+			buckets[key] = b
+		}
+		refill(b, now)
+
+		if b.tokens < 1 {
+			return true
+		}
+		b.tokens--
+		return false
+	}
+}
+
+func EventIPRateLimiter(tokensPerInterval int, interval time.Duration, maxTokens int) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	limited := hashedIPRateLimiter("event", tokensPerInterval, interval, maxTokens)
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		// events the relay adds itself, like backfill imports, come from
+		// no address
+		if khatru.GetConnection(ctx) == nil {
+			return false, ""
+		}
+		return limited(khatru.GetIP(ctx)), "rate-limited: slow down, please"
+	}
+}
+
+func ConnectionIPRateLimiter(tokensPerInterval int, interval time.Duration, maxTokens int) func(r *http.Request) bool {
+	limited := hashedIPRateLimiter("connection", tokensPerInterval, interval, maxTokens)
+	return func(r *http.Request) bool {
+		return limited(khatru.GetIPFromRequest(r))
+	}
+}
+
+func RunIPRetention(db Database) {
+	for {
+		if err := PruneIPs(db); err != nil {
+			ReportError(err, "iphash", nil)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// PruneIPs hashes raw IPs recorded before hashing was introduced and merges
+// read usage older than IP_RETENTION into rows without an IP, keeping the
+// per-pubkey totals.
+func PruneIPs(db Database) error {
+	var raw []string
+	if err := db.DB.Select(&raw, `SELECT DISTINCT ip FROM read_usage WHERE ip LIKE '%.%' OR ip LIKE '%:%'`); err != nil {
+		return err
+	}
+	for _, ip := range raw {
+		if err := mergeReadUsage(db, HashIP(ip), `ip = ?`, ip); err != nil {
+			return err
+		}
+	}
+
+	if ipRetention <= 0 {
+		return nil
+	}
+	cutoff := Now().UTC().Add(-ipRetention).Format("2006-01-02")
+	return mergeReadUsage(db, "", `day < ? AND ip != ''`, cutoff)
+}
+
+// mergeReadUsage moves the read usage rows matching where to ip, adding them
+// up per day and pubkey.
+func mergeReadUsage(db Database, ip string, where string, args ...any) error {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args = append([]any{ip}, args...)
+	if _, err := tx.Exec(
+		`INSERT INTO read_usage (day, pubkey, ip, events, bytes)
+		 SELECT day, pubkey, ?, SUM(events), SUM(bytes) FROM read_usage WHERE `+where+` GROUP BY day, pubkey
+		 ON CONFLICT(day, pubkey, ip) DO UPDATE SET events = read_usage.events + excluded.events, bytes = read_usage.bytes + excluded.bytes`,
+		args...,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM read_usage WHERE `+where+` AND ip != ?`, append(args[1:], ip)...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"os"
+	"sync"
+)
+
+// journalCompactAfter is how many entries the journal collects before it's
+// truncated, the next time nothing in it is pending.
+const journalCompactAfter = 10000
+
+type journalEntry struct {
+	Event *nostr.Event `json:"event,omitempty"`
+
+	// Done is the ID of a journaled event that was stored and everything
+	// after it (charging it among others) ran, or that failed to store
+	Done string `json:"done,omitempty"`
+}
+
+// Journal is an append-only file of the events being stored, written and
+// synced before the store is, so an event the relay crashes in the middle
+// of storing or charging for is stored and charged when it comes back up.
+type Journal struct {
+	file    *os.File
+	pending map[string]bool
+	entries int
+	mutex   sync.Mutex
+}
+
+var (
+	journalReplayed = NewCounter("ppe_journal_replayed_total", "Journaled events stored or charged again at startup after a crash.")
+	journalErrors   = NewCounter("ppe_journal_errors_total", "Events that couldn't be written to the journal, and were refused.")
+)
+
+// ConfigureJournal wraps the relay's StoreEvent handlers in the journal at
+// EVENT_JOURNAL (./db/journal by default, off to turn it off) and replays
+// what a previous run left pending. It must come after every StoreEvent
+// handler and OnEventSaved hook has been added.
+//
+// Replaying runs the event through all the OnEventSaved hooks again. Charges
+// are keyed by event ID, so an event charged before the crash isn't charged
+// twice, but a notification or webhook that went out can go out again.
+func ConfigureJournal() error {
+	path := GetEnvDefault("EVENT_JOURNAL", "./db/journal")
+	if path == "off" {
+		return nil
+	}
+	journal, pending, err := OpenJournal(path)
+	if err != nil {
+		return err
+	}
+
+	stores := relay.StoreEvent
+	store := func(ctx context.Context, event *nostr.Event) error {
+		for _, store := range stores {
+			if err := store(ctx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, event := range pending {
+		replayJournaledEvent(event, store)
+		journal.Done(event.ID)
+	}
+
+	relay.StoreEvent = []func(ctx context.Context, event *nostr.Event) error{func(ctx context.Context, event *nostr.Event) error {
+		if err := journal.Append(event); err != nil {
+			journalErrors.Inc()
+			ReportError(err, "journal", map[string]string{"event": event.ID})
+			return errors.New("error: couldn't save the event, try again later")
+		}
+		if err := store(ctx, event); err != nil {
+			journal.Done(event.ID)
+			return err
+		}
+		return nil
+	}}
+	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
+		journal.Done(event.ID)
+	})
+	return nil
+}
+
+func replayJournaledEvent(event *nostr.Event, store func(ctx context.Context, event *nostr.Event) error) {
+	defer RecoverPanic("journal", map[string]string{"event": event.ID})
+
+	ctx := context.Background()
+	if err := store(ctx, event); err != nil && err != eventstore.ErrDupEvent {
+		ReportError(err, "journal", map[string]string{"event": event.ID})
+		return
+	}
+	for _, hook := range relay.OnEventSaved {
+		hook(ctx, event)
+	}
+	journalReplayed.Inc()
+}
+
+// OpenJournal opens the journal at path, returning the events in it that
+// were never marked done.
+func OpenJournal(path string) (*Journal, []*nostr.Event, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	journal := &Journal{file: file, pending: make(map[string]bool)}
+
+	var events []*nostr.Event
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		// a line cut short by the crash is an event that was never stored
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		journal.entries++
+		if entry.Event != nil {
+			journal.pending[entry.Event.ID] = true
+			events = append(events, entry.Event)
+		} else if entry.Done != "" {
+			delete(journal.pending, entry.Done)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("reading the journal: %w", err)
+	}
+	// and the next entry mustn't be appended to it
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			file.Write([]byte{'\n'})
+		}
+	}
+
+	pending := events[:0]
+	for _, event := range events {
+		if journal.pending[event.ID] {
+			pending = append(pending, event)
+		}
+	}
+	return journal, pending, nil
+}
+
+// Append writes event to the journal and syncs it to disk.
+func (j *Journal) Append(event *nostr.Event) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if err := j.write(journalEntry{Event: event}); err != nil {
+		return err
+	}
+	j.pending[event.ID] = true
+	return j.file.Sync()
+}
+
+// Done marks a journaled event as handled. It isn't synced: losing it only
+// means the event is replayed, which stores and charges nothing twice.
+func (j *Journal) Done(id string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if !j.pending[id] {
+		return
+	}
+	delete(j.pending, id)
+	if err := j.write(journalEntry{Done: id}); err != nil {
+		ReportError(err, "journal", map[string]string{"event": id})
+	}
+
+	if len(j.pending) == 0 && j.entries >= journalCompactAfter {
+		if err := j.file.Truncate(0); err != nil {
+			ReportError(err, "journal", nil)
+			return
+		}
+		j.entries = 0
+	}
+}
+
+func (j *Journal) write(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	j.entries++
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var landingPage = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Info.Name}}</title>
+{{if .Info.Icon}}<link rel="icon" href="{{.Info.Icon}}">{{end}}
+</head>
+<body>
+{{if .Banner}}<img src="{{.Banner}}" alt="" style="max-width: 100%">{{end}}
+<h1>{{if .Info.Icon}}<img src="{{.Info.Icon}}" alt="" height="48"> {{end}}{{.Info.Name}}</h1>
+<p>{{.Info.Description}}</p>
+<p>Add <code>{{.URL}}</code> to your Nostr client to use this relay.</p>
+{{if .HiddenServices}}<p>Also reachable at {{range $i, $address := .HiddenServices}}{{if $i}}, {{end}}<code>ws://{{$address}}</code>{{end}}.</p>{{end}}
+
+<h2>Pricing</h2>
+{{if .DryRun}}<p>Posting is free for now: charges are only simulated.</p>{{end}}
+<ul>
+{{range .Pricing}}<li>{{.}}</li>
+{{end}}</ul>
+{{if .Packages}}<p>Or prepay for a package of events:</p>
+<ul>
+{{range .Packages}}<li>{{.Name}}: {{.Events}} events for {{.Sats}} sats</li>
+{{end}}</ul>{{end}}
+{{if .Pinning}}<p>Pin an event to keep it here for good, never pruned: {{.Pinning}}, paid once.</p>{{end}}
+
+{{if .TopUp}}<h2>Top up</h2>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+{{if .Invoice}}<p>Pay this invoice to add {{.Amount}} sats to {{.PubKey}}:</p>
+<a href="lightning:{{.Invoice}}" style="display: block; width: 256px">{{.QR}}</a>
+<p><code style="word-break: break-all">{{.Invoice}}</code></p>
+{{else}}<form method="get" action="/">
+<p><label>Your npub <input name="pubkey" value="{{.PubKey}}" size="64" required></label></p>
+<p><label>Sats <input name="amount" type="number" min="1" value="{{.Amount}}" required></label></p>
+<p><button type="submit">Get invoice</button></p>
+</form>{{end}}{{end}}
+
+{{if .Bot}}<h2>Bot</h2>
+<p>Message <a href="nostr:{{.Bot}}"><code>{{.Bot}}</code></a> with <code>help</code> to check your balance, buy packages and more.</p>{{end}}
+{{if .Push}}<h2>Push notifications</h2>
+<p>Paying users can get replies, mentions and zaps stored here on their phone through <a href="https://ntfy.sh">ntfy</a>. Pick a topic only you know, subscribe to it in the ntfy app and save it here with your Nostr browser extension. Leave it empty to stop them.</p>
+<form id="push">
+<p><label>ntfy topic <input name="topic" size="32"></label> <button type="submit">Save</button></p>
+</form>
+<p id="push-status"></p>
+<script>
+document.getElementById("push").addEventListener("submit", async (e) => {
+  e.preventDefault()
+  const status = document.getElementById("push-status")
+  if (!window.nostr) {
+    status.textContent = "You need a Nostr browser extension to sign in."
+    return
+  }
+  const body = JSON.stringify({topic: e.target.topic.value})
+  const digest = await crypto.subtle.digest("SHA-256", new TextEncoder().encode(body))
+  const payload = Array.from(new Uint8Array(digest), (b) => b.toString(16).padStart(2, "0")).join("")
+  const auth = await window.nostr.signEvent({
+    kind: 27235,
+    created_at: Math.floor(Date.now() / 1000),
+    tags: [["u", location.origin + "/push"], ["method", "POST"], ["payload", payload]],
+    content: "",
+  })
+  const response = await fetch("/push", {method: "POST", headers: {"Authorization": "Nostr " + btoa(JSON.stringify(auth))}, body})
+  const result = await response.json()
+  status.textContent = result.message || result.error
+})
+</script>{{end}}
+{{if .Info.Contact}}<p>Contact: {{.Info.Contact}}</p>{{end}}
+<p><a href="/stats">Stats</a></p>
+</body>
+</html>
+`))
+
+// HandleLandingPage serves / to browsers: what the relay is, what it costs
+// and, with a payment backend, a form that turns into a top-up invoice and
+// its QR code. Anything else that isn't a websocket or NIP-11 request gets a
+// short hint instead.
+func HandleLandingPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("Please use a Nostr client to connect.\n"))
+		return
+	}
+
+	info := *relay.Info
+	for _, overwrite := range relay.OverwriteRelayInformation {
+		info = overwrite(r.Context(), r, info)
+	}
+	page := map[string]any{
+		"Info":           info,
+		"Banner":         relayBanner,
+		"URL":            strings.Replace(relay.ServiceURL, "http", "ws", 1),
+		"HiddenServices": hiddenServiceAddresses,
+		"DryRun":         dryRun,
+		"Pricing":        DescribePricer(GetPricer()),
+		"Packages":       eventPackages,
+		"Pinning":        "",
+		"Push":           pushEnabled,
+		"TopUp":          paymentBackend != nil,
+		"PubKey":         r.URL.Query().Get("pubkey"),
+		"Amount":         r.URL.Query().Get("amount"),
+	}
+	if botPubkey != "" {
+		page["Bot"], _ = nip19.EncodePublicKey(botPubkey)
+	}
+	if pinningEnabled() {
+		page["Pinning"] = DescribePinPrice()
+	}
+
+	if paymentBackend != nil && page["PubKey"] != "" {
+		pubkey, err := ParsePubKey(page["PubKey"].(string))
+		amount, _ := strconv.ParseInt(page["Amount"].(string), 10, 64)
+		switch {
+		case err != nil:
+			page["Error"] = "That doesn't look like an npub."
+		case amount <= 0:
+			page["Error"] = "Enter how many sats to top up."
+		default:
+			bolt11, err := paymentBackend.CreateInvoice(pubkey, amount*1000)
+			if err != nil {
+				ReportError(err, "landing", map[string]string{"pubkey": pubkey})
+				page["Error"] = "Couldn't create an invoice, try again later."
+				break
+			}
+			invoicesIssued.Inc()
+			// upper case fits the QR code's compact alphanumeric mode
+			qr, err := EncodeQR("LIGHTNING:" + strings.ToUpper(bolt11))
+			if err != nil {
+				page["Error"] = err.Error()
+				break
+			}
+			page["Invoice"] = bolt11
+			page["QR"] = template.HTML(qr.SVG())
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if location := onionLocation(); location != "" && r.RemoteAddr != hiddenServiceIP+":0" {
+		w.Header().Set("Onion-Location", location+strings.TrimPrefix(r.URL.RequestURI(), "/"))
+	}
+	if err := landingPage.Execute(w, page); err != nil {
+		ReportError(err, "landing", nil)
+	}
+}
+
+// DescribePricer explains a pricer's prices in a line per rule.
+func DescribePricer(pricer Pricer) []string {
+	switch p := pricer.(type) {
+	case FlatPricer:
+		return []string{formatSatsShort(p.Msat) + " per event"}
+	case BytePricer:
+		return []string{fmt.Sprintf("%d msat per byte", p.MsatPerByte)}
+	case StoragePricer:
+		return []string{fmt.Sprintf("%s per event once you store more than %d MB", formatSatsShort(p.Msat), p.FreeBytes>>20)}
+	case KindPricer:
+		var lines []string
+		kinds := make([]int, 0, len(p.Prices))
+		for kind := range p.Prices {
+			kinds = append(kinds, kind)
+		}
+		slices.Sort(kinds)
+		for _, kind := range kinds {
+			lines = append(lines, fmt.Sprintf("kind %d: %s per event", kind, formatSatsShort(p.Prices[kind])))
+		}
+		if p.Default != nil {
+			for _, line := range DescribePricer(p.Default) {
+				lines = append(lines, "other kinds: "+line)
+			}
+		} else {
+			lines = append(lines, "other kinds aren't accepted")
+		}
+		return lines
+	case SumPricer:
+		var parts []string
+		for _, part := range p {
+			parts = append(parts, DescribePricer(part)...)
+		}
+		return []string{strings.Join(parts, ", plus ")}
+	case AppDataPricer:
+		kinds := make([]int, 0, len(p.Kinds))
+		for kind := range p.Kinds {
+			kinds = append(kinds, kind)
+		}
+		slices.Sort(kinds)
+		lines := DescribePricer(p.Inner)
+		for _, line := range DescribePricer(p.AppData) {
+			lines = append(lines, fmt.Sprintf("app data (kinds %s): %s, with a balance of at least %s",
+				strings.Trim(fmt.Sprint(kinds), "[]"), line, formatSatsShort(p.MinBalanceMsat)))
+		}
+		return lines
+	case ClientPricer:
+		clients := make([]string, 0, len(p.Percent))
+		for client := range p.Percent {
+			clients = append(clients, client)
+		}
+		slices.Sort(clients)
+		lines := DescribePricer(p.Inner)
+		for _, client := range clients {
+			name := client
+			if name == "" {
+				name = "clients that don't name themselves"
+			}
+			lines = append(lines, fmt.Sprintf("events from %s: %d%% of that", name, p.Percent[client]))
+		}
+		return lines
+	case LoyaltyPricer:
+		lines := DescribePricer(p.Inner)
+		for _, tier := range p.Tiers {
+			lines = append(lines, "loyalty: "+tier.Describe())
+		}
+		return lines
+	case PromotionPricer:
+		lines := DescribePricer(p.Inner)
+		for _, promotion := range p.Promotions {
+			line := promotion.Describe()
+			if promotion.On(Now()) {
+				line += " (on now)"
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	case ScriptPricer:
+		lines := DescribePricer(p.Inner)
+		for _, script := range p.Scripts {
+			if script.price != nil {
+				lines = append(lines, "adjusted by "+filepath.Base(script.Path))
+			}
+		}
+		return lines
+	case ModulePricer:
+		lines := DescribePricer(p.Inner)
+		for _, module := range p.Modules {
+			if module.price {
+				lines = append(lines, "adjusted by "+filepath.Base(module.Path))
+			}
+		}
+		return lines
+	case HookPricer:
+		return append(DescribePricer(p.Inner), "adjusted by an external policy")
+	case BotPricer:
+		return append(DescribePricer(p.Inner), fmt.Sprintf("%d times that for accounts flagged as likely bots", p.Multiplier))
+	case *DynamicPricer:
+		return append(DescribePricer(p.Inner), fmt.Sprintf("prices rise when more than %d events a minute are being stored", p.Target))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+var leaseSchema = Schema{
+	Tables: []string{"lease"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS lease (
+       name text NOT NULL PRIMARY KEY,
+       holder text NOT NULL,
+       expires_at bigint NOT NULL);`,
+	},
+}
+
+// leaseTTL is how long a lease lasts without being renewed. Holders renew
+// it three times as often, so a stalled or dead instance's jobs are taken
+// over within leaseTTL.
+const leaseTTL = 30 * time.Second
+
+var leasesLost = NewCounter("ppe_leases_lost_total", "Background job leases taken over by another instance.")
+
+// AcquireLease takes or renews the named lease for this instance, reporting
+// whether it holds it now.
+func AcquireLease(name string, db Database) (bool, error) {
+	now := time.Now()
+	result, err := db.DB.Exec(
+		`INSERT INTO lease (name, holder, expires_at) VALUES (?, ?, ?)
+		 ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		 WHERE lease.holder = excluded.holder OR lease.expires_at < ?`,
+		name, instanceID, now.Add(leaseTTL).Unix(), now.Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// Exclusively wraps a background job that must only run on one of the
+// instances sharing the database, like the bot, which would otherwise answer
+// every command once per instance. The returned func waits for the job's
+// lease and then runs it, renewing the lease meanwhile.
+//
+// Jobs don't return, so an instance that loses a lease it was holding exits
+// rather than keep running alongside the new holder; it's expected to be
+// restarted by whatever runs it.
+func Exclusively(name string, db Database, job func()) func() {
+	var renewing sync.Once
+	return func() {
+		for {
+			held, err := AcquireLease(name, db)
+			if err != nil {
+				ReportError(err, "leases", map[string]string{"lease": name})
+			}
+			if held {
+				break
+			}
+			time.Sleep(leaseTTL / 3)
+		}
+
+		// Supervise calls this again when the job panics
+		renewing.Do(func() { go renewLease(name, db) })
+		job()
+	}
+}
+
+func renewLease(name string, db Database) {
+	renewed := time.Now()
+	for {
+		time.Sleep(leaseTTL / 3)
+		held, err := AcquireLease(name, db)
+		if err != nil {
+			ReportError(err, "leases", map[string]string{"lease": name})
+			// keep going while the lease is still ours
+			if time.Since(renewed) < leaseTTL {
+				continue
+			}
+		}
+		if !held || err != nil {
+			leasesLost.Inc()
+			log.Fatalf("lost the %s lease to another instance", name)
+		}
+		renewed = time.Now()
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"slices"
+	"swarmstr.com/ppe-relay/ppe"
+	"sync"
+)
+
+// The ledger is ppe's SQLLedger, in tables of the ledger schema, which also
+// keeps track of checks on zap credits and of reads.
+var ledgerSchema = Schema{
+	Tables: append(slices.Clip(ppe.LedgerTables), "zap_check", "read_usage"),
+	DDLs: append(slices.Clip(ppe.LedgerDDLs),
+		`CREATE TABLE IF NOT EXISTS zap_check (
+       id text NOT NULL PRIMARY KEY,
+       checked_at bigint NOT NULL,
+       missing_since bigint,
+       problem text NOT NULL DEFAULT '');`,
+		`CREATE TABLE IF NOT EXISTS read_usage (
+       day text NOT NULL,
+       pubkey text NOT NULL,
+       ip text NOT NULL,
+       events bigint NOT NULL,
+       bytes bigint NOT NULL,
+       PRIMARY KEY (day, pubkey, ip));`,
+	),
+}
+
+// GetLedger returns the ledger in db.
+func GetLedger(db Database) ppe.SQLLedger {
+	return ppe.SQLLedger{DB: db.DB, Clock: clock}
+}
+
+// GetZapVerifier returns what verifies receipts of zaps to the bot, signed
+// by the zapper.
+func GetZapVerifier() ppe.ZapVerifier {
+	return ppe.ZapVerifier{Recipient: botPubkey, Zappers: GetZapperPubkeys(), Decode: DecodeInvoice}
+}
+
+var zapsCredited = NewCounter("ppe_zaps_credited_total", "Zap receipts credited to the ledger.")
+
+// balanceLocks serialize purchases paid up front from the same balance, and
+// the events it pays for, so two can't both pass the balance check before
+// either is debited. The bot, which takes most purchases, only runs on one
+// instance.
+var (
+	balanceLocks      = make(map[string]*balanceLock)
+	balanceLocksMutex sync.Mutex
+)
+
+type balanceLock struct {
+	sync.Mutex
+	holders int
+}
+
+// LockBalance holds pubkey's balance for a purchase until the returned func
+// is called.
+func LockBalance(pubkey string) (unlock func()) {
+	balanceLocksMutex.Lock()
+	lock, ok := balanceLocks[pubkey]
+	if !ok {
+		lock = &balanceLock{}
+		balanceLocks[pubkey] = lock
+	}
+	lock.holders++
+	balanceLocksMutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		balanceLocksMutex.Lock()
+		defer balanceLocksMutex.Unlock()
+		if lock.holders--; lock.holders == 0 {
+			delete(balanceLocks, pubkey)
+		}
+	}
+}
+
+// GetSpendableBalanceMsat is pubkey's balance less the prices of the events
+// it pays for that were accepted and not charged yet. Purchases check it with
+// the balance locked.
+func GetSpendableBalanceMsat(pubkey string, db Database) int64 {
+	return GetRemainingUserBalanceMsat(pubkey, db) - ppe.HeldMsat(pubkey)
+}
+
+// CreditZapEvent records a zap receipt in the ledger. Receipts already in the
+// ledger are ignored, so it's safe to call for every receipt seen upstream.
+func CreditZapEvent(event *nostr.Event, db Database) (credited bool, err error) {
+	zap, err := GetZapVerifier().Verify(event)
+	if errors.Is(err, ppe.ErrZapSigner) {
+		zapsWrongSigner.Inc()
+	}
+	if err != nil {
+		return false, err
+	}
+	zapRequest, err := GetZapRequestFromZapEvent(event)
+	if err != nil {
+		return false, err
+	}
+
+	// zaps naming a pool fund it rather than their sender
+	pubkey := GetZapBeneficiary(zapRequest)
+	if name := GetZapPool(zapRequest, db); name != "" {
+		pubkey = PoolAccount(name)
+	}
+	// the ledger credits an invoice once whatever receipt it comes in, and
+	// it's never credited again once the account it was credited to is
+	// erased
+	if IsErasedZap(zap.Bolt11, db) {
+		return false, nil
+	}
+	credited, err = GetLedger(db).CreditZap(zap, pubkey)
+	if err != nil {
+		ReportError(err, "ledger", map[string]string{"receipt": event.ID})
+		return false, err
+	}
+
+	if credited {
+		zapsCredited.Inc()
+
+		if err := CreditPackage(event, zapRequest, zap.AmountMsat, db); err != nil {
+			ReportError(err, "packages", map[string]string{"receipt": event.ID})
+		}
+
+		FireWebhook(WebhookPaymentReceived, map[string]any{"pubkey": pubkey, "amount": zap.AmountMsat / 1000, "receipt": event.ID})
+		if isPoolAccount(pubkey) {
+			poolsFunded.Inc()
+			return true, nil
+		}
+
+		var credits int
+		db.DB.QueryRow(`SELECT COUNT(*) FROM zap_credit WHERE pubkey = ?`, pubkey).Scan(&credits)
+		if credits == 1 {
+			FireWebhook(WebhookNewUser, map[string]any{"pubkey": pubkey})
+
+			if err := ApplyReferral(event, zapRequest, zap.AmountMsat, db); err != nil {
+				ReportError(err, "referrals", map[string]string{"receipt": event.ID})
+			}
+		}
+	}
+	return credited, nil
+}
+
+func GetCreditedTotalFromUser(pubkey string, db Database) int64 {
+	return GetCreditedMsatFromUser(pubkey, db) / 1000
+}
+
+func GetCreditedMsatFromUser(pubkey string, db Database) int64 {
+	totalMsat, err := GetLedger(db).CreditedMsat(pubkey)
+	if err != nil {
+		ReportError(err, "ledger", map[string]string{"pubkey": pubkey})
+		return 0
+	}
+	return totalMsat
+}
+
+// RecordBonusCredit adds sats that weren't paid for, like referral rewards.
+// As with debits, the id makes it idempotent.
+func RecordBonusCredit(id string, pubkey string, sats int64, reason string, db Database) (credited bool, err error) {
+	return RecordBonusCreditMsat(id, pubkey, sats*1000, reason, db)
+}
+
+func RecordBonusCreditMsat(id string, pubkey string, msat int64, reason string, db Database) (credited bool, err error) {
+	return GetLedger(db).Credit(id, pubkey, msat, reason)
+}
+
+// RecordDebit charges a pubkey for something other than storing an event.
+// The id makes the charge idempotent: debiting the same id twice is a no-op.
+func RecordDebit(id string, pubkey string, sats int64, reason string, db Database) (debited bool, err error) {
+	return RecordDebitMsat(id, pubkey, sats*1000, reason, db)
+}
+
+func RecordDebitMsat(id string, pubkey string, msat int64, reason string, db Database) (debited bool, err error) {
+	return GetLedger(db).Debit(id, pubkey, msat, reason)
+}
+
+func GetDebitedTotalFromUser(pubkey string, db Database) int64 {
+	return GetDebitedMsatFromUser(pubkey, db) / 1000
+}
+
+func GetDebitedMsatFromUser(pubkey string, db Database) int64 {
+	totalMsat, err := GetLedger(db).DebitedMsat(pubkey)
+	if err != nil {
+		ReportError(err, "ledger", map[string]string{"pubkey": pubkey})
+		return 0
+	}
+	return totalMsat
+}
+
+// GetUnpricedEventsCountFromUser counts stored events that predate per-event
+// charges. They're still billed the old way, one sat each for as long as
+// they're stored.
+func GetUnpricedEventsCountFromUser(pubkey string, db Database) int64 {
+	var count int64
+	err := db.DB.QueryRow(
+		`SELECT COUNT(*) FROM event WHERE pubkey = ? AND NOT EXISTS (SELECT 1 FROM debit WHERE debit.id = 'event:' || event.id)`,
+		pubkey,
+	).Scan(&count)
+	if err != nil {
+		ReportError(err, "ledger", map[string]string{"pubkey": pubkey})
+		return 0
+	}
+	return count
+}
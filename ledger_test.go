@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"github.com/nbd-wtf/go-nostr"
+	"swarmstr.com/ppe-relay/ppe"
+	"sync"
+	"testing"
+)
+
+func TestZapCreditedOncePerInvoice(t *testing.T) {
+	h := NewHarness(t)
+	pubkey := nostr.GeneratePrivateKey()
+
+	// copies of one receipt, each under an id of its own
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	credits := 0
+	for _, id := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			zap := &ppe.Zap{Receipt: &nostr.Event{ID: id}, Bolt11: "lnbc10n1", AmountMsat: 1000}
+			credited, err := GetLedger(h.DB).CreditZap(zap, pubkey)
+			if err != nil {
+				t.Errorf("crediting %s: %v", id, err)
+			}
+			if credited {
+				mutex.Lock()
+				credits++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if credits != 1 {
+		t.Fatalf("invoice credited %d times, expected once", credits)
+	}
+	if balance := GetLedgerBalanceMsat(pubkey, h.DB); balance != 1000 {
+		t.Fatalf("balance of %d msat, expected 1000", balance)
+	}
+}
+
+func TestAcceptedEventsHoldTheirPrice(t *testing.T) {
+	h := NewHarness(t)
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	if err := h.TopUp(pubkey, 1); err != nil {
+		t.Fatalf("topping up: %v", err)
+	}
+
+	// both are checked before either is saved and charged
+	require := RequireBalance(FlatPricer{Msat: 1000}, h.DB)
+	first := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "first"}
+	first.Sign(sk)
+	second := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "second"}
+	second.Sign(sk)
+	if reject, msg := require(context.Background(), &first); reject {
+		t.Fatalf("first event rejected: %s", msg)
+	}
+	if reject, _ := require(context.Background(), &second); !reject {
+		t.Fatal("second event accepted on the sat the first holds")
+	}
+	if reject, msg := require(context.Background(), &first); reject {
+		t.Fatalf("first event rejected when sent again: %s", msg)
+	}
+	if err := GiftBalance("held", pubkey, nostr.GeneratePrivateKey(), 1, h.DB); err == nil {
+		t.Fatal("gifted the sat the first event holds")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var spendLimitSchema = Schema{
+	Tables: []string{"spend_limit"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS spend_limit (
+       pubkey text NOT NULL,
+       unit text NOT NULL,
+       max bigint NOT NULL,
+       window_seconds bigint NOT NULL,
+       effective_at bigint NOT NULL,
+       PRIMARY KEY (pubkey, unit, effective_at));`,
+	},
+}
+
+// SpendLimit caps how much a pubkey can spend in a rolling window, in events
+// or millisats, regardless of its balance, so a leaked key can't drain it all
+// at once. Users set their own; a Max of 0 means no limit.
+type SpendLimit struct {
+	Unit   string
+	Max    int64
+	Window time.Duration
+}
+
+const (
+	SpendLimitEvents = "events"
+	SpendLimitMsat   = "msat"
+)
+
+// spendLimitCooldown delays limits being loosened or removed, so whoever
+// gets hold of a key can't just lift the limit first. Tightening a limit
+// takes effect immediately and cancels pending loosenings.
+var spendLimitCooldown time.Duration
+
+var spendLimitRejections = NewCounter("ppe_spend_limit_rejections_total", "Events rejected by a user's own spend limit.")
+
+// GetSpendLimit returns pubkey's limit in unit that's in effect now.
+func GetSpendLimit(pubkey string, unit string, db Database) SpendLimit {
+	limit := SpendLimit{Unit: unit}
+	var window int64
+	db.DB.QueryRow(
+		`SELECT max, window_seconds FROM spend_limit WHERE pubkey = ? AND unit = ? AND effective_at <= ? ORDER BY effective_at DESC LIMIT 1`,
+		pubkey, unit, NowTimestamp(),
+	).Scan(&limit.Max, &window)
+	limit.Window = time.Duration(window) * time.Second
+	return limit
+}
+
+// looser reports whether l allows more spending than other.
+func (l SpendLimit) looser(other SpendLimit) bool {
+	if other.Max == 0 {
+		return false
+	}
+	if l.Max == 0 {
+		return true
+	}
+	return l.Max*int64(other.Window.Seconds()) > other.Max*int64(l.Window.Seconds())
+}
+
+// SetSpendLimit changes pubkey's limit, returning when it takes effect.
+func SetSpendLimit(pubkey string, limit SpendLimit, db Database) (nostr.Timestamp, error) {
+	effectiveAt := NowTimestamp()
+	if limit.looser(GetSpendLimit(pubkey, limit.Unit, db)) {
+		effectiveAt += nostr.Timestamp(spendLimitCooldown.Seconds())
+	} else if _, err := db.DB.Exec(`DELETE FROM spend_limit WHERE pubkey = ? AND unit = ? AND effective_at > ?`, pubkey, limit.Unit, effectiveAt); err != nil {
+		return 0, err
+	}
+
+	_, err := db.DB.Exec(
+		`INSERT INTO spend_limit (pubkey, unit, max, window_seconds, effective_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (pubkey, unit, effective_at) DO UPDATE SET max = excluded.max, window_seconds = excluded.window_seconds`,
+		pubkey, limit.Unit, limit.Max, int64(limit.Window.Seconds()), effectiveAt,
+	)
+	return effectiveAt, err
+}
+
+// CheckSpendLimits returns an error if charging price for another event
+// would take pubkey over one of its limits. Spending is counted by the
+// author billed, the delegator for delegated events, whoever's balance paid
+// for it; debits from before authors were recorded go by the event's pubkey.
+func CheckSpendLimits(pubkey string, price int64, db Database) error {
+	for _, unit := range []string{SpendLimitEvents, SpendLimitMsat} {
+		limit := GetSpendLimit(pubkey, unit, db)
+		if limit.Max == 0 {
+			continue
+		}
+
+		var events, msat int64
+		err := db.DB.QueryRow(
+			`SELECT COUNT(*), COALESCE(SUM(debit.amount_msat), 0) FROM debit LEFT JOIN debit_author ON debit_author.id = debit.id
+			 WHERE debit.created_at >= ? AND (debit_author.author = ?
+			   OR (debit_author.id IS NULL AND debit.id IN (SELECT 'event:' || id FROM event WHERE pubkey = ?)))`,
+			Now().Add(-limit.Window).Unix(), pubkey, pubkey,
+		).Scan(&events, &msat)
+		if err != nil {
+			return err
+		}
+
+		if (unit == SpendLimitEvents && events+1 > limit.Max) || (unit == SpendLimitMsat && msat+price > limit.Max) {
+			spendLimitRejections.Inc()
+			return fmt.Errorf("you set a limit of %s per %s", limit.describeMax(), formatWindow(limit.Window))
+		}
+	}
+	return nil
+}
+
+func (l SpendLimit) describeMax() string {
+	if l.Unit == SpendLimitMsat {
+		return formatSatsShort(l.Max)
+	}
+	return fmt.Sprintf("%d events", l.Max)
+}
+
+var spendLimitWindows = map[string]time.Duration{"hour": time.Hour, "day": 24 * time.Hour, "week": 7 * 24 * time.Hour}
+
+func formatWindow(window time.Duration) string {
+	for name, d := range spendLimitWindows {
+		if d == window {
+			return name
+		}
+	}
+	return window.String()
+}
+
+// HandleLimitCommand answers "limit" with the user's limits, and "limit 100
+// events/hour", "limit 500 sats/day" or "limit events off" by changing them.
+func HandleLimitCommand(pubkey string, args []string, db Database) string {
+	usage := "Usage: limit <n> events|sats per hour|day|week, or limit events|sats off"
+	if len(args) == 0 {
+		var limits []string
+		for _, unit := range []string{SpendLimitEvents, SpendLimitMsat} {
+			if limit := GetSpendLimit(pubkey, unit, db); limit.Max > 0 {
+				limits = append(limits, fmt.Sprintf("%s per %s", limit.describeMax(), formatWindow(limit.Window)))
+			}
+		}
+		if len(limits) == 0 {
+			return "You have no spend limits. " + usage + "."
+		}
+		return "Your spend limits: " + strings.Join(limits, ", ") + "."
+	}
+
+	// accept "100 events/hour" as well as "100 events per hour"
+	words := strings.Fields(strings.ToLower(strings.ReplaceAll(strings.ReplaceAll(strings.Join(args, " "), "/", " "), " per ", " ")))
+	var limit SpendLimit
+	switch {
+	case len(words) == 2 && words[1] == "off":
+		limit.Unit = words[0]
+		limit.Window = time.Hour
+	case len(words) == 3:
+		n, err := strconv.ParseInt(words[0], 10, 64)
+		window, ok := spendLimitWindows[strings.TrimSuffix(words[2], "s")]
+		if err != nil || n <= 0 || !ok {
+			return usage
+		}
+		limit = SpendLimit{Unit: words[1], Max: n, Window: window}
+	default:
+		return usage
+	}
+
+	switch strings.TrimSuffix(limit.Unit, "s") {
+	case "event":
+		limit.Unit = SpendLimitEvents
+	case "sat":
+		limit.Unit = SpendLimitMsat
+		limit.Max *= 1000
+	default:
+		return usage
+	}
+
+	effectiveAt, err := SetSpendLimit(pubkey, limit, db)
+	if err != nil {
+		ReportError(err, "limits", map[string]string{"pubkey": pubkey})
+		return "Couldn't save your limit, try again later."
+	}
+	described := "no limit"
+	if limit.Max > 0 {
+		described = fmt.Sprintf("a limit of %s per %s", limit.describeMax(), formatWindow(limit.Window))
+	}
+	if effectiveAt > NowTimestamp() {
+		return fmt.Sprintf("To keep a stolen key from lifting it, you'll have %s from %s.", described, effectiveAt.Time().UTC().Format("2006-01-02 15:04 UTC"))
+	}
+	return fmt.Sprintf("You now have %s.", described)
+}
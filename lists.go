@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ListAddress points at a NIP-51 list: a replaceable list like the kind 10000
+// mute list, or a kind 30000 follow set when D is set.
+type ListAddress struct {
+	Kind   int
+	PubKey string
+	D      string
+}
+
+func (a ListAddress) String() string {
+	if a.D == "" {
+		return fmt.Sprintf("%d:%s", a.Kind, a.PubKey)
+	}
+	return fmt.Sprintf("%d:%s:%s", a.Kind, a.PubKey, a.D)
+}
+
+var (
+	allowLists []ListAddress
+	denyLists  []ListAddress
+
+	// allowed and denied are nil until the lists were first fetched
+	allowedPubKeys map[string]bool
+	deniedPubKeys  map[string]bool
+	listsMutex     sync.RWMutex
+
+	listSyncFailures = NewCounter("ppe_list_sync_failures_total", "Allow and deny list syncs that failed to find a list.")
+)
+
+// ConfigureLists reads ALLOW_LISTS and DENY_LISTS, comma separated NIP-51
+// list addresses like "30000:<pubkey>:<d tag>" or "10000:<pubkey>". Either
+// side defaults to the operator's key when the pubkey is left out, so
+// DENY_LISTS=10000 applies the operator's public mute list. Only the lists'
+// public p tags are used.
+func ConfigureLists() error {
+	var err error
+	if allowLists, err = parseListAddresses(GetEnvList("ALLOW_LISTS", nil)); err != nil {
+		return err
+	}
+	if denyLists, err = parseListAddresses(GetEnvList("DENY_LISTS", nil)); err != nil {
+		return err
+	}
+	if len(allowLists) == 0 && len(denyLists) == 0 {
+		return nil
+	}
+
+	relay.RejectEvent = append(relay.RejectEvent, RejectByLists)
+	interval := GetEnvDuration("LIST_SYNC_INTERVAL", 15*time.Minute)
+	Supervise("list sync", func() { RunListSync(interval) })
+	return nil
+}
+
+func parseListAddresses(values []string) ([]ListAddress, error) {
+	var addresses []ListAddress
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 3)
+		kind, err := strconv.Atoi(parts[0])
+		if err != nil || !(kind >= 10000 && kind < 20000) && !(kind >= 30000 && kind < 40000) {
+			return nil, fmt.Errorf("invalid list %q: the kind must be a NIP-51 list's", value)
+		}
+		address := ListAddress{Kind: kind, PubKey: relay.Info.PubKey}
+		if len(parts) > 1 && parts[1] != "" {
+			if address.PubKey, err = ParsePubKey(parts[1]); err != nil {
+				return nil, fmt.Errorf("invalid list %q: %v", value, err)
+			}
+		}
+		if kind >= 30000 {
+			if len(parts) < 3 || parts[2] == "" {
+				return nil, fmt.Errorf("invalid list %q: kind %d lists need a d tag", value, kind)
+			}
+			address.D = parts[2]
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// RejectByLists refuses authors on a deny list and, when there are allow
+// lists, anyone not on one of them. Until the allow lists were fetched once
+// everyone is refused, rather than letting everyone in.
+func RejectByLists(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	author := GetEventAuthor(event)
+	listsMutex.RLock()
+	defer listsMutex.RUnlock()
+
+	if deniedPubKeys[author] {
+		return true, "blocked: you're on this relay's deny list"
+	}
+	if len(allowLists) > 0 {
+		if allowedPubKeys == nil {
+			return true, "restricted: this relay's allow list hasn't loaded yet, try again later"
+		}
+		if !allowedPubKeys[author] {
+			return true, "restricted: you're not on this relay's allow list"
+		}
+	}
+	return false, ""
+}
+
+func RunListSync(interval time.Duration) {
+	for {
+		SyncLists()
+		time.Sleep(interval)
+	}
+}
+
+// SyncLists fetches the lists through the pool. A list that can't be found
+// keeps the pubkeys it had, so an unreachable relay doesn't empty it.
+func SyncLists() {
+	allowed, allowedOK := fetchListPubKeys(allowLists)
+	denied, deniedOK := fetchListPubKeys(denyLists)
+
+	listsMutex.Lock()
+	defer listsMutex.Unlock()
+	if allowedOK {
+		allowedPubKeys = allowed
+	}
+	if deniedOK {
+		deniedPubKeys = denied
+	}
+}
+
+// fetchListPubKeys merges the p tags of the latest version of each list,
+// returning false when one of them couldn't be found.
+func fetchListPubKeys(addresses []ListAddress) (map[string]bool, bool) {
+	pubkeys := make(map[string]bool)
+	for _, address := range addresses {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		filter := nostr.Filter{Kinds: []int{address.Kind}, Authors: []string{address.PubKey}}
+		if address.D != "" {
+			filter.Tags = nostr.TagMap{"d": []string{address.D}}
+		}
+
+		var latest *nostr.Event
+		for event := range pool.SubManyEose(ctx, relays, []nostr.Filter{filter}) {
+			if latest == nil || event.CreatedAt > latest.CreatedAt {
+				latest = event.Event
+			}
+		}
+		cancel()
+
+		if latest == nil {
+			listSyncFailures.Inc()
+			fmt.Printf("couldn't find list %s\n", address)
+			return nil, false
+		}
+		for _, tag := range latest.Tags.GetAll([]string{"p", ""}) {
+			pubkeys[tag[1]] = true
+		}
+	}
+	return pubkeys, true
+}
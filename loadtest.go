@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// loadResult is what one client saw: how long each accepted event and each
+// query took, and why events weren't accepted.
+type loadResult struct {
+	accepted []time.Duration
+	queries  []time.Duration
+	rejected map[string]int
+	failed   int
+}
+
+// RunLoadTest has clients publish events to the relay at -url and query
+// them back, each over a connection of its own, and reports accept latency
+// and throughput. The clients are new pubkeys, so the relay has to accept
+// their events unpaid, e.g. by pricing them at 0 or running with DRY_RUN.
+//
+// Each client claims an address of its own in X-Forwarded-For, which relays
+// trusting the load tester as a proxy go by, so they're rate limited like
+// separate users: past the per-IP limit, 30 events at once, events are
+// rejected as they would be in production.
+func RunLoadTest(args []string) {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	url := flags.String("url", "", "relay to load, e.g. ws://localhost:3334")
+	clients := flags.Int("clients", 10, "concurrent clients")
+	events := flags.Int("events", 25, "events each client publishes")
+	queries := flags.Int("queries", 10, "queries each client runs once it's done publishing")
+	size := flags.Int("size", 200, "bytes of content per event")
+	flags.Parse(args)
+	if *url == "" {
+		log.Fatal("Usage: loadtest -url <relay> [-clients n] [-events n] [-queries n] [-size bytes]")
+	}
+
+	keys := make([]string, *clients)
+	for i := range keys {
+		keys[i] = nostr.GeneratePrivateKey()
+	}
+
+	results := make([]loadResult, *clients)
+	var wg sync.WaitGroup
+	started := time.Now()
+	for i, sk := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip := fmt.Sprintf("198.18.%d.%d", i/250, 1+i%250)
+			results[i] = runLoadClient(*url, ip, sk, *events, *queries, *size)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	var total loadResult
+	total.rejected = make(map[string]int)
+	for _, result := range results {
+		total.accepted = append(total.accepted, result.accepted...)
+		total.queries = append(total.queries, result.queries...)
+		total.failed += result.failed
+		for reason, count := range result.rejected {
+			total.rejected[reason] += count
+		}
+	}
+
+	rejected := 0
+	for _, count := range total.rejected {
+		rejected += count
+	}
+	fmt.Printf("%d clients, %d events and %d queries in %v\n", *clients, len(total.accepted)+rejected+total.failed, len(total.queries), elapsed.Round(time.Millisecond))
+	fmt.Printf("accepted  %d, %.1f/s\n", len(total.accepted), float64(len(total.accepted))/elapsed.Seconds())
+	fmt.Printf("accept    %s\n", formatLatencies(total.accepted))
+	fmt.Printf("query     %s\n", formatLatencies(total.queries))
+	fmt.Printf("failed    %d\n", total.failed)
+	for reason, count := range total.rejected {
+		fmt.Printf("rejected  %d: %s\n", count, reason)
+	}
+}
+
+func runLoadClient(url string, ip string, sk string, events int, queries int, size int) loadResult {
+	result := loadResult{rejected: make(map[string]int)}
+	ctx := context.Background()
+	pubkey, _ := nostr.GetPublicKey(sk)
+
+	client := nostr.NewRelay(ctx, url)
+	client.RequestHeader = http.Header{"X-Forwarded-For": []string{ip}}
+	if err := client.Connect(ctx); err != nil {
+		result.failed = events
+		return result
+	}
+	defer client.Close()
+
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = 'a' + byte(i%26)
+	}
+	for i := 0; i < events; i++ {
+		event := nostr.Event{
+			CreatedAt: nostr.Now(),
+			Kind:      nostr.KindTextNote,
+			Content:   fmt.Sprintf("%d %s", i, content),
+		}
+		event.Sign(sk)
+
+		publishCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		sent := time.Now()
+		err := client.Publish(publishCtx, event)
+		timedOut := publishCtx.Err() != nil
+		cancel()
+		switch {
+		case err == nil:
+			result.accepted = append(result.accepted, time.Since(sent))
+		case timedOut || !client.IsConnected():
+			result.failed++
+		default:
+			result.rejected[err.Error()]++
+		}
+	}
+
+	for i := 0; i < queries; i++ {
+		queryCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		sent := time.Now()
+		_, err := client.QuerySync(queryCtx, nostr.Filter{Authors: []string{pubkey}, Limit: 50})
+		cancel()
+		if err == nil {
+			result.queries = append(result.queries, time.Since(sent))
+		}
+	}
+	return result
+}
+
+func formatLatencies(latencies []time.Duration) string {
+	if len(latencies) == 0 {
+		return "none"
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	at := func(q float64) time.Duration {
+		return latencies[int(q*float64(len(latencies)-1))].Round(10 * time.Microsecond)
+	}
+	return fmt.Sprintf("p50 %v  p95 %v  p99 %v  max %v", at(0.5), at(0.95), at(0.99), at(1))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"testing"
+)
+
+// The billing path a stored event goes through, step by step, timed against
+// a fresh harness with a topped-up account.
+
+func benchmarkHarness(b *testing.B) (h *Harness, sk string, pubkey string) {
+	b.Helper()
+	h = NewHarness(b)
+
+	sk = nostr.GeneratePrivateKey()
+	pubkey, _ = nostr.GetPublicKey(sk)
+	if err := h.TopUp(pubkey, 1000000); err != nil {
+		b.Fatalf("topping up: %v", err)
+	}
+	// credit the top-up before timing anything
+	GetRemainingUserBalanceMsat(pubkey, h.DB)
+	b.ReportAllocs()
+	return h, sk, pubkey
+}
+
+func benchmarkEvent(sk string, i int) *nostr.Event {
+	event := &nostr.Event{CreatedAt: nostr.Now(), Kind: nostr.KindTextNote, Content: fmt.Sprintf("benchmark %d", i)}
+	event.Sign(sk)
+	return event
+}
+
+func BenchmarkPrice(b *testing.B) {
+	h, sk, pubkey := benchmarkHarness(b)
+	pricer := GetPricer()
+	event, account := benchmarkEvent(sk, 0), GetRecordedBillingAccount(pubkey, h.DB)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pricer.Price(event, account)
+	}
+}
+
+func BenchmarkLedgerBalance(b *testing.B) {
+	h, _, pubkey := benchmarkHarness(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		GetLedgerBalanceMsat(pubkey, h.DB)
+	}
+}
+
+func BenchmarkRecordedBillingAccount(b *testing.B) {
+	h, _, pubkey := benchmarkHarness(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		GetRecordedBillingAccount(pubkey, h.DB)
+	}
+}
+
+func BenchmarkRequireBalance(b *testing.B) {
+	h, sk, _ := benchmarkHarness(b)
+	require := RequireBalance(GetPricer(), h.DB)
+	event := benchmarkEvent(sk, 0)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require(ctx, event)
+	}
+}
+
+func BenchmarkChargeEvent(b *testing.B) {
+	h, sk, _ := benchmarkHarness(b)
+	charge := ChargeEvent(GetPricer(), h.DB)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		event := benchmarkEvent(sk, i)
+		quotePrice(event, event.PubKey, 1000)
+		h.DB.SaveEvent(ctx, event)
+		b.StartTimer()
+		charge(ctx, event)
+	}
+}
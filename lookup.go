@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HandleEventLookup serves /e/<id>, a stored event as JSON, for services
+// that would rather not open a websocket. The id can be hex, a note or an
+// nevent.
+func HandleEventLookup(w http.ResponseWriter, r *http.Request, db Database) {
+	reader, ok := authorizeLookup(w, r, db)
+	if !ok {
+		return
+	}
+	id, err := parseEventID(strings.TrimPrefix(r.URL.Path, "/e/"))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	events := GetVisibleEvents(nostr.Filter{IDs: []string{id}}, reader, db)
+	if len(events) == 0 {
+		WriteJSONError(w, http.StatusNotFound, "event not found")
+		return
+	}
+	WriteJSON(w, http.StatusOK, events[0])
+}
+
+// HandleAuthorLookup serves /p/<npub>, an author's latest stored events as
+// a JSON array. ?kinds=1,30023, ?since=, ?until= and ?limit= (20 by
+// default, at most 100) narrow it down like a filter would.
+func HandleAuthorLookup(w http.ResponseWriter, r *http.Request, db Database) {
+	reader, ok := authorizeLookup(w, r, db)
+	if !ok {
+		return
+	}
+	pubkey, err := ParsePubKey(strings.TrimPrefix(r.URL.Path, "/p/"))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "pubkey must be an npub or hex public key")
+		return
+	}
+
+	filter := nostr.Filter{Authors: []string{pubkey}, Limit: 20}
+	query := r.URL.Query()
+	for _, value := range strings.Split(query.Get("kinds"), ",") {
+		if value == "" {
+			continue
+		}
+		kind, err := strconv.Atoi(value)
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, "kinds must be comma separated numbers")
+			return
+		}
+		filter.Kinds = append(filter.Kinds, kind)
+	}
+	if filter.Since, err = parseTimestampParam(query.Get("since")); err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "since must be a unix timestamp")
+		return
+	}
+	if filter.Until, err = parseTimestampParam(query.Get("until")); err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "until must be a unix timestamp")
+		return
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit <= 0 {
+			WriteJSONError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		filter.Limit = min(filter.Limit, 100)
+	}
+
+	events := GetVisibleEvents(filter, reader, db)
+	if events == nil {
+		events = []*nostr.Event{}
+	}
+	WriteJSON(w, http.StatusOK, events)
+}
+
+// authorizeLookup returns who's reading: the pubkey of a NIP-98
+// Authorization header, if there is one, which also lets follower-only
+// accounts' followers see their events. With PAID_READS it's required, like
+// on the websocket.
+func authorizeLookup(w http.ResponseWriter, r *http.Request, db Database) (string, bool) {
+	var reader string
+	if r.Header.Get("Authorization") != "" {
+		var err error
+		if reader, err = VerifyNIP98(r, nil); err != nil {
+			WriteJSONError(w, http.StatusUnauthorized, err.Error())
+			return "", false
+		}
+	}
+	if paidReads {
+		if reader == "" {
+			WriteJSONError(w, http.StatusUnauthorized, "this relay only serves paying customers: send a NIP-98 Authorization header")
+			return "", false
+		}
+		if !HasReadAccess(reader, db) {
+			WriteJSONError(w, http.StatusPaymentRequired, "top up your balance to read from this relay")
+			return "", false
+		}
+	}
+	return reader, true
+}
+
+func parseEventID(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "note1"), strings.HasPrefix(value, "nevent1"):
+		prefix, decoded, err := nip19.Decode(value)
+		if err != nil {
+			return "", err
+		}
+		if prefix == "note" {
+			return decoded.(string), nil
+		}
+		return decoded.(nostr.EventPointer).ID, nil
+	case nostr.IsValid32ByteHex(value):
+		return value, nil
+	default:
+		return "", errors.New("the event id must be hex, a note or an nevent")
+	}
+}
+
+func parseTimestampParam(value string) (*nostr.Timestamp, error) {
+	if value == "" {
+		return nil, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := nostr.Timestamp(seconds)
+	return &timestamp, nil
+}
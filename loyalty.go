@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"strings"
+)
+
+// LoyaltyTier takes PercentOff off the price of events for accounts that
+// spent at least SpentMsat here, or that first paid at least AgeDays ago.
+type LoyaltyTier struct {
+	SpentMsat  int64
+	AgeDays    int64
+	PercentOff int64
+}
+
+// LoyaltyPricer discounts Inner's prices for long-standing customers. Only
+// the largest discount of the tiers they reach applies.
+type LoyaltyPricer struct {
+	Tiers []LoyaltyTier
+	Inner Pricer
+}
+
+func (p LoyaltyPricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	price, err := p.Inner.Price(event, account)
+	if err != nil {
+		return 0, err
+	}
+	if tier, ok := p.Tier(account); ok {
+		price = price * (100 - tier.PercentOff) / 100
+	}
+	return price, nil
+}
+
+// Tier returns the tier with the largest discount account reaches.
+func (p LoyaltyPricer) Tier(account BillingAccount) (LoyaltyTier, bool) {
+	var best LoyaltyTier
+	found := false
+	for _, tier := range p.Tiers {
+		reached := (tier.SpentMsat > 0 && account.LifetimeSpendMsat >= tier.SpentMsat) ||
+			(tier.AgeDays > 0 && account.AccountAgeDays >= tier.AgeDays)
+		if reached && (!found || tier.PercentOff > best.PercentOff) {
+			best, found = tier, true
+		}
+	}
+	return best, found
+}
+
+// Describe explains the tier in a line.
+func (t LoyaltyTier) Describe() string {
+	if t.SpentMsat > 0 {
+		return fmt.Sprintf("%d%% off once you've spent %s here", t.PercentOff, formatSatsShort(t.SpentMsat))
+	}
+	return fmt.Sprintf("%d%% off once you've been paying for %d days", t.PercentOff, t.AgeDays)
+}
+
+// ParseLoyaltyTiers parses a comma-separated list of tiers:
+//
+//	spent:10000=5    5% off after spending 10000 sats in total
+//	age:365=10       10% off a year after the account's first payment
+func ParseLoyaltyTiers(specs []string) ([]LoyaltyTier, error) {
+	var tiers []LoyaltyTier
+	for _, spec := range specs {
+		name, value, _ := strings.Cut(spec, ":")
+		threshold, percent, found := strings.Cut(value, "=")
+		amount, err := strconv.ParseInt(threshold, 10, 64)
+		off, err2 := strconv.ParseInt(percent, 10, 64)
+		if !found || err != nil || err2 != nil || amount <= 0 || off < 1 || off > 100 {
+			return nil, fmt.Errorf("invalid loyalty tier %q, expected spent:<sats>=<percent> or age:<days>=<percent>", spec)
+		}
+		switch name {
+		case "spent":
+			tiers = append(tiers, LoyaltyTier{SpentMsat: amount * 1000, PercentOff: off})
+		case "age":
+			tiers = append(tiers, LoyaltyTier{AgeDays: amount, PercentOff: off})
+		default:
+			return nil, fmt.Errorf("unknown loyalty tier %q", name)
+		}
+	}
+	return tiers, nil
+}
+
+// GetLifetimeSpendMsat sums what pubkey was ever debited, refunds and gifts
+// aside.
+func GetLifetimeSpendMsat(pubkey string, db Database) int64 {
+	var totalMsat int64
+	err := db.DB.QueryRow(`SELECT COALESCE(SUM(amount_msat), 0) FROM debit WHERE pubkey = ? AND id NOT LIKE 'refund:%' AND id NOT LIKE 'gift:%'`, pubkey).Scan(&totalMsat)
+	if err != nil {
+		ReportError(err, "ledger", map[string]string{"pubkey": pubkey})
+		return 0
+	}
+	return totalMsat
+}
+
+// findLoyaltyPricer finds the LoyaltyPricer under the pricers GetPricer
+// wraps around it.
+func findLoyaltyPricer(pricer Pricer) (LoyaltyPricer, bool) {
+	switch p := pricer.(type) {
+	case LoyaltyPricer:
+		return p, true
+	case PromotionPricer:
+		return findLoyaltyPricer(p.Inner)
+	case ClientPricer:
+		return findLoyaltyPricer(p.Inner)
+	case BotPricer:
+		return findLoyaltyPricer(p.Inner)
+	case *DynamicPricer:
+		return findLoyaltyPricer(p.Inner)
+	}
+	return LoyaltyPricer{}, false
+}
@@ -5,15 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/fiatjaf/eventstore/sqlite3"
 	"github.com/fiatjaf/khatru"
 	"github.com/fiatjaf/khatru/policies"
 	"github.com/joho/godotenv"
 	"github.com/nbd-wtf/go-nostr"
-	decodepay "github.com/nbd-wtf/ln-decodepay"
-	"log"
+	"github.com/nbd-wtf/go-nostr/nip11"
 	"net/http"
-	"regexp"
+	"os"
+	"swarmstr.com/ppe-relay/ppe"
 	"time"
 )
 
@@ -37,10 +36,12 @@ var (
 		"wss://relay.nostr.band",
 		"wss://relay.primal.net",
 	}
-	botPubkey string
-	relay     = khatru.NewRelay()
-	pool      = nostr.NewSimplePool(context.Background())
-	port      = 3456
+	botPubkey   string
+	nip05Domain string
+	nip05Price  int64
+	relay       = khatru.NewRelay()
+	pool        = nostr.NewSimplePool(context.Background())
+	port        = 3456
 )
 
 func main() {
@@ -49,47 +50,380 @@ func main() {
 	relay.Info.Description = "Pay-Per-Event Relay."
 
 	godotenv.Load(".env")
+	ConfigureErrorReporting()
+	defer FlushErrorReports()
 	botPubkey, _ = nostr.GetPublicKey(GetEnv("BOT_PRIVATE_KEY"))
 
-	db := sqlite3.SQLite3Backend{DatabaseURL: "./db/db"}
-	if err := db.Init(); err != nil {
+	maxFilterLimit := GetEnvInt("MAX_FILTER_LIMIT", 500)
+
+	db, err := OpenDatabase(GetEnvDefault("DATABASE_URL", "./db/db"), maxFilterLimit)
+	if err != nil {
+		panic(err)
+	}
+	if err := CreateTables(db.DB); err != nil {
+		panic(err)
+	}
+	if err := ConfigureColdStorage(); err != nil {
 		panic(err)
 	}
 
+	dryRun = GetEnvDefault("DRY_RUN", "") == "true"
+	if len(os.Args) > 1 && os.Args[1] == "--dry-run" {
+		dryRun = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	if len(os.Args) > 1 {
+		RunCommand(os.Args[1], os.Args[2:], db)
+		return
+	}
+
+	ConfigureRelay(db)
+
+	fmt.Printf("Running on :%v", port)
+
+	// read usage is counted by every instance; the rest runs on one of the
+	// instances sharing the database at a time
+	Supervise("read usage flusher", func() { RunReadUsageFlusher(db) })
+	if isStandby() {
+		// until it's promoted, a standby's ledger and outbound publishes
+		// are its primary's
+		Supervise("replication", Exclusively("replication", db, func() { RunReplicationFollower(db) }))
+	} else {
+		Supervise("bot", Exclusively("bot", db, func() { HandleBotCommands(db) }))
+		Supervise("zap verifier", Exclusively("zap verifier", db, func() { RunZapVerifier(db) }))
+		Supervise("zap indexer", Exclusively("zap indexer", db, func() { WatchZapReceipts(db) }))
+		Supervise("outbound queue", Exclusively("outbound queue", db, func() { RunOutboundQueue(db) }))
+		if GetEnvDefault("REVENUE_REPORT_DM", "") == "true" {
+			Supervise("revenue reporter", Exclusively("revenue reporter", db, func() { RunRevenueReporter(db) }))
+		}
+		if interval := GetEnvDuration("STATE_ROOT_INTERVAL", 0); interval > 0 {
+			Supervise("state roots", Exclusively("state roots", db, func() { RunStateRootPublisher(interval, db) }))
+		}
+	}
+	Supervise("ip retention", Exclusively("ip retention", db, func() { RunIPRetention(db) }))
+	Supervise("stats aggregator", Exclusively("stats aggregator", db, func() { RunStatsAggregator(db) }))
+	if interval := GetEnvDuration("MAINTENANCE_INTERVAL", 24*time.Hour); interval > 0 {
+		Supervise("database maintenance", Exclusively("database maintenance", db, func() { RunMaintenance(interval, db) }))
+	}
+	if coldStorage != nil {
+		Supervise("cold storage", Exclusively("cold storage", db, func() { RunColdStorageMover(db) }))
+	}
+	if replicationEnabled {
+		Supervise("replication log pruner", Exclusively("replication log pruner", db, func() { RunReplicationLogPruner(db) }))
+	}
+
+	StartHiddenServices(RecoverHTTP(ServeBranding(relay)))
+	listener, err := Listen(fmt.Sprintf(":%v", port))
+	if err != nil {
+		panic(err)
+	}
+	http.Serve(listener, ServeClientIP(RecoverHTTP(ServeBranding(relay))))
+}
+
+// ConfigureRelay installs the billing policies, storage and HTTP routes on the
+// global relay.
+func ConfigureRelay(db Database) {
+	ConfigureIPHashing()
+	if err := ConfigureSharedState(); err != nil {
+		panic(err)
+	}
+	if err := ConfigureClientIP(); err != nil {
+		panic(err)
+	}
+	if err := ConfigureHiddenServices(); err != nil {
+		panic(err)
+	}
+	kinds := []uint16{1, 30023}
+	for _, kind := range GetAppDataKinds() {
+		kinds = append(kinds, uint16(kind))
+	}
+	if GetEnvDefault("ESCROW_REPORTS", "") == "true" {
+		kinds = append(kinds, 1984)
+		relay.OnEventSaved = append(relay.OnEventSaved, HoldReportedEvents(db))
+	}
+	if followersOnly = GetEnvDefault("FOLLOWERS_ONLY", "") == "true"; followersOnly {
+		// follower-only accounts are checked against their kind 3 here
+		kinds = append(kinds, 3)
+	}
+	escrowRefundOnTakedown = GetEnvDefault("ESCROW_REFUND_ON_TAKEDOWN", "true") == "true"
+	relay.MaxMessageSize = int64(GetEnvInt("WEBSOCKET_MAX_MESSAGE_SIZE", 512000))
+	if err := ConfigureCompression(); err != nil {
+		panic(err)
+	}
+	relay.RejectEvent = append(relay.RejectEvent, ValidateEvent(GetEventValidation()))
+	if maxEventAge = GetEnvDuration("EVENT_MAX_AGE", 365*24*time.Hour); backfillEnabled() {
+		backfillPermitPrice = int64(GetEnvInt("BACKFILL_PERMIT_SATS", 1000))
+		backfillPermitDuration = GetEnvDuration("BACKFILL_PERMIT_DURATION", 24*time.Hour)
+		relay.RejectEvent = append(relay.RejectEvent, RejectOldEvents(db))
+	}
+	if maxEventSize := GetEnvInt("MAX_EVENT_SIZE", 131072); maxEventSize > 0 {
+		relay.RejectEvent = append(relay.RejectEvent, MaxEventSize(maxEventSize))
+	}
+	if quota := GetEnvInt("STORAGE_QUOTA_MB", 0); quota > 0 {
+		relay.RejectEvent = append(relay.RejectEvent, RequireStorageQuota(int64(quota)<<20, db))
+	}
 	relay.RejectEvent = append(relay.RejectEvent,
-		policies.RejectEventsWithBase64Media,
-		policies.EventIPRateLimiter(5, time.Minute*1, 30),
-		policies.RestrictToSpecifiedKinds([]uint16{1, 30023}...),
+		WithRejectionCode(RejectBlocked, policies.RejectEventsWithBase64Media),
+		EventIPRateLimiter(5, time.Minute*1, 30),
+		WithRejectionCode(RejectBlocked, policies.RestrictToSpecifiedKinds(kinds...)),
+		RejectInvalidDelegation,
 	)
+	if blocked := GetEnvList("BLOCKED_CLIENTS", nil); len(blocked) > 0 {
+		relay.RejectEvent = append(relay.RejectEvent, RejectClients(blocked))
+	}
+	relay.OnEventSaved = append(relay.OnEventSaved, TrackClientUsage(db))
+	if err := ConfigureLists(); err != nil {
+		panic(err)
+	}
+	ConfigureStorageWatchdog(db)
 
 	relay.RejectFilter = append(relay.RejectFilter,
-		policies.NoEmptyFilters,
-		policies.NoComplexFilters,
+		WithRejectionCode(RejectInvalid, policies.NoEmptyFilters),
+		WithRejectionCode(RejectInvalid, policies.NoComplexFilters),
 	)
 
+	if maxFilterLimit := GetEnvInt("MAX_FILTER_LIMIT", 500); maxFilterLimit > 0 {
+		relay.RejectFilter = append(relay.RejectFilter, MaxFilterLimit(maxFilterLimit))
+	}
+	if maxFilterSpan := GetEnvDuration("MAX_FILTER_SPAN", 0); maxFilterSpan > 0 {
+		relay.RejectFilter = append(relay.RejectFilter, MaxFilterTimeSpan(maxFilterSpan))
+	}
+	if maxFilterAuthors := GetEnvInt("MAX_FILTER_AUTHORS", 500); maxFilterAuthors > 0 {
+		relay.RejectFilter = append(relay.RejectFilter, MaxFilterAuthors(maxFilterAuthors))
+	}
+	if maxFilterIDs := GetEnvInt("MAX_FILTER_IDS", 500); maxFilterIDs > 0 {
+		relay.RejectFilter = append(relay.RejectFilter, MaxFilterIDs(maxFilterIDs))
+	}
+	if maxFilterSize := GetEnvInt("MAX_FILTER_SIZE", 0); maxFilterSize > 0 {
+		relay.RejectFilter = append(relay.RejectFilter, MaxFilterSize(maxFilterSize))
+		relay.RejectCountFilter = append(relay.RejectCountFilter, MaxFilterSize(maxFilterSize))
+	}
+	relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation, func(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+		if info.Limitation == nil {
+			info.Limitation = &nip11.RelayLimitationDocument{}
+		}
+		info.Limitation.MaxMessageLength = int(relay.MaxMessageSize)
+		return info
+	})
+
+	var greylist *Greylist
+	if GetEnvDefault("GREYLIST", "") == "true" {
+		var err error
+		if greylist, err = ConfigureGreylist(); err != nil {
+			panic(err)
+		}
+		relay.RejectFilter = append(relay.RejectFilter, greylist.RejectFilter)
+		relay.RejectCountFilter = append(relay.RejectCountFilter, greylist.RejectFilter)
+	}
+	if paidReads = GetEnvDefault("PAID_READS", "") == "true"; paidReads {
+		relay.RejectFilter = append(relay.RejectFilter, RequirePaidReads(db))
+		relay.RejectCountFilter = append(relay.RejectCountFilter, RequirePaidReads(db))
+		relay.PreventBroadcast = append(relay.PreventBroadcast, PreventUnpaidBroadcast(db))
+		relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation, func(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+			if info.Limitation == nil {
+				info.Limitation = &nip11.RelayLimitationDocument{}
+			}
+			info.Limitation.AuthRequired = true
+			return info
+		})
+	}
+
 	relay.RejectConnection = append(relay.RejectConnection,
-		policies.ConnectionRateLimiter(10, time.Minute*2, 30),
+		ConnectionIPRateLimiter(10, time.Minute*2, 30),
 	)
+	if geoIPPolicy, err := ConfigureGeoIP(); err != nil {
+		panic(err)
+	} else if geoIPPolicy != nil {
+		relay.RejectConnection = append(relay.RejectConnection, geoIPPolicy.RejectConnection)
+	}
 
-	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
-		userPaidAmount := GetZapsTotalFromUser(event.PubKey)
-		userNotesCount := GetStoredEventsCountFromUser(event.PubKey, db)
+	relay.RejectEvent = append(relay.RejectEvent,
+		ReputationRateLimiter(5, time.Minute*1, 30, db),
+	)
+	if threshold := GetEnvInt("REPUTATION_SHADOWBAN_BELOW", 0); threshold > 0 {
+		relay.RejectEvent = append(relay.RejectEvent, ShadowBanLowReputation(float64(threshold), db))
+	}
+
+	if trialConfig := GetTrialConfig(); trialConfig.Credits > 0 {
+		relay.RejectEvent = append(relay.RejectEvent, GrantTrialCredits(trialConfig, db))
+	}
 
-		if userPaidAmount < (userNotesCount + 1) {
-			return true, "no sufficient balance; top up"
+	eventPackages = GetEventPackages()
+	referralConfig = GetReferralConfig()
+	pricer := GetPricer()
+	ConfigureBackfillImports(pricer)
+	if dryRun {
+		fmt.Println("Dry run: billing decisions are logged, not enforced")
+		relay.OnEventSaved = append(relay.OnEventSaved, LogSimulatedCharge(pricer, db))
+		relay.RejectEvent = append(relay.RejectEvent, SimulateBilling(RequireBalance(pricer, db)))
+	} else if err := ppe.Attach(context.Background(), relay, GetBillingConfig(pricer, db)); err != nil {
+		panic(err)
+	}
+	if !dryRun {
+		relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation, AdvertiseFees(pricer))
+	}
+	if classifier := GetSpamClassifier(); classifier != nil {
+		relay.RejectEvent = append(relay.RejectEvent, RejectSpam(classifier,
+			float64(GetEnvInt("SPAM_TRUSTED_REPUTATION", 70)), GetEnvInt("SPAM_FLAG_SCORE", 60), GetEnvInt("SPAM_REJECT_SCORE", 90), db))
+	}
+	for _, script := range GetPolicyScripts() {
+		if script.reject != nil {
+			relay.RejectEvent = append(relay.RejectEvent, RejectWithScript(script, db))
 		}
-		return false, ""
-	})
+	}
+	for _, module := range GetPolicyModules() {
+		if module.reject {
+			relay.RejectEvent = append(relay.RejectEvent, RejectWithModule(module, db))
+		}
+	}
+	if hook := GetPolicyHook(); hook != nil {
+		relay.RejectEvent = append(relay.RejectEvent, RejectWithHook(hook, db))
+	}
+	for _, plugin := range GetEventPlugins() {
+		relay.RejectEvent = append(relay.RejectEvent, plugin.RejectEvent)
+	}
 
-	relay.StoreEvent = append(relay.StoreEvent, db.SaveEvent)
-	relay.QueryEvents = append(relay.QueryEvents, db.QueryEvents)
-	relay.DeleteEvent = append(relay.DeleteEvent, db.DeleteEvent)
+	// must come after every other RejectEvent policy; duplicates skip all of
+	// them and aren't counted as rejections
+	relay.RejectEvent = []func(ctx context.Context, event *nostr.Event) (reject bool, msg string){SkipStoredDuplicates(RecordRejections(relay.RejectEvent, db), db)}
 
-	fmt.Printf("Running on :%v", port)
+	if err := LoadShadowBans(db); err != nil {
+		panic(err)
+	}
+	if err := LoadBotSuspects(db); err != nil {
+		panic(err)
+	}
+	if err := LoadBillingExemptions(db); err != nil {
+		panic(err)
+	}
+	if GetEnvDefault("BOT_DETECTION", "") == "true" {
+		botFlagScore = GetEnvInt("BOT_FLAG_SCORE", 60)
+		relay.OnEventSaved = append(relay.OnEventSaved, DetectBots(db))
+		Supervise("bot activity pruner", RunBotActivityPruner)
+	}
+	relay.PreventBroadcast = append(relay.PreventBroadcast, PreventShadowBannedBroadcast)
+
+	// enforced even with FOLLOWERS_ONLY off, so turning it off doesn't expose
+	// accounts that were made private
+	if err := LoadPrivateAccounts(db); err != nil {
+		panic(err)
+	}
+	relay.PreventBroadcast = append(relay.PreventBroadcast, PreventNonFollowerBroadcast(db))
+	relay.OnEventSaved = append(relay.OnEventSaved, ForgetFollowList)
 
-	go HandleBotCommands(db)
+	ConfigureWebhooks()
+
+	if err := ConfigurePush(db); err != nil {
+		panic(err)
+	}
+
+	billingReceipts = GetEnvDefault("BILLING_RECEIPTS", "") == "true"
+	balanceInOK = GetEnvDefault("BALANCE_IN_OK", "") == "true"
+	relay.OnConnect = append(relay.OnConnect, InterceptOKMessages)
+	botSessionTTL = GetEnvDuration("BOT_SESSION_TTL", 10*time.Minute)
+	refundsEnabled = GetEnvDefault("REFUNDS", "") == "true"
+	lowBalanceWarning = int64(GetEnvInt("LOW_BALANCE_WARNING", 0))
+	dedupWindow = GetEnvDuration("DEDUP_WINDOW", 10*time.Minute)
+	cursorOverlap = GetEnvDuration("SUBSCRIPTION_CURSOR_OVERLAP", 10*time.Minute)
+	spendLimitCooldown = GetEnvDuration("SPEND_LIMIT_COOLDOWN", 24*time.Hour)
+	seenEvents = NewSeenCache(GetEnvInt("SEEN_CACHE_SIZE", 10000))
+	ConfigureInvoiceCache(GetEnvInt("INVOICE_CACHE_SIZE", 10000))
+	if err := LoadNotificationPreferences(db); err != nil {
+		panic(err)
+	}
+	if err := ConfigureEncryption(); err != nil {
+		panic(err)
+	}
+	relay.PreventBroadcast = append(relay.PreventBroadcast, PreventProtectedBroadcast)
+	if err := EnsureStorageUsage(db); err != nil {
+		ReportError(err, "storage", nil)
+	}
+	if err := ConfigureReplication(db); err != nil {
+		panic(err)
+	}
+	relay.StoreEvent = append(relay.StoreEvent, EncryptAtRest(ReplicateSaves(TrackStorageSaves(db.SaveEvent, db), db)))
+	relay.DeleteEvent = append(relay.DeleteEvent, RefundUnpricedEvent(db), UnpinDeletedEvent(db), TrackStorageDeletes(coldStorage.WrapDelete(db.DeleteEvent), db))
+	if replicationEnabled {
+		relay.DeleteEvent = append(relay.DeleteEvent, ReplicateDeletes(db))
+	}
 
-	http.ListenAndServe(fmt.Sprintf(":%v", port), relay)
+	storedEvents := coldStorage.Wrap(db.QueryEvents)
+	if threshold := GetEnvDuration("SLOW_QUERY_THRESHOLD", 500*time.Millisecond); threshold > 0 {
+		storedEvents = LogSlowQueries(threshold, storedEvents)
+	}
+	rewriter := NewFilterRewriter(GetEnvInt("DEFAULT_FILTER_LIMIT", 100), GetEnvDuration("FILTER_WINDOW", 24*time.Hour))
+	// instances sharing a postgres database only hear of each other's
+	// events through Redis, so without it the cache is off unless asked for
+	defaultCacheSize := 1000
+	if db.DB.DriverName() != "sqlite3" && sharedState == nil {
+		defaultCacheSize = 0
+	}
+	if cacheSize := GetEnvInt("QUERY_CACHE_SIZE", defaultCacheSize); cacheSize > 0 {
+		queryCache := NewQueryCache(cacheSize, GetEnvDuration("QUERY_CACHE_TTL", 30*time.Second))
+		relay.QueryEvents = append(relay.QueryEvents, TrackReadUsage(HideShadowBanned(HideFromNonFollowers(DecryptAtRest(greylist.Wrap(rewriter.Wrap(queryCache.Wrap(storedEvents)))), db))))
+		relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
+			queryCache.Invalidate(event)
+		})
+		relay.DeleteEvent = append(relay.DeleteEvent, func(ctx context.Context, event *nostr.Event) error {
+			queryCache.Invalidate(event)
+			return nil
+		})
+	} else {
+		relay.QueryEvents = append(relay.QueryEvents, TrackReadUsage(HideShadowBanned(HideFromNonFollowers(DecryptAtRest(greylist.Wrap(rewriter.Wrap(storedEvents))), db))))
+	}
+
+	ConfigureBranding()
+	relay.Router().HandleFunc("/metrics", HandleMetrics)
+	relay.Router().HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		HandlePublicStats(w, r, db)
+	})
+	relay.Router().HandleFunc("/a/", func(w http.ResponseWriter, r *http.Request) {
+		HandleArticle(w, r, db)
+	})
+	relay.Router().HandleFunc("/feed/", func(w http.ResponseWriter, r *http.Request) {
+		HandleFeed(w, r, db)
+	})
+	relay.Router().HandleFunc("/e/", APIEndpoint(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		HandleEventLookup(w, r, db)
+	}))
+	relay.Router().HandleFunc("/p/", APIEndpoint(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		HandleAuthorLookup(w, r, db)
+	}))
+	RegisterAdminRoutes(relay.Router(), db)
+
+	if token := GetEnvDefault("FIREHOSE_TOKEN", ""); token != "" {
+		relay.OnEventSaved = append(relay.OnEventSaved, BroadcastToFirehose)
+		relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, BroadcastToFirehose)
+		relay.Router().HandleFunc("/firehose", AdminOnly(token, HandleFirehose))
+	}
+
+	nip05Domain = GetEnvDefault("NIP05_DOMAIN", "")
+	nip05Price = int64(GetEnvInt("NIP05_PRICE", 1000))
+	relay.Router().HandleFunc("/.well-known/nostr.json", func(w http.ResponseWriter, r *http.Request) {
+		HandleNostrJSON(w, r, db)
+	})
+	ConfigurePinning()
+
+	if address := GetEnvDefault("LIGHTNING_ADDRESS", ""); address != "" {
+		paymentBackend = &LNURLPayBackend{Address: address, ZapRequest: NewTopUpZapRequest}
+		relay.Router().HandleFunc("/invoice", HandleInvoice)
+		relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation, func(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+			info.PaymentsURL = relay.ServiceURL + "/invoice"
+			if info.Limitation == nil {
+				info.Limitation = &nip11.RelayLimitationDocument{}
+			}
+			info.Limitation.PaymentRequired = !dryRun
+			info.Limitation.RestrictedWrites = !dryRun
+			return info
+		})
+	}
+	RegisterAPIRoutes(relay.Router(), pricer, db)
+
+	// last, so it wraps every store and runs after every hook
+	if err := ConfigureJournal(); err != nil {
+		panic(err)
+	}
 }
 
 func GetZapEventsFromUser(pubkey string) map[string]*nostr.Event {
@@ -108,104 +442,138 @@ func GetZapEventsFromUser(pubkey string) map[string]*nostr.Event {
 		zapRequest, err := GetZapRequestFromZapEvent(event.Event)
 		if err != nil {
 			continue
-		} else if zapRequest.PubKey == pubkey {
+		} else if GetZapBeneficiary(zapRequest) == pubkey {
 			events[event.ID] = event.Event
 		}
 	}
 	return events
 }
 
+// GetZapRequestFromZapEvent parses the zap request in a receipt's
+// description tag, which must at least look like one. Its signature is left
+// to whoever depends on it, see ZapRequestEvent.
 func GetZapRequestFromZapEvent(event *nostr.Event) (*Description, error) {
-	var descriptionJSON string
-	for _, tag := range event.Tags {
-		if len(tag) > 1 && tag[0] == "description" {
-			descriptionJSON = tag[1]
-			break
-		}
-	}
-
-	if descriptionJSON == "" {
+	descriptionJSON, err := ValueFromTag(event, "description")
+	if err != nil {
 		return nil, errors.New("description tag not found")
 	}
 
 	var description Description
-	err := json.Unmarshal([]byte(descriptionJSON), &description)
-	if err != nil {
-		fmt.Printf("Error parsing description: %v\n", err)
+	if err := json.Unmarshal([]byte(*descriptionJSON), &description); err != nil {
 		return nil, fmt.Errorf("error parsing description: %v", err)
 	}
+	if description.Kind != nostr.KindZapRequest {
+		return nil, fmt.Errorf("description is a kind %d event, not a zap request", description.Kind)
+	}
+	if !nostr.IsValidPublicKey(description.PubKey) {
+		return nil, errors.New("description has an invalid pubkey")
+	}
 	return &description, nil
 }
 
-func GetZapsTotalFromUser(pubkey string) int64 {
-	zapEvents := GetZapEventsFromUser(pubkey)
-
-	total := int64(0)
-
-	for _, event := range zapEvents {
-		bolt11, err := ValueFromTag(event, "bolt11")
-		if err != nil {
-			continue
-		} else if bolt11 != nil {
-			decoded, err := decodepay.Decodepay(*bolt11)
-			if err != nil {
-				continue
-			} else {
-				total += decoded.MSatoshi
-			}
-		}
+// ZapRequestEvent turns a parsed zap request back into the event it was, to
+// check its signature.
+func ZapRequestEvent(zapRequest *Description) nostr.Event {
+	request := nostr.Event{
+		ID:        zapRequest.ID,
+		PubKey:    zapRequest.PubKey,
+		CreatedAt: nostr.Timestamp(zapRequest.CreatedAt),
+		Kind:      zapRequest.Kind,
+		Content:   zapRequest.Content,
+		Sig:       zapRequest.Sig,
 	}
-	return total / 1000
+	for _, tag := range zapRequest.Tags {
+		request.Tags = append(request.Tags, tag)
+	}
+	return request
 }
 
-func GetStoredEventsCountFromUser(pubkey string, db sqlite3.SQLite3Backend) int64 {
-	ctx := context.Background()
+func GetZapsTotalFromUser(pubkey string, db Database) int64 {
+	zapEvents := GetZapEventsFromUser(pubkey)
 
-	filter := nostr.Filter{
-		Authors: []string{pubkey},
+	for _, event := range zapEvents {
+		CreditZapEvent(event, db)
 	}
+	return GetCreditedTotalFromUser(pubkey, db)
+}
 
-	iCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+func GetRemainingUserBalance(pubkey string, db Database) int64 {
+	return GetRemainingUserBalanceMsat(pubkey, db) / 1000
+}
 
-	count, err := db.CountEvents(iCtx, filter)
-	if err != nil {
-		log.Fatalf("Failed to query events: %v", err)
+func GetRemainingUserBalanceMsat(pubkey string, db Database) int64 {
+	// pools are funded by zaps credited as their senders' are looked up
+	if isPoolAccount(pubkey) {
+		return GetLedgerBalanceMsat(pubkey, db)
 	}
-	return count
+	GetZapsTotalFromUser(pubkey, db)
+	return GetLedgerBalanceMsat(pubkey, db)
 }
 
-func GetRemainingUserBalance(pubkey string, db sqlite3.SQLite3Backend) int64 {
-	userPaidAmount := GetZapsTotalFromUser(pubkey)
-	userNotesCount := GetStoredEventsCountFromUser(pubkey, db)
+// GetLedgerBalanceMsat is the balance as currently recorded, without looking
+// upstream for new zaps first.
+func GetLedgerBalanceMsat(pubkey string, db Database) int64 {
+	userPaidAmount := GetCreditedMsatFromUser(pubkey, db)
+	userUnpricedCount := GetUnpricedEventsCountFromUser(pubkey, db)
+	userDebitedAmount := GetDebitedMsatFromUser(pubkey, db)
 
-	remainingBalance := userPaidAmount - userNotesCount
+	remainingBalance := userPaidAmount - userUnpricedCount*1000 - userDebitedAmount
 	return remainingBalance
 }
 
-func HandleBotCommands(db sqlite3.SQLite3Backend) {
+// HandleBotCommands answers mentions of the bot, resuming after the last one
+// it handled. The first time it goes through every mention upstream still
+// has; BotCommandFulfilled skips the ones that were already answered.
+func HandleBotCommands(db Database) {
 	ctx := context.Background()
 
+	cursor := NewSubscriptionCursor("bot commands", 0, db)
+	defer cursor.Flush()
+
 	tags := make(nostr.TagMap)
 	tags["p"] = []string{botPubkey}
 	filter := nostr.Filter{
 		Kinds: []int{nostr.KindTextNote},
 		Tags:  tags,
+		Since: cursor.Since(),
 	}
 
 	for event := range pool.SubMany(ctx, relays, []nostr.Filter{filter}) {
-		if !BotCommandFulfilled(event.ID) {
-			balanceRequest, _ := regexp.MatchString(`(?mi)\bbalance\b`, event.Content)
-			if balanceRequest {
-				userBalance := GetRemainingUserBalance(event.PubKey, db)
-				response := fmt.Sprintf("Your balance is %v sats.", userBalance)
-
-				PublishCommandResponseEvent(event.Event, response)
-			}
+		if !seenEvents.Seen(event.ID) {
+			HandleBotCommand(event.Event, event.Relay.URL, db)
 		}
+		cursor.Advance(event.CreatedAt)
 	}
 }
 
+// HandleBotCommand answers a single mention seen on relayURL. A panic here is
+// reported and the event skipped so one malformed note can't take down the
+// whole loop.
+func HandleBotCommand(event *nostr.Event, relayURL string, db Database) {
+	defer RecoverPanic("bot", map[string]string{"event": event.ID})
+
+	if BotCommandFulfilled(event.ID) {
+		return
+	}
+
+	// while a session is open the user's next note answers it, whether or not
+	// it addresses the bot like a command would
+	session, err := GetBotSession(event.PubKey, db)
+	if err != nil {
+		ReportError(err, "sessions", map[string]string{"pubkey": event.PubKey})
+	}
+	if session != nil {
+		PublishCommandResponseEvent(event, relayURL, ContinueBotSession(event, session, db), db)
+		return
+	}
+
+	command, ok := ParseBotCommand(event)
+	if !ok {
+		return
+	}
+	PublishCommandResponseEvent(event, relayURL, RunBotCommand(event, command, db), db)
+}
+
 func BotCommandFulfilled(ID string) bool {
 	ctx := context.Background()
 
@@ -223,29 +591,15 @@ func BotCommandFulfilled(ID string) bool {
 	return false
 }
 
-func PublishCommandResponseEvent(ev *nostr.Event, content string) {
+func PublishCommandResponseEvent(ev *nostr.Event, relayURL string, content string, db Database) {
 	event := nostr.Event{
 		PubKey:    botPubkey,
 		CreatedAt: nostr.Now(),
 		Kind:      nostr.KindTextNote,
 		Content:   content,
-		Tags:      []nostr.Tag{[]string{"e", ev.ID}, []string{"p", ev.PubKey}},
+		Tags:      ReplyTags(ev, relayURL),
 	}
 	event.Sign(GetEnv("BOT_PRIVATE_KEY"))
 
-	ctx := context.Background()
-
-	for _, url := range relays {
-		relay, err := nostr.RelayConnect(ctx, url)
-		if err != nil {
-			fmt.Println(err)
-			continue
-		}
-		if err := relay.Publish(ctx, event); err != nil {
-			fmt.Println(err)
-			continue
-		}
-
-		fmt.Printf("published to %s\n", url)
-	}
+	PublishBotEventWithRetry(event, db)
 }
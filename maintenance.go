@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	maintenanceLastSuccess = NewGaugeVec("ppe_db_maintenance_last_success_timestamp", "When each database maintenance task last succeeded, in Unix seconds.", "task")
+	maintenanceDuration    = NewGaugeVec("ppe_db_maintenance_duration_milliseconds", "How long each database maintenance task took the last time it ran.", "task")
+	maintenanceFailures    = NewCounterVec("ppe_db_maintenance_failures_total", "Database maintenance tasks that failed, including integrity checks that found problems.", "task")
+	integrityProblems      = NewGaugeVec("ppe_db_integrity_problems", "Problems the last integrity check found, 0 when the database is healthy.", "database")
+	databasePages          = NewGaugeVec("ppe_db_pages", "Pages in the sqlite database, in use and free.", "state")
+)
+
+// RunMaintenance checks and tidies the database every interval, starting
+// at startup.
+func RunMaintenance(interval time.Duration, db Database) {
+	for {
+		MaintainDatabase(db)
+		time.Sleep(interval)
+	}
+}
+
+// MaintainDatabase runs sqlite's integrity_check, hands free pages back with
+// an incremental vacuum and refreshes the query planner's statistics with
+// ANALYZE. Postgres vacuums itself and has no integrity check, so there it's
+// only ANALYZE.
+//
+// Incremental vacuums need auto_vacuum=INCREMENTAL, which a database created
+// without it only switches to after a full VACUUM: the first run on such a
+// database does one, blocking writes while it rewrites the file.
+func MaintainDatabase(db Database) {
+	if db.DB.DriverName() == "sqlite3" {
+		maintenanceTask("integrity_check", func() error {
+			var results []string
+			if err := db.DB.Select(&results, `PRAGMA integrity_check`); err != nil {
+				return err
+			}
+			problems := 0
+			if len(results) != 1 || results[0] != "ok" {
+				problems = len(results)
+			}
+			integrityProblems.Set("main", int64(problems))
+			if problems > 0 {
+				return fmt.Errorf("integrity check found %d problems: %s", problems, strings.Join(results, "; "))
+			}
+			return nil
+		})
+
+		maintenanceTask("incremental_vacuum", func() error {
+			// the auto_vacuum setting only sticks for the VACUUM run on the
+			// same connection
+			conn, err := db.DB.Connx(context.Background())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			var mode int
+			if err := conn.GetContext(context.Background(), &mode, `PRAGMA auto_vacuum`); err != nil {
+				return err
+			}
+			// 2 is INCREMENTAL
+			if mode != 2 {
+				fmt.Println("switching the database to incremental vacuums, this takes a full VACUUM")
+				if _, err := conn.ExecContext(context.Background(), `PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+					return err
+				}
+				if _, err := conn.ExecContext(context.Background(), `VACUUM`); err != nil {
+					return err
+				}
+			}
+			// it frees a page per step, so it's queried to the end rather
+			// than executed
+			rows, err := conn.QueryContext(context.Background(), `PRAGMA incremental_vacuum`)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			var pages, free int64
+			if err := conn.GetContext(context.Background(), &pages, `PRAGMA page_count`); err != nil {
+				return err
+			}
+			if err := conn.GetContext(context.Background(), &free, `PRAGMA freelist_count`); err != nil {
+				return err
+			}
+			databasePages.Set("used", pages-free)
+			databasePages.Set("free", free)
+			return nil
+		})
+	}
+
+	maintenanceTask("analyze", func() error {
+		_, err := db.DB.Exec(`ANALYZE`)
+		return err
+	})
+}
+
+func maintenanceTask(name string, task func() error) {
+	start := time.Now()
+	err := task()
+	maintenanceDuration.Set(name, time.Since(start).Milliseconds())
+	if err != nil {
+		maintenanceFailures.Inc(name)
+		ReportError(err, "maintenance", map[string]string{"task": name})
+		return
+	}
+	maintenanceLastSuccess.Set(name, time.Now().Unix())
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+var (
+	markdownHeading   = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	markdownListItem  = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+(.*)$`)
+	markdownRule      = regexp.MustCompile(`^\s*([-*_])(\s*[-*_]){2,}\s*$`)
+	markdownImage     = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	markdownLink      = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	markdownBold      = regexp.MustCompile(`(\*\*|__)(\S(?:.*?\S)?)(\*\*|__)`)
+	markdownItalic    = regexp.MustCompile(`(^|[^\w*])[*_](\S(?:[^*_]*?\S)?)[*_]`)
+	markdownBareURL   = regexp.MustCompile(`(^|[\s(])(https?://[^\s<]+[^\s<.,;:!?)"'])`)
+	markdownNostrLink = regexp.MustCompile(`nostr:((?:npub|nprofile|note|nevent|naddr)1[02-9ac-hj-np-z]+)`)
+	htmlTag           = regexp.MustCompile(`<[^>]*>`)
+)
+
+// RenderMarkdown renders the markdown long-form articles are written in:
+// headings, paragraphs, lists, quotes, code, rules, emphasis, links and
+// images. Everything is escaped before it's formatted and only http(s)
+// links are kept, so an article can't inject markup.
+func RenderMarkdown(text string) template.HTML {
+	var out strings.Builder
+	var paragraph []string
+	var listTag string
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + renderMarkdownInline(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if listTag != "" {
+			out.WriteString("</" + listTag + ">\n")
+			listTag = ""
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flushParagraph()
+			closeList()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case trimmed == "":
+			flushParagraph()
+			closeList()
+		case markdownHeading.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			match := markdownHeading.FindStringSubmatch(trimmed)
+			level := string(rune('0' + len(match[1])))
+			out.WriteString("<h" + level + ">" + renderMarkdownInline(match[2]) + "</h" + level + ">\n")
+		case markdownRule.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			out.WriteString("<hr>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flushParagraph()
+			closeList()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">"), " "))
+			}
+			i--
+			out.WriteString("<blockquote>\n" + string(RenderMarkdown(strings.Join(quote, "\n"))) + "</blockquote>\n")
+		case markdownListItem.MatchString(line):
+			flushParagraph()
+			match := markdownListItem.FindStringSubmatch(line)
+			tag := "ul"
+			if match[1][0] >= '0' && match[1][0] <= '9' {
+				tag = "ol"
+			}
+			if tag != listTag {
+				closeList()
+				out.WriteString("<" + tag + ">\n")
+				listTag = tag
+			}
+			out.WriteString("<li>" + renderMarkdownInline(match[2]) + "</li>\n")
+		default:
+			closeList()
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flushParagraph()
+	closeList()
+	return template.HTML(out.String())
+}
+
+// renderMarkdownInline formats a line's emphasis, links and code spans.
+// Code spans are split out first so nothing inside them is formatted.
+func renderMarkdownInline(text string) string {
+	var out strings.Builder
+	for i, part := range strings.Split(text, "`") {
+		if i%2 == 1 {
+			out.WriteString("<code>" + html.EscapeString(part) + "</code>")
+			continue
+		}
+		part = html.EscapeString(part)
+		part = markdownImage.ReplaceAllStringFunc(part, func(match string) string {
+			groups := markdownImage.FindStringSubmatch(match)
+			if !isWebURL(groups[2]) {
+				return groups[1]
+			}
+			return `<img src="` + groups[2] + `" alt="` + groups[1] + `">`
+		})
+		part = markdownLink.ReplaceAllStringFunc(part, func(match string) string {
+			groups := markdownLink.FindStringSubmatch(match)
+			if !isWebURL(groups[2]) {
+				return groups[1]
+			}
+			return `<a href="` + groups[2] + `" rel="nofollow noopener">` + groups[1] + `</a>`
+		})
+		part = markdownBareURL.ReplaceAllString(part, `$1<a href="$2" rel="nofollow noopener">$2</a>`)
+		part = markdownNostrLink.ReplaceAllString(part, `<a href="https://njump.me/$1" rel="nofollow noopener">$1</a>`)
+		part = markdownBold.ReplaceAllString(part, "<strong>$2</strong>")
+		part = markdownItalic.ReplaceAllString(part, "$1<em>$2</em>")
+		out.WriteString(strings.ReplaceAll(part, "\n", "<br>\n"))
+	}
+	return out.String()
+}
+
+// MarkdownPlainText is the text of an article without its formatting, for
+// summaries.
+func MarkdownPlainText(text string) string {
+	plain := html.UnescapeString(htmlTag.ReplaceAllString(string(RenderMarkdown(text)), " "))
+	return strings.Join(strings.Fields(plain), " ")
+}
+
+func isWebURL(value string) bool {
+	return strings.HasPrefix(value, "https://") || strings.HasPrefix(value, "http://")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type Counter struct {
+	Name  string
+	Help  string
+	value atomic.Int64
+}
+
+// MetricVec is a counter or gauge split by the value of a single label.
+type MetricVec struct {
+	Name  string
+	Help  string
+	Type  string
+	Label string
+
+	values map[string]*atomic.Int64
+	mutex  sync.Mutex
+}
+
+var (
+	counters      []*Counter
+	metricVecs    []*MetricVec
+	countersMutex sync.Mutex
+)
+
+func NewCounter(name string, help string) *Counter {
+	counter := &Counter{Name: name, Help: help}
+
+	countersMutex.Lock()
+	counters = append(counters, counter)
+	countersMutex.Unlock()
+
+	return counter
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+func NewCounterVec(name string, help string, label string) *MetricVec {
+	return newMetricVec(name, help, "counter", label)
+}
+
+func NewGaugeVec(name string, help string, label string) *MetricVec {
+	return newMetricVec(name, help, "gauge", label)
+}
+
+func newMetricVec(name string, help string, kind string, label string) *MetricVec {
+	vec := &MetricVec{Name: name, Help: help, Type: kind, Label: label, values: make(map[string]*atomic.Int64)}
+
+	countersMutex.Lock()
+	metricVecs = append(metricVecs, vec)
+	countersMutex.Unlock()
+
+	return vec
+}
+
+func (m *MetricVec) get(label string) *atomic.Int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	value, ok := m.values[label]
+	if !ok {
+		value = &atomic.Int64{}
+		m.values[label] = value
+	}
+	return value
+}
+
+func (m *MetricVec) Inc(label string) {
+	m.get(label).Add(1)
+}
+
+func (m *MetricVec) Set(label string, n int64) {
+	m.get(label).Store(n)
+}
+
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+
+	for _, counter := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n", counter.Name, counter.Help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", counter.Name)
+		fmt.Fprintf(w, "%s %d\n", counter.Name, counter.Value())
+	}
+
+	for _, vec := range metricVecs {
+		fmt.Fprintf(w, "# HELP %s %s\n", vec.Name, vec.Help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", vec.Name, vec.Type)
+
+		vec.mutex.Lock()
+		labels := make([]string, 0, len(vec.values))
+		for label := range vec.values {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			fmt.Fprintf(w, "%s{%s=%q} %d\n", vec.Name, vec.Label, label, vec.values[label].Load())
+		}
+		vec.mutex.Unlock()
+	}
+}
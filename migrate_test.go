@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateStorage(t *testing.T) {
+	h := NewHarness(t)
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	if err := h.TopUp(pubkey, 100); err != nil {
+		t.Fatalf("topping up: %v", err)
+	}
+	for _, content := range []string{"one", "two", "three"} {
+		if err := h.Publish(sk, content); err != nil {
+			t.Fatalf("publishing: %v", err)
+		}
+	}
+
+	target, err := OpenDatabase(filepath.Join(h.Dir, "target"), 500)
+	if err != nil {
+		t.Fatalf("opening target: %v", err)
+	}
+	defer target.Close()
+	if err := MigrateEvents(h.DB, target, 2); err != nil {
+		t.Fatalf("migrating events: %v", err)
+	}
+	if err := CreateTables(target.DB); err != nil {
+		t.Fatalf("creating tables: %v", err)
+	}
+	for _, table := range SchemaTables() {
+		if err := MigrateTable(h.DB.DB, target.DB, table, 2); err != nil {
+			t.Fatalf("migrating %s: %v", table, err)
+		}
+	}
+	if err := VerifyMigration(h.DB.DB, target.DB); err != nil {
+		t.Fatalf("verifying: %v", err)
+	}
+
+	// same number of rows, one of them different
+	if _, err := target.DB.Exec(`UPDATE zap_credit SET amount_msat = amount_msat + 1`); err != nil {
+		t.Fatalf("tampering with the target: %v", err)
+	}
+	if err := VerifyMigration(h.DB.DB, target.DB); err == nil || !strings.Contains(err.Error(), "zap_credit") {
+		t.Fatalf("verifying a tampered target gave %v", err)
+	}
+}
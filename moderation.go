@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+	"sync"
+)
+
+var moderationSchema = Schema{
+	Tables: []string{"shadow_ban"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS shadow_ban (
+       pubkey text NOT NULL PRIMARY KEY,
+       reason text NOT NULL,
+       created_at bigint NOT NULL);`,
+	},
+}
+
+type ShadowBan struct {
+	PubKey    string          `json:"pubkey"`
+	Reason    string          `json:"reason"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+var (
+	shadowBanned      = make(map[string]bool)
+	shadowBannedMutex sync.RWMutex
+
+	shadowHidden = NewCounter("ppe_shadow_hidden_total", "Events from shadow-banned pubkeys withheld from other users.")
+)
+
+func LoadShadowBans(db Database) error {
+	var pubkeys []string
+	if err := db.DB.Select(&pubkeys, `SELECT pubkey FROM shadow_ban`); err != nil {
+		return err
+	}
+
+	shadowBannedMutex.Lock()
+	defer shadowBannedMutex.Unlock()
+	for _, pubkey := range pubkeys {
+		shadowBanned[pubkey] = true
+	}
+	return nil
+}
+
+func IsShadowBanned(pubkey string) bool {
+	shadowBannedMutex.RLock()
+	defer shadowBannedMutex.RUnlock()
+	return shadowBanned[pubkey]
+}
+
+func ShadowBanPubKey(pubkey string, reason string, db Database) error {
+	_, err := db.DB.Exec(
+		`INSERT INTO shadow_ban (pubkey, reason, created_at) VALUES (?, ?, ?) ON CONFLICT(pubkey) DO UPDATE SET reason = excluded.reason`,
+		pubkey, reason, nostr.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	shadowBannedMutex.Lock()
+	shadowBanned[pubkey] = true
+	shadowBannedMutex.Unlock()
+	return nil
+}
+
+func LiftShadowBan(pubkey string, db Database) error {
+	if _, err := db.DB.Exec(`DELETE FROM shadow_ban WHERE pubkey = ?`, pubkey); err != nil {
+		return err
+	}
+
+	shadowBannedMutex.Lock()
+	delete(shadowBanned, pubkey)
+	shadowBannedMutex.Unlock()
+	return nil
+}
+
+func GetShadowBans(db Database) ([]ShadowBan, error) {
+	var bans []ShadowBan
+	rows, err := db.DB.Query(`SELECT pubkey, reason, created_at FROM shadow_ban ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ban ShadowBan
+		if err := rows.Scan(&ban.PubKey, &ban.Reason, &ban.CreatedAt); err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// HideShadowBanned wraps a QueryEvents handler so events from shadow-banned
+// pubkeys are only returned to their (authenticated) author. Their events are
+// still accepted and stored, so from the author's side nothing changes.
+func HideShadowBanned(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		results, err := query(ctx, filter)
+		if err != nil {
+			return results, err
+		}
+
+		authed := khatru.GetAuthed(ctx)
+
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+			for event := range results {
+				if event.PubKey != authed && IsShadowBanned(event.PubKey) {
+					shadowHidden.Inc()
+					continue
+				}
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					for range results {
+					}
+					return
+				}
+			}
+		}()
+		return ch, nil
+	}
+}
+
+func PreventShadowBannedBroadcast(ws *khatru.WebSocket, event *nostr.Event) bool {
+	return event.PubKey != ws.AuthedPublicKey && IsShadowBanned(event.PubKey)
+}
+
+func HandleAdminShadowBan(w http.ResponseWriter, r *http.Request, db Database) {
+	switch r.Method {
+	case http.MethodGet:
+		bans, err := GetShadowBans(db)
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		WriteJSON(w, http.StatusOK, bans)
+	case http.MethodPost, http.MethodDelete:
+		var request struct {
+			PubKey string `json:"pubkey"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteJSONError(w, http.StatusBadRequest, "invalid json body")
+			return
+		}
+		pubkey, err := ParsePubKey(request.PubKey)
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid pubkey: %v", err))
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			err = ShadowBanPubKey(pubkey, request.Reason, db)
+		} else {
+			err = LiftShadowBan(pubkey, db)
+		}
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]string{"pubkey": pubkey})
+	default:
+		WriteJSONError(w, http.StatusMethodNotAllowed, "use GET, POST or DELETE")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var nip05Schema = Schema{
+	Tables: []string{"nip05_name"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS nip05_name (
+       name text NOT NULL PRIMARY KEY,
+       pubkey text NOT NULL UNIQUE,
+       created_at bigint NOT NULL);`,
+	},
+}
+
+var (
+	nip05NamePattern = regexp.MustCompile(`^[a-z0-9_.-]{1,32}$`)
+
+	nip05NamesSold = NewCounter("ppe_nip05_names_sold_total", "NIP-05 names bought with sats balance.")
+)
+
+// HandleNostrJSON serves /.well-known/nostr.json for the relay's domain. The
+// root "_" identifier resolves to the relay operator.
+func HandleNostrJSON(w http.ResponseWriter, r *http.Request, db Database) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	name := strings.ToLower(r.URL.Query().Get("name"))
+	names := make(map[string]string)
+	relaysByPubkey := make(map[string][]string)
+
+	var pubkey string
+	if name == "_" {
+		pubkey = relay.Info.PubKey
+	} else if name != "" {
+		db.DB.QueryRow(`SELECT pubkey FROM nip05_name WHERE name = ?`, name).Scan(&pubkey)
+	}
+
+	if pubkey != "" {
+		names[name] = pubkey
+		relaysByPubkey[pubkey] = []string{strings.Replace(relay.ServiceURL, "http", "ws", 1)}
+	}
+	WriteJSON(w, http.StatusOK, map[string]any{"names": names, "relays": relaysByPubkey})
+}
+
+// GetNIP05Name returns the name pubkey owns, or "" if it has none.
+func GetNIP05Name(pubkey string, db Database) string {
+	var name string
+	db.DB.QueryRow(`SELECT name FROM nip05_name WHERE pubkey = ?`, pubkey).Scan(&name)
+	return name
+}
+
+// BuyNIP05Name registers name for pubkey, debiting the price from their
+// balance in the same transaction. Buying a new name replaces the pubkey's
+// previous one; buying back one it had before is paid for again.
+func BuyNIP05Name(pubkey string, name string, price int64, db Database) error {
+	name = strings.ToLower(name)
+	if !nip05NamePattern.MatchString(name) || name == "_" {
+		return errors.New("names can only use a-z, 0-9, '.', '-' and '_', up to 32 characters")
+	}
+
+	var owner string
+	db.DB.QueryRow(`SELECT pubkey FROM nip05_name WHERE name = ?`, name).Scan(&owner)
+	if owner == pubkey {
+		return nil
+	} else if owner != "" {
+		return fmt.Errorf("%s is already taken", name)
+	}
+
+	defer LockBalance(pubkey)()
+	if balance := GetSpendableBalanceMsat(pubkey, db) / 1000; balance < price {
+		return fmt.Errorf("a name costs %d sats and your balance is %d sats", price, balance)
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := NowTimestamp()
+	if _, err := tx.Exec(`DELETE FROM nip05_name WHERE pubkey = ?`, pubkey); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO nip05_name (name, pubkey, created_at) VALUES (?, ?, ?)`, name, pubkey, now); err != nil {
+		return fmt.Errorf("%s is already taken", name)
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO debit (id, pubkey, amount_msat, reason, created_at) VALUES (?, ?, ?, ?, ?)`,
+		fmt.Sprintf("nip05:%s:%s:%d", pubkey, name, now), pubkey, price*1000, "nip05 name "+name, now,
+	); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	nip05NamesSold.Inc()
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// nip98MaxSkew is how far a NIP-98 event's created_at may be from now.
+const nip98MaxSkew = time.Minute
+
+// VerifyNIP98 checks the NIP-98 Authorization header of a request, a signed
+// kind 27235 event naming its URL, method and, when there is one, the hash
+// of its body, and returns the pubkey that signed it.
+func VerifyNIP98(r *http.Request, body []byte) (string, error) {
+	encoded, found := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !found {
+		return "", errors.New("missing Nostr authorization")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", errors.New("authorization isn't base64")
+	}
+	var event nostr.Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return "", errors.New("authorization isn't a nostr event")
+	}
+
+	if event.Kind != 27235 {
+		return "", errors.New("authorization event must be kind 27235")
+	}
+	if skew := time.Since(event.CreatedAt.Time()); skew > nip98MaxSkew || skew < -nip98MaxSkew {
+		return "", errors.New("authorization event is too old or in the future")
+	}
+
+	signed, err := url.Parse(tagValue(event.Tags, "u"))
+	if err != nil || signed.Host != r.Host || signed.RequestURI() != r.URL.RequestURI() {
+		return "", errors.New("authorization event is for another URL")
+	}
+	if !strings.EqualFold(tagValue(event.Tags, "method"), r.Method) {
+		return "", errors.New("authorization event is for another method")
+	}
+	if len(body) > 0 {
+		hash := sha256.Sum256(body)
+		if tagValue(event.Tags, "payload") != hex.EncodeToString(hash[:]) {
+			return "", errors.New("authorization event is for another body")
+		}
+	}
+
+	if ok, err := event.CheckSignature(); err != nil || !ok {
+		return "", errors.New("authorization event has an invalid signature")
+	}
+	return event.PubKey, nil
+}
+
+// tagValue is the value of the first tag named key, or "".
+func tagValue(tags nostr.Tags, key string) string {
+	if tag := tags.GetFirst([]string{key, ""}); tag != nil && len(*tag) >= 2 {
+		return (*tag)[1]
+	}
+	return ""
+}
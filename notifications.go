@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strings"
+	"sync"
+)
+
+var notificationSchema = Schema{
+	Tables: []string{"notification_preference"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS notification_preference (
+       pubkey text NOT NULL,
+       kind text NOT NULL,
+       enabled boolean NOT NULL,
+       updated_at bigint NOT NULL,
+       PRIMARY KEY (pubkey, kind));`,
+	},
+}
+
+// Notifications users can turn off with the bot's "notify" command. Every
+// module that notifies users checks WantsNotification first.
+const (
+	NotifyReceipts   = "receipts"
+	NotifyLowBalance = "low-balance"
+	NotifyExpiry     = "expiry"
+	NotifyStatus     = "status"
+	NotifyReplies    = "replies"
+	NotifyZaps       = "zaps"
+	NotifyGifts      = "gifts"
+)
+
+var notificationKinds = []string{NotifyReceipts, NotifyLowBalance, NotifyExpiry, NotifyStatus, NotifyReplies, NotifyZaps, NotifyGifts}
+
+var (
+	// notificationPreferences holds the notifications each pubkey opted out
+	// of, so checking them on every charge doesn't hit the database
+	notificationPreferences      = make(map[string]map[string]bool)
+	notificationPreferencesMutex sync.RWMutex
+
+	lowBalanceWarning int64
+
+	lowBalanceWarningsSent = NewCounter("ppe_low_balance_warnings_total", "Low balance DMs sent to users.")
+)
+
+func LoadNotificationPreferences(db Database) error {
+	rows, err := db.DB.Query(`SELECT pubkey, kind FROM notification_preference WHERE NOT enabled`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	notificationPreferencesMutex.Lock()
+	defer notificationPreferencesMutex.Unlock()
+	for rows.Next() {
+		var pubkey, kind string
+		if err := rows.Scan(&pubkey, &kind); err != nil {
+			return err
+		}
+		if notificationPreferences[pubkey] == nil {
+			notificationPreferences[pubkey] = make(map[string]bool)
+		}
+		notificationPreferences[pubkey][kind] = true
+	}
+	return rows.Err()
+}
+
+// WantsNotification reports whether pubkey wants notifications of kind. They
+// all default to on.
+func WantsNotification(pubkey string, kind string) bool {
+	notificationPreferencesMutex.RLock()
+	defer notificationPreferencesMutex.RUnlock()
+	return !notificationPreferences[pubkey][kind]
+}
+
+func SetNotificationPreference(pubkey string, kind string, enabled bool, db Database) error {
+	_, err := db.DB.Exec(
+		`INSERT INTO notification_preference (pubkey, kind, enabled, updated_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (pubkey, kind) DO UPDATE SET enabled = excluded.enabled, updated_at = excluded.updated_at`,
+		pubkey, kind, enabled, nostr.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	notificationPreferencesMutex.Lock()
+	defer notificationPreferencesMutex.Unlock()
+	if notificationPreferences[pubkey] == nil {
+		notificationPreferences[pubkey] = make(map[string]bool)
+	}
+	notificationPreferences[pubkey][kind] = !enabled
+	return nil
+}
+
+// HandleNotifyCommand answers "notify" with the user's settings and
+// "notify <kind|all> on|off" by changing them.
+func HandleNotifyCommand(pubkey string, args []string, db Database) string {
+	if len(args) == 0 {
+		var settings []string
+		for _, kind := range notificationKinds {
+			setting := "on"
+			if !WantsNotification(pubkey, kind) {
+				setting = "off"
+			}
+			settings = append(settings, kind+" "+setting)
+		}
+		return fmt.Sprintf("Your notifications: %s. Change them with notify <kind|all> on|off.", strings.Join(settings, ", "))
+	}
+
+	if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+		return "Usage: notify <kind|all> on|off"
+	}
+	kinds := []string{strings.ToLower(args[0])}
+	if kinds[0] == "all" {
+		kinds = notificationKinds
+	} else if !isNotificationKind(kinds[0]) {
+		return fmt.Sprintf("Unknown notification %s. Kinds: %s.", args[0], strings.Join(notificationKinds, ", "))
+	}
+
+	for _, kind := range kinds {
+		if err := SetNotificationPreference(pubkey, kind, args[1] == "on", db); err != nil {
+			ReportError(err, "notifications", map[string]string{"pubkey": pubkey})
+			return "Couldn't save your notification settings, try again later."
+		}
+	}
+	return fmt.Sprintf("Turned %s %s notifications.", args[1], strings.Join(kinds, ", "))
+}
+
+func isNotificationKind(kind string) bool {
+	for _, k := range notificationKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// WarnLowBalance DMs pubkey when a charge takes their balance below
+// LOW_BALANCE_WARNING sats. It only fires on the charge that crosses the
+// threshold, so a user isn't messaged for every event after it.
+func WarnLowBalance(pubkey string, beforeMsat int64, afterMsat int64, db Database) {
+	threshold := lowBalanceWarning * 1000
+	if threshold <= 0 || beforeMsat < threshold || afterMsat >= threshold || isPoolAccount(pubkey) || !WantsNotification(pubkey, NotifyLowBalance) {
+		return
+	}
+
+	message := fmt.Sprintf("Your balance on %s is down to %d sats. Zap %s to top up, or mention me with \"notify low-balance off\" to stop these messages.",
+		relay.Info.Name, afterMsat/1000, GetEnvDefault("LIGHTNING_ADDRESS", "the bot"))
+	go func() {
+		if err := SendDirectMessage(pubkey, message, db); err != nil {
+			ReportError(err, "notifications", map[string]string{"pubkey": pubkey})
+			return
+		}
+		lowBalanceWarningsSent.Inc()
+	}()
+}
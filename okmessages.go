@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"io"
+	"net"
+	"sync"
+)
+
+// balanceInOK, BALANCE_IN_OK, has the OK accepting an event say what it cost
+// and what's left, e.g. "stored; 1 sat debited, 41 remaining".
+var balanceInOK bool
+
+// InterceptOKMessages is an OnConnect hook wrapping the connection's socket
+// in an okMessageConn, so the OKs accepting events can carry a message.
+//
+// khatru always accepts with an empty message and has no hook to change it,
+// so the connection khatru writes to is wrapped, by reflection as in
+// ConfigureCompression, and the accepting OK is rewritten on its way out
+// with the message SetOKMessage left for it. Only that one frame is touched:
+// everything else, and any OK without a message waiting, goes out as is.
+func InterceptOKMessages(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	conn := *unexportedField[*websocket.Conn](ws, "conn")
+
+	// taken like websocket.Conn does before writing, so a write can't
+	// happen halfway through the swap
+	mu := *unexportedField[chan struct{}](conn, "mu")
+	<-mu
+	socket := unexportedField[net.Conn](conn, "conn")
+	*socket = &okMessageConn{Conn: *socket, messages: make(map[string]string)}
+	mu <- struct{}{}
+}
+
+// SetOKMessage has the OK accepting event carry message instead of nothing.
+// It's a no-op unless ctx is a client's connection.
+func SetOKMessage(ctx context.Context, event *nostr.Event, message string) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	socket, ok := (*unexportedField[net.Conn](*unexportedField[*websocket.Conn](ws, "conn"), "conn")).(*okMessageConn)
+	if !ok {
+		return
+	}
+	socket.lock.Lock()
+	socket.messages[event.ID] = message
+	socket.lock.Unlock()
+}
+
+// SetBalanceInOK leaves the OK for event a message with what payer was
+// debited for it and the balance it has left, when BALANCE_IN_OK is on.
+func SetBalanceInOK(ctx context.Context, event *nostr.Event, payer string, debitedMsat int64, remainingMsat int64) {
+	if !balanceInOK {
+		return
+	}
+	SetOKMessage(ctx, event, fmt.Sprintf("stored; %s debited, %s remaining", formatSatsShort(debitedMsat), formatSatsShort(remainingMsat)))
+}
+
+// okMessageConn rewrites the frames of accepting OKs that have a message
+// waiting. websocket.Conn writes each frame of a small message with a single
+// Write, header and payload together, which is what's looked for.
+type okMessageConn struct {
+	net.Conn
+	lock     sync.Mutex
+	messages map[string]string
+}
+
+func (c *okMessageConn) Write(frame []byte) (int, error) {
+	if rewritten, ok := c.rewriteOK(frame); ok {
+		if _, err := c.Conn.Write(rewritten); err != nil {
+			return 0, err
+		}
+		return len(frame), nil
+	}
+	return c.Conn.Write(frame)
+}
+
+// rewriteOK returns frame with the OK it holds carrying the message waiting
+// for it, if it is a whole text frame holding an accepting OK without a
+// message, and there is one.
+func (c *okMessageConn) rewriteOK(frame []byte) ([]byte, bool) {
+	c.lock.Lock()
+	waiting := len(c.messages) > 0
+	c.lock.Unlock()
+	if !waiting || len(frame) < 2 || frame[0]&0x8f != 0x81 || frame[1]&0x80 != 0 {
+		return nil, false
+	}
+	compressed := frame[0]&0x40 != 0
+
+	header, length := 2, uint64(frame[1]&0x7f)
+	switch length {
+	case 126:
+		if len(frame) < 4 {
+			return nil, false
+		}
+		header, length = 4, uint64(binary.BigEndian.Uint16(frame[2:4]))
+	case 127:
+		return nil, false
+	}
+	if uint64(len(frame)-header) != length {
+		return nil, false
+	}
+
+	payload := frame[header:]
+	if compressed {
+		// permessage-deflate without context takeover, the only kind
+		// websocket.Conn does, so each message inflates on its own
+		inflated, err := io.ReadAll(flate.NewReader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader([]byte("\x00\x00\xff\xff\x01\x00\x00\xff\xff")))))
+		if err != nil {
+			return nil, false
+		}
+		payload = inflated
+	}
+	if !bytes.HasPrefix(payload, []byte(`["OK",`)) {
+		return nil, false
+	}
+	var ok nostr.OKEnvelope
+	if err := json.Unmarshal(payload, &ok); err != nil || !ok.OK || ok.Reason != "" {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	message, found := c.messages[ok.EventID]
+	delete(c.messages, ok.EventID)
+	c.lock.Unlock()
+	if !found {
+		return nil, false
+	}
+	ok.Reason = message
+	payload, _ = ok.MarshalJSON()
+	if compressed {
+		var deflated bytes.Buffer
+		writer, _ := flate.NewWriter(&deflated, flate.BestSpeed)
+		writer.Write(payload)
+		writer.Flush()
+		payload = bytes.TrimSuffix(deflated.Bytes(), []byte("\x00\x00\xff\xff"))
+	}
+
+	rewritten := []byte{frame[0], 0}
+	switch {
+	case len(payload) < 126:
+		rewritten[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		rewritten[1] = 126
+		rewritten = binary.BigEndian.AppendUint16(rewritten, uint16(len(payload)))
+	default:
+		rewritten[1] = 127
+		rewritten = binary.BigEndian.AppendUint64(rewritten, uint64(len(payload)))
+	}
+	return append(rewritten, payload...), true
+}
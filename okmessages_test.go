@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"testing"
+)
+
+func TestBalanceInOK(t *testing.T) {
+	for _, compression := range []string{"", "true"} {
+		t.Run("compression="+compression, func(t *testing.T) {
+			t.Setenv("BALANCE_IN_OK", "true")
+			t.Setenv("WEBSOCKET_COMPRESSION", compression)
+			t.Cleanup(func() { balanceInOK = false })
+			h := NewHarness(t)
+
+			sk := nostr.GeneratePrivateKey()
+			pubkey, _ := nostr.GetPublicKey(sk)
+			if err := h.TopUp(pubkey, 42); err != nil {
+				t.Fatalf("topping up: %v", err)
+			}
+
+			dialer := websocket.Dialer{EnableCompression: compression == "true"}
+			conn, _, err := dialer.Dial(h.URL(), nil)
+			if err != nil {
+				t.Fatalf("connecting: %v", err)
+			}
+			defer conn.Close()
+
+			event := nostr.Event{CreatedAt: nostr.Now(), Kind: nostr.KindTextNote, Content: "hello"}
+			event.Sign(sk)
+			if err := conn.WriteJSON([]any{"EVENT", event}); err != nil {
+				t.Fatalf("publishing: %v", err)
+			}
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("reading the OK: %v", err)
+			}
+			var ok nostr.OKEnvelope
+			if err := ok.UnmarshalJSON(message); err != nil {
+				t.Fatalf("parsing %s: %v", message, err)
+			}
+			if !ok.OK || ok.Reason != "stored; 1 sat debited, 41 sats remaining" {
+				t.Fatalf("got %s", message)
+			}
+		})
+	}
+}
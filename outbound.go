@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"github.com/nbd-wtf/go-nostr"
+	"time"
+)
+
+var outboundSchema = Schema{
+	Tables: []string{"outbound_event"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS outbound_event (
+       id text NOT NULL,
+       relay text NOT NULL,
+       event text NOT NULL,
+       attempts bigint NOT NULL,
+       next_attempt_at bigint NOT NULL,
+       last_error text NOT NULL,
+       created_at bigint NOT NULL,
+       PRIMARY KEY (id, relay));`,
+		`CREATE INDEX IF NOT EXISTS outboundnextattemptidx ON outbound_event(next_attempt_at)`,
+	},
+}
+
+type outboundEvent struct {
+	id       string
+	relay    string
+	event    string
+	attempts int
+}
+
+var (
+	outboundQueued    = NewCounter("ppe_outbound_queued_total", "Bot publishes queued for retry after failing.")
+	outboundDelivered = NewCounter("ppe_outbound_delivered_total", "Queued bot publishes that went through on retry.")
+	outboundAbandoned = NewCounter("ppe_outbound_abandoned_total", "Queued bot publishes given up on after too many attempts.")
+)
+
+// PublishBotEventWithRetry publishes like PublishBotEvent, then queues the
+// relays that failed so the outbound worker keeps trying them, even across
+// restarts.
+func PublishBotEventWithRetry(event nostr.Event, db Database) {
+	for _, result := range PublishBotEvent(event) {
+		if result.Err == nil {
+			continue
+		}
+		_, err := db.DB.Exec(
+			`INSERT INTO outbound_event (id, relay, event, attempts, next_attempt_at, last_error, created_at) VALUES (?, ?, ?, 1, ?, ?, ?) ON CONFLICT DO NOTHING`,
+			event.ID, result.Relay, event.String(), time.Now().Add(outboundBackoff(1)).Unix(), result.Err.Error(), nostr.Now(),
+		)
+		if err != nil {
+			ReportError(err, "outbound", map[string]string{"event": event.ID, "relay": result.Relay})
+			continue
+		}
+		outboundQueued.Inc()
+	}
+}
+
+// outboundBackoff doubles from 30 seconds up to 6 hours.
+func outboundBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second << min(attempts-1, 10)
+	return min(backoff, 6*time.Hour)
+}
+
+// RunOutboundQueue retries queued publishes as they come due, dropping them
+// after OUTBOUND_MAX_ATTEMPTS (20 by default).
+func RunOutboundQueue(db Database) {
+	maxAttempts := GetEnvInt("OUTBOUND_MAX_ATTEMPTS", 20)
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		RetryOutboundEvents(maxAttempts, db)
+		<-ticker.C
+	}
+}
+
+func RetryOutboundEvents(maxAttempts int, db Database) {
+	rows, err := db.DB.Query(
+		`SELECT id, relay, event, attempts FROM outbound_event WHERE next_attempt_at <= ? ORDER BY next_attempt_at LIMIT 100`,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		ReportError(err, "outbound", nil)
+		return
+	}
+	// collect before publishing: the updates below can't run while the
+	// cursor is open
+	var due []outboundEvent
+	for rows.Next() {
+		var o outboundEvent
+		if err := rows.Scan(&o.id, &o.relay, &o.event, &o.attempts); err == nil {
+			due = append(due, o)
+		}
+	}
+	rows.Close()
+
+	timeout := GetEnvDuration("PUBLISH_TIMEOUT", 10*time.Second)
+	for _, o := range due {
+		var event nostr.Event
+		if err := event.UnmarshalJSON([]byte(o.event)); err != nil {
+			db.DB.Exec(`DELETE FROM outbound_event WHERE id = ? AND relay = ?`, o.id, o.relay)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := publishToRelay(ctx, o.relay, event)
+		cancel()
+		recordPublishResult(PublishResult{Relay: o.relay, Err: err})
+
+		switch {
+		case err == nil:
+			outboundDelivered.Inc()
+			db.DB.Exec(`DELETE FROM outbound_event WHERE id = ? AND relay = ?`, o.id, o.relay)
+		case o.attempts+1 >= maxAttempts:
+			outboundAbandoned.Inc()
+			db.DB.Exec(`DELETE FROM outbound_event WHERE id = ? AND relay = ?`, o.id, o.relay)
+		default:
+			db.DB.Exec(
+				`UPDATE outbound_event SET attempts = attempts + 1, next_attempt_at = ?, last_error = ? WHERE id = ? AND relay = ?`,
+				time.Now().Add(outboundBackoff(o.attempts+1)).Unix(), err.Error(), o.id, o.relay,
+			)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"strings"
+)
+
+var packageSchema = Schema{
+	Tables: []string{"package_credit"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS package_credit (
+       id text NOT NULL PRIMARY KEY,
+       pubkey text NOT NULL,
+       package text NOT NULL,
+       events bigint NOT NULL,
+       amount_msat bigint NOT NULL,
+       created_at bigint NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS packagecreditpubkeyidx ON package_credit(pubkey)`,
+	},
+}
+
+// EventPackage is a bundle of prepaid events sold at a discount to paying
+// for them one by one.
+type EventPackage struct {
+	Name   string
+	Events int64
+	Sats   int64
+}
+
+var (
+	eventPackages []EventPackage
+
+	packagesSold = NewCounter("ppe_packages_sold_total", "Event packages paid for.")
+)
+
+// GetEventPackages reads PACKAGES, a comma-separated list of
+// name:events:sats, e.g. "starter:1000:800,pro:10000:7000".
+func GetEventPackages() []EventPackage {
+	var packages []EventPackage
+	for _, spec := range GetEnvList("PACKAGES", nil) {
+		parts := strings.Split(spec, ":")
+		if len(parts) != 3 {
+			panic(fmt.Errorf("invalid package %q, expected name:events:sats", spec))
+		}
+		events, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || events <= 0 {
+			panic(fmt.Errorf("invalid event count in package %q", spec))
+		}
+		sats, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || sats <= 0 {
+			panic(fmt.Errorf("invalid price in package %q", spec))
+		}
+		packages = append(packages, EventPackage{Name: strings.ToLower(parts[0]), Events: events, Sats: sats})
+	}
+	return packages
+}
+
+func FindEventPackage(name string) (EventPackage, bool) {
+	for _, p := range eventPackages {
+		if p.Name == strings.ToLower(name) {
+			return p, true
+		}
+	}
+	return EventPackage{}, false
+}
+
+// CreatePackageInvoice issues an invoice that, once paid, credits pubkey with
+// the package's events instead of sats.
+func CreatePackageInvoice(pubkey string, p EventPackage) (string, error) {
+	if paymentBackend == nil {
+		return "", fmt.Errorf("invoices aren't available on this relay")
+	}
+	return paymentBackend.CreateInvoice(pubkey, p.Sats*1000, nostr.Tag{"package", p.Name})
+}
+
+// CreditPackage converts a credited zap into package events when its zap
+// request was issued by the bot for a package. The sats paid are debited
+// again so they aren't spent twice.
+func CreditPackage(receipt *nostr.Event, zapRequest *Description, amountMsat int64, db Database) error {
+	request := GetBotZapRequest(zapRequest)
+	if request == nil {
+		return nil
+	}
+	tag := request.Tags.GetFirst([]string{"package", ""})
+	if tag == nil {
+		return nil
+	}
+	p, ok := FindEventPackage((*tag)[1])
+	if !ok || amountMsat < p.Sats*1000 {
+		return nil
+	}
+
+	pubkey := GetZapBeneficiary(zapRequest)
+	result, err := db.DB.Exec(
+		`INSERT INTO package_credit (id, pubkey, package, events, amount_msat, created_at) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		receipt.ID, pubkey, p.Name, p.Events, amountMsat, NowTimestamp(),
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil
+	}
+	packagesSold.Inc()
+
+	_, err = RecordDebitMsat("package:"+receipt.ID, pubkey, amountMsat, "package "+p.Name, db)
+	return err
+}
+
+// GetPackageEventsRemaining is how many prepaid events pubkey has left. Each
+// event covered by a package is recorded as a zero-amount "package" debit.
+func GetPackageEventsRemaining(pubkey string, db Database) int64 {
+	var remaining int64
+	err := db.DB.QueryRow(
+		`SELECT
+		   (SELECT COALESCE(SUM(events), 0) FROM package_credit WHERE pubkey = ? AND id NOT IN (SELECT id FROM zap_revocation)) -
+		   (SELECT COUNT(*) FROM debit WHERE pubkey = ? AND reason = 'package')`,
+		pubkey, pubkey,
+	).Scan(&remaining)
+	if err != nil {
+		ReportError(err, "packages", map[string]string{"pubkey": pubkey})
+		return 0
+	}
+	return remaining
+}
+
+// HandlePackageCommand answers "package <name>" with an invoice for it, or
+// the list of packages if the name isn't one of them.
+func HandlePackageCommand(pubkey string, name string) string {
+	p, ok := FindEventPackage(name)
+	if !ok {
+		return fmt.Sprintf("Unknown package %s. Available: %s.", name, packageChoices())
+	}
+
+	bolt11, err := CreatePackageInvoice(pubkey, p)
+	if err != nil {
+		return fmt.Sprintf("Couldn't create an invoice for %s: %v.", p.Name, err)
+	}
+	invoicesIssued.Inc()
+	return fmt.Sprintf("Pay this invoice for %d events: %s", p.Events, bolt11)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"net/http"
+	"strconv"
+	"strings"
+	"swarmstr.com/ppe-relay/ppe"
+	"time"
+)
+
+// PaymentBackend and LNURLPayBackend are the ppe package's.
+type (
+	PaymentBackend  = ppe.PaymentBackend
+	LNURLPayBackend = ppe.LNURLPayBackend
+)
+
+var (
+	paymentBackend PaymentBackend
+	httpClient     = &http.Client{Timeout: 15 * time.Second}
+
+	invoicesIssued = NewCounter("ppe_invoices_issued_total", "Top-up invoices handed out by the invoice endpoint.")
+)
+
+// NewTopUpZapRequest builds the bot-signed zap request that credits pubkey
+// once the invoice it's attached to is paid. Extra tags describe what the
+// payment is for, e.g. a package.
+func NewTopUpZapRequest(pubkey string, amountMsat int64, tags ...nostr.Tag) (*nostr.Event, error) {
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	content := fmt.Sprintf("%s top-up for %s", relay.Info.Name, npub)
+	return ppe.TopUpZapRequest(GetEnv("BOT_PRIVATE_KEY"), pubkey, amountMsat, relays, content, tags...)
+}
+
+func getJSON(url string, value any) error {
+	response, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
+
+// GetZapBeneficiary returns the pubkey a zap should be credited to: the
+// sender, or for top-ups requested through the bot, the pubkey in its
+// "credit" tag.
+func GetZapBeneficiary(zapRequest *Description) string {
+	if request := GetBotZapRequest(zapRequest); request != nil {
+		return ppe.ZapBeneficiary(botPubkey, request)
+	}
+	return zapRequest.PubKey
+}
+
+// GetBotZapRequest returns the zap request if it was signed by the bot, which
+// makes its tags trustworthy, or nil otherwise.
+func GetBotZapRequest(zapRequest *Description) *nostr.Event {
+	if zapRequest.PubKey != botPubkey {
+		return nil
+	}
+
+	request := ZapRequestEvent(zapRequest)
+	if ok, _ := request.CheckSignature(); !ok {
+		return nil
+	}
+	return &request
+}
+
+// WatchZapReceipts credits zap receipts as soon as they're published instead
+// of waiting for the payer's next event to trigger a scan. It resumes from
+// the last receipt it saw, so receipts published while the relay was down
+// are credited on startup.
+func WatchZapReceipts(db Database) {
+	ctx := context.Background()
+
+	cursor := NewSubscriptionCursor("zap receipts", nostr.Now(), db)
+	defer cursor.Flush()
+
+	tags := make(nostr.TagMap)
+	tags["p"] = []string{botPubkey}
+	filter := nostr.Filter{
+		Kinds: []int{nostr.KindZap},
+		Tags:  tags,
+		Since: cursor.Since(),
+	}
+
+	for event := range pool.SubMany(ctx, relays, []nostr.Filter{filter}) {
+		if seenEvents.Seen(event.ID) {
+			continue
+		}
+		func() {
+			defer RecoverPanic("zap indexer", map[string]string{"receipt": event.ID})
+			CreditZapEvent(event.Event, db)
+		}()
+		cursor.Advance(event.CreatedAt)
+	}
+}
+
+func HandleInvoice(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	pubkey, err := ParsePubKey(r.URL.Query().Get("pubkey"))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "pubkey must be an npub or hex public key")
+		return
+	}
+	amount, _ := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+	invoice, status, err := IssueTopUpInvoice(pubkey, amount, r.URL.Query().Get("package"), r.URL.Query().Get("ref"))
+	if err != nil {
+		WriteJSONError(w, status, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, invoice)
+}
+
+// TopUpInvoice is an invoice crediting PubKey once paid, for Amount sats or
+// the named Package.
+type TopUpInvoice struct {
+	PubKey  string `json:"pubkey"`
+	Amount  int64  `json:"amount"`
+	Package string `json:"package,omitempty"`
+	Events  int64  `json:"events,omitempty"`
+	Invoice string `json:"invoice"`
+}
+
+// IssueTopUpInvoice asks the payment backend for an invoice for a package,
+// when one is named, or amount sats, returning the HTTP status to answer
+// with when it fails.
+func IssueTopUpInvoice(pubkey string, amount int64, packageName string, ref string) (TopUpInvoice, int, error) {
+	if paymentBackend == nil {
+		return TopUpInvoice{}, http.StatusServiceUnavailable, errors.New("invoices aren't available on this relay")
+	}
+
+	if packageName != "" {
+		p, ok := FindEventPackage(packageName)
+		if !ok {
+			return TopUpInvoice{}, http.StatusBadRequest, errors.New("unknown package")
+		}
+		bolt11, err := CreatePackageInvoice(pubkey, p)
+		if err != nil {
+			return TopUpInvoice{}, http.StatusBadGateway, err
+		}
+		invoicesIssued.Inc()
+		return TopUpInvoice{PubKey: pubkey, Amount: p.Sats, Package: p.Name, Events: p.Events, Invoice: bolt11}, http.StatusOK, nil
+	}
+
+	if amount <= 0 {
+		return TopUpInvoice{}, http.StatusBadRequest, errors.New("amount must be a positive number of sats")
+	}
+	var tags []nostr.Tag
+	if ref != "" {
+		tags = append(tags, nostr.Tag{"referral", strings.ToLower(ref)})
+	}
+	bolt11, err := paymentBackend.CreateInvoice(pubkey, amount*1000, tags...)
+	if err != nil {
+		return TopUpInvoice{}, http.StatusBadGateway, err
+	}
+	invoicesIssued.Inc()
+	return TopUpInvoice{PubKey: pubkey, Amount: amount, Invoice: bolt11}, http.StatusOK, nil
+}
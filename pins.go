@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var pinSchema = Schema{
+	Tables: []string{"pin"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS pin (
+       event_id text NOT NULL PRIMARY KEY,
+       pubkey text NOT NULL,
+       amount_msat bigint NOT NULL,
+       created_at bigint NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS pinpubkeyidx ON pin (pubkey);`,
+	},
+}
+
+// pinPriceMsat and pinPriceMsatPerKB are what pinning an event costs: a
+// flat fee plus a fee for every started KB of it, paid once. Pinning is
+// off when both are 0.
+var (
+	pinPriceMsat      int64
+	pinPriceMsatPerKB int64
+
+	eventsPinned = NewCounter("ppe_events_pinned_total", "Events pinned by users paying to keep them.")
+)
+
+type Pin struct {
+	EventID    string          `json:"event_id"`
+	PubKey     string          `json:"pubkey"`
+	AmountMsat int64           `json:"amount_msat"`
+	CreatedAt  nostr.Timestamp `json:"created_at"`
+}
+
+// ConfigurePinning reads PIN_PRICE and PIN_PRICE_PER_KB, in sats.
+func ConfigurePinning() {
+	pinPriceMsat = int64(GetEnvInt("PIN_PRICE", 0)) * 1000
+	pinPriceMsatPerKB = int64(GetEnvInt("PIN_PRICE_PER_KB", 0)) * 1000
+}
+
+func pinningEnabled() bool {
+	return pinPriceMsat > 0 || pinPriceMsatPerKB > 0
+}
+
+// PinPrice is what pinning event costs.
+func PinPrice(event *nostr.Event) int64 {
+	kilobytes := (int64(len(event.String())) + 1023) / 1024
+	return pinPriceMsat + kilobytes*pinPriceMsatPerKB
+}
+
+// DescribePinPrice is PinPrice for the landing page and the bot.
+func DescribePinPrice() string {
+	switch {
+	case pinPriceMsatPerKB == 0:
+		return formatSatsShort(pinPriceMsat) + " per event"
+	case pinPriceMsat == 0:
+		return formatSatsShort(pinPriceMsatPerKB) + " per KB"
+	}
+	return fmt.Sprintf("%s per event plus %s per KB", formatSatsShort(pinPriceMsat), formatSatsShort(pinPriceMsatPerKB))
+}
+
+// PinEvent has pubkey pay, once, to keep a stored event for good: pinned
+// events are never pruned, whatever happens to their author's balance or
+// the database's size. Only regular events can be pinned, since replaceable
+// ones are deleted when they're replaced. Their author deleting them, or
+// moderation taking them down, still removes them.
+//
+// It returns the pin, which is someone else's when they pinned the event
+// first, or the HTTP status to answer with and why it couldn't pin it.
+func PinEvent(pubkey string, id string, db Database) (Pin, int, error) {
+	if !pinningEnabled() {
+		return Pin{}, http.StatusNotFound, errors.New("this relay doesn't offer pinning")
+	}
+	pin := Pin{EventID: id, PubKey: pubkey}
+	if err := db.DB.QueryRow(`SELECT pubkey, amount_msat, created_at FROM pin WHERE event_id = ?`, id).Scan(&pin.PubKey, &pin.AmountMsat, &pin.CreatedAt); err == nil {
+		return pin, http.StatusOK, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		ReportError(err, "pins", map[string]string{"event": id})
+		return pin, http.StatusInternalServerError, errors.New("couldn't look the event up")
+	}
+
+	event, err := getStoredEvent(id, db)
+	if errors.Is(err, sql.ErrNoRows) {
+		return pin, http.StatusNotFound, errors.New("that event isn't stored here")
+	} else if err != nil {
+		ReportError(err, "pins", map[string]string{"event": id})
+		return pin, http.StatusInternalServerError, errors.New("couldn't look the event up")
+	}
+	if !isRegularKind(event.Kind) {
+		return pin, http.StatusBadRequest, fmt.Errorf("kind %d events are replaced or expire, only regular events can be pinned", event.Kind)
+	}
+
+	pin.AmountMsat = PinPrice(event)
+	if balance := GetRemainingUserBalanceMsat(pubkey, db); balance < pin.AmountMsat {
+		return pin, http.StatusPaymentRequired, fmt.Errorf("pinning it costs %s and your balance is %s", formatSatsShort(pin.AmountMsat), formatSatsShort(balance))
+	}
+	pin.CreatedAt = nostr.Now()
+	result, err := db.DB.Exec(
+		`INSERT INTO pin (event_id, pubkey, amount_msat, created_at) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		pin.EventID, pin.PubKey, pin.AmountMsat, pin.CreatedAt,
+	)
+	if err != nil {
+		ReportError(err, "pins", map[string]string{"event": id})
+		return pin, http.StatusInternalServerError, errors.New("couldn't pin the event")
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		// pinned by someone else in the meantime
+		return PinEvent(pubkey, id, db)
+	}
+	if _, err := RecordDebitMsat("pin:"+id, pubkey, pin.AmountMsat, "pin "+id, db); err != nil {
+		ReportError(err, "pins", map[string]string{"event": id, "pubkey": pubkey})
+	}
+	eventsPinned.Inc()
+	return pin, http.StatusOK, nil
+}
+
+// GetPins lists the events pubkey pinned, newest first.
+func GetPins(pubkey string, db Database) ([]Pin, error) {
+	pins := []Pin{}
+	rows, err := db.DB.Query(`SELECT event_id, pubkey, amount_msat, created_at FROM pin WHERE pubkey = ? ORDER BY created_at DESC`, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pin Pin
+		if err := rows.Scan(&pin.EventID, &pin.PubKey, &pin.AmountMsat, &pin.CreatedAt); err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	return pins, rows.Err()
+}
+
+// UnpinDeletedEvent is a DeleteEvent handler dropping the pins of events
+// deleted by their author or moderation.
+func UnpinDeletedEvent(db Database) func(ctx context.Context, event *nostr.Event) error {
+	return func(ctx context.Context, event *nostr.Event) error {
+		_, err := db.DB.Exec(`DELETE FROM pin WHERE event_id = ?`, event.ID)
+		return err
+	}
+}
+
+// notPinned is the SQL condition leaving pinned events out of a query on
+// the event table.
+const notPinned = `NOT EXISTS (SELECT 1 FROM pin WHERE pin.event_id = event.id)`
+
+func isRegularKind(kind int) bool {
+	return kind != 0 && kind != 3 &&
+		!(kind >= 10000 && kind < 20000) &&
+		!(kind >= 20000 && kind < 30000) &&
+		!(kind >= 30000 && kind < 40000)
+}
+
+func HandlePinCommand(pubkey string, args []string, db Database) string {
+	if len(args) == 0 {
+		pins, err := GetPins(pubkey, db)
+		if err != nil {
+			ReportError(err, "pins", map[string]string{"pubkey": pubkey})
+			return "Couldn't list your pins, try again later."
+		}
+		if len(pins) == 0 {
+			return fmt.Sprintf("You haven't pinned anything. Pinning an event keeps it here for good, for %s: send pin <note id>.", DescribePinPrice())
+		}
+		lines := make([]string, len(pins))
+		for i, pin := range pins {
+			note, _ := nip19.EncodeNote(pin.EventID)
+			lines[i] = note
+		}
+		return "Your pinned events: " + strings.Join(lines, ", ") + "."
+	}
+
+	id, err := parseEventID(strings.TrimPrefix(args[0], "nostr:"))
+	if err != nil {
+		return "Usage: pin <note id>"
+	}
+	pin, _, err := PinEvent(pubkey, id, db)
+	if err != nil {
+		return fmt.Sprintf("Couldn't pin it: %v.", err)
+	}
+	if pin.PubKey != pubkey {
+		return "Someone already pinned that event, it's kept for good."
+	}
+	return fmt.Sprintf("Pinned for %s, it won't ever be pruned.", formatSatsShort(pin.AmountMsat))
+}
+
+// HandleAPIPin pins {"event"} for the NIP-98 authenticated caller.
+func HandleAPIPin(w http.ResponseWriter, r *http.Request, db Database) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "couldn't read the body")
+		return
+	}
+	pubkey, err := VerifyNIP98(r, body)
+	if err != nil {
+		WriteJSONError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	var request struct {
+		Event string `json:"event"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "invalid json body")
+		return
+	}
+	id, err := parseEventID(strings.TrimPrefix(request.Event, "nostr:"))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pin, status, err := PinEvent(pubkey, id, db)
+	if err != nil {
+		WriteJSONError(w, status, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, pin)
+}
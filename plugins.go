@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventPlugin is an external program deciding which events the relay
+// accepts, speaking strfry's write policy plugin protocol: it reads one
+// JSON request per line on stdin and answers each with one JSON line on
+// stdout, so plugins written for strfry work unchanged. It's started on
+// first use and again whenever it exits.
+//
+// Events are signed, so a plugin can only accept or reject them, not change
+// them. khatru can't acknowledge an event without storing it, so
+// shadowReject is treated like reject.
+type EventPlugin struct {
+	Command string
+	Timeout time.Duration
+
+	mutex  sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+}
+
+type pluginRequest struct {
+	Type       string       `json:"type"`
+	Event      *nostr.Event `json:"event"`
+	ReceivedAt int64        `json:"receivedAt"`
+	SourceType string       `json:"sourceType"`
+	SourceInfo string       `json:"sourceInfo"`
+}
+
+type pluginResponse struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Msg    string `json:"msg"`
+}
+
+var pluginDecisions = NewCounterVec("ppe_plugin_decisions_total", "Events run through write policy plugins, by the action taken.", "action")
+
+// GetEventPlugins reads EVENT_PLUGINS, the commands of the plugins every
+// event goes through in order, and PLUGIN_TIMEOUT, how long each gets to
+// answer.
+func GetEventPlugins() []*EventPlugin {
+	timeout := GetEnvDuration("PLUGIN_TIMEOUT", 5*time.Second)
+	var plugins []*EventPlugin
+	for _, command := range GetEnvList("EVENT_PLUGINS", nil) {
+		plugins = append(plugins, &EventPlugin{Command: command, Timeout: timeout})
+	}
+	return plugins
+}
+
+// RejectEvent is a RejectEvent policy asking the plugin about each event.
+// A plugin that fails or doesn't answer in time rejects the event, as it
+// would in strfry, since it may be what keeps the relay within the law.
+func (p *EventPlugin) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	var ip string
+	sourceType := "Import"
+	if khatru.GetConnection(ctx) != nil {
+		ip = khatru.GetIP(ctx)
+		sourceType = "IP4"
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+			sourceType = "IP6"
+		}
+	}
+
+	response, err := p.ask(pluginRequest{Type: "new", Event: event, ReceivedAt: time.Now().Unix(), SourceType: sourceType, SourceInfo: ip})
+	if err != nil {
+		ReportError(err, "plugins", map[string]string{"plugin": p.Command, "event": event.ID})
+		pluginDecisions.Inc("error")
+		return true, RejectError + ": couldn't check this event, try again later"
+	}
+
+	pluginDecisions.Inc(response.Action)
+	switch response.Action {
+	case "accept":
+		return false, ""
+	case "reject", "shadowReject":
+		if response.Msg == "" {
+			return true, RejectBlocked + ": rejected by policy"
+		}
+		return true, response.Msg
+	}
+	ReportError(fmt.Errorf("unknown action %q", response.Action), "plugins", map[string]string{"plugin": p.Command, "event": event.ID})
+	return true, RejectError + ": couldn't check this event, try again later"
+}
+
+// ask sends request to the plugin and waits for its answer about the same
+// event, starting the plugin if it isn't running. Requests are sent one at
+// a time; a plugin that times out is killed, so a late answer can't be
+// taken for the next event's.
+func (p *EventPlugin) ask(request pluginRequest) (pluginResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return pluginResponse{}, err
+		}
+	}
+
+	line, err := json.Marshal(request)
+	if err != nil {
+		return pluginResponse{}, err
+	}
+	if _, err := p.stdin.Write(append(line, '\n')); err != nil {
+		p.stop()
+		return pluginResponse{}, err
+	}
+
+	type result struct {
+		response pluginResponse
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		for p.stdout.Scan() {
+			var response pluginResponse
+			if err := json.Unmarshal(p.stdout.Bytes(), &response); err != nil {
+				done <- result{err: fmt.Errorf("malformed response %q: %w", p.stdout.Text(), err)}
+				return
+			}
+			// answers about other events are left over from before a
+			// restart; skip them
+			if response.ID == request.Event.ID {
+				done <- result{response: response}
+				return
+			}
+		}
+		err := p.stdout.Err()
+		if err == nil {
+			err = errors.New("plugin exited")
+		}
+		done <- result{err: err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			p.stop()
+		}
+		return r.response, r.err
+	case <-time.After(p.Timeout):
+		p.stop()
+		<-done
+		return pluginResponse{}, fmt.Errorf("no answer within %s", p.Timeout)
+	}
+}
+
+func (p *EventPlugin) start() error {
+	fields := strings.Fields(p.Command)
+	if len(fields) == 0 {
+		return errors.New("empty plugin command")
+	}
+	cmd := exec.Command(fields[0], fields[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting plugin: %w", err)
+	}
+
+	p.cmd, p.stdin = cmd, stdin
+	p.stdout = bufio.NewScanner(stdout)
+	p.stdout.Buffer(make([]byte, 64*1024), 1<<20)
+	return nil
+}
+
+func (p *EventPlugin) stop() {
+	if p.cmd == nil {
+		return
+	}
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+	p.cmd = nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"time"
+)
+
+func MaxFilterLimit(max int) func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	return func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+		if filter.Limit > max {
+			return true, fmt.Sprintf("invalid: limit can't be above %d, paginate with until instead", max)
+		}
+		return false, ""
+	}
+}
+
+// MaxFilterTimeSpan rejects filters asking for a window wider than max. The
+// span is only checked when since is set; filters without it are already
+// bounded by their limit.
+func MaxFilterTimeSpan(max time.Duration) func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	return func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+		if filter.Since == nil {
+			return false, ""
+		}
+
+		until := nostr.Now()
+		if filter.Until != nil {
+			until = *filter.Until
+		}
+		if until.Time().Sub(filter.Since.Time()) > max {
+			return true, fmt.Sprintf("invalid: time range can't span more than %v", max)
+		}
+		return false, ""
+	}
+}
+
+func MaxFilterAuthors(max int) func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	return func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+		if len(filter.Authors) > max {
+			return true, fmt.Sprintf("invalid: can't filter for more than %d authors", max)
+		}
+		return false, ""
+	}
+}
+
+func MaxFilterIDs(max int) func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	return func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+		if len(filter.IDs) > max {
+			return true, fmt.Sprintf("invalid: can't filter for more than %d ids", max)
+		}
+		return false, ""
+	}
+}
+
+// MaxFilterSize rejects filters taking more than max bytes of JSON, like
+// thousands of tag values that are cheap to send but costly to match.
+func MaxFilterSize(max int) func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	return func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+		if size := len(filter.String()); size > max {
+			return true, fmt.Sprintf("invalid: filter is %d bytes, can't be more than %d", size, max)
+		}
+		return false, ""
+	}
+}
+
+// MaxEventSize rejects events taking more than max bytes of JSON. Messages
+// over WEBSOCKET_MAX_MESSAGE_SIZE never get this far: the websocket is
+// closed as soon as one is read.
+func MaxEventSize(max int) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if size := len(event.String()); size > max {
+			return true, fmt.Sprintf("invalid: event is %d bytes, can't be more than %d", size, max)
+		}
+		return false, ""
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PolicyHook POSTs each event, with its author's account and price, to an
+// external service as JSON (see policyInput), which answers
+//
+//	{"action": "accept" | "reject", "msg": "...", "price_msat": 2000}
+//
+// price_msat is optional and replaces the price the relay came up with. A
+// hook that fails or doesn't answer within Timeout lets events through at
+// the usual price, or with FailClosed, rejects them.
+//
+// The answer about an event is kept for a minute, so pricing it and then
+// accepting it only asks once.
+type PolicyHook struct {
+	URL        string
+	Token      string
+	Timeout    time.Duration
+	FailClosed bool
+
+	decisions map[string]hookDecision
+	pruned    time.Time
+	mutex     sync.Mutex
+}
+
+// HookPricer charges the price the hook answers with instead of Inner's.
+type HookPricer struct {
+	Hook  *PolicyHook
+	Inner Pricer
+}
+
+type hookDecision struct {
+	Action    string `json:"action"`
+	Msg       string `json:"msg"`
+	PriceMsat *int64 `json:"price_msat"`
+
+	err     error
+	expires time.Time
+}
+
+const hookDecisionTTL = time.Minute
+
+var (
+	policyHook     *PolicyHook
+	policyHookOnce sync.Once
+
+	policyHookDecisions = NewCounterVec("ppe_policy_hook_decisions_total", "Events the HTTP policy hook was asked about, by its answer.", "action")
+)
+
+// GetPolicyHook reads POLICY_HOOK_URL, POLICY_HOOK_TOKEN, sent as a bearer
+// token, POLICY_HOOK_TIMEOUT and POLICY_HOOK_FAIL, open or closed. It's nil
+// without a URL. There's one hook, shared by the pricer and the RejectEvent
+// policy.
+func GetPolicyHook() *PolicyHook {
+	policyHookOnce.Do(func() {
+		url := GetEnvDefault("POLICY_HOOK_URL", "")
+		if url == "" {
+			return
+		}
+		failure := GetEnvDefault("POLICY_HOOK_FAIL", "open")
+		if failure != "open" && failure != "closed" {
+			panic(fmt.Sprintf("POLICY_HOOK_FAIL must be open or closed, got %q", failure))
+		}
+		policyHook = &PolicyHook{
+			URL:        url,
+			Token:      GetEnvDefault("POLICY_HOOK_TOKEN", ""),
+			Timeout:    GetEnvDuration("POLICY_HOOK_TIMEOUT", 2*time.Second),
+			FailClosed: failure == "closed",
+			decisions:  make(map[string]hookDecision),
+		}
+	})
+	return policyHook
+}
+
+// decide returns the hook's answer about event, asking it unless it was
+// asked in the last minute. Failures are remembered too, so an event isn't
+// held up by the same timeout twice.
+func (h *PolicyHook) decide(event *nostr.Event, account BillingAccount, msat *int64) hookDecision {
+	now := time.Now()
+	h.mutex.Lock()
+	decision, ok := h.decisions[event.ID]
+	h.mutex.Unlock()
+	if ok && now.Before(decision.expires) {
+		return decision
+	}
+
+	decision = h.ask(policyInput{Event: event, Author: account.PubKey, Account: newPolicyAccount(account), Msat: msat})
+	if decision.err != nil {
+		policyHookDecisions.Inc("error")
+		ReportError(decision.err, "policyhook", map[string]string{"event": event.ID})
+	} else {
+		policyHookDecisions.Inc(decision.Action)
+	}
+	decision.expires = now.Add(hookDecisionTTL)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if now.Sub(h.pruned) > hookDecisionTTL {
+		for id, cached := range h.decisions {
+			if now.After(cached.expires) {
+				delete(h.decisions, id)
+			}
+		}
+		h.pruned = now
+	}
+	h.decisions[event.ID] = decision
+	return decision
+}
+
+func (h *PolicyHook) ask(input policyInput) hookDecision {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return hookDecision{err: err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return hookDecision{err: err}
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if h.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return hookDecision{err: err}
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return hookDecision{err: fmt.Errorf("policy hook returned %s", response.Status)}
+	}
+
+	var decision hookDecision
+	if err := json.NewDecoder(response.Body).Decode(&decision); err != nil {
+		return hookDecision{err: fmt.Errorf("policy hook returned malformed json: %w", err)}
+	}
+	if decision.Action != "accept" && decision.Action != "reject" {
+		return hookDecision{err: fmt.Errorf("policy hook returned unknown action %q", decision.Action)}
+	}
+	if decision.PriceMsat != nil && *decision.PriceMsat < 0 {
+		return hookDecision{err: errors.New("policy hook returned a negative price")}
+	}
+	return decision
+}
+
+// RejectWithHook is a RejectEvent policy asking the hook whether to accept
+// each event. The account's balance is as recorded, without looking
+// upstream for new zaps first.
+func RejectWithHook(h *PolicyHook, db Database) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		decision := h.decide(event, GetRecordedBillingAccount(GetEventAuthor(event), db), nil)
+		if decision.err != nil {
+			if h.FailClosed {
+				return true, RejectError + ": couldn't check this event, try again later"
+			}
+			return false, ""
+		}
+		if decision.Action != "reject" {
+			return false, ""
+		}
+		if decision.Msg == "" {
+			return true, RejectBlocked + ": rejected by policy"
+		}
+		return true, decision.Msg
+	}
+}
+
+func (p HookPricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	price, err := p.Inner.Price(event, account)
+	if err != nil {
+		return 0, err
+	}
+	decision := p.Hook.decide(event, account, &price)
+	if decision.err != nil {
+		if p.Hook.FailClosed {
+			return 0, errors.New("couldn't price this event, try again later")
+		}
+		return price, nil
+	}
+	if decision.PriceMsat != nil {
+		return *decision.PriceMsat, nil
+	}
+	return price, nil
+}
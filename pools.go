@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"regexp"
+	"strings"
+)
+
+var poolSchema = Schema{
+	Tables: []string{"balance_pool", "pool_member"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS balance_pool (
+       name text NOT NULL PRIMARY KEY,
+       admin text NOT NULL,
+       created_at bigint NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS balancepooladminidx ON balance_pool(admin)`,
+		`CREATE TABLE IF NOT EXISTS pool_member (
+       pubkey text NOT NULL PRIMARY KEY,
+       pool text NOT NULL,
+       accepted boolean NOT NULL,
+       added_at bigint NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS poolmemberpoolidx ON pool_member(pool)`,
+	},
+}
+
+// A BalancePool is a balance a community funds together: anyone can zap the
+// bot with "pool:<name>" in the comment to add to it, and it pays for the
+// events of the members its admin invites, once they accept with "pool join
+// <name>", for as long as it has a balance. Its ledger entries are under
+// PoolAccount(name) rather than a pubkey.
+type BalancePool struct {
+	Name      string          `json:"name"`
+	Admin     string          `json:"admin"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+const poolAccountPrefix = "pool:"
+
+var (
+	poolNamePattern    = regexp.MustCompile(`^[a-z0-9-]{3,32}$`)
+	poolCommentPattern = regexp.MustCompile(`(?i)\bpool:([a-z0-9-]{3,32})\b`)
+
+	poolsFunded = NewCounter("ppe_pool_zaps_total", "Zaps credited to a community balance pool.")
+)
+
+// PoolAccount is the ledger account of the pool named name.
+func PoolAccount(name string) string {
+	return poolAccountPrefix + name
+}
+
+func isPoolAccount(account string) bool {
+	return strings.HasPrefix(account, poolAccountPrefix)
+}
+
+func GetPool(name string, db Database) (*BalancePool, error) {
+	var p BalancePool
+	err := db.DB.QueryRow(`SELECT name, admin, created_at FROM balance_pool WHERE name = ?`, name).Scan(&p.Name, &p.Admin, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return &p, err
+}
+
+// GetAdministeredPool returns the pool admin runs, if any.
+func GetAdministeredPool(admin string, db Database) (*BalancePool, error) {
+	var p BalancePool
+	err := db.DB.QueryRow(`SELECT name, admin, created_at FROM balance_pool WHERE admin = ?`, admin).Scan(&p.Name, &p.Admin, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return &p, err
+}
+
+// GetMemberPool returns the name of the pool pubkey draws on, or "".
+func GetMemberPool(pubkey string, db Database) string {
+	var name string
+	err := db.DB.QueryRow(`SELECT pool FROM pool_member WHERE pubkey = ? AND accepted`, pubkey).Scan(&name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		ReportError(err, "pools", map[string]string{"pubkey": pubkey})
+	}
+	return name
+}
+
+// GetZapPool returns the existing pool a zap's comment names, or "".
+func GetZapPool(zapRequest *Description, db Database) string {
+	match := poolCommentPattern.FindStringSubmatch(zapRequest.Content)
+	if match == nil {
+		return ""
+	}
+	name := strings.ToLower(match[1])
+	if p, err := GetPool(name, db); err != nil {
+		ReportError(err, "pools", map[string]string{"pool": name})
+		return ""
+	} else if p == nil {
+		return ""
+	}
+	return name
+}
+
+// CreatePool creates a pool run by admin. Each pubkey runs at most one.
+func CreatePool(name string, admin string, db Database) error {
+	name = strings.ToLower(name)
+	if !poolNamePattern.MatchString(name) {
+		return errors.New("names are 3 to 32 letters, digits or dashes")
+	}
+	if existing, err := GetAdministeredPool(admin, db); err != nil {
+		return err
+	} else if existing != nil {
+		return fmt.Errorf("you already run the pool %s", existing.Name)
+	}
+	result, err := db.DB.Exec(`INSERT INTO balance_pool (name, admin, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, name, admin, NowTimestamp())
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("that name is taken")
+	}
+	return nil
+}
+
+// AddPoolMember invites member to the pool, which pays for their events
+// once they JoinPool. A pubkey draws on one pool at a time.
+func AddPoolMember(name string, member string, db Database) error {
+	// a pending invitation can be replaced by another one, an accepted
+	// membership only by the same pool
+	result, err := db.DB.Exec(
+		`INSERT INTO pool_member (pubkey, pool, accepted, added_at) VALUES (?, ?, false, ?)
+		 ON CONFLICT (pubkey) DO UPDATE SET pool = excluded.pool, accepted = pool_member.accepted AND pool_member.pool = excluded.pool, added_at = excluded.added_at
+		 WHERE NOT pool_member.accepted OR pool_member.pool = excluded.pool`,
+		member, name, NowTimestamp(),
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("that pubkey is in another pool")
+	}
+	return nil
+}
+
+// JoinPool accepts the invitation to the pool named name.
+func JoinPool(member string, name string, db Database) error {
+	result, err := db.DB.Exec(`UPDATE pool_member SET accepted = true WHERE pubkey = ? AND pool = ?`, member, name)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("you weren't invited to that pool")
+	}
+	return nil
+}
+
+func RemovePoolMember(name string, member string, db Database) error {
+	result, err := db.DB.Exec(`DELETE FROM pool_member WHERE pubkey = ? AND pool = ?`, member, name)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("that pubkey isn't in the pool")
+	}
+	return nil
+}
+
+func CountPoolMembers(name string, db Database) int64 {
+	var count int64
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM pool_member WHERE pool = ? AND accepted`, name).Scan(&count); err != nil {
+		ReportError(err, "pools", map[string]string{"pool": name})
+	}
+	return count
+}
+
+// HandlePoolCommand answers "pool", "pool create <name>", "pool add <npub>",
+// "pool remove <npub>", "pool join <name>" and "pool leave".
+func HandlePoolCommand(pubkey string, args []string, db Database) string {
+	if len(args) == 0 {
+		run, err := GetAdministeredPool(pubkey, db)
+		if err != nil {
+			ReportError(err, "pools", map[string]string{"pubkey": pubkey})
+			return "Couldn't look up your pool, try again later."
+		}
+		if run != nil {
+			return fmt.Sprintf("You run the pool %s: %d sats left for its %d members. Anyone can add to it by zapping me with \"pool:%s\" in the comment.",
+				run.Name, GetLedgerBalanceMsat(PoolAccount(run.Name), db)/1000, CountPoolMembers(run.Name, db), run.Name)
+		}
+		if name := GetMemberPool(pubkey, db); name != "" {
+			return fmt.Sprintf("The pool %s pays for your events while it has a balance, %d sats now. Zap me with \"pool:%s\" in the comment to add to it.",
+				name, GetLedgerBalanceMsat(PoolAccount(name), db)/1000, name)
+		}
+		return "You're not in a pool. Start one for your community with pool create <name>."
+	}
+
+	switch action := strings.ToLower(args[0]); action {
+	case "create":
+		if len(args) != 2 {
+			return "Usage: pool create <name>"
+		}
+		if err := CreatePool(args[1], pubkey, db); err != nil {
+			return fmt.Sprintf("Couldn't create the pool: %v.", err)
+		}
+		name := strings.ToLower(args[1])
+		return fmt.Sprintf("Created the pool %s. Zaps to me with \"pool:%s\" in the comment fund it, and it pays for the events of the members you invite with pool add <npub> once they join.", name, name)
+	case "join":
+		if len(args) != 2 {
+			return "Usage: pool join <name>"
+		}
+		name := strings.ToLower(args[1])
+		if err := JoinPool(pubkey, name, db); err != nil {
+			return fmt.Sprintf("Couldn't join the pool: %v.", err)
+		}
+		return fmt.Sprintf("You joined the pool %s, it pays for your events while it has a balance.", name)
+	case "leave":
+		name := GetMemberPool(pubkey, db)
+		if name == "" {
+			return "You're not in a pool."
+		}
+		if err := RemovePoolMember(name, pubkey, db); err != nil {
+			return fmt.Sprintf("Couldn't leave the pool: %v.", err)
+		}
+		return "You left the pool, your events are paid from your own balance again."
+	case "add", "remove":
+		if len(args) != 2 {
+			return fmt.Sprintf("Usage: pool %s <npub>", action)
+		}
+		member, err := ParsePubKey(strings.TrimPrefix(args[1], "nostr:"))
+		if err != nil {
+			return fmt.Sprintf("Invalid pubkey: %v.", err)
+		}
+		run, err := GetAdministeredPool(pubkey, db)
+		if err != nil {
+			ReportError(err, "pools", map[string]string{"pubkey": pubkey})
+			return "Couldn't look up your pool, try again later."
+		} else if run == nil {
+			return "You don't run a pool. Start one with pool create <name>."
+		}
+		if action == "add" {
+			err = AddPoolMember(run.Name, member, db)
+		} else {
+			err = RemovePoolMember(run.Name, member, db)
+		}
+		if err != nil {
+			return fmt.Sprintf("Couldn't %s %s: %v.", action, args[1], err)
+		}
+		if action == "remove" {
+			return fmt.Sprintf("Removed %s from the pool.", args[1])
+		}
+		npub, _ := nip19.EncodePublicKey(member)
+		go func() {
+			message := fmt.Sprintf("You were invited to the community pool %s on %s. Mention me with \"pool join %s\" to have it pay for your events while it has a balance.", run.Name, relay.Info.Name, run.Name)
+			if err := SendDirectMessage(member, message, db); err != nil {
+				ReportError(err, "pools", map[string]string{"pubkey": member})
+			}
+		}()
+		return fmt.Sprintf("Invited nostr:%s. Once they send \"pool join %s\", the pool pays for their events.", npub, run.Name)
+	}
+	return "Usage: pool [create <name>|add <npub>|remove <npub>|join <name>|leave]"
+}
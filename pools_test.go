@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"testing"
+)
+
+func TestPoolMembership(t *testing.T) {
+	h := NewHarness(t)
+	admin, member := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	if err := CreatePool("party", admin, h.DB); err != nil {
+		t.Fatalf("creating pool: %v", err)
+	}
+
+	for comment, pool := range map[string]string{
+		"pool:party":          "party",
+		"for the Pool:PARTY!": "party",
+		"pool party tonight":  "",
+		"pool: party":         "",
+		"carpool:party":       "",
+	} {
+		if got := GetZapPool(&Description{Content: comment}, h.DB); got != pool {
+			t.Errorf("comment %q funds pool %q, expected %q", comment, got, pool)
+		}
+	}
+
+	if err := AddPoolMember("party", member, h.DB); err != nil {
+		t.Fatalf("inviting: %v", err)
+	}
+	if name := GetMemberPool(member, h.DB); name != "" {
+		t.Fatalf("invited pubkey draws on %s before joining", name)
+	}
+	if err := JoinPool(member, "other", h.DB); err == nil {
+		t.Fatal("joined a pool without an invitation")
+	}
+	if err := JoinPool(member, "party", h.DB); err != nil {
+		t.Fatalf("joining: %v", err)
+	}
+	if name := GetMemberPool(member, h.DB); name != "party" {
+		t.Fatalf("member draws on %q after joining, expected party", name)
+	}
+}
@@ -0,0 +1,173 @@
+package ppe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Config is how Attach bills a relay's events. Only Ledger is required.
+type Config struct {
+	// Ledger records what pubkeys pay and are charged.
+	Ledger Ledger
+
+	// Pricer prices events, one sat each if nil.
+	Pricer Pricer
+
+	// Account describes the author of an event for Pricer. Without it,
+	// accounts only have a pubkey and its payer's balance in the ledger.
+	Account func(ctx context.Context, pubkey string) (BillingAccount, error)
+
+	// Payments issues top-up invoices at /invoice?pubkey=...&amount=<sats>.
+	// There's no such endpoint without it.
+	Payments PaymentBackend
+
+	// Recipient is the hex pubkey top-ups are zapped to, and ZapRelays where
+	// the receipts of those zaps are watched for to credit them, see
+	// CreditZapReceipt. Without both, crediting is up to the caller.
+	Recipient string
+	ZapRelays []string
+
+	// Zappers are the pubkeys whose zap receipts are trusted, the
+	// nostrPubkey of the lightning address top-ups are paid to. If empty,
+	// it's looked up from Payments when that's an LNURLPayBackend.
+	Zappers []string
+
+	// Clock times price quotes, the system's if nil.
+	Clock Clock
+
+	// The rest are for relays billing more than an event's author, which
+	// is how ppe-relay hooks its teams, allowances, packages and the like
+	// in. Each has a default doing without.
+
+	// Author is who an event is billed for, e.g. its delegator, rather
+	// than its pubkey.
+	Author func(event *nostr.Event) string
+
+	// Payer is whoever pays for author's events, rather than author.
+	Payer func(author string) string
+
+	// Lock holds payer's balance while an event is checked against it or
+	// charged, until the returned func is called, so nothing else spending
+	// from it can run in between. Events are checked against the balance
+	// less the prices held for others either way, see HeldMsat.
+	Lock func(payer string) (unlock func())
+
+	// Exempt returns why an event isn't billed at all, or "". Exempt events
+	// are accepted whatever the balance and debited nothing, with the
+	// reason.
+	Exempt func(ctx context.Context, event *nostr.Event, author string) string
+
+	// Check can reject an event over its price before the balance is
+	// checked, e.g. for going over a spend limit.
+	Check func(ctx context.Context, account BillingAccount, price int64) (reject bool, msg string)
+
+	// Afford replaces checking that the account's balance covers the price.
+	Afford func(ctx context.Context, account BillingAccount, price int64) (reject bool, msg string)
+
+	// Waive returns why a stored event isn't charged, e.g. a prepaid
+	// package covering it, or "" to charge it. Waived events are debited
+	// nothing, with the reason.
+	Waive func(ctx context.Context, event *nostr.Event, author string, payer string) string
+
+	// Charged is called once a stored event is debited, with the reason it
+	// was exempt or waived if it was.
+	Charged func(ctx context.Context, event *nostr.Event, author string, payer string, msat int64, waived string)
+
+	// Report is told about events that couldn't be billed, which are
+	// logged without it.
+	Report func(err error, event *nostr.Event)
+}
+
+// Attach adds pay-per-event billing to relay: events are rejected unless
+// their author can afford them and charged once stored, with the top-up
+// endpoint and zap receipt watcher Config asks for, the watcher running
+// until ctx is done. Its policies are appended to the relay's, so ones that
+// reject events for free should be added first.
+//
+// Attach wires billing, not a whole ppe-relay: ppe-relay attaches its own
+// billing with it, but its other policies, bot, admin routes and background
+// jobs aren't part of the package, and relays embedding it don't get them.
+func Attach(ctx context.Context, relay *khatru.Relay, cfg Config) error {
+	if cfg.Ledger == nil {
+		return errors.New("ppe: a Ledger is required")
+	}
+	if cfg.Pricer == nil {
+		cfg.Pricer = FlatPricer{Msat: 1000}
+	}
+	if (cfg.Recipient == "") != (len(cfg.ZapRelays) == 0) {
+		return errors.New("ppe: Recipient and ZapRelays go together")
+	}
+	if cfg.Recipient != "" && !nostr.IsValidPublicKey(cfg.Recipient) {
+		return fmt.Errorf("ppe: invalid Recipient %q", cfg.Recipient)
+	}
+	if cfg.Recipient != "" && len(cfg.Zappers) == 0 {
+		lnurl, ok := cfg.Payments.(*LNURLPayBackend)
+		if !ok {
+			return errors.New("ppe: Zappers is required to credit zap receipts")
+		}
+		params, err := lnurl.PayParams()
+		if err != nil {
+			return fmt.Errorf("ppe: looking up the zapper: %w", err)
+		}
+		if !nostr.IsValidPublicKey(params.NostrPubkey) {
+			return errors.New("ppe: the lightning address has no valid nostrPubkey")
+		}
+		cfg.Zappers = []string{params.NostrPubkey}
+	}
+
+	relay.RejectEvent = append(relay.RejectEvent, RequireBalance(cfg))
+	relay.OnEventSaved = append(relay.OnEventSaved, ChargeEvent(cfg))
+	if cfg.Payments != nil {
+		relay.Router().HandleFunc("/invoice", HandleInvoice(cfg.Payments))
+	}
+	if cfg.Recipient != "" {
+		go WatchZapReceipts(ctx, cfg.Ledger, ZapVerifier{Recipient: cfg.Recipient, Zappers: cfg.Zappers}, cfg.ZapRelays)
+	}
+	return nil
+}
+
+// HandleInvoice answers ?pubkey=<npub or hex>&amount=<sats> with an invoice
+// from payments crediting pubkey once paid, as {"pubkey", "amount",
+// "invoice"}.
+func HandleInvoice(payments PaymentBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+
+		pubkey := r.URL.Query().Get("pubkey")
+		if strings.HasPrefix(pubkey, "npub1") {
+			if _, decoded, err := nip19.Decode(pubkey); err == nil {
+				pubkey, _ = decoded.(string)
+			}
+		}
+		if !nostr.IsValidPublicKey(pubkey) {
+			writeError(w, http.StatusBadRequest, "pubkey must be an npub or hex public key")
+			return
+		}
+		amount, _ := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+		if amount <= 0 {
+			writeError(w, http.StatusBadRequest, "amount must be a positive number of sats")
+			return
+		}
+
+		bolt11, err := payments.CreateInvoice(pubkey, amount*1000)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"pubkey": pubkey, "amount": amount, "invoice": bolt11})
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
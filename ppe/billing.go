@@ -0,0 +1,211 @@
+package ppe
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"log"
+	"sync"
+	"time"
+)
+
+// An event is priced once, by RequireBalance, and charged that price once
+// it's saved. khatru hands both the connection's context, which can't carry
+// a value from one to the other, so the quote is kept by event id until the
+// event is saved or QuoteTTL has passed. Meanwhile the price is held on its
+// payer's balance, see HeldMsat.
+const QuoteTTL = time.Minute
+
+type priceQuote struct {
+	payer   string
+	msat    int64
+	expires time.Time
+}
+
+var (
+	priceQuotes      = make(map[string]priceQuote)
+	priceHeld        = make(map[string]int64)
+	priceQuotesMutex sync.Mutex
+	priceQuotesPrune time.Time
+)
+
+// QuotePrice remembers msat as event's price for TakeQuotedPrice, holding
+// it on payer's balance, for QuoteTTL by clock, the system's if nil.
+func QuotePrice(clock Clock, event *nostr.Event, payer string, msat int64) {
+	now := now(clock)
+	priceQuotesMutex.Lock()
+	defer priceQuotesMutex.Unlock()
+	if now.Sub(priceQuotesPrune) > QuoteTTL {
+		for id, quote := range priceQuotes {
+			if now.After(quote.expires) {
+				forgetQuote(id)
+			}
+		}
+		priceQuotesPrune = now
+	}
+	forgetQuote(event.ID)
+	priceQuotes[event.ID] = priceQuote{payer: payer, msat: msat, expires: now.Add(QuoteTTL)}
+	priceHeld[payer] += msat
+}
+
+// TakeQuotedPrice returns the price quoted for event, forgetting it.
+func TakeQuotedPrice(clock Clock, event *nostr.Event) (msat int64, ok bool) {
+	priceQuotesMutex.Lock()
+	defer priceQuotesMutex.Unlock()
+	quote, ok := forgetQuote(event.ID)
+	return quote.msat, ok && now(clock).Before(quote.expires)
+}
+
+// HeldMsat is what events payer pays for were quoted and not charged yet,
+// which a check of its balance has to leave for them.
+func HeldMsat(payer string) int64 {
+	return heldMsat(payer, "")
+}
+
+// heldMsat leaves out the quote for the event with id, which a copy of it
+// sent again replaces.
+func heldMsat(payer string, id string) int64 {
+	priceQuotesMutex.Lock()
+	defer priceQuotesMutex.Unlock()
+	held := priceHeld[payer]
+	if quote, ok := priceQuotes[id]; ok && quote.payer == payer {
+		held -= quote.msat
+	}
+	return held
+}
+
+func forgetQuote(id string) (priceQuote, bool) {
+	quote, ok := priceQuotes[id]
+	if !ok {
+		return quote, false
+	}
+	delete(priceQuotes, id)
+	if priceHeld[quote.payer] -= quote.msat; priceHeld[quote.payer] <= 0 {
+		delete(priceHeld, quote.payer)
+	}
+	return quote, true
+}
+
+// RequireBalance is a RejectEvent policy rejecting events whoever pays for
+// them can't afford at the current price, quoting it for ChargeEvent.
+// Prices quoted for other events and not charged yet don't count as
+// balance. Exempt events are let through without a price.
+func RequireBalance(cfg Config) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		author := cfg.author(event)
+		if cfg.exempt(ctx, event, author) != "" {
+			return false, ""
+		}
+		payer := cfg.payer(author)
+		defer cfg.lock(payer)()
+		account, err := cfg.account(ctx, author)
+		if err != nil {
+			cfg.report(fmt.Errorf("billing account %s: %w", author, err), event)
+			return true, "error: couldn't check your balance, try again later"
+		}
+		account.BalanceMsat -= heldMsat(payer, event.ID)
+		price, err := cfg.Pricer.Price(event, account)
+		if err != nil {
+			return true, "blocked: " + err.Error()
+		}
+		if cfg.Check != nil {
+			if reject, msg := cfg.Check(ctx, account, price); reject {
+				return true, msg
+			}
+		}
+		if cfg.Afford != nil {
+			reject, msg = cfg.Afford(ctx, account, price)
+		} else if account.BalanceMsat < price {
+			reject, msg = true, "payment-required: no sufficient balance; top up"
+		}
+		if !reject {
+			QuotePrice(cfg.Clock, event, payer, price)
+		}
+		return reject, msg
+	}
+}
+
+// ChargeEvent is an OnEventSaved hook debiting whoever pays for a stored
+// event the price RequireBalance quoted, or nothing if it's exempt or
+// waived. The debit is keyed by the event's id, so an event is never
+// charged twice, and events without a quote aren't charged at all.
+func ChargeEvent(cfg Config) func(ctx context.Context, event *nostr.Event) {
+	return func(ctx context.Context, event *nostr.Event) {
+		if dynamic, ok := cfg.Pricer.(*DynamicPricer); ok {
+			dynamic.Observe()
+		}
+		author := cfg.author(event)
+		payer := cfg.payer(author)
+		// the quote stays held until the debit's recorded
+		unlock := cfg.lock(payer)
+		price, quoted := TakeQuotedPrice(cfg.Clock, event)
+		waived := cfg.exempt(ctx, event, author)
+		if waived == "" && cfg.Waive != nil {
+			waived = cfg.Waive(ctx, event, author, payer)
+		}
+		reason := fmt.Sprintf("kind %d", event.Kind)
+		switch {
+		case waived != "":
+			// recorded as a free debit, so the event is known to be billed
+			price, reason = 0, waived
+		case !quoted:
+			unlock()
+			cfg.report(fmt.Errorf("no price quoted for event %s", event.ID), event)
+			return
+		}
+
+		charged, err := cfg.Ledger.DebitEvent(event, author, payer, price, reason)
+		unlock()
+		if err != nil {
+			cfg.report(err, event)
+			return
+		}
+		if charged && cfg.Charged != nil {
+			cfg.Charged(ctx, event, author, payer, price, waived)
+		}
+	}
+}
+
+func (cfg Config) author(event *nostr.Event) string {
+	if cfg.Author != nil {
+		return cfg.Author(event)
+	}
+	return event.PubKey
+}
+
+func (cfg Config) payer(author string) string {
+	if cfg.Payer != nil {
+		return cfg.Payer(author)
+	}
+	return author
+}
+
+func (cfg Config) lock(payer string) (unlock func()) {
+	if cfg.Lock != nil {
+		return cfg.Lock(payer)
+	}
+	return func() {}
+}
+
+func (cfg Config) exempt(ctx context.Context, event *nostr.Event, author string) string {
+	if cfg.Exempt != nil {
+		return cfg.Exempt(ctx, event, author)
+	}
+	return ""
+}
+
+func (cfg Config) account(ctx context.Context, pubkey string) (BillingAccount, error) {
+	if cfg.Account != nil {
+		return cfg.Account(ctx, pubkey)
+	}
+	balance, err := cfg.Ledger.BalanceMsat(cfg.payer(pubkey))
+	return BillingAccount{PubKey: pubkey, BalanceMsat: balance}, err
+}
+
+func (cfg Config) report(err error, event *nostr.Event) {
+	if cfg.Report != nil {
+		cfg.Report(err, event)
+		return
+	}
+	log.Printf("billing event %s: %v", event.ID, err)
+}
@@ -0,0 +1,51 @@
+package ppe
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is where billing gets the time from, so tests can set it.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the time as the system has it.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a Clock that only moves when told to, starting at its
+// zero time unless Set.
+type ManualClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) Set(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = t
+}
+
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// now is c's time, or the system's when c is nil.
+func now(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
@@ -0,0 +1,32 @@
+// Package ppe is the billing at the core of ppe-relay, pay-per-event nostr
+// relay, for operators who want to charge for events on relays of their own.
+//
+// A Pricer decides what an event costs given what's known about its
+// author's BillingAccount; ParsePricing builds one from the same specs as
+// ppe-relay's PRICING. A Ledger records what each pubkey has paid and been
+// charged, and a PaymentBackend issues invoices that top balances up.
+//
+// Attach wires them into a khatru relay:
+//
+//	ledger := ppe.SQLLedger{DB: db}
+//	ledger.Init()
+//	pricer, _ := ppe.ParsePricing("kind:1=1000,*=2000")
+//	err := ppe.Attach(ctx, relay, ppe.Config{
+//		Ledger:    ledger,
+//		Pricer:    pricer,
+//		Payments:  &ppe.LNURLPayBackend{Address: "me@getalby.com", ZapRequest: topUp},
+//		Recipient: myPubkey,
+//		ZapRelays: []string{"wss://nos.lol"},
+//	})
+//
+// where topUp calls TopUpZapRequest with the secret key of myPubkey, the
+// lightning address's owner, and cancelling ctx stops watching for zaps.
+//
+// This is ppe-relay's own billing, not a copy of it: ppe-relay keeps its
+// balances in SQLLedger, credits zaps with ZapVerifier and bills events by
+// calling Attach, hooking its teams, allowances, spend limits, packages and
+// the like in through Config. A relay on SQLLedger
+// shares ppe-relay's ledger tables, so the two can run on one database.
+// The rest of ppe-relay, its bot, admin routes and background jobs, is out
+// of the package's scope.
+package ppe
@@ -0,0 +1,181 @@
+package ppe
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Ledger records what pubkeys pay and are charged. Entries have ids that
+// make them idempotent: crediting or debiting the same id twice is a no-op,
+// reported with false, so a payment or an event seen twice isn't counted
+// twice.
+type Ledger interface {
+	// CreditZap credits a verified zap to pubkey, once per invoice
+	// whatever receipt it comes in.
+	CreditZap(zap *Zap, pubkey string) (credited bool, err error)
+	// Credit adds msat that weren't zapped, like referral rewards.
+	Credit(id string, pubkey string, msat int64, reason string) (credited bool, err error)
+	// Debit charges pubkey for something other than storing an event.
+	Debit(id string, pubkey string, msat int64, reason string) (debited bool, err error)
+	// DebitEvent charges payer for a stored event, noting the author it
+	// was billed for, which needn't be payer or the event's pubkey.
+	DebitEvent(event *nostr.Event, author string, payer string, msat int64, reason string) (debited bool, err error)
+	BalanceMsat(pubkey string) (int64, error)
+}
+
+// SQLLedger is ppe-relay's Ledger, in a sqlite or postgres database with
+// the tables LedgerDDLs create: zaps are credited to zap_credit, unless
+// revoked in zap_revocation, other credits to bonus_credit and trial_credit,
+// and charges to debit, with the authors of charged events in debit_author.
+// Entries are dated by Clock, the system's if nil.
+type SQLLedger struct {
+	DB    *sqlx.DB
+	Clock Clock
+}
+
+// LedgerTables are the tables LedgerDDLs create.
+var LedgerTables = []string{"zap_credit", "zap_revocation", "trial_credit", "debit", "debit_author", "bonus_credit"}
+
+// LedgerDDLs create SQLLedger's tables if they don't exist.
+var LedgerDDLs = []string{
+	`CREATE TABLE IF NOT EXISTS zap_credit (
+       id text NOT NULL PRIMARY KEY,
+       pubkey text NOT NULL,
+       amount_msat bigint NOT NULL,
+       bolt11 text NOT NULL,
+       created_at bigint NOT NULL,
+       credited_at bigint NOT NULL);`,
+	`CREATE INDEX IF NOT EXISTS zapcreditpubkeyidx ON zap_credit(pubkey)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS zapcreditbolt11idx ON zap_credit(bolt11)`,
+	`CREATE TABLE IF NOT EXISTS zap_revocation (
+       id text NOT NULL PRIMARY KEY,
+       reason text NOT NULL,
+       revoked_at bigint NOT NULL);`,
+	`CREATE TABLE IF NOT EXISTS trial_credit (
+       pubkey text NOT NULL PRIMARY KEY,
+       method text NOT NULL,
+       domain text NOT NULL,
+       amount_msat bigint NOT NULL,
+       granted_at bigint NOT NULL);`,
+	`CREATE INDEX IF NOT EXISTS trialcreditdomainidx ON trial_credit(domain)`,
+	`CREATE TABLE IF NOT EXISTS debit (
+       id text NOT NULL PRIMARY KEY,
+       pubkey text NOT NULL,
+       amount_msat bigint NOT NULL,
+       reason text NOT NULL,
+       created_at bigint NOT NULL);`,
+	`CREATE INDEX IF NOT EXISTS debitpubkeyidx ON debit(pubkey)`,
+	`CREATE TABLE IF NOT EXISTS debit_author (
+       id text NOT NULL PRIMARY KEY,
+       author text NOT NULL);`,
+	`CREATE INDEX IF NOT EXISTS debitauthoridx ON debit_author(author)`,
+	`CREATE TABLE IF NOT EXISTS bonus_credit (
+       id text NOT NULL PRIMARY KEY,
+       pubkey text NOT NULL,
+       amount_msat bigint NOT NULL,
+       reason text NOT NULL,
+       created_at bigint NOT NULL);`,
+	`CREATE INDEX IF NOT EXISTS bonuscreditpubkeyidx ON bonus_credit(pubkey)`,
+}
+
+// Init creates the ledger's tables.
+func (l SQLLedger) Init() error {
+	for _, ddl := range LedgerDDLs {
+		if _, err := l.DB.Exec(ddl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreditZap credits zap to pubkey under the id of its receipt, unless its
+// invoice was already credited: anyone can publish a copy of a receipt
+// under an id of their own. bolt11 is unique, so copies credited at the
+// same time can't both be.
+func (l SQLLedger) CreditZap(zap *Zap, pubkey string) (bool, error) {
+	return l.exec(
+		`INSERT INTO zap_credit (id, pubkey, amount_msat, bolt11, created_at, credited_at) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		zap.Receipt.ID, pubkey, zap.AmountMsat, zap.Bolt11, zap.Receipt.CreatedAt, now(l.Clock).Unix(),
+	)
+}
+
+func (l SQLLedger) Credit(id string, pubkey string, msat int64, reason string) (bool, error) {
+	return l.insert("bonus_credit", id, pubkey, msat, reason)
+}
+
+// CreditTrial grants pubkey its one trial credit, found by method for an
+// account on domain, if any.
+func (l SQLLedger) CreditTrial(pubkey string, method string, domain string, msat int64) (bool, error) {
+	return l.exec(
+		`INSERT INTO trial_credit (pubkey, method, domain, amount_msat, granted_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		pubkey, method, domain, msat, now(l.Clock).Unix(),
+	)
+}
+
+// RevokeZap takes back the zap credited under id, e.g. for a receipt found
+// to be forged, noting why.
+func (l SQLLedger) RevokeZap(id string, reason string) (bool, error) {
+	return l.exec(
+		`INSERT INTO zap_revocation (id, reason, revoked_at) SELECT id, ?, ? FROM zap_credit WHERE id = ? ON CONFLICT DO NOTHING`,
+		reason, now(l.Clock).Unix(), id,
+	)
+}
+
+func (l SQLLedger) Debit(id string, pubkey string, msat int64, reason string) (bool, error) {
+	return l.insert("debit", id, pubkey, msat, reason)
+}
+
+// DebitEvent debits the event under "event:" and its id.
+func (l SQLLedger) DebitEvent(event *nostr.Event, author string, payer string, msat int64, reason string) (bool, error) {
+	id := "event:" + event.ID
+	if _, err := l.exec(`INSERT INTO debit_author (id, author) VALUES (?, ?) ON CONFLICT DO NOTHING`, id, author); err != nil {
+		return false, err
+	}
+	return l.Debit(id, payer, msat, reason)
+}
+
+func (l SQLLedger) insert(table string, id string, pubkey string, msat int64, reason string) (bool, error) {
+	return l.exec(
+		`INSERT INTO `+table+` (id, pubkey, amount_msat, reason, created_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		id, pubkey, msat, reason, now(l.Clock).Unix(),
+	)
+}
+
+func (l SQLLedger) exec(query string, args ...any) (bool, error) {
+	result, err := l.DB.Exec(l.DB.Rebind(query), args...)
+	if err != nil {
+		return false, err
+	}
+	rows, _ := result.RowsAffected()
+	return rows > 0, nil
+}
+
+// CreditedMsat is what pubkey has been credited, zaps that were revoked
+// aside.
+func (l SQLLedger) CreditedMsat(pubkey string) (int64, error) {
+	var credited int64
+	err := l.DB.QueryRow(l.DB.Rebind(
+		`SELECT
+		   (SELECT COALESCE(SUM(amount_msat), 0) FROM zap_credit WHERE pubkey = ? AND id NOT IN (SELECT id FROM zap_revocation)) +
+		   (SELECT COALESCE(SUM(amount_msat), 0) FROM trial_credit WHERE pubkey = ?) +
+		   (SELECT COALESCE(SUM(amount_msat), 0) FROM bonus_credit WHERE pubkey = ?)`),
+		pubkey, pubkey, pubkey,
+	).Scan(&credited)
+	return credited, err
+}
+
+// DebitedMsat is what pubkey has been charged.
+func (l SQLLedger) DebitedMsat(pubkey string) (int64, error) {
+	var debited int64
+	err := l.DB.QueryRow(l.DB.Rebind(`SELECT COALESCE(SUM(amount_msat), 0) FROM debit WHERE pubkey = ?`), pubkey).Scan(&debited)
+	return debited, err
+}
+
+func (l SQLLedger) BalanceMsat(pubkey string) (int64, error) {
+	credited, err := l.CreditedMsat(pubkey)
+	if err != nil {
+		return 0, err
+	}
+	debited, err := l.DebitedMsat(pubkey)
+	return credited - debited, err
+}
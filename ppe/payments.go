@@ -0,0 +1,150 @@
+package ppe
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PaymentBackend issues invoices that credit a pubkey's balance once paid.
+type PaymentBackend interface {
+	CreateInvoice(pubkey string, amountMsat int64, tags ...nostr.Tag) (bolt11 string, err error)
+}
+
+// LNURLPayBackend requests invoices from a lightning address using zap
+// requests made by ZapRequest, usually TopUpZapRequest, which name the
+// pubkey to credit. Settlement is then detected like any other zap: the
+// wallet publishes a receipt to the relays the zap request lists, and
+// whoever watches them credits it.
+type LNURLPayBackend struct {
+	Address    string
+	ZapRequest func(pubkey string, amountMsat int64, tags ...nostr.Tag) (*nostr.Event, error)
+	Client     *http.Client
+}
+
+// PayParams are a lightning address's LNURL-pay parameters.
+type PayParams struct {
+	Callback    string `json:"callback"`
+	MinSendable int64  `json:"minSendable"`
+	MaxSendable int64  `json:"maxSendable"`
+	AllowsNostr bool   `json:"allowsNostr"`
+	NostrPubkey string `json:"nostrPubkey"`
+	Status      string `json:"status"`
+	Reason      string `json:"reason"`
+}
+
+type lnurlInvoice struct {
+	PR     string `json:"pr"`
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+var defaultClient = &http.Client{Timeout: 15 * time.Second}
+
+// PayParams fetches the lightning address's LNURL-pay parameters, failing
+// unless it accepts zaps.
+func (b *LNURLPayBackend) PayParams() (PayParams, error) {
+	var params PayParams
+	name, domain, found := strings.Cut(b.Address, "@")
+	if !found {
+		return params, fmt.Errorf("invalid lightning address %s", b.Address)
+	}
+	if err := b.getJSON(fmt.Sprintf("https://%s/.well-known/lnurlp/%s", domain, name), &params); err != nil {
+		return params, err
+	}
+	if params.Status == "ERROR" {
+		return params, errors.New(params.Reason)
+	}
+	if !params.AllowsNostr {
+		return params, fmt.Errorf("%s doesn't support zaps", b.Address)
+	}
+	return params, nil
+}
+
+func (b *LNURLPayBackend) CreateInvoice(pubkey string, amountMsat int64, tags ...nostr.Tag) (string, error) {
+	params, err := b.PayParams()
+	if err != nil {
+		return "", err
+	}
+	if amountMsat < params.MinSendable || (params.MaxSendable > 0 && amountMsat > params.MaxSendable) {
+		return "", fmt.Errorf("amount must be between %d and %d sats", params.MinSendable/1000, params.MaxSendable/1000)
+	}
+
+	zapRequest, err := b.ZapRequest(pubkey, amountMsat, tags...)
+	if err != nil {
+		return "", err
+	}
+
+	callback, err := url.Parse(params.Callback)
+	if err != nil {
+		return "", err
+	}
+	query := callback.Query()
+	query.Set("amount", strconv.FormatInt(amountMsat, 10))
+	query.Set("nostr", zapRequest.String())
+	callback.RawQuery = query.Encode()
+
+	var invoice lnurlInvoice
+	if err := b.getJSON(callback.String(), &invoice); err != nil {
+		return "", err
+	}
+	if invoice.Status == "ERROR" {
+		return "", errors.New(invoice.Reason)
+	}
+	return invoice.PR, nil
+}
+
+func (b *LNURLPayBackend) getJSON(url string, value any) error {
+	client := b.Client
+	if client == nil {
+		client = defaultClient
+	}
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
+
+// TopUpZapRequest builds a zap request to the pubkey of secretKey that
+// credits pubkey once the invoice it's attached to is paid, naming it in a
+// "credit" tag. Receipts are to be published to relays. Extra tags describe
+// what the payment is for.
+//
+// A zap request's tags can only be trusted when it's signed by the
+// recipient, so only credit tags in zap requests signed with secretKey
+// should be honored.
+func TopUpZapRequest(secretKey string, pubkey string, amountMsat int64, relays []string, content string, tags ...nostr.Tag) (*nostr.Event, error) {
+	recipient, err := nostr.GetPublicKey(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	zapRequest := nostr.Event{
+		PubKey:    recipient,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindZapRequest,
+		Content:   content,
+		Tags: nostr.Tags{
+			{"p", recipient},
+			{"amount", strconv.FormatInt(amountMsat, 10)},
+			append(nostr.Tag{"relays"}, relays...),
+			{"credit", pubkey},
+		},
+	}
+	zapRequest.Tags = append(zapRequest.Tags, tags...)
+	if err := zapRequest.Sign(secretKey); err != nil {
+		return nil, err
+	}
+	return &zapRequest, nil
+}
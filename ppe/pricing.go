@@ -0,0 +1,227 @@
+package ppe
+
+import (
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Pricer decides what an event costs. Returning an error rejects the event
+// outright, e.g. for kinds a pricer doesn't accept at any price.
+type Pricer interface {
+	Price(event *nostr.Event, account BillingAccount) (msat int64, err error)
+}
+
+// BillingAccount is what a Pricer knows about the author of an event.
+// LifetimeSpendMsat, like the balance, is whoever pays for its events'.
+type BillingAccount struct {
+	PubKey            string
+	BalanceMsat       int64
+	StoredEvents      int64
+	StoredBytes       int64
+	AccountAgeDays    int64
+	LifetimeSpendMsat int64
+}
+
+// FlatPricer charges the same for every event.
+type FlatPricer struct {
+	Msat int64
+}
+
+// KindPricer charges per kind, falling back to Default for kinds without a
+// price of their own. Kinds without a price are rejected if Default is nil.
+type KindPricer struct {
+	Prices  map[int]int64
+	Default Pricer
+}
+
+// BytePricer charges for the serialized size of the event.
+type BytePricer struct {
+	MsatPerByte int64
+}
+
+// StoragePricer charges Msat for each event from accounts already storing
+// more than FreeBytes, so heavy users pay for the space they take.
+type StoragePricer struct {
+	FreeBytes int64
+	Msat      int64
+}
+
+// SumPricer adds up the prices of its parts, so a flat fee can be combined
+// with a size-based one.
+type SumPricer []Pricer
+
+// AppDataPricer prices application-specific data kinds (NIP-78's 30078,
+// drafts and the like) separately from everything else, and only accepts
+// them from accounts with at least MinBalanceMsat: storing app data is a
+// perk of the higher tiers.
+type AppDataPricer struct {
+	Kinds          map[int]bool
+	MinBalanceMsat int64
+	AppData        Pricer
+	Inner          Pricer
+}
+
+// DynamicPricer scales another pricer's prices with load: once more than
+// Target events a minute are being stored, prices rise proportionally.
+// Minutes are told by Clock, the system's if nil.
+type DynamicPricer struct {
+	Inner  Pricer
+	Target int64
+	Clock  Clock
+
+	minute   int64
+	current  int64
+	previous int64
+	mutex    sync.Mutex
+}
+
+func (p FlatPricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	return p.Msat, nil
+}
+
+func (p KindPricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	if price, ok := p.Prices[event.Kind]; ok {
+		return price, nil
+	}
+	if p.Default == nil {
+		return 0, fmt.Errorf("kind %d isn't accepted", event.Kind)
+	}
+	return p.Default.Price(event, account)
+}
+
+func (p BytePricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	return int64(len(event.String())) * p.MsatPerByte, nil
+}
+
+func (p StoragePricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	if account.StoredBytes > p.FreeBytes {
+		return p.Msat, nil
+	}
+	return 0, nil
+}
+
+func (p SumPricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	var total int64
+	for _, pricer := range p {
+		price, err := pricer.Price(event, account)
+		if err != nil {
+			return 0, err
+		}
+		total += price
+	}
+	return total, nil
+}
+
+func (p AppDataPricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	if !p.Kinds[event.Kind] {
+		return p.Inner.Price(event, account)
+	}
+	if account.BalanceMsat < p.MinBalanceMsat {
+		return 0, fmt.Errorf("storing kind %d needs a balance of at least %d sats", event.Kind, p.MinBalanceMsat/1000)
+	}
+	return p.AppData.Price(event, account)
+}
+
+func (p *DynamicPricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	price, err := p.Inner.Price(event, account)
+	if err != nil {
+		return 0, err
+	}
+
+	p.mutex.Lock()
+	p.rotate()
+	rate := p.previous
+	p.mutex.Unlock()
+
+	if rate > p.Target {
+		price = price * rate / p.Target
+	}
+	return price, nil
+}
+
+// Observe counts a stored event towards the load the price is based on.
+func (p *DynamicPricer) Observe() {
+	p.mutex.Lock()
+	p.rotate()
+	p.current++
+	p.mutex.Unlock()
+}
+
+func (p *DynamicPricer) rotate() {
+	minute := now(p.Clock).Unix() / 60
+	if minute == p.minute {
+		return
+	}
+	if minute == p.minute+1 {
+		p.previous = p.current
+	} else {
+		p.previous = 0
+	}
+	p.current = 0
+	p.minute = minute
+}
+
+// ParsePricing builds a pricer from a spec of "+"-separated parts that are
+// added together:
+//
+//	flat:1000                 every event costs 1000 msat
+//	kind:1=1000,30023=5000    per kind; add *=<msat> to price other kinds
+//	bytes:2                   2 msat per byte of JSON
+//	stored:100=500            500 msat once the author stores over 100 MB
+func ParsePricing(spec string) (Pricer, error) {
+	var pricers SumPricer
+	for _, part := range strings.Split(spec, "+") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), ":")
+		switch name {
+		case "flat":
+			msat, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid flat price %q", value)
+			}
+			pricers = append(pricers, FlatPricer{Msat: msat})
+		case "bytes":
+			msat, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid per-byte price %q", value)
+			}
+			pricers = append(pricers, BytePricer{MsatPerByte: msat})
+		case "stored":
+			free, price, found := strings.Cut(value, "=")
+			megabytes, err := strconv.ParseInt(free, 10, 64)
+			msat, err2 := strconv.ParseInt(price, 10, 64)
+			if !found || err != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid storage price %q", value)
+			}
+			pricers = append(pricers, StoragePricer{FreeBytes: megabytes << 20, Msat: msat})
+		case "kind":
+			pricer := KindPricer{Prices: make(map[int]int64)}
+			for _, entry := range strings.Split(value, ",") {
+				kind, price, found := strings.Cut(entry, "=")
+				msat, err := strconv.ParseInt(price, 10, 64)
+				if !found || err != nil {
+					return nil, fmt.Errorf("invalid kind price %q", entry)
+				}
+				if kind == "*" {
+					pricer.Default = FlatPricer{Msat: msat}
+					continue
+				}
+				k, err := strconv.Atoi(kind)
+				if err != nil {
+					return nil, fmt.Errorf("invalid kind %q", kind)
+				}
+				pricer.Prices[k] = msat
+			}
+			pricers = append(pricers, pricer)
+		default:
+			return nil, fmt.Errorf("unknown pricer %q", name)
+		}
+	}
+
+	if len(pricers) == 1 {
+		return pricers[0], nil
+	}
+	return pricers, nil
+}
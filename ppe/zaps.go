@@ -0,0 +1,142 @@
+package ppe
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"log"
+	"slices"
+)
+
+// ErrZapSigner is returned for zap receipts not validly signed by a zapper.
+var ErrZapSigner = errors.New("zap receipt isn't signed by the zapper")
+
+// Zap is a zap receipt that passed ZapVerifier.Verify, with the zap request
+// it carries and its invoice's amount.
+type Zap struct {
+	Receipt    *nostr.Event
+	Request    *nostr.Event
+	Bolt11     string
+	AmountMsat int64
+}
+
+// ZapVerifier checks zap receipts for zaps to Recipient.
+//
+// Receipts must be signed by one of Zappers, the nostrPubkey of the
+// lightning address paid (NIP-57 appendix F), as the rest of them could
+// come from anyone's node. Invoices are decoded with Decode,
+// decodepay.Decodepay if nil.
+type ZapVerifier struct {
+	Recipient string
+	Zappers   []string
+	Decode    func(bolt11 string) (decodepay.Bolt11, error)
+}
+
+// Verify checks receipt is a zap to the recipient: signed by a zapper, its
+// zap request signed by its sender, and its invoice for that zap request,
+// settled by its preimage if it has one.
+func (v ZapVerifier) Verify(receipt *nostr.Event) (*Zap, error) {
+	if receipt.Kind != nostr.KindZap {
+		return nil, errors.New("not a zap receipt")
+	}
+	if len(v.Zappers) == 0 {
+		return nil, errors.New("don't know who signs zap receipts for this relay yet")
+	}
+	if !slices.Contains(v.Zappers, receipt.PubKey) {
+		return nil, ErrZapSigner
+	}
+	if ok, _ := receipt.CheckSignature(); !ok {
+		return nil, fmt.Errorf("%w: invalid signature", ErrZapSigner)
+	}
+	description := receipt.Tags.GetFirst([]string{"description", ""})
+	bolt11 := receipt.Tags.GetFirst([]string{"bolt11", ""})
+	if description == nil || bolt11 == nil {
+		return nil, errors.New("zap receipt lacks a description or bolt11 tag")
+	}
+
+	// a receipt could carry a zap request naming anyone as its sender, or
+	// someone else's invoice
+	var request nostr.Event
+	if err := json.Unmarshal([]byte((*description)[1]), &request); err != nil {
+		return nil, errors.New("zap receipt has a malformed description")
+	}
+	if ok, _ := request.CheckSignature(); !ok || request.Kind != nostr.KindZapRequest {
+		return nil, errors.New("zap receipt's description isn't a signed zap request")
+	}
+	if p := request.Tags.GetFirst([]string{"p", ""}); p == nil || (*p)[1] != v.Recipient {
+		return nil, errors.New("zap isn't for the recipient")
+	}
+
+	decode := v.Decode
+	if decode == nil {
+		decode = decodepay.Decodepay
+	}
+	invoice, err := decode((*bolt11)[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid bolt11: %v", err)
+	}
+	hash := sha256.Sum256([]byte((*description)[1]))
+	if invoice.DescriptionHash != hex.EncodeToString(hash[:]) {
+		return nil, errors.New("invoice description hash doesn't match zap request")
+	}
+	if preimage := receipt.Tags.GetFirst([]string{"preimage", ""}); preimage != nil {
+		raw, err := hex.DecodeString((*preimage)[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid preimage: %v", err)
+		}
+		paymentHash := sha256.Sum256(raw)
+		if invoice.PaymentHash != hex.EncodeToString(paymentHash[:]) {
+			return nil, errors.New("preimage doesn't match payment hash")
+		}
+	}
+	if invoice.MSatoshi <= 0 {
+		return nil, errors.New("zap invoice has no amount")
+	}
+	return &Zap{Receipt: receipt, Request: &request, Bolt11: (*bolt11)[1], AmountMsat: invoice.MSatoshi}, nil
+}
+
+// ZapBeneficiary returns who a zap request to recipient credits: its
+// sender or, for requests signed by recipient itself like
+// TopUpZapRequest's, the pubkey in their credit tag. The request's
+// signature must have been checked.
+func ZapBeneficiary(recipient string, request *nostr.Event) string {
+	if request.PubKey == recipient {
+		if credit := request.Tags.GetFirst([]string{"credit", ""}); credit != nil && nostr.IsValidPublicKey((*credit)[1]) {
+			return (*credit)[1]
+		}
+	}
+	return request.PubKey
+}
+
+// CreditZapReceipt credits a zap receipt that verifier verifies to its
+// beneficiary, see ZapBeneficiary. Receipts already credited, or for an
+// invoice that was, are ignored.
+func CreditZapReceipt(ledger Ledger, verifier ZapVerifier, receipt *nostr.Event) (credited bool, err error) {
+	zap, err := verifier.Verify(receipt)
+	if err != nil {
+		return false, err
+	}
+	return ledger.CreditZap(zap, ZapBeneficiary(verifier.Recipient, zap.Request))
+}
+
+// WatchZapReceipts credits receipts of zaps to the verifier's recipient as
+// relays publish them, until ctx is done. It asks for every receipt the
+// relays still have, so ones published while it wasn't watching are
+// credited when it starts.
+func WatchZapReceipts(ctx context.Context, ledger Ledger, verifier ZapVerifier, relays []string) {
+	pool := nostr.NewSimplePool(ctx)
+	filter := nostr.Filter{
+		Kinds: []int{nostr.KindZap},
+		Tags:  nostr.TagMap{"p": []string{verifier.Recipient}},
+	}
+	for event := range pool.SubMany(ctx, relays, []nostr.Filter{filter}) {
+		if _, err := CreditZapReceipt(ledger, verifier, event.Event); err != nil {
+			log.Printf("zap receipt %s: %v", event.ID, err)
+		}
+	}
+}
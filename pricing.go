@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"swarmstr.com/ppe-relay/ppe"
+)
+
+// The pricers are the ppe package's, aliased so the rest of the relay can
+// keep naming them as before.
+type (
+	Pricer         = ppe.Pricer
+	BillingAccount = ppe.BillingAccount
+	FlatPricer     = ppe.FlatPricer
+	KindPricer     = ppe.KindPricer
+	BytePricer     = ppe.BytePricer
+	StoragePricer  = ppe.StoragePricer
+	SumPricer      = ppe.SumPricer
+	AppDataPricer  = ppe.AppDataPricer
+	DynamicPricer  = ppe.DynamicPricer
+)
+
+var eventsCharged = NewCounter("ppe_events_charged_msat_total", "Millisats charged for stored events.")
+
+// quotePrice and takeQuotedPrice keep the price RequireBalance quotes for
+// an event until ChargeEvent charges it, see ppe.QuotePrice.
+func quotePrice(event *nostr.Event, payer string, msat int64) {
+	ppe.QuotePrice(clock, event, payer, msat)
+}
+
+func takeQuotedPrice(event *nostr.Event) (msat int64, ok bool) {
+	return ppe.TakeQuotedPrice(clock, event)
+}
+
+// ParsePricing builds a pricer from a PRICING spec, see ppe.ParsePricing.
+func ParsePricing(spec string) (Pricer, error) {
+	return ppe.ParsePricing(spec)
+}
+
+// GetPricer reads PRICING (one sat per event by default) and, if
+// PRICING_DYNAMIC_TARGET is set, makes it scale with load. App data kinds are
+// priced with APP_DATA_PRICING, which defaults to PRICING. CLIENT_PRICING
+// adjusts both per client app, LOYALTY_DISCOUNTS discount them for
+// long-standing customers, and PROMOTIONS while they're on.
+func GetPricer() Pricer {
+	pricing := GetEnvDefault("PRICING", "flat:1000")
+	pricer, err := ParsePricing(pricing)
+	if err != nil {
+		panic(err)
+	}
+	if kinds := GetAppDataKinds(); len(kinds) > 0 {
+		appData, err := ParsePricing(GetEnvDefault("APP_DATA_PRICING", pricing))
+		if err != nil {
+			panic(err)
+		}
+		appDataPricer := AppDataPricer{
+			Kinds:          make(map[int]bool),
+			MinBalanceMsat: int64(GetEnvInt("APP_DATA_MIN_BALANCE", 1000)) * 1000,
+			AppData:        appData,
+			Inner:          pricer,
+		}
+		for _, kind := range kinds {
+			appDataPricer.Kinds[kind] = true
+		}
+		pricer = appDataPricer
+	}
+	if specs := GetEnvList("CLIENT_PRICING", nil); len(specs) > 0 {
+		percent, err := ParseClientPricing(specs)
+		if err != nil {
+			panic(err)
+		}
+		pricer = ClientPricer{Percent: percent, Inner: pricer}
+	}
+	if specs := GetEnvList("LOYALTY_DISCOUNTS", nil); len(specs) > 0 {
+		tiers, err := ParseLoyaltyTiers(specs)
+		if err != nil {
+			panic(err)
+		}
+		pricer = LoyaltyPricer{Tiers: tiers, Inner: pricer}
+	}
+	if promotions := GetPromotions(); len(promotions) > 0 {
+		pricer = PromotionPricer{Promotions: promotions, Inner: pricer}
+	}
+	if scripts := GetPolicyScripts(); len(scripts) > 0 {
+		pricer = ScriptPricer{Scripts: scripts, Inner: pricer}
+	}
+	if modules := GetPolicyModules(); len(modules) > 0 {
+		pricer = ModulePricer{Modules: modules, Inner: pricer}
+	}
+	if hook := GetPolicyHook(); hook != nil {
+		pricer = HookPricer{Hook: hook, Inner: pricer}
+	}
+	if multiplier := GetEnvInt("BOT_PRICE_MULTIPLIER", 0); multiplier > 1 {
+		pricer = BotPricer{Multiplier: int64(multiplier), Inner: pricer}
+	}
+	if target := GetEnvInt("PRICING_DYNAMIC_TARGET", 0); target > 0 {
+		return &DynamicPricer{Inner: pricer, Target: int64(target), Clock: clock}
+	}
+	return pricer
+}
+
+// GetAppDataKinds reads APP_DATA_KINDS, e.g. "30078,31234". They're only
+// accepted from accounts holding APP_DATA_MIN_BALANCE sats.
+func GetAppDataKinds() []int {
+	var kinds []int
+	for _, value := range GetEnvList("APP_DATA_KINDS", nil) {
+		kind, err := strconv.Atoi(value)
+		if err != nil {
+			panic(fmt.Errorf("invalid app data kind %q", value))
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+// GetBillingAccount describes pubkey for pricing. The balance is that of
+// whoever pays for pubkey's events, see GetBillingPubKey.
+func GetBillingAccount(pubkey string, db Database) BillingAccount {
+	storage := GetStorageUsage(pubkey, db)
+	payer := GetBillingPubKey(pubkey, db)
+	return BillingAccount{
+		PubKey:            pubkey,
+		BalanceMsat:       GetRemainingUserBalanceMsat(payer, db),
+		StoredEvents:      storage.Events,
+		StoredBytes:       storage.Bytes,
+		AccountAgeDays:    GetAccountAgeDays(pubkey, db),
+		LifetimeSpendMsat: GetLifetimeSpendMsat(payer, db),
+	}
+}
+
+// GetRecordedBillingAccount is GetBillingAccount with the balance as
+// recorded, without looking upstream for new zaps first, for policies that
+// run on every event.
+func GetRecordedBillingAccount(pubkey string, db Database) BillingAccount {
+	storage := GetStorageUsage(pubkey, db)
+	payer := GetBillingPubKey(pubkey, db)
+	return BillingAccount{
+		PubKey:            pubkey,
+		BalanceMsat:       GetLedgerBalanceMsat(payer, db),
+		StoredEvents:      storage.Events,
+		StoredBytes:       storage.Bytes,
+		AccountAgeDays:    GetAccountAgeDays(pubkey, db),
+		LifetimeSpendMsat: GetLifetimeSpendMsat(payer, db),
+	}
+}
+
+// GetBillingConfig bills events with ppe's policies the way the relay
+// does: to their author (see GetEventAuthor) or whoever pays for it (see
+// ResolveBilling), within spend limits and allowances, drawing on prepaid
+// package events first. Exempt pubkeys and backfill imports, which were
+// paid for up front, aren't billed, and duplicates aren't charged. Events
+// are checked and charged with their payer's balance locked, as purchases
+// like gifts are (see LockBalance).
+func GetBillingConfig(pricer Pricer, db Database) ppe.Config {
+	return ppe.Config{
+		Ledger: GetLedger(db),
+		Pricer: pricer,
+		Clock:  clock,
+		Account: func(ctx context.Context, pubkey string) (BillingAccount, error) {
+			return GetBillingAccount(pubkey, db), nil
+		},
+		Author: GetEventAuthor,
+		Payer: func(author string) string {
+			return GetBillingPubKey(author, db)
+		},
+		Lock: LockBalance,
+		Exempt: func(ctx context.Context, event *nostr.Event, author string) string {
+			switch {
+			case IsBillingExempt(author):
+				return "exempt"
+			case BackfillImportID(ctx) != "":
+				return "backfill"
+			}
+			return ""
+		},
+		Check: func(ctx context.Context, account BillingAccount, price int64) (reject bool, msg string) {
+			if err := CheckSpendLimits(account.PubKey, price, db); err != nil {
+				return true, "rate-limited: " + err.Error()
+			}
+			return false, ""
+		},
+		Afford: func(ctx context.Context, account BillingAccount, price int64) (reject bool, msg string) {
+			payer, allowance := ResolveBilling(account.PubKey, db)
+			if allowance != nil {
+				if price > allowance.RemainingMsat() {
+					return true, fmt.Sprintf("payment-required: only %s of your allowance is left", formatSatsShort(allowance.RemainingMsat()))
+				}
+				if account.BalanceMsat < price {
+					return true, "payment-required: no sufficient balance; the allowance's owner needs to top up"
+				}
+				return false, ""
+			}
+			if account.BalanceMsat < price && GetPackageEventsRemaining(payer, db) <= 0 {
+				return true, "payment-required: no sufficient balance; top up"
+			}
+			return false, ""
+		},
+		Waive: func(ctx context.Context, event *nostr.Event, author string, payer string) string {
+			if DuplicateOf(event, db) != "" {
+				return "duplicate"
+			}
+			if _, allowance := ResolveBilling(author, db); allowance == nil && GetPackageEventsRemaining(payer, db) > 0 {
+				return "package"
+			}
+			return ""
+		},
+		Charged: func(ctx context.Context, event *nostr.Event, author string, payer string, msat int64, waived string) {
+			switch waived {
+			case "exempt":
+				exemptEvents.Inc()
+			case "duplicate":
+				duplicatesNotCharged.Inc()
+				EmitBillingStatus(BillingCharged, event, 0, "Not charged: it repeats "+DuplicateOf(event, db)+".")
+				if balanceInOK {
+					SetBalanceInOK(ctx, event, payer, 0, GetLedgerBalanceMsat(payer, db))
+				}
+			case "package":
+				EmitBillingStatus(BillingCharged, event, 0, "Covered by your package.")
+				if balanceInOK {
+					SetOKMessage(ctx, event, fmt.Sprintf("stored; covered by your package, %d events remaining", GetPackageEventsRemaining(payer, db)))
+				}
+			case "":
+				eventsCharged.Add(msat)
+				if _, allowance := ResolveBilling(author, db); allowance != nil {
+					if err := SpendAllowance(author, msat, db); err != nil {
+						ReportError(err, "allowances", map[string]string{"event": event.ID, "pubkey": author})
+					}
+				}
+				remaining := GetLedgerBalanceMsat(payer, db)
+				EmitBillingStatus(BillingCharged, event, msat, fmt.Sprintf("Charged %d msat, %d msat left.", msat, remaining))
+				SetBalanceInOK(ctx, event, payer, msat, remaining)
+				WarnLowBalance(payer, remaining+msat, remaining, db)
+				NotifyBalanceExhausted(payer, remaining+msat, remaining)
+			}
+		},
+		Report: func(err error, event *nostr.Event) {
+			ReportError(err, "billing", map[string]string{"event": event.ID, "pubkey": event.PubKey})
+		},
+	}
+}
+
+// RequireBalance rejects events their author can't afford at the current
+// price, quoting it for ChargeEvent, see GetBillingConfig.
+func RequireBalance(pricer Pricer, db Database) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return ppe.RequireBalance(GetBillingConfig(pricer, db))
+}
+
+// ChargeEvent debits whoever pays for a stored event the price
+// RequireBalance quoted, see GetBillingConfig. The debit id is derived from
+// the event id, so an event is never charged twice.
+func ChargeEvent(pricer Pricer, db Database) func(ctx context.Context, event *nostr.Event) {
+	return ppe.ChargeEvent(GetBillingConfig(pricer, db))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"strings"
+	"sync"
+)
+
+var privateSchema = Schema{
+	Tables: []string{"private_account"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS private_account (
+       pubkey text NOT NULL PRIMARY KEY,
+       created_at bigint NOT NULL);`,
+	},
+}
+
+var (
+	followersOnly bool
+
+	privateAccounts      = make(map[string]bool)
+	privateAccountsMutex sync.RWMutex
+
+	// follow lists of private accounts, from their latest kind 3 here
+	followLists      = make(map[string]map[string]bool)
+	followListsMutex sync.Mutex
+
+	privateHidden = NewCounter("ppe_private_hidden_total", "Events of follower-only accounts withheld from pubkeys they don't follow.")
+)
+
+func LoadPrivateAccounts(db Database) error {
+	var pubkeys []string
+	if err := db.DB.Select(&pubkeys, `SELECT pubkey FROM private_account`); err != nil {
+		return err
+	}
+
+	privateAccountsMutex.Lock()
+	defer privateAccountsMutex.Unlock()
+	for _, pubkey := range pubkeys {
+		privateAccounts[pubkey] = true
+	}
+	return nil
+}
+
+func IsPrivateAccount(pubkey string) bool {
+	privateAccountsMutex.RLock()
+	defer privateAccountsMutex.RUnlock()
+	return privateAccounts[pubkey]
+}
+
+func SetPrivateAccount(pubkey string, private bool, db Database) error {
+	var err error
+	if private {
+		_, err = db.DB.Exec(`INSERT INTO private_account (pubkey, created_at) VALUES (?, ?) ON CONFLICT (pubkey) DO NOTHING`, pubkey, nostr.Now())
+	} else {
+		_, err = db.DB.Exec(`DELETE FROM private_account WHERE pubkey = ?`, pubkey)
+	}
+	if err != nil {
+		return err
+	}
+
+	privateAccountsMutex.Lock()
+	if private {
+		privateAccounts[pubkey] = true
+	} else {
+		delete(privateAccounts, pubkey)
+	}
+	privateAccountsMutex.Unlock()
+	return nil
+}
+
+// GetFollowList returns the pubkeys in the latest follow list (kind 3)
+// pubkey stored here, or nil if it has none.
+func GetFollowList(pubkey string, db Database) map[string]bool {
+	followListsMutex.Lock()
+	defer followListsMutex.Unlock()
+	if follows, ok := followLists[pubkey]; ok {
+		return follows
+	}
+
+	var raw string
+	err := db.DB.QueryRow(`SELECT tags FROM event WHERE pubkey = ? AND kind = 3 ORDER BY created_at DESC LIMIT 1`, pubkey).Scan(&raw)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		ReportError(err, "private", map[string]string{"pubkey": pubkey})
+		return nil
+	}
+
+	var follows map[string]bool
+	var tags nostr.Tags
+	if json.Unmarshal([]byte(raw), &tags) == nil {
+		follows = make(map[string]bool)
+		for _, tag := range tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				follows[tag[1]] = true
+			}
+		}
+	}
+	followLists[pubkey] = follows
+	return follows
+}
+
+// CanSee reports whether reader may see author's events: everyone can,
+// unless author is a follower-only account that reader isn't followed by.
+func CanSee(reader string, author string, db Database) bool {
+	if !IsPrivateAccount(author) {
+		return true
+	}
+	if reader == "" {
+		return false
+	}
+	return reader == author || reader == relay.Info.PubKey || GetFollowList(author, db)[reader]
+}
+
+// HideFromNonFollowers wraps a QueryEvents handler so the events of
+// follower-only accounts are only sent to the (authenticated) pubkeys they
+// follow.
+func HideFromNonFollowers(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error), db Database) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		results, err := query(ctx, filter)
+		if err != nil {
+			return results, err
+		}
+
+		authed := khatru.GetAuthed(ctx)
+		request := IsRequest(ctx)
+
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+			challenged := false
+			for event := range results {
+				if request && !CanSee(authed, event.PubKey, db) {
+					privateHidden.Inc()
+					// followers may not have authenticated yet
+					if authed == "" && !challenged {
+						khatru.RequestAuth(ctx)
+						challenged = true
+					}
+					continue
+				}
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					for range results {
+					}
+					return
+				}
+			}
+		}()
+		return ch, nil
+	}
+}
+
+// IsRequest reports whether a query comes from a client's REQ, as opposed
+// to khatru looking up duplicates and replaced versions of an event it's
+// storing, which has to see every event.
+func IsRequest(ctx context.Context) (request bool) {
+	// GetSubscriptionID panics outside of a REQ
+	defer func() { recover() }()
+	return khatru.GetSubscriptionID(ctx) != ""
+}
+
+func PreventNonFollowerBroadcast(db Database) func(ws *khatru.WebSocket, event *nostr.Event) bool {
+	return func(ws *khatru.WebSocket, event *nostr.Event) bool {
+		return !CanSee(ws.AuthedPublicKey, event.PubKey, db)
+	}
+}
+
+// ForgetFollowList is an OnEventSaved hook that drops the cached follow list
+// when a private account publishes a new one.
+func ForgetFollowList(ctx context.Context, event *nostr.Event) {
+	if event.Kind != 3 {
+		return
+	}
+	followListsMutex.Lock()
+	delete(followLists, event.PubKey)
+	followListsMutex.Unlock()
+}
+
+// HandlePrivateCommand answers "private" with whether pubkey's account is
+// follower-only and "private on|off" by changing it. Only paying customers
+// can make their account follower-only.
+func HandlePrivateCommand(pubkey string, args []string, db Database) string {
+	if len(args) == 0 {
+		if IsPrivateAccount(pubkey) {
+			return "Your events are only shown to the people you follow. Use private off to make them public."
+		}
+		return "Your events are public. Use private on to only show them to the people you follow."
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "on":
+		if !IsPayingCustomer(pubkey, db) {
+			return "Follower-only accounts are for paying customers, top up first."
+		}
+		if err := SetPrivateAccount(pubkey, true, db); err != nil {
+			ReportError(err, "private", map[string]string{"pubkey": pubkey})
+			return "Couldn't change your account, try again later."
+		}
+		if GetFollowList(pubkey, db) == nil {
+			return "Your events are now hidden from everyone but you. Publish your follow list to this relay to show them to the people you follow."
+		}
+		return "Your events are now only shown to the people you follow, once they authenticate."
+	case "off":
+		if err := SetPrivateAccount(pubkey, false, db); err != nil {
+			ReportError(err, "private", map[string]string{"pubkey": pubkey})
+			return "Couldn't change your account, try again later."
+		}
+		return "Your events are public again."
+	}
+	return "Usage: private [on|off]"
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Promotion takes PercentOff off the price of events, of Kinds or of every
+// kind when it's empty, while it's on: between From and Until, or weekly on
+// Days between FromHour and UntilHour, in UTC.
+type Promotion struct {
+	Name       string
+	PercentOff int64
+	Kinds      []int
+	Schedule   string
+
+	From      time.Time
+	Until     time.Time
+	Days      [7]bool
+	FromHour  int
+	UntilHour int
+}
+
+// PromotionPricer discounts Inner's prices while promotions are on. Only the
+// largest discount applies when several are.
+type PromotionPricer struct {
+	Promotions []Promotion
+	Inner      Pricer
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (p PromotionPricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	price, err := p.Inner.Price(event, account)
+	if err != nil {
+		return 0, err
+	}
+	if promotion, ok := p.Current(event.Kind, Now()); ok {
+		price = price * (100 - promotion.PercentOff) / 100
+	}
+	return price, nil
+}
+
+// Current returns the promotion with the largest discount on kind at t.
+func (p PromotionPricer) Current(kind int, t time.Time) (Promotion, bool) {
+	var best Promotion
+	found := false
+	for _, promotion := range p.Promotions {
+		if promotion.On(t) && promotion.Covers(kind) && (!found || promotion.PercentOff > best.PercentOff) {
+			best, found = promotion, true
+		}
+	}
+	return best, found
+}
+
+// On reports whether the promotion is on at t.
+func (p Promotion) On(t time.Time) bool {
+	t = t.UTC()
+	if !p.From.IsZero() {
+		return !t.Before(p.From) && t.Before(p.Until)
+	}
+	if !p.Days[t.Weekday()] {
+		return false
+	}
+	if p.FromHour <= p.UntilHour {
+		return t.Hour() >= p.FromHour && t.Hour() < p.UntilHour
+	}
+	// like 22-06: from 22:00 and until 06:00 on each of the days
+	return t.Hour() >= p.FromHour || t.Hour() < p.UntilHour
+}
+
+func (p Promotion) Covers(kind int) bool {
+	return len(p.Kinds) == 0 || slices.Contains(p.Kinds, kind)
+}
+
+// Describe explains the promotion in a line.
+func (p Promotion) Describe() string {
+	discount := fmt.Sprintf("%d%% off", p.PercentOff)
+	if p.PercentOff == 100 {
+		discount = "free"
+	}
+	if len(p.Kinds) == 1 {
+		discount += fmt.Sprintf(" for kind %d", p.Kinds[0])
+	} else if len(p.Kinds) > 1 {
+		discount += " for kinds " + strings.Trim(fmt.Sprint(p.Kinds), "[]")
+	}
+	days, _, _ := strings.Cut(p.Schedule, "@")
+	when := days + " UTC"
+	if p.FromHour != 0 || p.UntilHour != 24 {
+		when = fmt.Sprintf("%s %02d:00-%02d:00 UTC", days, p.FromHour, p.UntilHour)
+	}
+	if !p.From.IsZero() {
+		when = fmt.Sprintf("from %s until %s UTC", p.From.Format("2006-01-02 15:04"), p.Until.Format("2006-01-02 15:04"))
+	}
+	return fmt.Sprintf("%s: %s, %s", p.Name, discount, when)
+}
+
+// ParsePromotion parses name:percent:schedule[:kinds], e.g.
+//
+//	weekend:50:sat-sun                    half price on weekends
+//	nights:25:daily@22-06                 a quarter off overnight
+//	notes-day:100:2026-11-01/2026-11-01:1 kind 1 free for a day
+//	launch:20:2026-11-01T18/2026-11-08T18 a week from 18:00
+//
+// Dates are UTC, with an optional hour; a date on its own as the end runs to
+// the end of that day. Several kinds are joined with "+", like 1+6+7.
+func ParsePromotion(spec string) (Promotion, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 3 || len(parts) > 4 || parts[0] == "" {
+		return Promotion{}, fmt.Errorf("invalid promotion %q, expected name:percent:schedule[:kinds]", spec)
+	}
+	promotion := Promotion{Name: parts[0], Schedule: parts[2], UntilHour: 24}
+	percent, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || percent < 1 || percent > 100 {
+		return promotion, fmt.Errorf("invalid discount in promotion %q, expected a percentage from 1 to 100", spec)
+	}
+	promotion.PercentOff = percent
+	if len(parts) == 4 {
+		for _, value := range strings.Split(parts[3], "+") {
+			kind, err := strconv.Atoi(value)
+			if err != nil || kind < 0 || kind > 65535 {
+				return promotion, fmt.Errorf("invalid kind %q in promotion %q", value, spec)
+			}
+			promotion.Kinds = append(promotion.Kinds, kind)
+		}
+	}
+
+	if from, until, found := strings.Cut(parts[2], "/"); found {
+		if promotion.From, err = parsePromotionTime(from, false); err != nil {
+			return promotion, fmt.Errorf("invalid start in promotion %q: %w", spec, err)
+		}
+		if promotion.Until, err = parsePromotionTime(until, true); err != nil {
+			return promotion, fmt.Errorf("invalid end in promotion %q: %w", spec, err)
+		}
+		if !promotion.Until.After(promotion.From) {
+			return promotion, fmt.Errorf("promotion %q ends before it starts", spec)
+		}
+		return promotion, nil
+	}
+
+	days, hours, _ := strings.Cut(parts[2], "@")
+	if err := promotion.parseDays(days); err != nil {
+		return promotion, fmt.Errorf("invalid days in promotion %q: %w", spec, err)
+	}
+	if hours != "" {
+		from, until, found := strings.Cut(hours, "-")
+		fromHour, err := strconv.Atoi(from)
+		untilHour, err2 := strconv.Atoi(until)
+		if !found || err != nil || err2 != nil || fromHour < 0 || fromHour > 23 || untilHour < 0 || untilHour > 24 || fromHour == untilHour {
+			return promotion, fmt.Errorf("invalid hours %q in promotion %q, expected like 22-06", hours, spec)
+		}
+		promotion.FromHour, promotion.UntilHour = fromHour, untilHour
+	}
+	return promotion, nil
+}
+
+func parsePromotionTime(value string, end bool) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02T15", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return t, fmt.Errorf("%q isn't a date like 2026-11-01 or 2026-11-01T18", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func (p *Promotion) parseDays(value string) error {
+	if value == "daily" {
+		p.Days = [7]bool{true, true, true, true, true, true, true}
+		return nil
+	}
+	first, last, found := strings.Cut(value, "-")
+	if !found {
+		last = first
+	}
+	from, until := slices.Index(weekdays, first), slices.Index(weekdays, last)
+	if from < 0 || until < 0 {
+		return fmt.Errorf("%q isn't a day like sat or a range like fri-sun", value)
+	}
+	// ranges can wrap around the week, like fri-mon
+	for day := from; ; day = (day + 1) % 7 {
+		p.Days[day] = true
+		if day == until {
+			return nil
+		}
+	}
+}
+
+// GetPromotions reads PROMOTIONS, a comma-separated list of promotions as
+// ParsePromotion reads them.
+func GetPromotions() []Promotion {
+	var promotions []Promotion
+	for _, spec := range GetEnvList("PROMOTIONS", nil) {
+		promotion, err := ParsePromotion(spec)
+		if err != nil {
+			panic(err)
+		}
+		promotions = append(promotions, promotion)
+	}
+	return promotions
+}
+
+// findPromotionPricer finds the PromotionPricer under the pricers GetPricer
+// wraps around it.
+func findPromotionPricer(pricer Pricer) (PromotionPricer, bool) {
+	switch p := pricer.(type) {
+	case PromotionPricer:
+		return p, true
+	case LoyaltyPricer:
+		return findPromotionPricer(p.Inner)
+	case ClientPricer:
+		return findPromotionPricer(p.Inner)
+	case BotPricer:
+		return findPromotionPricer(p.Inner)
+	case *DynamicPricer:
+		return findPromotionPricer(p.Inner)
+	}
+	return PromotionPricer{}, false
+}
+
+// pricedKinds lists the kinds pricer prices apart from the rest, kind 1
+// standing in for those.
+func pricedKinds(pricer Pricer) []int {
+	kinds := []int{1}
+	var walk func(pricer Pricer)
+	walk = func(pricer Pricer) {
+		switch p := pricer.(type) {
+		case KindPricer:
+			for kind := range p.Prices {
+				kinds = append(kinds, kind)
+			}
+			if p.Default != nil {
+				walk(p.Default)
+			}
+		case SumPricer:
+			for _, part := range p {
+				walk(part)
+			}
+		case AppDataPricer:
+			for kind := range p.Kinds {
+				kinds = append(kinds, kind)
+			}
+			walk(p.Inner)
+		case PromotionPricer:
+			for _, promotion := range p.Promotions {
+				kinds = append(kinds, promotion.Kinds...)
+			}
+			walk(p.Inner)
+		case LoyaltyPricer:
+			walk(p.Inner)
+		case ClientPricer:
+			walk(p.Inner)
+		case BotPricer:
+			walk(p.Inner)
+		case *DynamicPricer:
+			walk(p.Inner)
+		}
+	}
+	walk(pricer)
+	slices.Sort(kinds)
+	return slices.Compact(kinds)
+}
+
+// AdvertiseFees lists what publishing costs right now in the NIP-11
+// document (promotions included), quoted for an empty event from a new
+// account, grouping the kinds that cost the same.
+func AdvertiseFees(pricer Pricer) func(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+	return func(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+		fees := nip11.RelayFeesDocument{}
+		if info.Fees != nil {
+			fees = *info.Fees
+		}
+		for _, kind := range pricedKinds(pricer) {
+			msat, err := pricer.Price(&nostr.Event{Kind: kind, CreatedAt: nostr.Now()}, BillingAccount{})
+			if err != nil {
+				continue
+			}
+			grouped := false
+			for i := range fees.Publication {
+				if fees.Publication[i].Amount == int(msat) {
+					fees.Publication[i].Kinds = append(fees.Publication[i].Kinds, kind)
+					grouped = true
+					break
+				}
+			}
+			if !grouped {
+				fees.Publication = append(fees.Publication, struct {
+					Kinds  []int  `json:"kinds"`
+					Amount int    `json:"amount"`
+					Unit   string `json:"unit"`
+				}{[]int{kind}, int(msat), "msats"})
+			}
+		}
+		info.Fees = &fees
+		return info
+	}
+}
+
+// HandlePriceCommand answers the bot's price command: the price schedule,
+// with what's on now, or with a kind what an event of it costs pubkey.
+func HandlePriceCommand(pubkey string, args []string, db Database) string {
+	pricer := GetPricer()
+	if len(args) == 0 {
+		return "Prices: " + strings.Join(DescribePricer(pricer), "; ") + "."
+	}
+	kind, err := strconv.Atoi(args[0])
+	if err != nil || kind < 0 || kind > 65535 {
+		return "Usage: price [kind]"
+	}
+	account := GetBillingAccount(pubkey, db)
+	msat, err := pricer.Price(&nostr.Event{Kind: kind, CreatedAt: nostr.Now()}, account)
+	if err != nil {
+		return fmt.Sprintf("Kind %d can't be stored: %v.", kind, err)
+	}
+	reply := fmt.Sprintf("A short kind %d event costs you %s right now.", kind, formatSatsShort(msat))
+	if loyalty, ok := findLoyaltyPricer(pricer); ok {
+		if tier, reached := loyalty.Tier(account); reached {
+			reply += fmt.Sprintf(" That's with your %d%% loyalty discount.", tier.PercentOff)
+		}
+	}
+	if promotions, ok := findPromotionPricer(pricer); ok {
+		if promotion, on := promotions.Current(kind, Now()); on {
+			reply += " That's with " + promotion.Describe() + "."
+		}
+	}
+	return reply
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StorageProof shows an event is among the leaves of a published state
+// root: hashing its id as leaf LeafIndex of a tree of TreeSize leaves up
+// through Path, bottom up, gives Root. It's RFC 6962's audit path, so any
+// implementation of its inclusion proofs can check it.
+type StorageProof struct {
+	EventID     string          `json:"event_id"`
+	Root        string          `json:"root"`
+	StateRootID string          `json:"state_root_event,omitempty"`
+	CreatedAt   nostr.Timestamp `json:"created_at"`
+	LeafIndex   int64           `json:"leaf_index"`
+	TreeSize    int64           `json:"tree_size"`
+	Path        []string        `json:"path"`
+	Algorithm   string          `json:"alg"`
+}
+
+var (
+	errNoStateRoot     = errors.New("no state root was published yet")
+	errNotInStateRoot  = errors.New("the event isn't in the latest state root")
+	errStoredAfterRoot = errors.New("the event was stored after the latest state root, it'll be in the next one")
+)
+
+// ProveEvent proves the event with id is in the latest state root, from
+// the leaves kept when it was published.
+func ProveEvent(id string, db Database) (StorageProof, error) {
+	proof := StorageProof{EventID: id, Algorithm: "rfc6962-sha256"}
+	leaf, err := hex.DecodeString(id)
+	if err != nil || len(leaf) != 32 {
+		return proof, errors.New("invalid event id")
+	}
+	roots, err := GetStateRoots(1, db)
+	if err != nil {
+		return proof, err
+	}
+	if len(roots) == 0 {
+		return proof, errNoStateRoot
+	}
+	root := roots[0]
+	proof.Root, proof.StateRootID, proof.CreatedAt, proof.TreeSize = root.Root, root.EventID, root.CreatedAt, root.Events
+
+	file, err := os.Open(stateRootLeavesPath(root.CreatedAt))
+	if errors.Is(err, os.ErrNotExist) {
+		return proof, fmt.Errorf("the leaves of the state root published at %s weren't kept", root.CreatedAt.Time().UTC().Format(time.DateTime))
+	} else if err != nil {
+		return proof, err
+	}
+	defer file.Close()
+	leaves := &merkleLeaves{file}
+
+	// leaves are ordered by id
+	var readErr error
+	index := sort.Search(int(root.Events), func(i int) bool {
+		at, err := leaves.at(int64(i))
+		if err != nil {
+			readErr = err
+			return true
+		}
+		return bytes.Compare(at, leaf) >= 0
+	})
+	if readErr != nil {
+		return proof, readErr
+	}
+	if at, err := leaves.at(int64(index)); index == int(root.Events) || err != nil || !bytes.Equal(at, leaf) {
+		if _, err := getStoredEvent(id, db); err == nil {
+			return proof, errStoredAfterRoot
+		}
+		return proof, errNotInStateRoot
+	}
+	proof.LeafIndex = int64(index)
+
+	path, err := leaves.auditPath(proof.LeafIndex, 0, root.Events)
+	if err != nil {
+		return proof, err
+	}
+	proof.Path = make([]string, len(path))
+	for i, hash := range path {
+		proof.Path[i] = hex.EncodeToString(hash)
+	}
+	// the leaves don't match the root when they were tampered with
+	if err := VerifyInclusionProof(proof); err != nil {
+		return proof, fmt.Errorf("the leaves kept don't match the state root: %w", err)
+	}
+	return proof, nil
+}
+
+// merkleLeaves reads a state root's leaves file.
+type merkleLeaves struct {
+	file io.ReaderAt
+}
+
+func (l *merkleLeaves) at(i int64) ([]byte, error) {
+	leaf := make([]byte, 32)
+	_, err := l.file.ReadAt(leaf, i*32)
+	return leaf, err
+}
+
+// auditPath is RFC 6962's PATH(m, D[from:to]), the hashes of the subtrees
+// next to leaf m's ancestors, bottom up.
+func (l *merkleLeaves) auditPath(m int64, from int64, to int64) ([][]byte, error) {
+	n := to - from
+	if n <= 1 {
+		return nil, nil
+	}
+	k := int64(1)
+	for k*2 < n {
+		k *= 2
+	}
+	var path [][]byte
+	var sibling []byte
+	var err error
+	if m < from+k {
+		if path, err = l.auditPath(m, from, from+k); err == nil {
+			sibling, err = l.subtreeHash(from+k, to)
+		}
+	} else {
+		if path, err = l.auditPath(m, from+k, to); err == nil {
+			sibling, err = l.subtreeHash(from, from+k)
+		}
+	}
+	return append(path, sibling), err
+}
+
+// subtreeHash is MTH(D[from:to]).
+func (l *merkleLeaves) subtreeHash(from int64, to int64) ([]byte, error) {
+	var tree MerkleTree
+	for i := from; i < to; i++ {
+		leaf, err := l.at(i)
+		if err != nil {
+			return nil, err
+		}
+		tree.Add(leaf)
+	}
+	return tree.Root(), nil
+}
+
+// VerifyInclusionProof checks proof the way RFC 9162 verifies inclusion
+// proofs, as a user holding the root would.
+func VerifyInclusionProof(proof StorageProof) error {
+	leaf, err := hex.DecodeString(proof.EventID)
+	if err != nil {
+		return err
+	}
+	if proof.LeafIndex < 0 || proof.LeafIndex >= proof.TreeSize {
+		return errors.New("the leaf index is outside the tree")
+	}
+	hash := MerkleLeafHash(leaf)
+	fn, sn := proof.LeafIndex, proof.TreeSize-1
+	for _, value := range proof.Path {
+		sibling, err := hex.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		if sn == 0 {
+			return errors.New("the path is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			hash = MerkleNodeHash(sibling, hash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = MerkleNodeHash(hash, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("the path is too short")
+	}
+	if hex.EncodeToString(hash) != proof.Root {
+		return errors.New("the path doesn't lead to the root")
+	}
+	return nil
+}
+
+func provingEnabled() bool {
+	return GetEnvDuration("STATE_ROOT_INTERVAL", 0) > 0
+}
+
+// HandleProveCommand answers the bot's prove command with the proof, for
+// checking against the state root the bot published.
+func HandleProveCommand(args []string, db Database) string {
+	if len(args) == 0 {
+		return "Usage: prove <note id>"
+	}
+	id, err := parseEventID(strings.TrimPrefix(args[0], "nostr:"))
+	if err != nil {
+		return "Usage: prove <note id>"
+	}
+	proof, err := ProveEvent(id, db)
+	switch {
+	case errors.Is(err, errNoStateRoot), errors.Is(err, errNotInStateRoot), errors.Is(err, errStoredAfterRoot):
+		return fmt.Sprintf("Can't prove it: %v.", err)
+	case err != nil:
+		ReportError(err, "proofs", map[string]string{"event": id})
+		return "Couldn't prove it, try again later."
+	}
+
+	published := proof.CreatedAt.Time().UTC().Format(time.DateTime) + " UTC"
+	if proof.StateRootID != "" {
+		note, _ := nip19.EncodeNote(proof.StateRootID)
+		published += " in " + note
+	}
+	path := "none, it's the only leaf"
+	if len(proof.Path) > 0 {
+		path = strings.Join(proof.Path, " ")
+	}
+	return fmt.Sprintf("It's leaf %d of %d in the state root %s published %s. Audit path, bottom up (RFC 6962, SHA-256): %s",
+		proof.LeafIndex, proof.TreeSize, proof.Root, published, path)
+}
+
+// HandleAPIProof proves ?event= is in the latest state root.
+func HandleAPIProof(w http.ResponseWriter, r *http.Request, db Database) {
+	id, err := parseEventID(r.URL.Query().Get("event"))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "invalid event id")
+		return
+	}
+	proof, err := ProveEvent(id, db)
+	switch {
+	case errors.Is(err, errNoStateRoot), errors.Is(err, errNotInStateRoot), errors.Is(err, errStoredAfterRoot):
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		ReportError(err, "proofs", map[string]string{"event": id})
+		WriteJSONError(w, http.StatusInternalServerError, "couldn't prove it")
+		return
+	}
+	WriteJSON(w, http.StatusOK, proof)
+}
+
+// RunProve prints the proof an event is in the latest state root.
+func RunProve(args []string, db Database) {
+	if len(args) != 1 {
+		fmt.Println("Usage: prove <event id>")
+		os.Exit(1)
+	}
+	id, err := parseEventID(args[0])
+	if err != nil {
+		log.Fatalf("Invalid event id: %v", err)
+	}
+	proof, err := ProveEvent(id, db)
+	if err != nil {
+		log.Fatalf("Failed to prove %s: %v", id, err)
+	}
+	fmt.Printf("root       %s\n", proof.Root)
+	fmt.Printf("published  %s\n", proof.CreatedAt.Time().UTC().Format(time.DateTime))
+	fmt.Printf("leaf       %d of %d\n", proof.LeafIndex, proof.TreeSize)
+	for _, hash := range proof.Path {
+		fmt.Printf("path       %s\n", hash)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"sync"
+	"time"
+)
+
+// PublishResult is the outcome of publishing to one relay.
+type PublishResult struct {
+	Relay string
+	Err   error
+}
+
+const relayFailureThreshold = 5
+
+var (
+	relayFailures      = make(map[string]int)
+	relayFailuresMutex sync.Mutex
+
+	botPublishes           = NewCounterVec("ppe_bot_publishes_total", "Bot events successfully published, by relay.", "relay")
+	botPublishFailures     = NewCounterVec("ppe_bot_publish_failures_total", "Bot events that failed to publish, by relay.", "relay")
+	botConsecutiveFailures = NewGaugeVec("ppe_bot_relay_consecutive_failures", "Publishes in a row that failed, by relay.", "relay")
+)
+
+// PublishBotEvent sends an event signed by the bot to all upstream relays at
+// once, giving each PUBLISH_TIMEOUT (10s by default) to connect and accept it
+// so a single slow relay can't hold up the rest.
+func PublishBotEvent(event nostr.Event) []PublishResult {
+	timeout := GetEnvDuration("PUBLISH_TIMEOUT", 10*time.Second)
+	results := make([]PublishResult, len(relays))
+
+	var wg sync.WaitGroup
+	for i, url := range relays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			results[i] = PublishResult{Relay: url, Err: publishToRelay(ctx, url, event)}
+			recordPublishResult(results[i])
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func publishToRelay(ctx context.Context, url string, event nostr.Event) error {
+	relay, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer relay.Close()
+	return relay.Publish(ctx, event)
+}
+
+// recordPublishResult keeps per-relay metrics and flags relays once they've
+// failed relayFailureThreshold times in a row.
+func recordPublishResult(result PublishResult) {
+	relayFailuresMutex.Lock()
+	defer relayFailuresMutex.Unlock()
+
+	if result.Err == nil {
+		botPublishes.Inc(result.Relay)
+		relayFailures[result.Relay] = 0
+		botConsecutiveFailures.Set(result.Relay, 0)
+		return
+	}
+
+	botPublishFailures.Inc(result.Relay)
+	relayFailures[result.Relay]++
+	botConsecutiveFailures.Set(result.Relay, int64(relayFailures[result.Relay]))
+
+	if relayFailures[result.Relay] == relayFailureThreshold {
+		ReportError(fmt.Errorf("%d publishes in a row failed: %v", relayFailureThreshold, result.Err), "publishing", map[string]string{"relay": result.Relay})
+	} else {
+		fmt.Printf("Error publishing to %s: %v\n", result.Relay, result.Err)
+	}
+}
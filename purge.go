@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// purgePageSize is how many stored events PurgeEvents reads at a time.
+var purgePageSize = 500
+
+type PurgeCriteria struct {
+	IDs     []string `json:"ids"`
+	Authors []string `json:"authors"`
+	Kinds   []int    `json:"kinds"`
+	Content string   `json:"content"`
+	DryRun  bool     `json:"dry_run"`
+}
+
+type PurgeResult struct {
+	Matched int      `json:"matched"`
+	Deleted int      `json:"deleted"`
+	IDs     []string `json:"ids"`
+}
+
+// PurgeEvents deletes every stored event matching all of the given criteria
+// (the content regex is applied on top of the id/author/kind selection, to
+// the decrypted content of encrypted kinds). Events are read and deleted a
+// page at a time, so a purge of a large account doesn't hold it all in
+// memory. With DryRun set nothing is deleted and only the matches are reported.
+func PurgeEvents(criteria PurgeCriteria, db Database, deleteEvent func(context.Context, *nostr.Event) error) (PurgeResult, error) {
+	var result PurgeResult
+
+	if len(criteria.IDs) == 0 && len(criteria.Authors) == 0 && len(criteria.Kinds) == 0 && criteria.Content == "" {
+		return result, errors.New("at least one of ids, authors, kinds or content is required")
+	}
+
+	var content *regexp.Regexp
+	if criteria.Content != "" {
+		var err error
+		if content, err = regexp.Compile(criteria.Content); err != nil {
+			return result, fmt.Errorf("invalid content regex: %v", err)
+		}
+	}
+
+	authors := make([]string, 0, len(criteria.Authors))
+	for _, author := range criteria.Authors {
+		pubkey, err := ParsePubKey(author)
+		if err != nil {
+			return result, fmt.Errorf("invalid author %s: %v", author, err)
+		}
+		authors = append(authors, pubkey)
+	}
+
+	conditions := []string{"1 = 1"}
+	params := []any{}
+	for column, values := range map[string][]any{"id": toAnySlice(criteria.IDs), "pubkey": toAnySlice(authors), "kind": toAnySlice(criteria.Kinds)} {
+		if len(values) == 0 {
+			continue
+		}
+		condition, args, err := sqlx.In(column+" IN (?)", values)
+		if err != nil {
+			return result, err
+		}
+		conditions = append(conditions, condition)
+		params = append(params, args...)
+	}
+
+	ctx := context.Background()
+	for _, store := range EventDatabases(db) {
+		// pages are keyed by id rather than offset, as deleting shifts the rows
+		after := ""
+		for {
+			page, err := scanStoredEvents(store,
+				`SELECT id, pubkey, created_at, kind, tags, content, sig FROM event WHERE `+strings.Join(conditions, " AND ")+` AND id > ? ORDER BY id LIMIT ?`,
+				append(slices.Clip(params), after, purgePageSize),
+			)
+			if err != nil {
+				return result, err
+			}
+			for _, event := range page {
+				if content != nil && !purgeContentMatches(content, event) {
+					continue
+				}
+				result.Matched++
+				result.IDs = append(result.IDs, event.ID)
+
+				if criteria.DryRun {
+					continue
+				}
+				if err := deleteEvent(ctx, event); err != nil {
+					fmt.Printf("Error deleting %s: %v\n", event.ID, err)
+					continue
+				}
+				result.Deleted++
+			}
+			if len(page) < purgePageSize {
+				break
+			}
+			after = page[len(page)-1].ID
+		}
+	}
+	return result, nil
+}
+
+// purgeContentMatches matches content against event's content as it was
+// published, not as EncryptAtRest stored it. Events that can't be decrypted
+// don't match.
+func purgeContentMatches(content *regexp.Regexp, event *nostr.Event) bool {
+	text, err := DecryptContent(event)
+	if err != nil {
+		ReportError(err, "purge", map[string]string{"event": event.ID})
+		return false
+	}
+	return content.MatchString(text)
+}
+
+func toAnySlice[T any](values []T) []any {
+	result := make([]any, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
+
+func HandleAdminPurge(w http.ResponseWriter, r *http.Request, db Database) {
+	if r.Method != http.MethodPost {
+		WriteJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var criteria PurgeCriteria
+	if err := json.NewDecoder(r.Body).Decode(&criteria); err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "invalid json body")
+		return
+	}
+
+	result, err := PurgeEvents(criteria, db, func(ctx context.Context, event *nostr.Event) error {
+		for _, del := range relay.DeleteEvent {
+			if err := del(ctx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, result)
+}
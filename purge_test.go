@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"github.com/nbd-wtf/go-nostr"
+	"testing"
+)
+
+func TestPurgeMatchesDecryptedContent(t *testing.T) {
+	h := NewHarness(t)
+	encryptionKey, encryptedKinds[nostr.KindEncryptedDirectMessage], purgePageSize = make([]byte, 32), true, 2
+	t.Cleanup(func() {
+		encryptionKey, purgePageSize = nil, 500
+		delete(encryptedKinds, nostr.KindEncryptedDirectMessage)
+	})
+
+	sk := nostr.GeneratePrivateKey()
+	store := EncryptAtRest(h.DB.SaveEvent)
+	var spam []string
+	for i, content := range []string{"buy now", "hello", "buy now", "hi", "buy now"} {
+		event := nostr.Event{Kind: nostr.KindEncryptedDirectMessage, CreatedAt: nostr.Timestamp(i + 1), Content: content}
+		event.Sign(sk)
+		if err := store(context.Background(), &event); err != nil {
+			t.Fatalf("storing: %v", err)
+		}
+		if content == "buy now" {
+			spam = append(spam, event.ID)
+		}
+	}
+
+	result, err := PurgeEvents(PurgeCriteria{Content: "^buy"}, h.DB, h.DB.DeleteEvent)
+	if err != nil {
+		t.Fatalf("purging: %v", err)
+	}
+	if result.Matched != len(spam) || result.Deleted != len(spam) {
+		t.Fatalf("matched %d and deleted %d events, expected %d", result.Matched, result.Deleted, len(spam))
+	}
+	var left int
+	h.DB.DB.Get(&left, `SELECT COUNT(*) FROM event`)
+	if left != 2 {
+		t.Fatalf("%d events left, expected the 2 that weren't spam", left)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var pushSchema = Schema{
+	Tables: []string{"push_subscription"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS push_subscription (
+       pubkey text NOT NULL PRIMARY KEY,
+       url text NOT NULL,
+       created_at bigint NOT NULL);`,
+	},
+}
+
+type PushNotification struct {
+	URL     string
+	Title   string
+	Message string
+	Click   string
+}
+
+var (
+	pushEnabled bool
+	ntfyServers []string
+	pushQueue   = make(chan PushNotification, 1000)
+
+	// pushSubscriptions maps pubkeys to their ntfy topic URLs, so checking
+	// every recipient of every note doesn't hit the database
+	pushSubscriptions      = make(map[string]string)
+	pushSubscriptionsMutex sync.RWMutex
+
+	ntfyTopicPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+	pushesSent    = NewCounter("ppe_push_notifications_sent_total", "Push notifications accepted by ntfy.")
+	pushesFailed  = NewCounter("ppe_push_notifications_failed_total", "Push notifications ntfy didn't accept.")
+	pushesDropped = NewCounter("ppe_push_notifications_dropped_total", "Push notifications dropped because the queue was full.")
+)
+
+// ConfigurePush turns on push notifications with PUSH_NOTIFICATIONS=true.
+// Paying users pick an ntfy topic, through the bot or the landing page, and
+// get a notification there when a reply, mention or zap for them is stored
+// here. Topics can be full URLs on any of NTFY_SERVERS, so the relay can't be
+// made to POST anywhere else. Only ntfy is supported, not browser Web Push.
+func ConfigurePush(db Database) error {
+	pushEnabled = GetEnvDefault("PUSH_NOTIFICATIONS", "") == "true"
+	if !pushEnabled {
+		return nil
+	}
+	ntfyServers = GetEnvList("NTFY_SERVERS", []string{"https://ntfy.sh"})
+	for i, server := range ntfyServers {
+		ntfyServers[i] = strings.TrimSuffix(server, "/")
+	}
+	if err := LoadPushSubscriptions(db); err != nil {
+		return err
+	}
+
+	relay.OnEventSaved = append(relay.OnEventSaved, NotifyRecipients(db))
+	relay.Router().HandleFunc("/push", func(w http.ResponseWriter, r *http.Request) {
+		HandlePush(w, r, db)
+	})
+	Supervise("push dispatcher", RunPushDispatcher)
+	return nil
+}
+
+func LoadPushSubscriptions(db Database) error {
+	rows, err := db.DB.Query(`SELECT pubkey, url FROM push_subscription`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	pushSubscriptionsMutex.Lock()
+	defer pushSubscriptionsMutex.Unlock()
+	for rows.Next() {
+		var pubkey, url string
+		if err := rows.Scan(&pubkey, &url); err != nil {
+			return err
+		}
+		pushSubscriptions[pubkey] = url
+	}
+	return rows.Err()
+}
+
+// NtfyTopicURL turns a topic name or URL into the URL to publish to, or an
+// error when it isn't on one of NTFY_SERVERS.
+func NtfyTopicURL(topic string) (string, error) {
+	for _, server := range ntfyServers {
+		if name, found := strings.CutPrefix(topic, server+"/"); found {
+			topic = name
+			if !ntfyTopicPattern.MatchString(topic) {
+				return "", fmt.Errorf("%s isn't an ntfy topic", topic)
+			}
+			return server + "/" + topic, nil
+		}
+	}
+	if strings.Contains(topic, "://") {
+		return "", fmt.Errorf("notifications can only go to %s", strings.Join(ntfyServers, ", "))
+	}
+	if !ntfyTopicPattern.MatchString(topic) {
+		return "", fmt.Errorf("%s isn't an ntfy topic: use letters, digits, - and _", topic)
+	}
+	return ntfyServers[0] + "/" + topic, nil
+}
+
+// SubscribePush sends pubkey's notifications to url, one of NtfyTopicURL's,
+// or stops them when url is empty.
+func SubscribePush(pubkey string, url string, db Database) error {
+	if url == "" {
+		if _, err := db.DB.Exec(`DELETE FROM push_subscription WHERE pubkey = ?`, pubkey); err != nil {
+			return err
+		}
+		pushSubscriptionsMutex.Lock()
+		delete(pushSubscriptions, pubkey)
+		pushSubscriptionsMutex.Unlock()
+		return nil
+	}
+
+	_, err := db.DB.Exec(
+		`INSERT INTO push_subscription (pubkey, url, created_at) VALUES (?, ?, ?)
+		 ON CONFLICT (pubkey) DO UPDATE SET url = excluded.url, created_at = excluded.created_at`,
+		pubkey, url, nostr.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	pushSubscriptionsMutex.Lock()
+	pushSubscriptions[pubkey] = url
+	pushSubscriptionsMutex.Unlock()
+	return nil
+}
+
+func GetPushSubscription(pubkey string) string {
+	pushSubscriptionsMutex.RLock()
+	defer pushSubscriptionsMutex.RUnlock()
+	return pushSubscriptions[pubkey]
+}
+
+// HandlePushCommand answers "push" with where the user's notifications go,
+// "push <topic>" by sending them there and "push off" by stopping them.
+func HandlePushCommand(pubkey string, args []string, db Database) string {
+	if len(args) == 0 {
+		if url := GetPushSubscription(pubkey); url != "" {
+			return fmt.Sprintf("Your notifications go to %s. Change it with push <topic>, or stop them with push off.", url)
+		}
+		return "Get replies, mentions and zaps on your phone with push <ntfy topic>."
+	}
+	if len(args) != 1 {
+		return "Usage: push [<ntfy topic>|off]"
+	}
+
+	var url string
+	if strings.ToLower(args[0]) != "off" {
+		if !IsPayingCustomer(pubkey, db) {
+			return "Push notifications are for paying users: top up your balance first."
+		}
+		var err error
+		if url, err = NtfyTopicURL(args[0]); err != nil {
+			return err.Error() + "."
+		}
+	}
+	if err := SubscribePush(pubkey, url, db); err != nil {
+		ReportError(err, "push", map[string]string{"pubkey": pubkey})
+		return "Couldn't save your push settings, try again later."
+	}
+	if url == "" {
+		return "Stopped your push notifications."
+	}
+	return fmt.Sprintf("Your replies, mentions and zaps will be pushed to %s. Subscribe to it in the ntfy app.", url)
+}
+
+// HandlePush is the landing page's push settings form: a NIP-98
+// authenticated POST of {"topic": "..."}, where an empty topic stops them.
+func HandlePush(w http.ResponseWriter, r *http.Request, db Database) {
+	if r.Method != http.MethodPost {
+		WriteJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "request too large")
+		return
+	}
+	pubkey, err := VerifyNIP98(r, body)
+	if err != nil {
+		WriteJSONError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var request struct {
+		Topic string `json:"topic"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "body must be {\"topic\": \"...\"}")
+		return
+	}
+	var url string
+	if topic := strings.TrimSpace(request.Topic); topic != "" {
+		if !IsPayingCustomer(pubkey, db) {
+			WriteJSONError(w, http.StatusPaymentRequired, "push notifications are for paying users: top up your balance first")
+			return
+		}
+		if url, err = NtfyTopicURL(topic); err != nil {
+			WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err := SubscribePush(pubkey, url, db); err != nil {
+		ReportError(err, "push", map[string]string{"pubkey": pubkey})
+		WriteJSONError(w, http.StatusInternalServerError, "couldn't save your push settings")
+		return
+	}
+	if url == "" {
+		WriteJSON(w, http.StatusOK, map[string]any{"message": "Stopped your push notifications."})
+		return
+	}
+	WriteJSON(w, http.StatusOK, map[string]any{"url": url, "message": "Notifications will be pushed to " + url + "."})
+}
+
+// NotifyRecipients is an OnEventSaved hook pushing notes to the pubkeys they
+// tag and zap receipts to whoever was zapped, when those are subscribed,
+// still paying and allowed to see the author. Encrypted kinds are announced
+// without their content.
+func NotifyRecipients(db Database) func(ctx context.Context, event *nostr.Event) {
+	return func(ctx context.Context, event *nostr.Event) {
+		var recipients []string
+		var kind, title string
+		switch event.Kind {
+		case nostr.KindTextNote:
+			kind, title = NotifyReplies, "New reply from "
+			for _, tag := range event.Tags.GetAll([]string{"p", ""}) {
+				recipients = append(recipients, tag[1])
+			}
+		case nostr.KindZap:
+			kind, title = NotifyZaps, "New zap from "
+			if recipient := tagValue(event.Tags, "p"); recipient != "" {
+				recipients = append(recipients, recipient)
+			}
+		default:
+			return
+		}
+
+		author := GetEventAuthor(event)
+		if event.Kind == nostr.KindZap {
+			if zapRequest, err := GetZapRequestFromZapEvent(event); err == nil {
+				author = zapRequest.PubKey
+			}
+		}
+		npub, _ := nip19.EncodePublicKey(author)
+		note, _ := nip19.EncodeNote(event.ID)
+		message := "You were zapped."
+		if event.Kind == nostr.KindTextNote {
+			message = "Open it in your Nostr app."
+			if !encryptedKinds[event.Kind] && event.Content != "" {
+				message = truncate(event.Content, 200)
+			}
+		}
+
+		sent := make(map[string]bool)
+		for _, recipient := range recipients {
+			if recipient == author || sent[recipient] {
+				continue
+			}
+			url := GetPushSubscription(recipient)
+			if url == "" || !WantsNotification(recipient, kind) || !CanSee(recipient, author, db) || !IsPayingCustomer(recipient, db) {
+				continue
+			}
+			sent[recipient] = true
+
+			select {
+			case pushQueue <- PushNotification{URL: url, Title: title + truncate(npub, 16), Message: message, Click: "nostr:" + note}:
+			default:
+				pushesDropped.Inc()
+			}
+		}
+	}
+}
+
+func RunPushDispatcher() {
+	for notification := range pushQueue {
+		DeliverPush(notification)
+	}
+}
+
+// DeliverPush publishes a notification to its ntfy topic, once: a missed
+// push isn't worth holding up the ones behind it.
+func DeliverPush(notification PushNotification) {
+	request, err := http.NewRequest(http.MethodPost, notification.URL, strings.NewReader(notification.Message))
+	if err != nil {
+		fmt.Printf("Error creating push request: %v\n", err)
+		return
+	}
+	request.Header.Set("Title", notification.Title)
+	request.Header.Set("Click", notification.Click)
+	request.Header.Set("Tags", "speech_balloon")
+
+	response, err := httpClient.Do(request)
+	if err == nil {
+		response.Body.Close()
+		if response.StatusCode < 300 {
+			pushesSent.Inc()
+			return
+		}
+		err = fmt.Errorf("status %s", response.Status)
+	}
+	fmt.Printf("push to %s failed: %v\n", notification.URL, err)
+	pushesFailed.Inc()
+}
+
+// truncate shortens s to at most n runes, marking the cut with an ellipsis.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type queryCacheEntry struct {
+	key     string
+	filter  nostr.Filter
+	events  []*nostr.Event
+	expires time.Time
+}
+
+// QueryCache is an LRU of query results keyed by the serialized filter.
+// Entries are dropped whenever an event matching their filter is stored or
+// deleted, so cached results never miss newer events, and after ttl.
+//
+// Instances sharing a database store events the others' caches don't hear
+// of. With Redis, every instance's stores and deletes bump a shared
+// generation, and an instance seeing it change drops its whole cache;
+// while Redis can't be reached, entries only go stale for ttl.
+type QueryCache struct {
+	size       int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	order      *list.List
+	generation uint64
+	mutex      sync.Mutex
+
+	// the shared generation this instance's entries were cached at
+	sharedGeneration int64
+}
+
+var (
+	queryCacheHits   = NewCounter("ppe_query_cache_hits_total", "Queries answered from the query cache.")
+	queryCacheMisses = NewCounter("ppe_query_cache_misses_total", "Queries that had to hit the database.")
+)
+
+const queryCacheGenerationKey = "querycache:generation"
+
+func NewQueryCache(size int, ttl time.Duration) *QueryCache {
+	return &QueryCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Wrap returns a QueryEvents handler answering repeated filters from the cache
+// and falling back to the given handler on a miss.
+func (c *QueryCache) Wrap(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		key := filter.String()
+		sharedGeneration, shared := getSharedQueryCacheGeneration()
+
+		c.mutex.Lock()
+		if shared && sharedGeneration != c.sharedGeneration {
+			c.clear()
+			c.sharedGeneration = sharedGeneration
+		}
+		element, ok := c.entries[key]
+		if ok && Now().After(element.Value.(*queryCacheEntry).expires) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+			ok = false
+		}
+		if ok {
+			c.order.MoveToFront(element)
+			events := element.Value.(*queryCacheEntry).events
+			c.mutex.Unlock()
+
+			queryCacheHits.Inc()
+			ch := make(chan *nostr.Event, len(events))
+			for _, event := range events {
+				ch <- event
+			}
+			close(ch)
+			return ch, nil
+		}
+		generation := c.generation
+		c.mutex.Unlock()
+
+		queryCacheMisses.Inc()
+		results, err := query(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+
+			var events []*nostr.Event
+			for event := range results {
+				events = append(events, event)
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					// the consumer went away, don't cache a partial result
+					for range results {
+					}
+					return
+				}
+			}
+			c.add(key, filter, events, generation)
+		}()
+		return ch, nil
+	}
+}
+
+func (c *QueryCache) add(key string, filter nostr.Filter, events []*nostr.Event, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// something was stored or deleted while we were querying, so these
+	// results may already be stale
+	if generation != c.generation {
+		return
+	}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&queryCacheEntry{key: key, filter: filter, events: events, expires: Now().Add(c.ttl)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*queryCacheEntry).key)
+	}
+}
+
+// Invalidate drops every cached result the event could belong to, here
+// and, through the shared generation, on the other instances.
+func (c *QueryCache) Invalidate(event *nostr.Event) {
+	sharedGeneration, shared := SharedIncrement(queryCacheGenerationKey)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// only this bump is accounted for below; if another instance's came
+	// in between, the next query still sees a generation it didn't cache
+	// at and drops everything
+	if shared && sharedGeneration == c.sharedGeneration+1 {
+		c.sharedGeneration = sharedGeneration
+	}
+	c.generation++
+	for key, element := range c.entries {
+		if element.Value.(*queryCacheEntry).filter.Matches(event) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// clear drops every entry, for results cached before another instance
+// stored or deleted something.
+func (c *QueryCache) clear() {
+	c.generation++
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// getSharedQueryCacheGeneration reads the generation bumped by every
+// instance's stores and deletes; shared is false without Redis.
+func getSharedQueryCacheGeneration() (generation int64, shared bool) {
+	value, found, ok := SharedGet(queryCacheGenerationKey)
+	if !ok {
+		return 0, false
+	}
+	if found {
+		generation, _ = strconv.ParseInt(value, 10, 64)
+	}
+	return generation, true
+}
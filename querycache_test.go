@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingQuery answers every filter with event, counting how often it's
+// asked.
+func countingQuery(event *nostr.Event, queries *int) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		*queries++
+		ch := make(chan *nostr.Event, 1)
+		ch <- event
+		close(ch)
+		return ch, nil
+	}
+}
+
+func drain(t *testing.T, query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error), filter nostr.Filter) {
+	t.Helper()
+	ch, err := query(context.Background(), filter)
+	if err != nil {
+		t.Fatalf("querying: %v", err)
+	}
+	for range ch {
+	}
+}
+
+func TestQueryCacheExpires(t *testing.T) {
+	now := manualClock(t, time.Date(2026, 11, 1, 12, 0, 0, 0, time.UTC))
+	event := &nostr.Event{ID: "a", Kind: nostr.KindTextNote}
+	filter := nostr.Filter{Kinds: []int{nostr.KindTextNote}}
+
+	var queries int
+	query := NewQueryCache(10, 30*time.Second).Wrap(countingQuery(event, &queries))
+	drain(t, query, filter)
+	drain(t, query, filter)
+	if queries != 1 {
+		t.Fatalf("%d queries within the TTL, expected 1", queries)
+	}
+	now.Advance(31 * time.Second)
+	drain(t, query, filter)
+	if queries != 2 {
+		t.Fatalf("%d queries after the TTL, expected 2", queries)
+	}
+}
+
+func TestQueryCacheSharedInvalidation(t *testing.T) {
+	address := fakeRedis(t)
+	client, err := NewRedisClient("redis://" + address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedState = client
+	t.Cleanup(func() { sharedState = nil })
+
+	event := &nostr.Event{ID: "a", Kind: nostr.KindTextNote}
+	filter := nostr.Filter{Kinds: []int{nostr.KindTextNote}}
+	var queries int
+	cache, other := NewQueryCache(10, time.Hour), NewQueryCache(10, time.Hour)
+	query := cache.Wrap(countingQuery(event, &queries))
+
+	drain(t, query, filter)
+	// this instance's own invalidations leave unrelated entries alone
+	cache.Invalidate(&nostr.Event{ID: "b", Kind: nostr.KindReaction})
+	drain(t, query, filter)
+	if queries != 1 {
+		t.Fatalf("%d queries, expected the second to be cached", queries)
+	}
+
+	// another instance storing anything drops them
+	other.Invalidate(&nostr.Event{ID: "c", Kind: nostr.KindReaction})
+	drain(t, query, filter)
+	if queries != 2 {
+		t.Fatalf("%d queries, expected another instance's store to drop the cache", queries)
+	}
+}
+
+// fakeRedis serves GET and INCR, all the query cache uses, on a local port.
+func fakeRedis(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mutex sync.Mutex
+	values := make(map[string]int64)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					var count int
+					if _, err := fmt.Fscanf(reader, "*%d\r\n", &count); err != nil {
+						return
+					}
+					args := make([]string, count)
+					for i := range args {
+						var size int
+						fmt.Fscanf(reader, "$%d\r\n", &size)
+						data := make([]byte, size+2)
+						if _, err := io.ReadFull(reader, data); err != nil {
+							return
+						}
+						args[i] = string(data[:size])
+					}
+
+					mutex.Lock()
+					value, found := values[args[1]]
+					switch args[0] {
+					case "INCR":
+						values[args[1]] = value + 1
+						fmt.Fprintf(conn, ":%d\r\n", value+1)
+					case "GET":
+						if found {
+							text := strconv.FormatInt(value, 10)
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(text), text)
+						} else {
+							fmt.Fprint(conn, "$-1\r\n")
+						}
+					}
+					mutex.Unlock()
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"sync"
+	"time"
+)
+
+// readAccessTTL is how long a read access decision is reused. Broadcasts
+// check it for every event and every listener, so they can't go to the
+// database each time.
+const readAccessTTL = time.Minute
+
+type readAccess struct {
+	allowed bool
+	expires time.Time
+}
+
+var (
+	paidReads bool
+
+	readAccessCache = make(map[string]readAccess)
+	readAccessMutex sync.Mutex
+
+	readsRefused = NewCounter("ppe_reads_refused_total", "Subscriptions refused because the connection isn't a paying customer.")
+)
+
+// HasReadAccess reports whether pubkey may read from a PAID_READS relay,
+// which only paying customers can. Pubkeys exempt from billing, the operator
+// and the bot among them, can always read. Decisions are cached in Redis
+// when there is one, in memory otherwise.
+func HasReadAccess(pubkey string, db Database) bool {
+	if pubkey == "" {
+		return false
+	}
+	if IsBillingExempt(pubkey) {
+		return true
+	}
+
+	if value, found, ok := SharedGet("read:" + pubkey); ok && found {
+		return value == "1"
+	}
+	readAccessMutex.Lock()
+	cached, ok := readAccessCache[pubkey]
+	readAccessMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.allowed
+	}
+
+	allowed := IsPayingCustomer(pubkey, db)
+
+	value := "0"
+	if allowed {
+		value = "1"
+	}
+	if SharedSet("read:"+pubkey, value, readAccessTTL) {
+		return allowed
+	}
+	readAccessMutex.Lock()
+	readAccessCache[pubkey] = readAccess{allowed: allowed, expires: time.Now().Add(readAccessTTL)}
+	readAccessMutex.Unlock()
+	return allowed
+}
+
+// IsPayingCustomer reports whether pubkey, or whoever pays for its events,
+// has a positive balance or prepaid events left.
+func IsPayingCustomer(pubkey string, db Database) bool {
+	payer, allowance := ResolveBilling(pubkey, db)
+	return allowance != nil || GetRemainingUserBalanceMsat(payer, db) > 0 || GetPackageEventsRemaining(payer, db) > 0
+}
+
+// RequirePaidReads is a RejectFilter policy that only serves authenticated
+// paying customers, asking everyone else to AUTH first.
+func RequirePaidReads(db Database) func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	return func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+		pubkey := khatru.GetAuthed(ctx)
+		if pubkey == "" {
+			readsRefused.Inc()
+			return true, "auth-required: this relay only serves paying customers"
+		}
+		if !HasReadAccess(pubkey, db) {
+			readsRefused.Inc()
+			return true, "payment-required: top up your balance to read from this relay"
+		}
+		return false, ""
+	}
+}
+
+// PreventUnpaidBroadcast keeps live events from reaching subscriptions that
+// skipped RequirePaidReads (limit:0 REQs aren't filtered) or whose balance
+// has since run out.
+func PreventUnpaidBroadcast(db Database) func(ws *khatru.WebSocket, event *nostr.Event) bool {
+	return func(ws *khatru.WebSocket, event *nostr.Event) bool {
+		return !HasReadAccess(ws.AuthedPublicKey, db)
+	}
+}
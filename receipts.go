@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+)
+
+// KindBillingStatus follows NIP-90's job feedback kind: each charge, refund
+// and rejection is reported to the author as a status event referencing the
+// event it's about. They're broadcast to live subscribers only, never stored.
+const KindBillingStatus = 7000
+
+const (
+	BillingCharged  = "charged"
+	BillingRefunded = "refunded"
+	BillingRejected = "rejected"
+)
+
+var (
+	billingReceipts bool
+
+	billingStatusesSent = NewCounter("ppe_billing_statuses_sent_total", "Billing status events broadcast to authors.")
+)
+
+// EmitBillingStatus broadcasts a bot-signed status event to subscribers
+// listening for the author's p tag. It's a no-op unless BILLING_RECEIPTS is on
+// and the author wants receipts.
+func EmitBillingStatus(status string, event *nostr.Event, amountMsat int64, message string) {
+	if !billingReceipts || !WantsNotification(event.PubKey, NotifyReceipts) {
+		return
+	}
+
+	receipt := nostr.Event{
+		PubKey:    botPubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      KindBillingStatus,
+		Content:   message,
+		Tags: nostr.Tags{
+			{"status", status, message},
+			{"e", event.ID},
+			{"p", event.PubKey},
+			{"k", strconv.Itoa(event.Kind)},
+		},
+	}
+	if amountMsat > 0 {
+		receipt.Tags = append(receipt.Tags, nostr.Tag{"amount", strconv.FormatInt(amountMsat, 10)})
+	}
+	if err := receipt.Sign(GetEnv("BOT_PRIVATE_KEY")); err != nil {
+		ReportError(err, "receipts", map[string]string{"event": event.ID})
+		return
+	}
+
+	relay.BroadcastEvent(&receipt)
+	billingStatusesSent.Inc()
+}
+
+// RefundUnpricedEvent reports the implicit refund when an event stored before
+// per-event charges is deleted: those are billed for as long as they're
+// stored, so deleting one gives its sat back.
+func RefundUnpricedEvent(db Database) func(ctx context.Context, event *nostr.Event) error {
+	return func(ctx context.Context, event *nostr.Event) error {
+		if !billingReceipts {
+			return nil
+		}
+
+		var charged int
+		db.DB.QueryRow(`SELECT COUNT(*) FROM debit WHERE id = ?`, "event:"+event.ID).Scan(&charged)
+		if charged == 0 {
+			EmitBillingStatus(BillingRefunded, event, 1000, fmt.Sprintf("Refunded 1 sat for deleting %s.", event.ID))
+		}
+		return nil
+	}
+}
+
+// formatSatsShort prints whole sats as "1 sat" or "41 sats", falling back
+// to millisat precision otherwise.
+func formatSatsShort(msat int64) string {
+	switch {
+	case msat == 1000:
+		return "1 sat"
+	case msat%1000 == 0:
+		return fmt.Sprintf("%d sats", msat/1000)
+	}
+	return formatSats(msat) + " sats"
+}
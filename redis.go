@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RedisClient speaks just enough of the Redis protocol for the state
+// instances behind a load balancer share: seen events, rate limit buckets
+// and read access decisions. Connections are pooled and redialed on error.
+//
+// Balances aren't cached here. The ledger is written from too many places,
+// gifts, escrow and erasures among them, for every write to invalidate a
+// cached balance, and billing decides on the balance in the database that
+// every instance shares anyway, so a stale one could only let events
+// through that can't be paid for.
+type RedisClient struct {
+	address  string
+	password string
+	database int
+	conns    chan *redisConn
+
+	// unreachable until then, so a Redis outage doesn't add a timeout to
+	// every event and connection
+	downUntil atomic.Int64
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+type RedisError string
+
+func (e RedisError) Error() string {
+	return string(e)
+}
+
+var (
+	sharedState *RedisClient
+
+	redisErrors = NewCounter("ppe_redis_errors_total", "Redis commands that failed, falling back to this instance's memory.")
+)
+
+const (
+	redisTimeout = 2 * time.Second
+	redisBackoff = 5 * time.Second
+)
+
+// ConfigureSharedState connects to REDIS_URL (redis://[:password@]host:port/db)
+// when it's set. Without it every instance keeps its own seen events, rate
+// limits and caches, as does an instance that can't reach Redis.
+func ConfigureSharedState() error {
+	value := GetEnvDefault("REDIS_URL", "")
+	if value == "" {
+		sharedState = nil
+		return nil
+	}
+	client, err := NewRedisClient(value)
+	if err != nil {
+		return err
+	}
+	if _, err := client.Do("PING"); err != nil {
+		ReportError(err, "redis", nil)
+	}
+	sharedState = client
+	return nil
+}
+
+func NewRedisClient(value string) (*RedisClient, error) {
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "redis" && parsed.Scheme != "rediss") {
+		return nil, fmt.Errorf("REDIS_URL must be a redis:// URL, got %q", value)
+	}
+	if parsed.Scheme == "rediss" {
+		return nil, errors.New("TLS connections to Redis aren't supported, use redis://")
+	}
+
+	client := &RedisClient{address: parsed.Host, conns: make(chan *redisConn, 16)}
+	if !strings.Contains(client.address, ":") {
+		client.address += ":6379"
+	}
+	if parsed.User != nil {
+		client.password, _ = parsed.User.Password()
+		if client.password == "" {
+			client.password = parsed.User.Username()
+		}
+	}
+	if database := strings.Trim(parsed.Path, "/"); database != "" {
+		if client.database, err = strconv.Atoi(database); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", database)
+		}
+	}
+	return client, nil
+}
+
+func (c *RedisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", c.address, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: conn, reader: bufio.NewReader(conn)}
+	if c.password != "" {
+		if _, err := rc.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.database != 0 {
+		if _, err := rc.do("SELECT", c.database); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// Do runs a command and returns its reply: a string, an int64, nil, a []any
+// of those or a RedisError.
+func (c *RedisClient) Do(args ...any) (any, error) {
+	if time.Now().UnixNano() < c.downUntil.Load() {
+		return nil, errors.New("redis is unreachable")
+	}
+
+	var conn *redisConn
+	select {
+	case conn = <-c.conns:
+	default:
+		var err error
+		if conn, err = c.dial(); err != nil {
+			c.downUntil.Store(time.Now().Add(redisBackoff).UnixNano())
+			return nil, err
+		}
+	}
+
+	reply, err := conn.do(args...)
+	var redisError RedisError
+	if err != nil && !errors.As(err, &redisError) {
+		conn.Close()
+		c.downUntil.Store(time.Now().Add(redisBackoff).UnixNano())
+		return nil, err
+	}
+	select {
+	case c.conns <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisConn) do(args ...any) (any, error) {
+	c.SetDeadline(time.Now().Add(redisTimeout))
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		value := fmt.Sprint(arg)
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(value), value)
+	}
+	if _, err := c.Write([]byte(command.String())); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty Redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		values := make([]any, count)
+		for i := range values {
+			if values[i], err = c.readReply(); err != nil {
+				var redisError RedisError
+				if !errors.As(err, &redisError) {
+					return nil, err
+				}
+				values[i] = err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected Redis reply %q", line)
+}
+
+// SharedSeen is SeenCache.Seen across instances: ok is false when Redis
+// couldn't answer.
+func SharedSeen(id string, ttl time.Duration) (seen bool, ok bool) {
+	if sharedState == nil {
+		return false, false
+	}
+	reply, err := sharedState.Do("SET", "ppe:seen:"+id, 1, "NX", "EX", int(ttl.Seconds()))
+	if err != nil {
+		redisErrors.Inc()
+		return false, false
+	}
+	// NX makes SET return nil when the key already existed
+	return reply == nil, true
+}
+
+// redisTokenBucket refills and takes from a bucket kept in a hash, all in
+// one script so instances can't interleave between reading and writing it.
+const redisTokenBucket = `
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(bucket[1]) or capacity
+local last = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - last) * rate)
+local limited = 0
+if tokens < 1 then
+  limited = 1
+else
+  tokens = tokens - 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('EXPIRE', KEYS[1], math.ceil(capacity / rate) + 1)
+return limited
+`
+
+// SharedRateLimited takes a token from the named bucket shared by all
+// instances, which holds capacity tokens and gets rate more every second.
+func SharedRateLimited(key string, capacity float64, rate float64) (limited bool, ok bool) {
+	if sharedState == nil {
+		return false, false
+	}
+	now := float64(time.Now().UnixMilli()) / 1000
+	reply, err := sharedState.Do("EVAL", redisTokenBucket, 1, "ppe:ratelimit:"+key,
+		strconv.FormatFloat(capacity, 'f', -1, 64), strconv.FormatFloat(rate, 'f', -1, 64), strconv.FormatFloat(now, 'f', 3, 64))
+	if err != nil {
+		redisErrors.Inc()
+		return false, false
+	}
+	return reply == int64(1), true
+}
+
+// SharedGet and SharedSet keep small cache entries in Redis.
+func SharedGet(key string) (value string, found bool, ok bool) {
+	if sharedState == nil {
+		return "", false, false
+	}
+	reply, err := sharedState.Do("GET", "ppe:"+key)
+	if err != nil {
+		redisErrors.Inc()
+		return "", false, false
+	}
+	value, found = reply.(string)
+	return value, found, true
+}
+
+func SharedSet(key string, value string, ttl time.Duration) bool {
+	if sharedState == nil {
+		return false
+	}
+	if _, err := sharedState.Do("SET", "ppe:"+key, value, "PX", ttl.Milliseconds()); err != nil {
+		redisErrors.Inc()
+		return false
+	}
+	return true
+}
+
+// SharedIncrement adds one to a counter kept in Redis, returning its new
+// value.
+func SharedIncrement(key string) (value int64, ok bool) {
+	if sharedState == nil {
+		return 0, false
+	}
+	reply, err := sharedState.Do("INCR", "ppe:"+key)
+	if err != nil {
+		redisErrors.Inc()
+		return 0, false
+	}
+	value, ok = reply.(int64)
+	return value, ok
+}
+
+// SharedDelete drops a cache entry, e.g. when what it was computed from
+// changes.
+func SharedDelete(key string) {
+	if sharedState == nil {
+		return
+	}
+	if _, err := sharedState.Do("DEL", "ppe:"+key); err != nil {
+		redisErrors.Inc()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"regexp"
+	"strings"
+)
+
+var referralSchema = Schema{
+	Tables: []string{"referral_code", "referral"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS referral_code (
+       code text NOT NULL PRIMARY KEY,
+       pubkey text NOT NULL UNIQUE,
+       created_at bigint NOT NULL);`,
+		`CREATE TABLE IF NOT EXISTS referral (
+       referee text NOT NULL PRIMARY KEY,
+       referrer text NOT NULL,
+       code text NOT NULL,
+       receipt text NOT NULL,
+       created_at bigint NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS referralreferreridx ON referral(referrer)`,
+	},
+}
+
+type ReferralConfig struct {
+	Bonus       int64
+	MinTopUp    int64
+	MaxPerCode  int
+	MinReferrer int64
+}
+
+var (
+	referralConfig ReferralConfig
+
+	referralCodePattern = regexp.MustCompile(`(?i)\bref(?:erral)?[:\s]+([a-z2-7]{8})\b`)
+
+	referralsRewarded = NewCounter("ppe_referrals_rewarded_total", "Referrals that earned both accounts a bonus.")
+)
+
+// GetReferralConfig reads REFERRAL_BONUS (0 disables referrals) and the
+// limits that keep people from farming bonuses with throwaway keys: a minimum
+// top-up for the referee, a minimum paid balance for the referrer and a cap on
+// rewarded referrals per code.
+func GetReferralConfig() ReferralConfig {
+	return ReferralConfig{
+		Bonus:       int64(GetEnvInt("REFERRAL_BONUS", 0)),
+		MinTopUp:    int64(GetEnvInt("REFERRAL_MIN_TOPUP", 100)),
+		MaxPerCode:  GetEnvInt("REFERRAL_MAX_PER_CODE", 20),
+		MinReferrer: int64(GetEnvInt("REFERRAL_MIN_REFERRER_PAID", 100)),
+	}
+}
+
+// GetReferralCode returns pubkey's code, generating one the first time.
+func GetReferralCode(pubkey string, db Database) (string, error) {
+	var code string
+	err := db.DB.QueryRow(`SELECT code FROM referral_code WHERE pubkey = ?`, pubkey).Scan(&code)
+	if err == nil {
+		return code, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	code = strings.ToLower(base32.StdEncoding.EncodeToString(RandomBytes(5)))
+
+	_, err = db.DB.Exec(`INSERT INTO referral_code (code, pubkey, created_at) VALUES (?, ?, ?)`, code, pubkey, NowTimestamp())
+	return code, err
+}
+
+// GetReferralCodeFromZapRequest finds the code a top-up was made with: the
+// "referral" tag of a bot-issued zap request, or a "ref CODE" zap comment.
+func GetReferralCodeFromZapRequest(zapRequest *Description) string {
+	if request := GetBotZapRequest(zapRequest); request != nil {
+		if tag := request.Tags.GetFirst([]string{"referral", ""}); tag != nil {
+			return strings.ToLower((*tag)[1])
+		}
+	}
+	if match := referralCodePattern.FindStringSubmatch(zapRequest.Content); match != nil {
+		return strings.ToLower(match[1])
+	}
+	return ""
+}
+
+// ApplyReferral rewards both sides of a referral when a new user's first
+// top-up names a code. Each referee can only ever be referred once, and
+// only before they've paid: someone with zaps credited before this one, or
+// credited to an account since erased, is no new user.
+func ApplyReferral(receipt *nostr.Event, zapRequest *Description, amountMsat int64, db Database) error {
+	if referralConfig.Bonus <= 0 {
+		return nil
+	}
+	code := GetReferralCodeFromZapRequest(zapRequest)
+	if code == "" || amountMsat < referralConfig.MinTopUp*1000 {
+		return nil
+	}
+
+	var referrer string
+	err := db.DB.QueryRow(`SELECT pubkey FROM referral_code WHERE code = ?`, code).Scan(&referrer)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	referee := GetZapBeneficiary(zapRequest)
+	if referee == referrer {
+		return nil
+	}
+	var customer bool
+	db.DB.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM zap_credit WHERE pubkey = ? AND id != ?) OR EXISTS (SELECT 1 FROM erased_zap WHERE pubkey_hash = ?)`,
+		referee, receipt.ID, erasureHash(referee),
+	).Scan(&customer)
+	if customer {
+		return nil
+	}
+
+	var referred int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM referral WHERE referrer = ?`, referrer).Scan(&referred)
+	if referred >= referralConfig.MaxPerCode {
+		return nil
+	}
+
+	var paidMsat int64
+	db.DB.QueryRow(
+		`SELECT COALESCE(SUM(amount_msat), 0) FROM zap_credit WHERE pubkey = ? AND id NOT IN (SELECT id FROM zap_revocation)`,
+		referrer,
+	).Scan(&paidMsat)
+	if paidMsat < referralConfig.MinReferrer*1000 {
+		return nil
+	}
+
+	result, err := db.DB.Exec(
+		`INSERT INTO referral (referee, referrer, code, receipt, created_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		referee, referrer, code, receipt.ID, NowTimestamp(),
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil
+	}
+
+	if _, err := RecordBonusCredit("referral:"+referee, referee, referralConfig.Bonus, "referred by "+referrer, db); err != nil {
+		return err
+	}
+	if _, err := RecordBonusCredit("referrer:"+referee, referrer, referralConfig.Bonus, "referred "+referee, db); err != nil {
+		return err
+	}
+	referralsRewarded.Inc()
+	return nil
+}
+
+func HandleReferralCommand(pubkey string, db Database) string {
+	code, err := GetReferralCode(pubkey, db)
+	if err != nil {
+		ReportError(err, "referrals", map[string]string{"pubkey": pubkey})
+		return "Couldn't get your referral code, try again later."
+	}
+	return fmt.Sprintf("Your referral code is %s. When someone new tops up at least %d sats with \"ref %s\" in the zap comment, you both get %d sats.",
+		code, referralConfig.MinTopUp, code, referralConfig.Bonus)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"github.com/nbd-wtf/go-nostr"
+	"log"
+	"strings"
+)
+
+// Rejection codes prefix every OK and CLOSED message the relay refuses
+// something with, as in "payment-required: no sufficient balance; top up",
+// so clients can react to them without parsing the rest:
+//
+//	blocked           not accepted from anyone like you: a deny list, spam, a kind this relay doesn't take
+//	rate-limited      slow down and try again later
+//	payment-required  top up the balance that pays for your events, or reads
+//	invalid           the event or filter is malformed or over a limit
+//	restricted        not for you: not on the allow list, no access to what you asked for
+//	auth-required     authenticate with NIP-42 first
+//	error             something went wrong on the relay, try again later
+//	duplicate         the relay already has this event; nothing was charged
+const (
+	RejectBlocked         = "blocked"
+	RejectRateLimited     = "rate-limited"
+	RejectPaymentRequired = "payment-required"
+	RejectInvalid         = "invalid"
+	RejectRestricted      = "restricted"
+	RejectAuthRequired    = "auth-required"
+	RejectError           = "error"
+	RejectDuplicate       = "duplicate"
+)
+
+var rejectionCodes = []string{RejectBlocked, RejectRateLimited, RejectPaymentRequired, RejectInvalid, RejectRestricted, RejectAuthRequired, RejectError, RejectDuplicate}
+
+var rejectionSchema = Schema{
+	Tables: []string{"event_rejection"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS event_rejection (
+       pubkey text NOT NULL,
+       day text NOT NULL,
+       reason text NOT NULL,
+       count bigint NOT NULL,
+       PRIMARY KEY (pubkey, day, reason));`,
+	},
+}
+
+var eventsRejected = NewCounter("ppe_events_rejected_total", "Events rejected by any policy.")
+
+// RecordRejections wraps every RejectEvent policy so rejections are counted
+// per pubkey, day and reason, and carry a rejection code. It has to be
+// applied once all policies are in place.
+func RecordRejections(policies []func(ctx context.Context, event *nostr.Event) (reject bool, msg string), db Database) []func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	wrapped := make([]func(ctx context.Context, event *nostr.Event) (reject bool, msg string), len(policies))
+	for i, policy := range policies {
+		wrapped[i] = func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+			reject, msg = policy(ctx, event)
+			if reject && RejectionCode(msg) == "" {
+				msg = RejectBlocked + ": " + msg
+			}
+			if reject {
+				eventsRejected.Inc()
+				RecordRejection(event.PubKey, msg, db)
+				FireWebhook(WebhookEventRejected, map[string]any{"pubkey": event.PubKey, "event": event.ID, "kind": event.Kind, "code": RejectionCode(msg), "reason": msg})
+				EmitBillingStatus(BillingRejected, event, 0, msg)
+				if dryRun {
+					log.Printf("dry-run: rejected %s from %s: %s", event.ID, event.PubKey, msg)
+				}
+			}
+			return reject, msg
+		}
+	}
+	return wrapped
+}
+
+// RejectionCode returns msg's rejection code, or "" when it has none.
+func RejectionCode(msg string) string {
+	code, _, found := strings.Cut(msg, ":")
+	if !found {
+		return ""
+	}
+	for _, known := range rejectionCodes {
+		if code == known {
+			return code
+		}
+	}
+	return ""
+}
+
+// WithRejectionCode prefixes a policy's messages with code unless they
+// already have one, for the libraries' policies.
+func WithRejectionCode[T any](code string, policy func(ctx context.Context, value T) (reject bool, msg string)) func(ctx context.Context, value T) (reject bool, msg string) {
+	return func(ctx context.Context, value T) (reject bool, msg string) {
+		reject, msg = policy(ctx, value)
+		if reject && RejectionCode(msg) == "" {
+			msg = code + ": " + msg
+		}
+		return reject, msg
+	}
+}
+
+func RecordRejection(pubkey string, reason string, db Database) {
+	_, err := db.DB.Exec(
+		`INSERT INTO event_rejection (pubkey, day, reason, count) VALUES (?, ?, ?, 1)
+		 ON CONFLICT(pubkey, day, reason) DO UPDATE SET count = event_rejection.count + 1`,
+		pubkey, Now().UTC().Format("2006-01-02"), reason,
+	)
+	if err != nil {
+		ReportError(err, "rejections", map[string]string{"pubkey": pubkey, "reason": reason})
+	}
+}
+
+func GetRecentRejectionsCount(pubkey string, days int, db Database) int64 {
+	since := Now().UTC().AddDate(0, 0, -days+1).Format("2006-01-02")
+
+	var count int64
+	err := db.DB.QueryRow(`SELECT COALESCE(SUM(count), 0) FROM event_rejection WHERE pubkey = ? AND day >= ?`, pubkey, since).Scan(&count)
+	if err != nil {
+		ReportError(err, "rejections", map[string]string{"pubkey": pubkey})
+	}
+	return count
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var replicationSchema = Schema{
+	Tables: []string{"replication_log"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS replication_log (
+       seq bigint NOT NULL PRIMARY KEY,
+       change text NOT NULL,
+       event text NOT NULL,
+       created_at bigint NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS replicationlogcreatedatidx ON replication_log (created_at);`,
+	},
+}
+
+const (
+	// replicationBatch is how many changes a follower is sent at a time.
+	replicationBatch = 500
+	// replicationWait is how long a follower's request for changes waits for
+	// one when there are none, under httpClient's timeout.
+	replicationWait = 10 * time.Second
+	// replicationPoll is how often a follower's waiting request looks for
+	// changes logged by the database's triggers, which don't wake it.
+	replicationPoll = time.Second
+)
+
+// replicatedTables are the tables a follower mirrors row by row: the ledger
+// and everything users have paid for. Triggers log every insert, update and
+// delete on them as a "row" change, so erasures and spent allowances reach
+// followers like credits do. read_usage is left out: it's counted on every
+// instance and billed as debits, which are replicated.
+var replicatedTables = []string{
+	"zap_credit", "zap_revocation", "bonus_credit", "trial_credit", "debit", "debit_author", "erased_zap",
+	"package_credit", "nip05_name", "pin", "backfill_permit", "allowance", "team_member", "spend_limit",
+}
+
+type ReplicationChange struct {
+	Seq    int64        `json:"seq"`
+	Change string       `json:"change"`
+	Event  *nostr.Event `json:"event,omitempty"`
+	Row    *RowChange   `json:"row,omitempty"`
+}
+
+// RowChange is a row of a replicated table upserted or deleted, with its
+// columns by name.
+type RowChange struct {
+	Table string         `json:"table"`
+	Op    string         `json:"op"`
+	Row   map[string]any `json:"row"`
+}
+
+// logged is the change as it's kept in the log's event column.
+func (c ReplicationChange) logged() string {
+	if c.Row != nil {
+		data, _ := json.Marshal(c.Row)
+		return string(data)
+	}
+	return c.Event.String()
+}
+
+var (
+	replicationEnabled bool
+	replicationMu      sync.Mutex
+	replicationLogged  = make(chan struct{})
+
+	replicationApplied  = NewCounterVec("ppe_replication_applied_total", "Changes a follower applied from its primary's log, by change.", "change")
+	replicationPosition = NewGaugeVec("ppe_replication_position", "The newest replication log entry a follower has, and its primary's.", "log")
+)
+
+// ConfigureReplication has ReplicateSaves and ReplicateDeletes log the
+// events stored and deleted for followers when REPLICATION_TOKEN is set,
+// along with the changes to replicatedTables, and serves the log to
+// followers sending it as a bearer token.
+//
+// With REPLICATE_FROM set too the relay is a standby following the primary
+// there: it refuses events, which only the primary takes, and main runs the
+// followers instead of the background jobs. A standby is set up by restoring
+// a backup of the primary, which it follows on from, and promoted by
+// unsetting REPLICATE_FROM and restarting it. It mirrors the primary's log,
+// so the standbys of a failed primary can follow the promoted one.
+func ConfigureReplication(db Database) error {
+	token := GetEnvDefault("REPLICATION_TOKEN", "")
+	if token == "" {
+		if isStandby() {
+			return errors.New("REPLICATE_FROM needs REPLICATION_TOKEN, the primary's")
+		}
+		return nil
+	}
+	replicationEnabled = true
+	relay.Router().HandleFunc("/replication/log", AdminOnly(token, func(w http.ResponseWriter, r *http.Request) {
+		HandleReplicationLog(w, r, db)
+	}))
+
+	if isStandby() {
+		relay.RejectEvent = append([]func(ctx context.Context, event *nostr.Event) (bool, string){RejectOnStandby}, relay.RejectEvent...)
+		// a standby's rows are its primary's, logged as they're applied;
+		// the triggers of the backup it was restored from would log them twice
+		return DropReplicationTriggers(db)
+	}
+	return CreateReplicationTriggers(db)
+}
+
+// CreateReplicationTriggers (re)creates the triggers logging the changes to
+// replicatedTables, for the columns they have now. They number changes like
+// AppendReplicationLog; on postgres one that loses a race for a number tries
+// again rather than failing the write it logs.
+func CreateReplicationTriggers(db Database) error {
+	if err := DropReplicationTriggers(db); err != nil {
+		return err
+	}
+	if db.DB.DriverName() != "sqlite3" {
+		if _, err := db.DB.Exec(`CREATE OR REPLACE FUNCTION replicate_row() RETURNS trigger AS $$
+			DECLARE
+				change json;
+			BEGIN
+				IF TG_OP = 'DELETE' THEN
+					change := json_build_object('table', TG_TABLE_NAME, 'op', 'delete', 'row', row_to_json(OLD));
+				ELSE
+					change := json_build_object('table', TG_TABLE_NAME, 'op', 'upsert', 'row', row_to_json(NEW));
+				END IF;
+				LOOP
+					BEGIN
+						INSERT INTO replication_log (seq, change, event, created_at)
+							SELECT COALESCE(MAX(seq), 0) + 1, 'row', change::text, extract(epoch from now())::bigint FROM replication_log;
+						RETURN NULL;
+					EXCEPTION WHEN unique_violation THEN
+					END;
+				END LOOP;
+			END
+			$$ LANGUAGE plpgsql`); err != nil {
+			return err
+		}
+		for _, table := range replicatedTables {
+			if _, err := db.DB.Exec(fmt.Sprintf(`CREATE TRIGGER replicate_row AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE FUNCTION replicate_row()`, table)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, table := range replicatedTables {
+		var columns []string
+		if err := db.DB.Select(&columns, `SELECT name FROM pragma_table_info(?) ORDER BY cid`, table); err != nil {
+			return err
+		}
+		for _, trigger := range []struct{ on, op, row string }{{"INSERT", "upsert", "NEW"}, {"UPDATE", "upsert", "NEW"}, {"DELETE", "delete", "OLD"}} {
+			var fields []string
+			for _, column := range columns {
+				fields = append(fields, fmt.Sprintf(`'%s', %s.%s`, column, trigger.row, column))
+			}
+			if _, err := db.DB.Exec(fmt.Sprintf(
+				`CREATE TRIGGER replicate_%s_%s AFTER %s ON %s BEGIN
+				 INSERT INTO replication_log (seq, change, event, created_at)
+				 SELECT COALESCE(MAX(seq), 0) + 1, 'row', json_object('table', '%s', 'op', '%s', 'row', json_object(%s)), unixepoch() FROM replication_log;
+				 END`,
+				table, strings.ToLower(trigger.on), trigger.on, table, table, trigger.op, strings.Join(fields, ", "),
+			)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func DropReplicationTriggers(db Database) error {
+	for _, table := range replicatedTables {
+		drops := []string{fmt.Sprintf(`DROP TRIGGER IF EXISTS replicate_row ON %s`, table)}
+		if db.DB.DriverName() == "sqlite3" {
+			drops = []string{
+				fmt.Sprintf(`DROP TRIGGER IF EXISTS replicate_%s_insert`, table),
+				fmt.Sprintf(`DROP TRIGGER IF EXISTS replicate_%s_update`, table),
+				fmt.Sprintf(`DROP TRIGGER IF EXISTS replicate_%s_delete`, table),
+			}
+		}
+		for _, drop := range drops {
+			if _, err := db.DB.Exec(drop); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isStandby() bool {
+	return GetEnvDefault("REPLICATE_FROM", "") != ""
+}
+
+// RejectOnStandby refuses every event before any policy charges for it.
+func RejectOnStandby(ctx context.Context, event *nostr.Event) (bool, string) {
+	return true, "restricted: this relay is a standby, publish to its primary"
+}
+
+// ReplicateSaves wraps the database's SaveEvent, logging each event stored,
+// as it's stored, for followers. It leaves save as it is when replication
+// is off.
+func ReplicateSaves(save func(ctx context.Context, event *nostr.Event) error, db Database) func(ctx context.Context, event *nostr.Event) error {
+	if !replicationEnabled {
+		return save
+	}
+	return func(ctx context.Context, event *nostr.Event) error {
+		if err := save(ctx, event); err != nil {
+			return err
+		}
+		if err := AppendReplicationLog("save", event, db); err != nil {
+			ReportError(err, "replication", map[string]string{"event": event.ID})
+		}
+		return nil
+	}
+}
+
+// ReplicateDeletes is a DeleteEvent handler logging deletions, replaced
+// events' included, for followers. Only what identifies the event is
+// logged: khatru passes it along decrypted.
+func ReplicateDeletes(db Database) func(ctx context.Context, event *nostr.Event) error {
+	return func(ctx context.Context, event *nostr.Event) error {
+		deleted := &nostr.Event{ID: event.ID, PubKey: event.PubKey, CreatedAt: event.CreatedAt, Kind: event.Kind, Tags: nostr.Tags{}}
+		if err := AppendReplicationLog("delete", deleted, db); err != nil {
+			ReportError(err, "replication", map[string]string{"event": event.ID})
+		}
+		return nil
+	}
+}
+
+// AppendReplicationLog adds a change to the log, numbered after the last.
+// Instances sharing a postgres database can number two changes the same at
+// once, and the one that loses tries again.
+func AppendReplicationLog(change string, event *nostr.Event, db Database) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		_, err = db.DB.Exec(
+			`INSERT INTO replication_log (seq, change, event, created_at) SELECT COALESCE(MAX(seq), 0) + 1, ?, ?, ? FROM replication_log`,
+			change, event.String(), Now().Unix(),
+		)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	notifyReplicationLogged()
+	return nil
+}
+
+func notifyReplicationLogged() {
+	replicationMu.Lock()
+	close(replicationLogged)
+	replicationLogged = make(chan struct{})
+	replicationMu.Unlock()
+}
+
+// replicationLogHead is the newest change in the log.
+func replicationLogHead(db Database) (int64, error) {
+	var head int64
+	err := db.DB.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM replication_log`).Scan(&head)
+	return head, err
+}
+
+// GetReplicationLog returns the changes logged after seq, oldest first, and
+// the last one logged.
+func GetReplicationLog(after int64, db Database) ([]ReplicationChange, int64, error) {
+	head, err := replicationLogHead(db)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.DB.Query(`SELECT seq, change, event FROM replication_log WHERE seq > ? ORDER BY seq LIMIT ?`, after, replicationBatch)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	changes := []ReplicationChange{}
+	for rows.Next() {
+		var change ReplicationChange
+		var logged string
+		if err := rows.Scan(&change.Seq, &change.Change, &logged); err != nil {
+			return nil, 0, err
+		}
+		if change.Change == "row" {
+			change.Row = &RowChange{}
+			decoder := json.NewDecoder(strings.NewReader(logged))
+			decoder.UseNumber()
+			err = decoder.Decode(change.Row)
+		} else {
+			change.Event = &nostr.Event{}
+			err = change.Event.UnmarshalJSON([]byte(logged))
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, head, rows.Err()
+}
+
+// PruneReplicationLog drops changes older than retention. A follower that
+// was away longer has to be restored from a backup before it follows again.
+func PruneReplicationLog(retention time.Duration, db Database) error {
+	// the newest stays, for the next one to be numbered after
+	_, err := db.DB.Exec(
+		`DELETE FROM replication_log WHERE created_at < ? AND seq < (SELECT MAX(seq) FROM replication_log)`,
+		Now().Add(-retention).Unix(),
+	)
+	return err
+}
+
+func RunReplicationLogPruner(db Database) {
+	retention := GetEnvDuration("REPLICATION_LOG_RETENTION", 7*24*time.Hour)
+	for {
+		if err := PruneReplicationLog(retention, db); err != nil {
+			ReportError(err, "replication", nil)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// HandleReplicationLog answers ?after=<seq> with the changes logged since,
+// waiting a little for one when there are none yet.
+func HandleReplicationLog(w http.ResponseWriter, r *http.Request, db Database) {
+	after, err := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "after must be a log position")
+		return
+	}
+	var oldest int64
+	if err := db.DB.QueryRow(`SELECT COALESCE(MIN(seq), 0) FROM replication_log`).Scan(&oldest); err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if oldest > after+1 {
+		WriteJSONError(w, http.StatusGone, fmt.Sprintf("changes before %d were pruned, restore from a backup", oldest))
+		return
+	}
+
+	timeout := time.NewTimer(replicationWait)
+	defer timeout.Stop()
+	poll := time.NewTicker(replicationPoll)
+	defer poll.Stop()
+	for {
+		replicationMu.Lock()
+		logged := replicationLogged
+		replicationMu.Unlock()
+
+		changes, head, err := GetReplicationLog(after, db)
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(changes) > 0 {
+			WriteJSON(w, http.StatusOK, map[string]any{"changes": changes, "head": head})
+			return
+		}
+		select {
+		case <-logged:
+		case <-poll.C:
+		case <-timeout.C:
+			// another instance sharing the database may have logged one
+			changes, head, err = GetReplicationLog(after, db)
+			if err != nil {
+				WriteJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			WriteJSON(w, http.StatusOK, map[string]any{"changes": changes, "head": head})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// RunReplicationFollower applies the primary's replication log as it grows.
+func RunReplicationFollower(db Database) {
+	primary := strings.TrimSuffix(GetEnv("REPLICATE_FROM"), "/")
+	token := GetEnv("REPLICATION_TOKEN")
+	save := TrackStorageSaves(db.SaveEvent, db)
+	del := TrackStorageDeletes(coldStorage.WrapDelete(db.DeleteEvent), db)
+
+	for {
+		applied, err := FollowReplicationLog(primary, token, save, del, db)
+		if err != nil {
+			ReportError(err, "replication", map[string]string{"primary": primary})
+		}
+		if err != nil || applied == 0 {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// FollowReplicationLog fetches and applies the primary's changes after the
+// newest the follower has, returning how many it applied. Each is added to
+// the follower's log after it's applied, so one a crash interrupts is
+// applied again, which stores and deletes nothing twice.
+func FollowReplicationLog(primary string, token string, save func(ctx context.Context, event *nostr.Event) error, del func(ctx context.Context, event *nostr.Event) error, db Database) (int, error) {
+	position, err := replicationLogHead(db)
+	if err != nil {
+		return 0, err
+	}
+	var response struct {
+		Changes []ReplicationChange `json:"changes"`
+		Head    int64               `json:"head"`
+	}
+	if err := getFromPrimary(primary+"/replication/log?after="+strconv.FormatInt(position, 10), token, &response); err != nil {
+		return 0, err
+	}
+	replicationPosition.Set("primary", response.Head)
+
+	ctx := context.Background()
+	for i, change := range response.Changes {
+		var err error
+		switch change.Change {
+		case "save":
+			// events are logged as stored, encrypted ones encrypted
+			if err = save(ctx, change.Event); errors.Is(err, eventstore.ErrDupEvent) {
+				err = nil
+			}
+		case "delete":
+			err = del(ctx, change.Event)
+		case "row":
+			err = ApplyRowChange(change.Row, db)
+		}
+		if err != nil {
+			return i, fmt.Errorf("applying change %d: %w", change.Seq, err)
+		}
+		if _, err := db.DB.Exec(
+			`INSERT INTO replication_log (seq, change, event, created_at) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+			change.Seq, change.Change, change.logged(), Now().Unix(),
+		); err != nil {
+			return i, err
+		}
+		replicationApplied.Inc(change.Change)
+		replicationPosition.Set("follower", change.Seq)
+	}
+	if len(response.Changes) > 0 {
+		notifyReplicationLogged()
+	}
+	return len(response.Changes), nil
+}
+
+// ApplyRowChange upserts or deletes a row of one of replicatedTables by its
+// primary key, so applying a change twice leaves the row as once.
+func ApplyRowChange(change *RowChange, db Database) error {
+	if change == nil || !slices.Contains(replicatedTables, change.Table) {
+		return errors.New("row change to a table that isn't replicated")
+	}
+	key, err := primaryKey(db.DB, change.Table)
+	if err != nil {
+		return err
+	}
+	columns := slices.Sorted(maps.Keys(change.Row))
+	values := make([]any, len(columns))
+	for i, column := range columns {
+		values[i] = change.Row[column]
+		// numbers arrive as json.Number, and the tables' are integers
+		if number, ok := values[i].(json.Number); ok {
+			if values[i], err = number.Int64(); err != nil {
+				values[i], _ = number.Float64()
+			}
+		}
+	}
+
+	if change.Op == "delete" {
+		var conditions []string
+		var keyValues []any
+		for _, column := range key {
+			i := slices.Index(columns, column)
+			if i < 0 {
+				return fmt.Errorf("%s row deleted without its %s", change.Table, column)
+			}
+			conditions = append(conditions, column+" = ?")
+			keyValues = append(keyValues, values[i])
+		}
+		_, err := db.DB.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s`, change.Table, strings.Join(conditions, " AND ")), keyValues...)
+		return err
+	}
+
+	var updates []string
+	for _, column := range columns {
+		if !slices.Contains(key, column) {
+			updates = append(updates, column+" = excluded."+column)
+		}
+	}
+	conflict := "DO NOTHING"
+	if len(updates) > 0 {
+		conflict = "DO UPDATE SET " + strings.Join(updates, ", ")
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	_, err = db.DB.Exec(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) %s`,
+		change.Table, strings.Join(columns, ", "), placeholders, strings.Join(key, ", "), conflict), values...)
+	return err
+}
+
+func getFromPrimary(url string, token string, value any) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(response.Body).Decode(&body)
+		return fmt.Errorf("primary answered %s: %s", response.Status, body.Error)
+	}
+	decoder := json.NewDecoder(response.Body)
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplicationMirrorsLedgerChanges(t *testing.T) {
+	t.Setenv("REPLICATION_TOKEN", "secret")
+	t.Cleanup(func() { replicationEnabled = false })
+	h := NewHarness(t)
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	if err := h.TopUp(pubkey, 100); err != nil {
+		t.Fatalf("topping up: %v", err)
+	}
+	if err := h.Publish(sk, "hello"); err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+	backfillPermitPrice, backfillPermitDuration = 10, time.Hour
+	t.Cleanup(func() { backfillPermitPrice, backfillPermitDuration = 0, 0 })
+	if _, err := BuyBackfillPermit(pubkey, h.DB); err != nil {
+		t.Fatalf("buying a permit: %v", err)
+	}
+	// updates and deletes, as an erasure makes them
+	for _, statement := range []string{
+		`UPDATE backfill_permit SET expires_at = 1`,
+		`INSERT INTO trial_credit (pubkey, method, domain, amount_msat, granted_at) VALUES ('` + pubkey + `', 'pow', '', 5000, 1)`,
+		`UPDATE trial_credit SET amount_msat = 0`,
+		`DELETE FROM debit WHERE reason = 'backfill permit'`,
+	} {
+		if _, err := h.DB.DB.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+
+	follower, err := OpenDatabase(filepath.Join(h.Dir, "follower"), 500)
+	if err != nil {
+		t.Fatalf("opening the follower: %v", err)
+	}
+	defer follower.Close()
+	if err := CreateTables(follower.DB); err != nil {
+		t.Fatalf("creating tables: %v", err)
+	}
+	primaryHead, _ := replicationLogHead(h.DB)
+	for {
+		position, _ := replicationLogHead(follower)
+		if position >= primaryHead {
+			break
+		}
+		if _, err := FollowReplicationLog(h.Relay.URL, "secret", follower.SaveEvent, follower.DeleteEvent, follower); err != nil {
+			t.Fatalf("following: %v", err)
+		}
+	}
+
+	var expiresAt, trialMsat int64
+	follower.DB.QueryRow(`SELECT expires_at FROM backfill_permit WHERE pubkey = ?`, pubkey).Scan(&expiresAt)
+	follower.DB.QueryRow(`SELECT amount_msat FROM trial_credit WHERE pubkey = ?`, pubkey).Scan(&trialMsat)
+	if expiresAt != 1 || trialMsat != 0 {
+		t.Fatalf("follower's permit expires at %d and trial is %d msat, expected the primary's updates", expiresAt, trialMsat)
+	}
+
+	for _, table := range append([]string{"event"}, replicatedTables...) {
+		query := `SELECT * FROM ` + table
+		if table == "event" {
+			query = `SELECT id FROM event`
+		}
+		primaryRows, primarySum, err := checksumRows(h.DB.DB, query)
+		if err != nil {
+			t.Fatalf("reading the primary's %s: %v", table, err)
+		}
+		followerRows, followerSum, err := checksumRows(follower.DB, query)
+		if err != nil {
+			t.Fatalf("reading the follower's %s: %v", table, err)
+		}
+		if primaryRows != followerRows || primarySum != followerSum {
+			t.Errorf("%s: primary has %d rows, follower %d, or they differ", table, primaryRows, followerRows)
+		}
+	}
+}
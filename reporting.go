@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	// errorReportQueueSize is how many reports HTTPErrorReporter holds while
+	// the collector is slow or down; more are dropped.
+	errorReportQueueSize    = 100
+	errorReportFlushTimeout = 2 * time.Second
+)
+
+// ErrorReporter ships unexpected errors somewhere an operator will see them.
+type ErrorReporter interface {
+	Report(err error, component string, details map[string]string, stack []byte)
+	Flush()
+}
+
+type SentryReporter struct{}
+
+// HTTPErrorReporter POSTs each error as JSON to a generic collector, one at
+// a time from a bounded queue, so an error storm against a dead collector
+// costs at most errorReportQueueSize reports rather than a goroutine each.
+type HTTPErrorReporter struct {
+	URL   string
+	queue chan errorReport
+}
+
+// errorReport is a report to deliver or, with flushed set, a marker closed
+// once everything queued before it has been delivered.
+type errorReport struct {
+	body    []byte
+	flushed chan struct{}
+}
+
+var (
+	errorReporters []ErrorReporter
+
+	errorsReported      = NewCounter("ppe_errors_reported_total", "Unexpected errors and panics captured by the error reporter.")
+	errorReportsDropped = NewCounter("ppe_error_reports_dropped_total", "Error reports dropped because the HTTP reporter's queue was full.")
+)
+
+// ConfigureErrorReporting enables the reporters for whichever of SENTRY_DSN
+// and ERROR_REPORT_URL are set.
+func ConfigureErrorReporting() {
+	if dsn := GetEnvDefault("SENTRY_DSN", ""); dsn != "" {
+		if err := sentry.Init(sentry.ClientOptions{Dsn: dsn, Release: relay.Info.Version}); err != nil {
+			fmt.Printf("Error initializing sentry: %v\n", err)
+		} else {
+			errorReporters = append(errorReporters, SentryReporter{})
+		}
+	}
+	if url := GetEnvDefault("ERROR_REPORT_URL", ""); url != "" {
+		errorReporters = append(errorReporters, NewHTTPErrorReporter(url))
+	}
+}
+
+// ReportError logs an unexpected error and forwards it to the configured
+// reporters, tagged with the component it came from.
+func ReportError(err error, component string, details map[string]string) {
+	fmt.Printf("Error in %s: %v\n", component, err)
+	errorsReported.Inc()
+
+	for _, reporter := range errorReporters {
+		reporter.Report(err, component, details, nil)
+	}
+}
+
+func ReportPanic(recovered any, component string, details map[string]string) {
+	stack := debug.Stack()
+	fmt.Printf("Panic in %s: %v\n%s", component, recovered, stack)
+	errorsReported.Inc()
+
+	err := fmt.Errorf("panic: %v", recovered)
+	for _, reporter := range errorReporters {
+		reporter.Report(err, component, details, stack)
+	}
+}
+
+// FlushErrorReports gives reporters a chance to deliver before the process
+// exits.
+func FlushErrorReports() {
+	for _, reporter := range errorReporters {
+		reporter.Flush()
+	}
+}
+
+// RecoverHTTP reports panics from HTTP handlers instead of letting net/http
+// swallow them into its log.
+func RecoverHTTP(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				ReportPanic(recovered, "http", map[string]string{"method": r.Method, "path": r.URL.Path})
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (SentryReporter) Report(err error, component string, details map[string]string, stack []byte) {
+	sentry.WithScope(func(scope *sentry.Scope) {
+		scope.SetTag("component", component)
+		for key, value := range details {
+			scope.SetExtra(key, value)
+		}
+		if stack != nil {
+			scope.SetExtra("stack", string(stack))
+		}
+		sentry.CaptureException(err)
+	})
+}
+
+func (SentryReporter) Flush() {
+	sentry.Flush(2 * time.Second)
+}
+
+// NewHTTPErrorReporter starts the worker delivering reports to url.
+func NewHTTPErrorReporter(url string) *HTTPErrorReporter {
+	r := &HTTPErrorReporter{URL: url, queue: make(chan errorReport, errorReportQueueSize)}
+	go r.run()
+	return r
+}
+
+func (r *HTTPErrorReporter) Report(err error, component string, details map[string]string, stack []byte) {
+	body, _ := json.Marshal(map[string]any{
+		"message":   err.Error(),
+		"component": component,
+		"details":   details,
+		"stack":     string(stack),
+		"time":      time.Now().Unix(),
+	})
+
+	select {
+	case r.queue <- errorReport{body: body}:
+	default:
+		errorReportsDropped.Inc()
+	}
+}
+
+// Flush waits up to errorReportFlushTimeout for the reports queued so far to
+// be delivered.
+func (r *HTTPErrorReporter) Flush() {
+	timeout := time.After(errorReportFlushTimeout)
+	flushed := make(chan struct{})
+	select {
+	case r.queue <- errorReport{flushed: flushed}:
+	case <-timeout:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-timeout:
+	}
+}
+
+func (r *HTTPErrorReporter) run() {
+	for report := range r.queue {
+		if report.flushed != nil {
+			close(report.flushed)
+			continue
+		}
+		response, err := httpClient.Post(r.URL, "application/json", bytes.NewReader(report.body))
+		if err != nil {
+			fmt.Printf("Error delivering error report: %v\n", err)
+			continue
+		}
+		response.Body.Close()
+	}
+}
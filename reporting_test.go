@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPErrorReporterFlush(t *testing.T) {
+	var received atomic.Int64
+	release := make(chan struct{})
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		received.Add(1)
+	}))
+	defer collector.Close()
+
+	reporter := NewHTTPErrorReporter(collector.URL)
+	for range errorReportQueueSize + 10 {
+		reporter.Report(errors.New("boom"), "test", nil, nil)
+	}
+	close(release)
+	reporter.Flush()
+
+	// the worker holds one report while the queue fills behind it
+	if got := received.Load(); got < errorReportQueueSize || got > errorReportQueueSize+1 {
+		t.Fatalf("collector received %d reports, expected the %d queued", got, errorReportQueueSize)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Reputation struct {
+	PubKey     string  `json:"pubkey"`
+	Score      float64 `json:"score"`
+	PaidSats   int64   `json:"paid_sats"`
+	AgeDays    int64   `json:"age_days"`
+	Reporters  int     `json:"reporters"`
+	Rejections int64   `json:"rejections"`
+	ComputedAt int64   `json:"computed_at"`
+}
+
+var (
+	reputations      = make(map[string]Reputation)
+	reputationsMutex sync.Mutex
+	reputationsPrune time.Time
+	reputationTTL    = time.Hour
+
+	// reputationCacheSize caps how many scores are cached, as anyone can
+	// publish under a new pubkey; expired ones go first.
+	reputationCacheSize = 100000
+
+	// reportersLookups are the pubkeys whose reporters are being looked up
+	// upstream, at most maxReportersLookups at a time.
+	reportersLookups    = make(map[string]bool)
+	maxReportersLookups = 8
+)
+
+// credibleReporterScore is the reputation a reporter who hasn't paid
+// needs for their reports to count.
+const credibleReporterScore = 70
+
+// GetReputation scores a pubkey between 0 and 100, starting from a neutral
+// 50: sats paid and account age raise it, credible upstream reporters
+// (kind 1984) and recent rejections lower it. Scores are cached for an hour.
+// Reporters are looked up upstream in the background, so a score starts out
+// with those last known, none the first time, and is revised once they're
+// in.
+func GetReputation(pubkey string, db Database) Reputation {
+	reputationsMutex.Lock()
+	cached, ok := reputations[pubkey]
+	reputationsMutex.Unlock()
+	if ok && time.Since(time.Unix(cached.ComputedAt, 0)) < reputationTTL {
+		return cached
+	}
+
+	reputation := Reputation{
+		PubKey:     pubkey,
+		PaidSats:   GetCreditedTotalFromUser(pubkey, db),
+		AgeDays:    GetAccountAgeDays(pubkey, db),
+		Reporters:  cached.Reporters,
+		Rejections: GetRecentRejectionsCount(pubkey, 30, db),
+		ComputedAt: time.Now().Unix(),
+	}
+	reputation.score()
+	cacheReputation(reputation)
+	go lookUpReporters(pubkey, db)
+
+	return reputation
+}
+
+func (r *Reputation) score() {
+	score := 50.0
+	score += math.Min(25, math.Log2(1+float64(r.PaidSats))*2.5)
+	score += math.Min(15, float64(r.AgeDays)/4)
+	score -= math.Min(40, float64(r.Reporters)*5)
+	score -= math.Min(20, float64(r.Rejections)/10)
+	r.Score = math.Round(math.Max(0, math.Min(100, score)))
+}
+
+func cacheReputation(reputation Reputation) {
+	now := time.Now()
+	reputationsMutex.Lock()
+	defer reputationsMutex.Unlock()
+	if now.Sub(reputationsPrune) > reputationTTL || len(reputations) >= reputationCacheSize {
+		for pubkey, cached := range reputations {
+			if now.Sub(time.Unix(cached.ComputedAt, 0)) >= reputationTTL {
+				delete(reputations, pubkey)
+			}
+		}
+		reputationsPrune = now
+	}
+	for pubkey := range reputations {
+		if len(reputations) < reputationCacheSize {
+			break
+		}
+		delete(reputations, pubkey)
+	}
+	reputations[reputation.PubKey] = reputation
+}
+
+// lookUpReporters counts pubkey's reporters upstream and rescores it,
+// unless they're already being looked up or too many lookups are running,
+// in which case it's left for the next event.
+func lookUpReporters(pubkey string, db Database) {
+	reputationsMutex.Lock()
+	if reportersLookups[pubkey] || len(reportersLookups) >= maxReportersLookups {
+		reputationsMutex.Unlock()
+		return
+	}
+	reportersLookups[pubkey] = true
+	reputationsMutex.Unlock()
+
+	reporters := GetReportersCount(pubkey, db)
+
+	reputationsMutex.Lock()
+	defer reputationsMutex.Unlock()
+	delete(reportersLookups, pubkey)
+	if reputation, ok := reputations[pubkey]; ok {
+		reputation.Reporters = reporters
+		reputation.score()
+		reputations[pubkey] = reputation
+	}
+}
+
+// GetAccountAgeDays counts days since the pubkey's first credited zap.
+func GetAccountAgeDays(pubkey string, db Database) int64 {
+	var firstSeen int64
+	err := db.DB.QueryRow(`SELECT COALESCE(MIN(credited_at), 0) FROM zap_credit WHERE pubkey = ?`, pubkey).Scan(&firstSeen)
+	if err != nil || firstSeen == 0 {
+		return 0
+	}
+	return int64(Now().Sub(time.Unix(firstSeen, 0)).Hours() / 24)
+}
+
+// GetReportersCount counts the credible pubkeys reporting pubkey upstream,
+// see isCredibleReporter, so throwaway keys can't report a paying user
+// into a shadow ban.
+func GetReportersCount(pubkey string, db Database) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tags := make(nostr.TagMap)
+	tags["p"] = []string{pubkey}
+	filter := nostr.Filter{
+		Kinds: []int{1984},
+		Tags:  tags,
+		Limit: 500,
+	}
+
+	reporters := make(map[string]bool)
+	for event := range pool.SubManyEose(ctx, relays, []nostr.Filter{filter}) {
+		if event.PubKey != pubkey && !reporters[event.PubKey] && isCredibleReporter(event.PubKey, db) {
+			reporters[event.PubKey] = true
+		}
+	}
+	return len(reporters)
+}
+
+// isCredibleReporter reports whether pubkey has paid this relay, or has a
+// cached reputation of at least credibleReporterScore. Reporters' own
+// reputations aren't computed, which would mean looking up their reporters
+// too.
+func isCredibleReporter(pubkey string, db Database) bool {
+	if GetCreditedTotalFromUser(pubkey, db) > 0 {
+		return true
+	}
+	reputationsMutex.Lock()
+	defer reputationsMutex.Unlock()
+	cached, ok := reputations[pubkey]
+	return ok && cached.Score >= credibleReporterScore
+}
+
+// ReputationRateLimiter is a per-pubkey token bucket whose size scales with
+// reputation: pubkeys scoring below 30 get half the burst, above 70 double.
+// With Redis the buckets are shared by all instances. Backfill imports are
+// rate limited on their own. Buckets that have filled up again are dropped
+// every interval.
+func ReputationRateLimiter(tokensPerInterval int, interval time.Duration, maxTokens int, db Database) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	type bucket struct {
+		tokens   float64
+		capacity float64
+		last     time.Time
+	}
+	buckets := make(map[string]*bucket)
+	var mutex sync.Mutex
+
+	go func() {
+		for range time.Tick(interval) {
+			mutex.Lock()
+			now := time.Now()
+			for pubkey, b := range buckets {
+				if b.tokens+now.Sub(b.last).Seconds()/interval.Seconds()*float64(tokensPerInterval) >= b.capacity {
+					delete(buckets, pubkey)
+				}
+			}
+			mutex.Unlock()
+		}
+	}()
+
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if BackfillImportID(ctx) != "" {
+			return false, ""
+		}
+		capacity := float64(maxTokens)
+		if score := GetReputation(event.PubKey, db).Score; score < 30 {
+			capacity /= 2
+		} else if score > 70 {
+			capacity *= 2
+		}
+		if limited, ok := SharedRateLimited("reputation:"+event.PubKey, capacity, float64(tokensPerInterval)/interval.Seconds()); ok {
+			if limited {
+				return true, "rate-limited: slow down, please"
+			}
+			return false, ""
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		now := time.Now()
+		b, ok := buckets[event.PubKey]
+		if !ok {
+			b = &bucket{tokens: capacity, last: now}
+			buckets[event.PubKey] = b
+		}
+		b.capacity = capacity
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()/interval.Seconds()*float64(tokensPerInterval))
+		b.last = now
+
+		if b.tokens < 1 {
+			return true, "rate-limited: slow down, please"
+		}
+		b.tokens--
+		return false, ""
+	}
+}
+
+// ShadowBanLowReputation shadow-bans pubkeys whose score drops below the
+// threshold. Their event still goes through; it just stops being served.
+func ShadowBanLowReputation(threshold float64, db Database) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if IsShadowBanned(event.PubKey) {
+			return false, ""
+		}
+		if reputation := GetReputation(event.PubKey, db); reputation.Score < threshold {
+			ShadowBanPubKey(event.PubKey, fmt.Sprintf("reputation score %v below %v", reputation.Score, threshold), db)
+		}
+		return false, ""
+	}
+}
+
+func HandleAdminReputation(w http.ResponseWriter, r *http.Request, db Database) {
+	pubkey, err := ParsePubKey(r.URL.Query().Get("pubkey"))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "pubkey must be an npub or hex public key")
+		return
+	}
+	WriteJSON(w, http.StatusOK, GetReputation(pubkey, db))
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// RestoreReport is what RestoreSnapshot put back.
+type RestoreReport struct {
+	Snapshot     string
+	SafetyBackup string
+	Events       int64
+	Credits      int64
+	CreditedMsat int64
+	Debits       int64
+	DebitedMsat  int64
+	Accounts     int64
+	Delivered    int64
+	Queued       int64
+	Erasures     int64
+}
+
+// ValidateSnapshot checks the backup at path can be restored into db: it's
+// the same kind of database, matches the path.sha256 written with it when
+// there is one, and passes the integrity check backups are verified with.
+func ValidateSnapshot(path string, db Database) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 16)
+	_, err = file.Read(header)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't read it: %w", err)
+	}
+	sqlite := bytes.HasPrefix(header, []byte("SQLite format 3\x00"))
+	switch {
+	case sqlite && db.DB.DriverName() != "sqlite3":
+		return errors.New("it's a sqlite database and DATABASE_URL is postgres")
+	case !sqlite && !bytes.HasPrefix(header, []byte("PGDMP")):
+		return errors.New("it's neither a sqlite database nor a pg_dump archive")
+	case !sqlite && db.DB.DriverName() == "sqlite3":
+		return errors.New("it's a postgres dump and DATABASE_URL is sqlite")
+	}
+
+	if expected, err := os.ReadFile(path + ".sha256"); err == nil {
+		sum, _, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		if fields := strings.Fields(string(expected)); len(fields) == 0 || fields[0] != sum {
+			return fmt.Errorf("its sha256 is %s, not the one in %s.sha256", sum, path)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if sqlite {
+		_, err = verifySQLiteSnapshot(path)
+		return err
+	}
+	return verifyPostgresDump(path)
+}
+
+// RestoreSnapshot replaces db's contents, events and ledger alike, with the
+// backup at path, then brings the schema up to date and retries the queued
+// outbound publishes straight away, since the ones queued when the snapshot
+// was taken may never have gone out. Unless safetyBackup is empty, what db
+// held is backed up there first.
+//
+// Everything written after the snapshot was taken is lost, except the
+// events the journal still has pending, which are stored again when the
+// relay starts, and erasures: accounts erased since are erased again. Cold
+// storage isn't part of the snapshot and is left as it is.
+func RestoreSnapshot(path string, safetyBackup string, db Database) (RestoreReport, error) {
+	report := RestoreReport{Snapshot: path, SafetyBackup: safetyBackup}
+	if err := ValidateSnapshot(path, db); err != nil {
+		return report, fmt.Errorf("%s can't be restored: %w", path, err)
+	}
+
+	if safetyBackup != "" {
+		if _, err := StartBackup(safetyBackup, db); err != nil {
+			return report, err
+		}
+		for {
+			time.Sleep(100 * time.Millisecond)
+			if backup, _ := GetLastBackup(); backup.Status == "failed" {
+				return report, fmt.Errorf("couldn't back the database up first: %s", backup.Error)
+			} else if backup.Status == "done" {
+				break
+			}
+		}
+	}
+
+	erasures, err := GetErasures(db)
+	if err != nil {
+		return report, fmt.Errorf("couldn't read the erasures to apply again: %w", err)
+	}
+
+	if db.DB.DriverName() == "sqlite3" {
+		err = restoreSQLite(path, db)
+	} else {
+		err = restorePostgres(path)
+	}
+	if err != nil {
+		return report, err
+	}
+	if err := CreateTables(db.DB); err != nil {
+		return report, err
+	}
+	// nothing's running, whatever held leases when the snapshot was taken
+	if _, err := db.DB.Exec(`DELETE FROM lease`); err != nil {
+		return report, err
+	}
+
+	// the snapshot can predate erasures, and hold what they erased
+	var reapply []Erasure
+	for _, erasure := range erasures {
+		var erasedAt nostr.Timestamp
+		db.DB.QueryRow(`SELECT erased_at FROM erasure WHERE pubkey = ?`, erasure.PubKey).Scan(&erasedAt)
+		if erasedAt < erasure.ErasedAt {
+			reapply = append(reapply, erasure)
+		}
+	}
+	if err := ReapplyErasures(reapply, db); err != nil {
+		return report, err
+	}
+	report.Erasures = int64(len(reapply))
+
+	if report.Delivered, report.Queued, err = replayOutboundQueue(db); err != nil {
+		return report, err
+	}
+
+	err = db.DB.QueryRow(`SELECT COUNT(*) FROM event`).Scan(&report.Events)
+	if err == nil {
+		err = db.DB.QueryRow(`SELECT COUNT(*), COALESCE(SUM(amount_msat), 0) FROM zap_credit`).Scan(&report.Credits, &report.CreditedMsat)
+	}
+	if err == nil {
+		err = db.DB.QueryRow(`SELECT COUNT(*), COALESCE(SUM(amount_msat), 0) FROM debit`).Scan(&report.Debits, &report.DebitedMsat)
+	}
+	if err == nil {
+		err = db.DB.QueryRow(`SELECT COUNT(*) FROM (SELECT pubkey FROM zap_credit UNION SELECT pubkey FROM debit) accounts`).Scan(&report.Accounts)
+	}
+	return report, err
+}
+
+// restoreSQLite copies the snapshot at path over db with sqlite's backup
+// API, which replaces the database under the open connections.
+func restoreSQLite(path string, db Database) error {
+	ctx := context.Background()
+	snapshotDB, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer snapshotDB.Close()
+	src, err := snapshotDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := db.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	return dest.Raw(func(destConn any) error {
+		return src.Raw(func(srcConn any) error {
+			backup, err := destConn.(*sqlite3.SQLiteConn).Backup("main", srcConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			defer backup.Close()
+			for {
+				done, err := backup.Step(-1)
+				if err != nil {
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				// the database is busy
+				time.Sleep(backupStepPause)
+			}
+		})
+	})
+}
+
+// restorePostgres has pg_restore drop and recreate everything the dump has,
+// in one transaction, so a failed restore leaves the database as it was.
+func restorePostgres(path string) error {
+	restore := exec.Command("pg_restore", "--clean", "--if-exists", "--no-owner", "--single-transaction", "--dbname="+GetEnv("DATABASE_URL"), path)
+	if output, err := restore.CombinedOutput(); err != nil {
+		return fmt.Errorf("pg_restore failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// replayOutboundQueue retries every queued outbound publish now, returning
+// how many went through and how many are still queued.
+func replayOutboundQueue(db Database) (delivered int64, queued int64, err error) {
+	var before int64
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM outbound_event`).Scan(&before); err != nil {
+		return 0, 0, err
+	}
+	if _, err := db.DB.Exec(`UPDATE outbound_event SET next_attempt_at = 0`); err != nil {
+		return 0, 0, err
+	}
+	maxAttempts := GetEnvInt("OUTBOUND_MAX_ATTEMPTS", 20)
+	for last := int64(-1); ; {
+		var due int64
+		if err := db.DB.QueryRow(`SELECT COUNT(*) FROM outbound_event WHERE next_attempt_at <= ?`, time.Now().Unix()).Scan(&due); err != nil {
+			return 0, 0, err
+		}
+		// RetryOutboundEvents reports its errors rather than return them
+		if due == 0 || due == last {
+			break
+		}
+		last = due
+		RetryOutboundEvents(maxAttempts, db)
+	}
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM outbound_event`).Scan(&queued); err != nil {
+		return 0, 0, err
+	}
+	// abandoned ones are dropped too, but only after OUTBOUND_MAX_ATTEMPTS
+	return before - queued, queued, nil
+}
+
+// relayRunning reports whether an instance holds a background job lease on
+// db, which it renews while it runs.
+func relayRunning(db Database) (bool, error) {
+	var running bool
+	err := db.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM lease WHERE expires_at > ?)`, time.Now().Unix()).Scan(&running)
+	return running, err
+}
+
+// RunRestore restores a backup taken by the backup command or the admin
+// API. The relay must be stopped first.
+func RunRestore(args []string, db Database) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	skipBackup := flags.Bool("skip-backup", false, "don't back the current database up first, for when it's unreadable")
+	force := flags.Bool("force", false, "restore even though a relay instance seems to be running")
+	check := flags.Bool("check", false, "only validate the snapshot")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: restore [-check] [-skip-backup] [-force] <snapshot>")
+		os.Exit(1)
+	}
+	path := flags.Arg(0)
+
+	if *check {
+		if err := ValidateSnapshot(path, db); err != nil {
+			log.Fatalf("%s can't be restored: %v", path, err)
+		}
+		fmt.Printf("%s can be restored\n", path)
+		return
+	}
+	running, err := relayRunning(db)
+	if err != nil && !*force {
+		log.Fatalf("Failed to check whether the relay is running: %v", err)
+	}
+	if running && !*force {
+		log.Fatalf("A relay instance is running on this database, stop it first")
+	}
+
+	safetyBackup := ""
+	if !*skipBackup {
+		safetyBackup = strings.Replace(DefaultBackupPath(db), "ppe-", "ppe-before-restore-", 1)
+	}
+	report, err := RestoreSnapshot(path, safetyBackup, db)
+	if err != nil {
+		log.Fatalf("Failed to restore: %v", err)
+	}
+
+	fmt.Printf("restored %s\n", report.Snapshot)
+	if report.SafetyBackup != "" {
+		fmt.Printf("the database as it was is backed up to %s\n", report.SafetyBackup)
+	}
+	fmt.Printf("%d events\n", report.Events)
+	fmt.Printf("%d accounts, %d credits for %d sats, %d debits for %d sats\n", report.Accounts, report.Credits, report.CreditedMsat/1000, report.Debits, report.DebitedMsat/1000)
+	fmt.Printf("%d outbound publishes went through, %d still queued\n", report.Delivered, report.Queued)
+	if report.Erasures > 0 {
+		fmt.Printf("%d accounts erased since the snapshot were erased again\n", report.Erasures)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RevenueReport summarizes a calendar month (UTC) of the ledger.
+type RevenueReport struct {
+	Month              string `json:"month"`
+	SatsReceived       int64  `json:"sats_received"`
+	Payments           int64  `json:"payments"`
+	EventsPaid         int64  `json:"events_paid"`
+	EventRevenueSats   int64  `json:"event_revenue_sats"`
+	OtherRevenueSats   int64  `json:"other_revenue_sats"`
+	RefundedSats       int64  `json:"refunded_sats"`
+	EscrowedSats       int64  `json:"escrowed_sats"`
+	BonusSats          int64  `json:"bonus_sats"`
+	OutstandingBalance int64  `json:"outstanding_balance_sats"`
+}
+
+// GetRevenueReport computes the report for the month starting at start.
+// Refunds are zap credits revoked, balances refunded and charges of removed
+// events given back during the month, escrowed is what's still held for
+// disputed events at the end of it, bonus covers trial and bonus credits, and
+// the outstanding balance is what paying users could still spend at the end
+// of it: the relay's liability.
+func GetRevenueReport(start time.Time, db Database) (RevenueReport, error) {
+	start = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	from, until := start.Unix(), start.AddDate(0, 1, 0).Unix()
+	report := RevenueReport{Month: start.Format("2006-01")}
+
+	var received, eventCharges, unpriced, other, refunded, escrowed, bonus, outstanding int64
+	queries := []struct {
+		query string
+		args  []any
+		dest  []any
+	}{
+		{`SELECT COALESCE(SUM(amount_msat), 0), COUNT(*) FROM zap_credit WHERE created_at >= ? AND created_at < ?`,
+			[]any{from, until}, []any{&received, &report.Payments}},
+		{`SELECT COALESCE(SUM(amount_msat), 0), COUNT(*) FROM debit WHERE id LIKE 'event:%' AND created_at >= ? AND created_at < ?`,
+			[]any{from, until}, []any{&eventCharges, &report.EventsPaid}},
+		{`SELECT COUNT(*) FROM event WHERE created_at >= ? AND created_at < ? AND NOT EXISTS (SELECT 1 FROM debit WHERE debit.id = 'event:' || event.id)`,
+			[]any{from, until}, []any{&unpriced}},
+		{`SELECT COALESCE(SUM(amount_msat), 0) FROM debit WHERE id NOT LIKE 'event:%' AND id NOT LIKE 'package:%' AND id NOT LIKE 'refund:%' AND id NOT LIKE 'escrow:%' AND id NOT LIKE 'gift:%' AND created_at >= ? AND created_at < ?`,
+			[]any{from, until}, []any{&other}},
+		{`SELECT
+		    (SELECT COALESCE(SUM(c.amount_msat), 0) FROM zap_revocation r JOIN zap_credit c ON c.id = r.id WHERE r.revoked_at >= ? AND r.revoked_at < ?) +
+		    (SELECT COALESCE(SUM(amount_msat), 0) FROM debit WHERE id LIKE 'refund:%' AND created_at >= ? AND created_at < ?) -
+		    (SELECT COALESCE(SUM(amount_msat), 0) FROM debit WHERE id LIKE 'escrow:%' AND created_at >= ? AND created_at < ?)`,
+			[]any{from, until, from, until, from, until}, []any{&refunded}},
+		{`SELECT COALESCE(SUM(amount_msat), 0) FROM escrow WHERE created_at < ? AND (resolved_at IS NULL OR resolved_at >= ?)`,
+			[]any{until, until}, []any{&escrowed}},
+		{`SELECT
+		    (SELECT COALESCE(SUM(amount_msat), 0) FROM trial_credit WHERE granted_at >= ? AND granted_at < ?) +
+		    (SELECT COALESCE(SUM(amount_msat), 0) FROM bonus_credit WHERE id NOT LIKE 'gift:%' AND created_at >= ? AND created_at < ?)`,
+			[]any{from, until, from, until}, []any{&bonus}},
+		{`SELECT COALESCE(SUM(balance), 0) FROM (
+		    SELECT pubkey, SUM(amount) AS balance FROM (
+		      SELECT pubkey, amount_msat AS amount FROM zap_credit WHERE credited_at < ? AND id NOT IN (SELECT id FROM zap_revocation WHERE revoked_at < ?)
+		      UNION ALL SELECT pubkey, amount_msat FROM trial_credit WHERE granted_at < ?
+		      UNION ALL SELECT pubkey, amount_msat FROM bonus_credit WHERE created_at < ?
+		      UNION ALL SELECT pubkey, -amount_msat FROM debit WHERE created_at < ?
+		      UNION ALL SELECT pubkey, -1000 FROM event WHERE created_at < ? AND NOT EXISTS (SELECT 1 FROM debit WHERE debit.id = 'event:' || event.id)
+		    ) GROUP BY pubkey
+		  ) WHERE balance > 0`,
+			[]any{until, until, until, until, until, until}, []any{&outstanding}},
+	}
+	for _, q := range queries {
+		if err := db.DB.QueryRow(q.query, q.args...).Scan(q.dest...); err != nil {
+			return report, err
+		}
+	}
+
+	report.SatsReceived = received / 1000
+	report.EventsPaid += unpriced
+	report.EventRevenueSats = (eventCharges + unpriced*1000) / 1000
+	report.OtherRevenueSats = other / 1000
+	report.RefundedSats = refunded / 1000
+	report.EscrowedSats = escrowed / 1000
+	report.BonusSats = bonus / 1000
+	report.OutstandingBalance = outstanding / 1000
+	return report, nil
+}
+
+func WriteRevenueReport(w io.Writer, format string, reports []RevenueReport) error {
+	if format == "json" {
+		return json.NewEncoder(w).Encode(reports)
+	}
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"month", "sats_received", "payments", "events_paid", "event_revenue_sats", "other_revenue_sats", "refunded_sats", "escrowed_sats", "bonus_sats", "outstanding_balance_sats"})
+	for _, r := range reports {
+		out.Write([]string{r.Month,
+			strconv.FormatInt(r.SatsReceived, 10), strconv.FormatInt(r.Payments, 10), strconv.FormatInt(r.EventsPaid, 10),
+			strconv.FormatInt(r.EventRevenueSats, 10), strconv.FormatInt(r.OtherRevenueSats, 10), strconv.FormatInt(r.RefundedSats, 10),
+			strconv.FormatInt(r.EscrowedSats, 10), strconv.FormatInt(r.BonusSats, 10), strconv.FormatInt(r.OutstandingBalance, 10),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// GetRevenueReports returns one report per month, oldest first, ending with
+// the month containing until.
+func GetRevenueReports(months int, until time.Time, db Database) ([]RevenueReport, error) {
+	var reports []RevenueReport
+	for i := months - 1; i >= 0; i-- {
+		report, err := GetRevenueReport(until.UTC().AddDate(0, -i, 0), db)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// HandleAdminRevenue serves /admin/revenue?months=N&format=csv|json.
+func HandleAdminRevenue(w http.ResponseWriter, r *http.Request, db Database) {
+	months, err := strconv.Atoi(r.URL.Query().Get("months"))
+	if err != nil || months < 1 {
+		months = 1
+	}
+
+	reports, err := GetRevenueReports(months, Now(), db)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="revenue.csv"`)
+		WriteRevenueReport(w, "csv", reports)
+		return
+	}
+	WriteJSON(w, http.StatusOK, reports)
+}
+
+func FormatRevenueReport(r RevenueReport) string {
+	return fmt.Sprintf("%s revenue report for %s\n\nReceived: %d sats in %d payments\nEvents paid for: %d (%d sats)\nOther charges: %d sats\nRefunded: %d sats\nIn escrow: %d sats\nBonus credits: %d sats\nOutstanding balances: %d sats",
+		relay.Info.Name, r.Month, r.SatsReceived, r.Payments, r.EventsPaid, r.EventRevenueSats, r.OtherRevenueSats, r.RefundedSats, r.EscrowedSats, r.BonusSats, r.OutstandingBalance)
+}
+
+// SendDirectMessage sends a NIP-04 DM from the bot.
+func SendDirectMessage(pubkey string, content string, db Database) error {
+	sharedSecret, err := nip04.ComputeSharedSecret(pubkey, GetEnv("BOT_PRIVATE_KEY"))
+	if err != nil {
+		return err
+	}
+	ciphertext, err := nip04.Encrypt(content, sharedSecret)
+	if err != nil {
+		return err
+	}
+
+	event := nostr.Event{
+		PubKey:    botPubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindEncryptedDirectMessage,
+		Content:   ciphertext,
+		Tags:      nostr.Tags{{"p", pubkey}},
+	}
+	if err := event.Sign(GetEnv("BOT_PRIVATE_KEY")); err != nil {
+		return err
+	}
+	PublishBotEventWithRetry(event, db)
+	return nil
+}
+
+// RunRevenueReporter DMs the previous month's report to the operator shortly
+// after each month ends.
+func RunRevenueReporter(db Database) {
+	for {
+		now := Now().UTC()
+		next := time.Date(now.Year(), now.Month()+1, 1, 0, 5, 0, 0, time.UTC)
+		time.Sleep(next.Sub(Now()))
+
+		report, err := GetRevenueReport(next.AddDate(0, -1, 0), db)
+		if err != nil {
+			ReportError(err, "revenue", nil)
+			continue
+		}
+		if err := SendDirectMessage(relay.Info.PubKey, FormatRevenueReport(report), db); err != nil {
+			ReportError(err, "revenue", nil)
+		}
+	}
+}
+
+func RunRevenue(args []string, db Database) {
+	flags := flag.NewFlagSet("revenue", flag.ExitOnError)
+	months := flags.Int("months", 1, "number of months to report, ending with -month")
+	month := flags.String("month", Now().UTC().Format("2006-01"), "last month to report (YYYY-MM)")
+	format := flags.String("format", "csv", "csv or json")
+	dm := flags.Bool("dm", false, "also DM the last month's report to the operator pubkey")
+	flags.Parse(args)
+
+	until, err := time.Parse("2006-01", *month)
+	if err != nil {
+		log.Fatalf("Invalid month %s", *month)
+	}
+	reports, err := GetRevenueReports(*months, until, db)
+	if err != nil {
+		log.Fatalf("Failed to compute revenue: %v", err)
+	}
+	WriteRevenueReport(os.Stdout, *format, reports)
+
+	if *dm {
+		if err := SendDirectMessage(relay.Info.PubKey, FormatRevenueReport(reports[len(reports)-1]), db); err != nil {
+			log.Fatalf("Failed to send report: %v", err)
+		}
+	}
+}
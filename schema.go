@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// Schema describes the tables a module keeps next to the events. The DDLs are
+// kept portable between sqlite and postgres so migrate-storage can recreate
+// them on either.
+type Schema struct {
+	Tables []string
+	DDLs   []string
+}
+
+var schemas = []Schema{ledgerSchema, moderationSchema, rejectionSchema, nip05Schema, statsSchema, packageSchema, referralSchema, outboundSchema, sessionSchema, notificationSchema, cursorSchema, teamSchema, allowanceSchema, spendLimitSchema, escrowSchema, privateSchema, erasureSchema, leaseSchema, pushSchema, spamSchema, botSchema, storageSchema, pinSchema, replicationSchema, stateRootSchema, poolSchema, clientSchema, exemptionSchema, backfillSchema, backfillImportSchema}
+
+func CreateTables(db *sqlx.DB) error {
+	for _, schema := range schemas {
+		for _, ddl := range schema.DDLs {
+			if _, err := db.Exec(ddl); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SchemaTables lists every table owned by the relay, in the order they should
+// be copied when migrating to another backend.
+func SchemaTables() []string {
+	var tables []string
+	for _, schema := range schemas {
+		tables = append(tables, schema.Tables...)
+	}
+	return tables
+}
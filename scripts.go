@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+	"os"
+	"time"
+)
+
+// PolicyScript is a Starlark script with reject and pricing rules, so
+// operators can change them without waiting for a release. It can define
+//
+//	def reject(event, account):   # a message to reject the event with, or None
+//	def price(event, account, msat):   # what to charge instead of msat
+//
+// event has the fields of a nostr event, tags as lists of strings, and
+// account those of a BillingAccount in snake_case. Scripts can't load
+// modules or reach the filesystem or network, and each call is cut off
+// after Timeout or MaxSteps.
+type PolicyScript struct {
+	Path     string
+	Timeout  time.Duration
+	MaxSteps uint64
+
+	reject starlark.Callable
+	price  starlark.Callable
+}
+
+// ScriptPricer charges what the scripts' price functions make of Inner's
+// price, each getting the one before's. A script that fails leaves the
+// price as it was.
+type ScriptPricer struct {
+	Scripts []*PolicyScript
+	Inner   Pricer
+}
+
+var scriptErrors = NewCounter("ppe_policy_script_errors_total", "Policy script calls that failed or ran out of time or steps.")
+
+// GetPolicyScripts reads POLICY_SCRIPTS, the paths of Starlark scripts,
+// SCRIPT_TIMEOUT and SCRIPT_MAX_STEPS. Scripts that don't compile, or run
+// over the limits when loaded, stop the relay from starting.
+func GetPolicyScripts() []*PolicyScript {
+	timeout := GetEnvDuration("SCRIPT_TIMEOUT", 50*time.Millisecond)
+	maxSteps := uint64(GetEnvInt("SCRIPT_MAX_STEPS", 100000))
+	var scripts []*PolicyScript
+	for _, path := range GetEnvList("POLICY_SCRIPTS", nil) {
+		script := &PolicyScript{Path: path, Timeout: timeout, MaxSteps: maxSteps}
+		if err := script.load(); err != nil {
+			panic(fmt.Errorf("POLICY_SCRIPTS: %s: %w", path, err))
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts
+}
+
+func (s *PolicyScript) load() error {
+	source, err := os.ReadFile(s.Path)
+	if err != nil {
+		return err
+	}
+	thread, stop := s.thread()
+	defer stop()
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, s.Path, source, nil)
+	if err != nil {
+		return err
+	}
+
+	for name, target := range map[string]*starlark.Callable{"reject": &s.reject, "price": &s.price} {
+		value, ok := globals[name]
+		if !ok {
+			continue
+		}
+		callable, ok := value.(starlark.Callable)
+		if !ok {
+			return fmt.Errorf("%s must be a function", name)
+		}
+		*target = callable
+	}
+	if s.reject == nil && s.price == nil {
+		return fmt.Errorf("defines neither reject nor price")
+	}
+	return nil
+}
+
+// thread is a fresh interpreter thread with the script's limits, and a
+// function to call once it's done. Without a Load function, load
+// statements fail.
+func (s *PolicyScript) thread() (*starlark.Thread, func()) {
+	thread := &starlark.Thread{Name: s.Path, Print: func(_ *starlark.Thread, msg string) {
+		fmt.Printf("%s: %s\n", s.Path, msg)
+	}}
+	thread.SetMaxExecutionSteps(s.MaxSteps)
+	timer := time.AfterFunc(s.Timeout, func() { thread.Cancel("took longer than " + s.Timeout.String()) })
+	return thread, func() { timer.Stop() }
+}
+
+func (s *PolicyScript) call(fn starlark.Callable, args ...starlark.Value) (starlark.Value, error) {
+	thread, stop := s.thread()
+	defer stop()
+	return starlark.Call(thread, fn, args, nil)
+}
+
+// RejectWithScript is a RejectEvent policy calling the script's reject
+// function. The account's balance is as recorded, without looking upstream
+// for new zaps first. A script that fails lets the event through.
+func RejectWithScript(s *PolicyScript, db Database) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		return s.rejectEvent(event, db)
+	}
+}
+
+func (s *PolicyScript) rejectEvent(event *nostr.Event, db Database) (reject bool, msg string) {
+	account := GetRecordedBillingAccount(GetEventAuthor(event), db)
+	result, err := s.call(s.reject, scriptEvent(event), scriptAccount(account))
+	if err != nil {
+		scriptErrors.Inc()
+		ReportError(err, "scripts", map[string]string{"script": s.Path, "event": event.ID})
+		return false, ""
+	}
+	if result == starlark.None {
+		return false, ""
+	}
+	message, ok := starlark.AsString(result)
+	if !ok {
+		scriptErrors.Inc()
+		ReportError(fmt.Errorf("reject returned %s, not a string or None", result.Type()), "scripts", map[string]string{"script": s.Path})
+		return false, ""
+	}
+	if message == "" {
+		return false, ""
+	}
+	return true, message
+}
+
+func (p ScriptPricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	price, err := p.Inner.Price(event, account)
+	if err != nil {
+		return 0, err
+	}
+	for _, script := range p.Scripts {
+		if script.price == nil {
+			continue
+		}
+		result, err := script.call(script.price, scriptEvent(event), scriptAccount(account), starlark.MakeInt64(price))
+		if err != nil {
+			scriptErrors.Inc()
+			ReportError(err, "scripts", map[string]string{"script": script.Path, "event": event.ID})
+			continue
+		}
+		msat, ok := result.(starlark.Int)
+		value, exact := int64(0), false
+		if ok {
+			value, exact = msat.Int64()
+		}
+		if !exact || value < 0 {
+			scriptErrors.Inc()
+			ReportError(fmt.Errorf("price returned %s, not a non-negative int", result), "scripts", map[string]string{"script": script.Path})
+			continue
+		}
+		price = value
+	}
+	return price, nil
+}
+
+func scriptEvent(event *nostr.Event) starlark.Value {
+	tags := make([]starlark.Value, len(event.Tags))
+	for i, tag := range event.Tags {
+		values := make([]starlark.Value, len(tag))
+		for j, value := range tag {
+			values[j] = starlark.String(value)
+		}
+		tags[i] = starlark.NewList(values)
+	}
+	return starlarkstruct.FromStringDict(starlark.String("event"), starlark.StringDict{
+		"id":         starlark.String(event.ID),
+		"pubkey":     starlark.String(event.PubKey),
+		"author":     starlark.String(GetEventAuthor(event)),
+		"kind":       starlark.MakeInt(event.Kind),
+		"created_at": starlark.MakeInt64(int64(event.CreatedAt)),
+		"content":    starlark.String(event.Content),
+		"tags":       starlark.NewList(tags),
+		"client":     starlark.String(GetEventClient(event)),
+	})
+}
+
+func scriptAccount(account BillingAccount) starlark.Value {
+	return starlarkstruct.FromStringDict(starlark.String("account"), starlark.StringDict{
+		"pubkey":              starlark.String(account.PubKey),
+		"balance_msat":        starlark.MakeInt64(account.BalanceMsat),
+		"stored_events":       starlark.MakeInt64(account.StoredEvents),
+		"stored_bytes":        starlark.MakeInt64(account.StoredBytes),
+		"account_age_days":    starlark.MakeInt64(account.AccountAgeDays),
+		"lifetime_spend_msat": starlark.MakeInt64(account.LifetimeSpendMsat),
+	})
+}
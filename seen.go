@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// SeenCache remembers the last Size event ids it was asked about, so events
+// that arrive from several upstream relays, or again after a subscription
+// resumes from its cursor, are only handled once.
+type SeenCache struct {
+	mutex sync.Mutex
+	ids   map[string]struct{}
+	ring  []string
+	next  int
+}
+
+// sharedSeenTTL is how long event ids are remembered in Redis, where the
+// cache isn't bounded by size.
+const sharedSeenTTL = 24 * time.Hour
+
+var (
+	seenEvents *SeenCache
+
+	seenEventsSkipped = NewCounter("ppe_upstream_duplicates_skipped_total", "Upstream events skipped because they were already handled.")
+)
+
+func NewSeenCache(size int) *SeenCache {
+	if size < 1 {
+		size = 1
+	}
+	return &SeenCache{ids: make(map[string]struct{}, size), ring: make([]string, size)}
+}
+
+// Seen reports whether id was seen before, marking it as seen. The oldest id
+// is forgotten once the cache is full. With Redis the ids are shared with
+// the other instances, so one taking over the bot or the zap indexer knows
+// what the last one handled.
+func (c *SeenCache) Seen(id string) bool {
+	if seen, ok := SharedSeen(id, sharedSeenTTL); ok {
+		if seen {
+			seenEventsSkipped.Inc()
+		}
+		return seen
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.ids[id]; ok {
+		seenEventsSkipped.Inc()
+		return true
+	}
+	if oldest := c.ring[c.next]; oldest != "" {
+		delete(c.ids, oldest)
+	}
+	c.ring[c.next] = id
+	c.next = (c.next + 1) % len(c.ring)
+	c.ids[id] = struct{}{}
+	return false
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strings"
+	"time"
+)
+
+var sessionSchema = Schema{
+	Tables: []string{"bot_session"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS bot_session (
+       pubkey text NOT NULL PRIMARY KEY,
+       flow text NOT NULL,
+       step text NOT NULL,
+       data text NOT NULL,
+       expires_at bigint NOT NULL);`,
+	},
+}
+
+// BotSession is a conversation the bot is having with a user across several
+// notes. Flow names the BotFlow that answers the user's next note, Step where
+// it is in that flow and Data whatever it collected so far.
+type BotSession struct {
+	PubKey    string
+	Flow      string
+	Step      string
+	Data      map[string]string
+	ExpiresAt nostr.Timestamp
+}
+
+// BotFlow answers the user's next note in a session. It moves the session
+// along by changing its Step and Data, and ends it by setting Step to "".
+type BotFlow func(event *nostr.Event, session *BotSession, answer string, db Database) string
+
+var (
+	botSessionTTL  time.Duration
+	refundsEnabled bool
+
+	botSessionsStarted = NewCounter("ppe_bot_sessions_started_total", "Multi-step bot conversations started.")
+	botSessionsExpired = NewCounter("ppe_bot_sessions_expired_total", "Bot conversations abandoned before they finished.")
+)
+
+func botFlows() map[string]BotFlow {
+	return map[string]BotFlow{
+		"package":  packageFlow,
+		"nip05":    nip05Flow,
+		"refund":   refundFlow,
+		"erase":    erasureFlow,
+		"backfill": backfillFlow,
+	}
+}
+
+// StartBotSession stores a new session for pubkey, replacing any it had, and
+// returns question so commands can end with `return StartBotSession(...)`.
+func StartBotSession(pubkey string, flow string, step string, data map[string]string, question string, db Database) string {
+	session := &BotSession{PubKey: pubkey, Flow: flow, Step: step, Data: data}
+	if err := SaveBotSession(session, db); err != nil {
+		ReportError(err, "sessions", map[string]string{"pubkey": pubkey, "flow": flow})
+		return "Something went wrong, try again later."
+	}
+	botSessionsStarted.Inc()
+	return question
+}
+
+// GetBotSession returns pubkey's session, or nil if it has none or it
+// expired.
+func GetBotSession(pubkey string, db Database) (*BotSession, error) {
+	session := &BotSession{PubKey: pubkey}
+	var data string
+	err := db.DB.QueryRow(
+		`SELECT flow, step, data, expires_at FROM bot_session WHERE pubkey = ?`, pubkey,
+	).Scan(&session.Flow, &session.Step, &data, &session.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if session.ExpiresAt < nostr.Now() {
+		botSessionsExpired.Inc()
+		return nil, ClearBotSession(pubkey, db)
+	}
+	if err := json.Unmarshal([]byte(data), &session.Data); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// SaveBotSession stores session, giving the user another BOT_SESSION_TTL to
+// answer.
+func SaveBotSession(session *BotSession, db Database) error {
+	if session.Data == nil {
+		session.Data = make(map[string]string)
+	}
+	data, err := json.Marshal(session.Data)
+	if err != nil {
+		return err
+	}
+	session.ExpiresAt = nostr.Timestamp(time.Now().Add(botSessionTTL).Unix())
+
+	_, err = db.DB.Exec(
+		`INSERT INTO bot_session (pubkey, flow, step, data, expires_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (pubkey) DO UPDATE SET flow = excluded.flow, step = excluded.step, data = excluded.data, expires_at = excluded.expires_at`,
+		session.PubKey, session.Flow, session.Step, string(data), session.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DB.Exec(`DELETE FROM bot_session WHERE expires_at < ?`, nostr.Now())
+	return err
+}
+
+func ClearBotSession(pubkey string, db Database) error {
+	_, err := db.DB.Exec(`DELETE FROM bot_session WHERE pubkey = ?`, pubkey)
+	return err
+}
+
+// ContinueBotSession answers a note from a user with an open session. Their
+// whole note is the answer; "cancel" ends the session instead.
+func ContinueBotSession(event *nostr.Event, session *BotSession, db Database) string {
+	answer := sessionAnswer(event)
+	if strings.EqualFold(answer, "cancel") {
+		if err := ClearBotSession(session.PubKey, db); err != nil {
+			ReportError(err, "sessions", map[string]string{"pubkey": session.PubKey})
+		}
+		return "Cancelled."
+	}
+
+	flow, ok := botFlows()[session.Flow]
+	if !ok {
+		ClearBotSession(session.PubKey, db)
+		return "Sorry, I lost track of what we were doing. Commands: " + botCommandUsage() + "."
+	}
+
+	response := flow(event, session, answer, db)
+
+	var err error
+	if session.Step == "" {
+		err = ClearBotSession(session.PubKey, db)
+	} else {
+		err = SaveBotSession(session, db)
+	}
+	if err != nil {
+		ReportError(err, "sessions", map[string]string{"pubkey": session.PubKey, "flow": session.Flow})
+	}
+	return response
+}
+
+// sessionAnswer is the first line of what the user said to the bot, whether
+// or not they mentioned it again.
+func sessionAnswer(event *nostr.Event) string {
+	text, ok := commandText(event)
+	if !ok {
+		text = nostrMentionPattern.ReplaceAllString(event.Content, "")
+	}
+	text = strings.TrimSpace(text)
+	if line, _, found := strings.Cut(text, "\n"); found {
+		text = line
+	}
+	return strings.TrimPrefix(strings.TrimSpace(text), "/")
+}
+
+func isYes(answer string) bool {
+	switch strings.ToLower(answer) {
+	case "yes", "y", "confirm", "ok":
+		return true
+	}
+	return false
+}
+
+func packageChoices() string {
+	var names []string
+	for _, p := range eventPackages {
+		names = append(names, fmt.Sprintf("%s (%d events for %d sats)", p.Name, p.Events, p.Sats))
+	}
+	return strings.Join(names, ", ")
+}
+
+// packageFlow asks which package to buy when "package" is sent without one.
+func packageFlow(event *nostr.Event, session *BotSession, answer string, db Database) string {
+	if _, ok := FindEventPackage(answer); !ok {
+		return fmt.Sprintf("There's no %s package. Reply with one of %s, or cancel.", answer, packageChoices())
+	}
+	session.Step = ""
+	return HandlePackageCommand(event.PubKey, answer)
+}
+
+// nip05Flow confirms that a user wants to give up the name they already have
+// for a new one.
+func nip05Flow(event *nostr.Event, session *BotSession, answer string, db Database) string {
+	session.Step = ""
+	if !isYes(answer) {
+		return "Ok, keeping your current name."
+	}
+	name := session.Data["name"]
+	if err := BuyNIP05Name(event.PubKey, name, nip05Price, db); err != nil {
+		return fmt.Sprintf("Couldn't register %s: %v.", name, err)
+	}
+	return fmt.Sprintf("You're now %s@%s.", name, nip05Domain)
+}
+
+// refundFlow collects an invoice for the user's remaining balance, confirms
+// it and then debits the balance and forwards the invoice to the operator to
+// pay.
+func refundFlow(event *nostr.Event, session *BotSession, answer string, db Database) string {
+	balance := GetRemainingUserBalance(event.PubKey, db)
+
+	switch session.Step {
+	case "invoice":
+		invoice, err := DecodeInvoice(answer)
+		if err != nil {
+			return "That doesn't look like a lightning invoice. Reply with one, or cancel."
+		}
+		sats := invoice.MSatoshi / 1000
+		if sats <= 0 || sats > balance {
+			return fmt.Sprintf("The invoice must be for between 1 and %d sats. Reply with another one, or cancel.", balance)
+		}
+		if time.Unix(int64(invoice.CreatedAt+invoice.Expiry), 0).Before(time.Now().Add(botSessionTTL)) {
+			return "That invoice expires too soon. Reply with one that lasts longer, or cancel."
+		}
+		session.Step = "confirm"
+		session.Data["bolt11"] = answer
+		session.Data["hash"] = invoice.PaymentHash
+		session.Data["sats"] = fmt.Sprint(sats)
+		return fmt.Sprintf("Refund %d sats out of your %d sats balance? Reply yes to confirm.", sats, balance)
+
+	case "confirm":
+		session.Step = ""
+		if !isYes(answer) {
+			return "Ok, no refund."
+		}
+		var sats int64
+		fmt.Sscan(session.Data["sats"], &sats)
+		if sats > balance {
+			return fmt.Sprintf("Your balance is only %d sats now, so I can't refund %d.", balance, sats)
+		}
+		debited, err := RecordDebitMsat("refund:"+session.Data["hash"], event.PubKey, sats*1000, "refund", db)
+		if err != nil {
+			ReportError(err, "sessions", map[string]string{"pubkey": event.PubKey, "flow": "refund"})
+			return "Couldn't record the refund, try again later."
+		} else if !debited {
+			return "That invoice was already refunded."
+		}
+		message := fmt.Sprintf("Refund of %d sats requested by %s. Please pay:\n\n%s", sats, event.PubKey, session.Data["bolt11"])
+		if err := SendDirectMessage(relay.Info.PubKey, message, db); err != nil {
+			ReportError(err, "sessions", map[string]string{"pubkey": event.PubKey, "flow": "refund"})
+		}
+		return fmt.Sprintf("Done, %d sats were taken off your balance and the operator will pay your invoice shortly.", sats)
+	}
+
+	session.Step = ""
+	return "Sorry, I lost track of your refund. Send refund to start again."
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"github.com/nbd-wtf/go-nostr"
+	"log"
+)
+
+// dryRun is set by DRY_RUN=true or a leading --dry-run argument. Billing
+// decisions are then logged instead of enforced, so pricing changes can be
+// tried against real traffic before anyone is turned away for them.
+var (
+	dryRun bool
+
+	simulatedRejections = NewCounter("ppe_dry_run_rejections_total", "Events that would have been rejected for insufficient balance in dry-run mode.")
+	simulatedCharges    = NewCounter("ppe_dry_run_charges_sats_total", "Sats that would have been charged for events accepted in dry-run mode.")
+)
+
+// SimulateBilling lets events through a billing policy that would have
+// rejected them, logging the decision instead.
+func SimulateBilling(policy func(ctx context.Context, event *nostr.Event) (reject bool, msg string)) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if reject, msg := policy(ctx, event); reject {
+			simulatedRejections.Inc()
+			log.Printf("dry-run: would reject %s from %s: %s", event.ID, event.PubKey, msg)
+		}
+		return false, ""
+	}
+}
+
+// LogSimulatedCharge takes the place of ChargeEvent, logging the price
+// RequireBalance quoted for an accepted event instead of debiting it.
+func LogSimulatedCharge(pricer Pricer, db Database) func(ctx context.Context, event *nostr.Event) {
+	return func(ctx context.Context, event *nostr.Event) {
+		if dynamic, ok := pricer.(*DynamicPricer); ok {
+			dynamic.Observe()
+		}
+		price, _ := takeQuotedPrice(event)
+		simulatedCharges.Add(price / 1000)
+		log.Printf("dry-run: accepted %s (kind %d) from %s, would charge %d msat, balance %d msat",
+			event.ID, event.Kind, event.PubKey, price, GetLedgerBalanceMsat(GetBillingPubKey(GetEventAuthor(event), db), db))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"log"
+	"strings"
+	"time"
+)
+
+var slowQueries = NewCounterVec("ppe_slow_queries_total", "Storage queries slower than SLOW_QUERY_THRESHOLD, by the fields their filter uses.", "shape")
+
+// LogSlowQueries wraps the database's QueryEvents, logging the queries that
+// take longer than threshold to return all their events along with their
+// filter, as rewritten by FilterRewriter, and counting them by shape.
+//
+// Results are buffered up to the filter's limit so the time measured is the
+// database's, not how long the client took to read them.
+func LogSlowQueries(threshold time.Duration, query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		start := time.Now()
+		results, err := query(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		buffer := filter.Limit
+		if buffer <= 0 || buffer > 500 {
+			buffer = 500
+		}
+		ch := make(chan *nostr.Event, buffer)
+		go func() {
+			defer close(ch)
+
+			count := 0
+			for event := range results {
+				count++
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					for range results {
+					}
+					return
+				}
+			}
+			if elapsed := time.Since(start); elapsed > threshold {
+				shape := FilterShape(filter)
+				slowQueries.Inc(shape)
+				log.Printf("slow query: %v for %d events, %s from %s: %s", elapsed.Round(time.Millisecond), count, shape, describeReader(ctx), filter.String())
+			}
+		}()
+		return ch, nil
+	}
+}
+
+// FilterShape names the fields filter uses, like "authors,kinds,since", to
+// group queries that stress the database the same way.
+func FilterShape(filter nostr.Filter) string {
+	var fields []string
+	if len(filter.IDs) > 0 {
+		fields = append(fields, "ids")
+	}
+	if len(filter.Authors) > 0 {
+		fields = append(fields, "authors")
+	}
+	if len(filter.Kinds) > 0 {
+		fields = append(fields, "kinds")
+	}
+	if len(filter.Tags) > 0 {
+		fields = append(fields, "tags")
+	}
+	if filter.Since != nil {
+		fields = append(fields, "since")
+	}
+	if filter.Until != nil {
+		fields = append(fields, "until")
+	}
+	if filter.Search != "" {
+		fields = append(fields, "search")
+	}
+	if len(fields) == 0 {
+		return "empty"
+	}
+	return strings.Join(fields, ",")
+}
+
+func describeReader(ctx context.Context) string {
+	if pubkey := khatru.GetAuthed(ctx); pubkey != "" {
+		return pubkey
+	}
+	if khatru.GetConnection(ctx) == nil {
+		return "the relay"
+	}
+	return "an unauthenticated connection"
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var spamSchema = Schema{
+	Tables: []string{"spam_score"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS spam_score (
+       event_id text NOT NULL PRIMARY KEY,
+       pubkey text NOT NULL,
+       kind integer NOT NULL,
+       score integer NOT NULL,
+       classifier text NOT NULL,
+       action text NOT NULL,
+       created_at bigint NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS spam_score_action_created_at ON spam_score (action, created_at);`,
+	},
+}
+
+// SpamClassifier scores how likely an event is to be spam, from 0 (surely
+// not) to 100 (surely).
+type SpamClassifier interface {
+	Classify(event *nostr.Event) (score int, err error)
+}
+
+type SpamScore struct {
+	EventID    string          `json:"event_id" db:"event_id"`
+	PubKey     string          `json:"pubkey" db:"pubkey"`
+	Kind       int             `json:"kind" db:"kind"`
+	Score      int             `json:"score" db:"score"`
+	Classifier string          `json:"classifier" db:"classifier"`
+	Action     string          `json:"action" db:"action"`
+	CreatedAt  nostr.Timestamp `json:"created_at" db:"created_at"`
+}
+
+const (
+	SpamPassed   = "passed"
+	SpamFlagged  = "flagged"
+	SpamRejected = "rejected"
+)
+
+var spamClassified = NewCounterVec("ppe_spam_classified_total", "Events run through the spam classifier, by what was done with them.", "action")
+
+// GetSpamClassifier reads SPAM_CLASSIFIER: "heuristic" for the built-in
+// HeuristicClassifier or the URL of an HTTPClassifier. It's nil when unset.
+func GetSpamClassifier() SpamClassifier {
+	switch value := GetEnvDefault("SPAM_CLASSIFIER", ""); {
+	case value == "":
+		return nil
+	case value == "heuristic":
+		return HeuristicClassifier{}
+	case strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://"):
+		return HTTPClassifier{URL: value}
+	default:
+		panic(fmt.Sprintf("SPAM_CLASSIFIER must be heuristic or a URL, got %q", value))
+	}
+}
+
+// RejectSpam classifies the events of authors whose reputation is below
+// trusted, rejecting those scoring rejectAbove or more and recording those
+// scoring flagAbove or more for an operator to review. A classifier that
+// fails lets the event through.
+func RejectSpam(classifier SpamClassifier, trusted float64, flagAbove int, rejectAbove int, db Database) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	name := "heuristic"
+	if remote, ok := classifier.(HTTPClassifier); ok {
+		name = remote.URL
+	}
+
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if GetReputation(GetEventAuthor(event), db).Score >= trusted {
+			return false, ""
+		}
+		score, err := classifier.Classify(event)
+		if err != nil {
+			ReportError(err, "spam", map[string]string{"event": event.ID})
+			return false, ""
+		}
+
+		action := SpamPassed
+		if score >= rejectAbove {
+			action = SpamRejected
+		} else if score >= flagAbove {
+			action = SpamFlagged
+		}
+		spamClassified.Inc(action)
+		if action == SpamPassed {
+			return false, ""
+		}
+
+		fmt.Printf("spam classifier %s event %s from %s: score %d\n", action, event.ID, event.PubKey, score)
+		_, err = db.DB.Exec(
+			`INSERT INTO spam_score (event_id, pubkey, kind, score, classifier, action, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+			 ON CONFLICT DO NOTHING`,
+			event.ID, event.PubKey, event.Kind, score, name, action, nostr.Now(),
+		)
+		if err != nil {
+			ReportError(err, "spam", map[string]string{"event": event.ID})
+		}
+		if action == SpamRejected {
+			return true, "blocked: this looks like spam"
+		}
+		return false, ""
+	}
+}
+
+// HeuristicClassifier scores text on the usual tells: lots of links,
+// mentions or hashtags, shouting, long runs of one character and giveaway
+// phrases.
+type HeuristicClassifier struct{}
+
+var (
+	spamLinkPattern = regexp.MustCompile(`https?://`)
+	spamPhrases     = []string{"airdrop", "giveaway", "free sats", "double your", "click here", "dm me on", "whatsapp", "telegram", "guaranteed profit"}
+)
+
+func (HeuristicClassifier) Classify(event *nostr.Event) (int, error) {
+	content := strings.ToLower(event.Content)
+	score := 0.0
+
+	links := len(spamLinkPattern.FindAllString(content, -1))
+	score += math.Max(0, float64(links-2)) * 15
+	if links > 0 && len(strings.Fields(event.Content)) <= links+1 {
+		// nothing but a link
+		score += 20
+	}
+	score += math.Min(30, math.Max(0, float64(len(event.Tags.GetAll([]string{"p", ""}))-10))*3)
+	score += math.Max(0, float64(len(event.Tags.GetAll([]string{"t", ""}))-5)) * 4
+
+	var letters, upper, run, longestRun int
+	var previous rune
+	for _, r := range event.Content {
+		if r == previous {
+			run++
+		} else {
+			run = 1
+		}
+		previous = r
+		longestRun = max(longestRun, run)
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters >= 20 && float64(upper)/float64(letters) > 0.7 {
+		score += 20
+	}
+	if longestRun >= 10 {
+		score += 10
+	}
+
+	phrases := 0
+	for _, phrase := range spamPhrases {
+		if strings.Contains(content, phrase) {
+			phrases++
+		}
+	}
+	score += math.Min(45, float64(phrases)*15)
+
+	return int(math.Min(100, score)), nil
+}
+
+// HTTPClassifier POSTs {"event": ...} to URL, which answers {"score": n}
+// with n from 0 to 100.
+type HTTPClassifier struct {
+	URL string
+}
+
+func (c HTTPClassifier) Classify(event *nostr.Event) (int, error) {
+	body, _ := json.Marshal(map[string]any{"event": event})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return 0, fmt.Errorf("spam classifier returned %s", response.Status)
+	}
+
+	var result struct {
+		Score *float64 `json:"score"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil || result.Score == nil {
+		return 0, fmt.Errorf("spam classifier didn't return a score")
+	}
+	return int(math.Max(0, math.Min(100, math.Round(*result.Score)))), nil
+}
+
+// HandleAdminSpam lists the last 500 events the classifier flagged, or
+// rejected with ?action=rejected.
+func HandleAdminSpam(w http.ResponseWriter, r *http.Request, db Database) {
+	action := r.URL.Query().Get("action")
+	if action == "" {
+		action = SpamFlagged
+	}
+	if action != SpamFlagged && action != SpamRejected {
+		WriteJSONError(w, http.StatusBadRequest, "action must be flagged or rejected")
+		return
+	}
+
+	scores := []SpamScore{}
+	err := db.DB.Select(&scores, `SELECT event_id, pubkey, kind, score, classifier, action, created_at FROM spam_score WHERE action = ? ORDER BY created_at DESC LIMIT 500`, action)
+	if err != nil {
+		ReportError(err, "spam", nil)
+		WriteJSONError(w, http.StatusInternalServerError, "couldn't read spam scores")
+		return
+	}
+	WriteJSON(w, http.StatusOK, scores)
+}
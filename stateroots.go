@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KindStateRoot is the regular kind the bot publishes state roots as, so
+// every one published stays around to be checked against.
+const KindStateRoot = 3333
+
+var stateRootSchema = Schema{
+	Tables: []string{"state_root"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS state_root (
+       created_at bigint NOT NULL PRIMARY KEY,
+       events bigint NOT NULL,
+       root text NOT NULL,
+       ledger_entries bigint NOT NULL,
+       ledger_root text NOT NULL,
+       event_id text NOT NULL);`,
+	},
+}
+
+// StateRoot commits to every event stored at CreatedAt, cold storage's
+// included, and with STATE_ROOT_LEDGER=true to every ledger entry, as the
+// roots of Merkle trees over them. Publishing it signed lets users who kept
+// the roots show later that an event of theirs was stored, and notice when
+// a later root leaves it out without a deletion explaining why.
+//
+// The trees are RFC 6962's, with SHA-256: events are leaves ordered by id,
+// each the id's 32 bytes, and ledger entries leaves in ledgerCommitments'
+// order. Events stored while the roots are computed may or may not be in
+// them.
+type StateRoot struct {
+	CreatedAt     nostr.Timestamp `json:"created_at"`
+	Events        int64           `json:"events"`
+	Root          string          `json:"root"`
+	LedgerEntries int64           `json:"ledger_entries,omitempty"`
+	LedgerRoot    string          `json:"ledger_root,omitempty"`
+	EventID       string          `json:"event_id,omitempty"`
+}
+
+// ledgerCommitments select each ledger table's entries, ordered, as the
+// text of their leaves.
+var ledgerCommitments = []string{
+	`SELECT 'zap_credit:' || id || ':' || pubkey || ':' || CAST(amount_msat AS text) FROM zap_credit ORDER BY id`,
+	`SELECT 'zap_revocation:' || id FROM zap_revocation ORDER BY id`,
+	`SELECT 'bonus_credit:' || id || ':' || pubkey || ':' || CAST(amount_msat AS text) FROM bonus_credit ORDER BY id`,
+	`SELECT 'trial_credit:' || pubkey || ':' || CAST(amount_msat AS text) FROM trial_credit ORDER BY pubkey`,
+	`SELECT 'debit:' || id || ':' || pubkey || ':' || CAST(amount_msat AS text) FROM debit ORDER BY id`,
+}
+
+var stateRootsPublished = NewCounter("ppe_state_roots_published_total", "State roots computed and published as signed events.")
+
+// MerkleTree computes an RFC 6962 Merkle tree root from its leaves, added
+// in order, keeping only the roots of the complete subtrees so far.
+type MerkleTree struct {
+	leaves  int64
+	subtree [][]byte
+	heights []int
+}
+
+func MerkleLeafHash(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{0}, data...))
+	return hash[:]
+}
+
+func MerkleNodeHash(left []byte, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{1})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+func (t *MerkleTree) Add(data []byte) {
+	t.leaves++
+	node, height := MerkleLeafHash(data), 0
+	for n := len(t.subtree); n > 0 && t.heights[n-1] == height; n-- {
+		node = MerkleNodeHash(t.subtree[n-1], node)
+		height++
+		t.subtree, t.heights = t.subtree[:n-1], t.heights[:n-1]
+	}
+	t.subtree = append(t.subtree, node)
+	t.heights = append(t.heights, height)
+}
+
+// Root is the tree's root, the hash of nothing for an empty tree.
+func (t *MerkleTree) Root() []byte {
+	if len(t.subtree) == 0 {
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	}
+	root := t.subtree[len(t.subtree)-1]
+	for i := len(t.subtree) - 2; i >= 0; i-- {
+		root = MerkleNodeHash(t.subtree[i], root)
+	}
+	return root
+}
+
+// ComputeStateRoot computes the roots over what db and cold storage hold
+// now, the ledger's only when ledger is set. The events' leaves are written
+// to leaves, when it isn't nil, for proving them later.
+func ComputeStateRoot(ledger bool, leaves io.Writer, db Database) (StateRoot, error) {
+	root := StateRoot{CreatedAt: nostr.Now()}
+
+	var events MerkleTree
+	var written error
+	err := forEachStoredID(db, func(id []byte) {
+		events.Add(id)
+		if leaves != nil && written == nil {
+			_, written = leaves.Write(id)
+		}
+	})
+	if err == nil {
+		err = written
+	}
+	if err != nil {
+		return root, err
+	}
+	root.Events, root.Root = events.leaves, hex.EncodeToString(events.Root())
+
+	if ledger {
+		var entries MerkleTree
+		for _, query := range ledgerCommitments {
+			rows, err := db.DB.Query(query)
+			if err != nil {
+				return root, err
+			}
+			for rows.Next() {
+				var entry string
+				if err := rows.Scan(&entry); err != nil {
+					rows.Close()
+					return root, err
+				}
+				entries.Add([]byte(entry))
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return root, err
+			}
+		}
+		root.LedgerEntries, root.LedgerRoot = entries.leaves, hex.EncodeToString(entries.Root())
+	}
+	return root, nil
+}
+
+// forEachStoredID calls fn with the id of every stored event, in order,
+// merging the database's with cold storage's.
+func forEachStoredID(db Database, fn func(id []byte)) error {
+	var cursors []*sql.Rows
+	defer func() {
+		for _, rows := range cursors {
+			rows.Close()
+		}
+	}()
+	for _, store := range EventDatabases(db) {
+		rows, err := store.DB.Query(`SELECT id FROM event ORDER BY id`)
+		if err != nil {
+			return err
+		}
+		cursors = append(cursors, rows)
+	}
+
+	next := make([]string, len(cursors))
+	advance := func(i int) error {
+		next[i] = ""
+		if cursors[i].Next() {
+			return cursors[i].Scan(&next[i])
+		}
+		return cursors[i].Err()
+	}
+	for i := range cursors {
+		if err := advance(i); err != nil {
+			return err
+		}
+	}
+	for {
+		smallest := ""
+		for _, id := range next {
+			if id != "" && (smallest == "" || id < smallest) {
+				smallest = id
+			}
+		}
+		if smallest == "" {
+			return nil
+		}
+		id, err := hex.DecodeString(smallest)
+		if err != nil {
+			return fmt.Errorf("stored event id %q: %w", smallest, err)
+		}
+		fn(id)
+		// an event being moved to cold storage is in both
+		for i := range next {
+			if next[i] == smallest {
+				if err := advance(i); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// PublishStateRoot computes the state root and has the bot sign it and publish
+// it, here and to the upstream relays, so the relay can't quietly rewrite
+// the roots it published. Its leaves are kept for ProveEvent, replacing the
+// previous root's.
+func PublishStateRoot(ledger bool, db Database) (StateRoot, error) {
+	dir := stateRootDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return StateRoot{}, err
+	}
+	leaves, err := os.CreateTemp(dir, "leaves-*")
+	if err != nil {
+		return StateRoot{}, err
+	}
+	defer os.Remove(leaves.Name())
+	defer leaves.Close()
+	buffered := bufio.NewWriter(leaves)
+	root, err := ComputeStateRoot(ledger, buffered, db)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		return root, err
+	}
+
+	content := fmt.Sprintf("%d events stored, Merkle root %s.", root.Events, root.Root)
+	tags := nostr.Tags{
+		{"root", root.Root},
+		{"events", strconv.FormatInt(root.Events, 10)},
+		{"alg", "rfc6962-sha256"},
+	}
+	if ledger {
+		content += fmt.Sprintf(" %d ledger entries, Merkle root %s.", root.LedgerEntries, root.LedgerRoot)
+		tags = append(tags, nostr.Tag{"ledger", root.LedgerRoot}, nostr.Tag{"ledger_entries", strconv.FormatInt(root.LedgerEntries, 10)})
+	}
+	if relay.ServiceURL != "" {
+		tags = append(tags, nostr.Tag{"r", strings.Replace(relay.ServiceURL, "http", "ws", 1)})
+	}
+	event := nostr.Event{
+		PubKey:    botPubkey,
+		CreatedAt: root.CreatedAt,
+		Kind:      KindStateRoot,
+		Content:   content,
+		Tags:      tags,
+	}
+	if err := event.Sign(GetEnv("BOT_PRIVATE_KEY")); err != nil {
+		return root, err
+	}
+	root.EventID = event.ID
+
+	if _, err := db.DB.Exec(
+		`INSERT INTO state_root (created_at, events, root, ledger_entries, ledger_root, event_id) VALUES (?, ?, ?, ?, ?, ?)`,
+		root.CreatedAt, root.Events, root.Root, root.LedgerEntries, root.LedgerRoot, root.EventID,
+	); err != nil {
+		return root, err
+	}
+	if err := os.Rename(leaves.Name(), stateRootLeavesPath(root.CreatedAt)); err != nil {
+		ReportError(err, "state roots", map[string]string{"event": event.ID})
+	}
+	if err := ReplicateSaves(TrackStorageSaves(db.SaveEvent, db), db)(context.Background(), &event); err != nil {
+		ReportError(err, "state roots", map[string]string{"event": event.ID})
+	}
+	relay.BroadcastEvent(&event)
+	PublishBotEventWithRetry(event, db)
+	stateRootsPublished.Inc()
+
+	previous, _ := filepath.Glob(filepath.Join(dir, "*.leaves"))
+	for _, path := range previous {
+		if path != stateRootLeavesPath(root.CreatedAt) {
+			os.Remove(path)
+		}
+	}
+	return root, nil
+}
+
+func stateRootDir() string {
+	return GetEnvDefault("STATE_ROOT_DIR", "./db/state-roots")
+}
+
+// stateRootLeavesPath is where the leaves of the root published at
+// createdAt are kept: the ids of the events it commits to, 32 bytes each,
+// in order.
+func stateRootLeavesPath(createdAt nostr.Timestamp) string {
+	return filepath.Join(stateRootDir(), strconv.FormatInt(int64(createdAt), 10)+".leaves")
+}
+
+// GetStateRoots lists the roots published, newest first.
+func GetStateRoots(limit int, db Database) ([]StateRoot, error) {
+	rows, err := db.DB.Query(`SELECT created_at, events, root, ledger_entries, ledger_root, event_id FROM state_root ORDER BY created_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roots := []StateRoot{}
+	for rows.Next() {
+		var root StateRoot
+		if err := rows.Scan(&root.CreatedAt, &root.Events, &root.Root, &root.LedgerEntries, &root.LedgerRoot, &root.EventID); err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	return roots, rows.Err()
+}
+
+// RunStateRootPublisher publishes a state root every interval.
+func RunStateRootPublisher(interval time.Duration, db Database) {
+	ledger := GetEnvDefault("STATE_ROOT_LEDGER", "") == "true"
+	for {
+		if _, err := PublishStateRoot(ledger, db); err != nil {
+			ReportError(err, "state roots", nil)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func HandleAPIStateRoots(w http.ResponseWriter, r *http.Request, db Database) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 || limit > 100 {
+		limit = 30
+	}
+	roots, err := GetStateRoots(limit, db)
+	if err != nil {
+		ReportError(err, "state roots", nil)
+		WriteJSONError(w, http.StatusInternalServerError, "couldn't list the state roots")
+		return
+	}
+	WriteJSON(w, http.StatusOK, roots)
+}
+
+// RunStateRoot prints the state root as it is now, publishing it with
+// -publish.
+func RunStateRoot(args []string, db Database) {
+	flags := flag.NewFlagSet("state-root", flag.ExitOnError)
+	ledger := flags.Bool("ledger", GetEnvDefault("STATE_ROOT_LEDGER", "") == "true", "commit to the ledger too")
+	publish := flags.Bool("publish", false, "sign and publish it")
+	flags.Parse(args)
+
+	var root StateRoot
+	var err error
+	if *publish {
+		root, err = PublishStateRoot(*ledger, db)
+	} else {
+		root, err = ComputeStateRoot(*ledger, nil, db)
+	}
+	if err != nil {
+		log.Fatalf("Failed to compute the state root: %v", err)
+	}
+	fmt.Printf("%d events, root %s\n", root.Events, root.Root)
+	if *ledger {
+		fmt.Printf("%d ledger entries, root %s\n", root.LedgerEntries, root.LedgerRoot)
+	}
+	if root.EventID != "" {
+		fmt.Printf("published as %s\n", root.EventID)
+	}
+}
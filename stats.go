@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+var statsSchema = Schema{
+	Tables: []string{"stats_hourly", "stats_daily"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS stats_hourly (
+       bucket bigint NOT NULL,
+       metric text NOT NULL,
+       dimension text NOT NULL,
+       value bigint NOT NULL,
+       PRIMARY KEY (bucket, metric, dimension));`,
+		`CREATE TABLE IF NOT EXISTS stats_daily (
+       bucket bigint NOT NULL,
+       metric text NOT NULL,
+       dimension text NOT NULL,
+       value bigint NOT NULL,
+       PRIMARY KEY (bucket, metric, dimension));`,
+	},
+}
+
+// rollupQueries compute one metric for the bucket [?, ?). Each returns
+// (dimension, value) rows; metrics without a breakdown use an empty dimension.
+var rollupQueries = map[string]string{
+	"events_stored": `SELECT '', COUNT(*) FROM event WHERE created_at >= ? AND created_at < ?`,
+	"active_users":  `SELECT '', COUNT(DISTINCT pubkey) FROM event WHERE created_at >= ? AND created_at < ?`,
+	"sats_received": `SELECT '', COALESCE(SUM(amount_msat), 0) / 1000 FROM zap_credit WHERE credited_at >= ? AND credited_at < ?`,
+	"paying_users":  `SELECT '', COUNT(DISTINCT pubkey) FROM zap_credit WHERE credited_at >= ? AND credited_at < ?`,
+}
+
+func RunStatsAggregator(db Database) {
+	for {
+		now := time.Now().UTC()
+
+		// the previous buckets are redone too, to catch whatever arrived
+		// after the last run but still belongs to them
+		for _, hour := range []time.Time{now.Add(-time.Hour), now} {
+			RollupBucket("stats_hourly", hour.Truncate(time.Hour), time.Hour, db)
+		}
+		for _, day := range []time.Time{now.AddDate(0, 0, -1), now} {
+			RollupBucket("stats_daily", day.Truncate(24*time.Hour), 24*time.Hour, db)
+		}
+
+		time.Sleep(GetEnvDuration("STATS_INTERVAL", 10*time.Minute))
+	}
+}
+
+func RollupBucket(table string, start time.Time, length time.Duration, db Database) {
+	from, to := start.Unix(), start.Add(length).Unix()
+
+	type rollup struct {
+		metric    string
+		dimension string
+		value     int64
+	}
+	var rollups []rollup
+
+	for metric, query := range rollupQueries {
+		rows, err := db.DB.Query(query, from, to)
+		if err != nil {
+			ReportError(err, "stats", map[string]string{"metric": metric})
+			continue
+		}
+		for rows.Next() {
+			entry := rollup{metric: metric}
+			if err := rows.Scan(&entry.dimension, &entry.value); err == nil {
+				rollups = append(rollups, entry)
+			}
+		}
+		rows.Close()
+	}
+
+	// rejections are only recorded per day, so they only go in the daily table
+	if table == "stats_daily" {
+		rows, err := db.DB.Query(`SELECT reason, SUM(count) FROM event_rejection WHERE day = ? GROUP BY reason`, start.Format("2006-01-02"))
+		if err != nil {
+			ReportError(err, "stats", map[string]string{"metric": "rejections"})
+		} else {
+			for rows.Next() {
+				entry := rollup{metric: "rejections"}
+				if err := rows.Scan(&entry.dimension, &entry.value); err == nil {
+					rollups = append(rollups, entry)
+				}
+			}
+			rows.Close()
+		}
+	}
+
+	// stored once all reads are done, sqlite won't let us write with a
+	// query still open
+	for _, entry := range rollups {
+		StoreRollup(table, from, entry.metric, entry.dimension, entry.value, db)
+	}
+}
+
+func StoreRollup(table string, bucket int64, metric string, dimension string, value int64, db Database) {
+	_, err := db.DB.Exec(
+		fmt.Sprintf(`INSERT INTO %s (bucket, metric, dimension, value) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(bucket, metric, dimension) DO UPDATE SET value = excluded.value`, table),
+		bucket, metric, dimension, value,
+	)
+	if err != nil {
+		ReportError(err, "stats", map[string]string{"metric": metric, "table": table})
+	}
+}
+
+// RunRollup recomputes the rollup tables for the last days, for filling them
+// in after upgrading or after a purge.
+func RunRollup(args []string, db Database) {
+	flags := flag.NewFlagSet("rollup", flag.ExitOnError)
+	days := flags.Int("days", 30, "number of days to recompute")
+	flags.Parse(args)
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for i := *days - 1; i >= 0; i-- {
+		day := today.AddDate(0, 0, -i)
+		RollupBucket("stats_daily", day, 24*time.Hour, db)
+		for hour := 0; hour < 24; hour++ {
+			RollupBucket("stats_hourly", day.Add(time.Duration(hour)*time.Hour), time.Hour, db)
+		}
+	}
+	log.Printf("recomputed rollups for %d days", *days)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+var storageSchema = Schema{
+	Tables: []string{"storage_usage"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS storage_usage (
+       pubkey text NOT NULL,
+       kind integer NOT NULL,
+       events bigint NOT NULL,
+       bytes bigint NOT NULL,
+       PRIMARY KEY (pubkey, kind));`,
+		`CREATE INDEX IF NOT EXISTS storageusagekindidx ON storage_usage (kind);`,
+	},
+}
+
+// StorageUsage is how many events, and bytes of their JSON as stored
+// (encrypted, for the kinds encrypted at rest), a pubkey or kind takes.
+type StorageUsage struct {
+	PubKey string `json:"pubkey,omitempty"`
+	Kind   *int   `json:"kind,omitempty"`
+	Events int64  `json:"events"`
+	Bytes  int64  `json:"bytes"`
+}
+
+var storageQuotaRejections = NewCounter("ppe_storage_quota_rejections_total", "Events rejected because their author's storage quota is used up.")
+
+// TrackStorageSaves wraps the database's SaveEvent, adding each event stored
+// to its author's usage. It goes under EncryptAtRest, so encrypted events
+// count what they take once encrypted.
+func TrackStorageSaves(save func(ctx context.Context, event *nostr.Event) error, db Database) func(ctx context.Context, event *nostr.Event) error {
+	return func(ctx context.Context, event *nostr.Event) error {
+		if err := save(ctx, event); err != nil {
+			return err
+		}
+		if err := AddStorageUsage(event.PubKey, event.Kind, 1, int64(len(event.String())), db); err != nil {
+			ReportError(err, "storage", map[string]string{"event": event.ID})
+		}
+		return nil
+	}
+}
+
+// TrackStorageDeletes wraps the database's DeleteEvent, taking each event
+// deleted off its author's usage. The size is read from the stored event:
+// the one khatru passes along may have been decrypted.
+func TrackStorageDeletes(del func(ctx context.Context, event *nostr.Event) error, db Database) func(ctx context.Context, event *nostr.Event) error {
+	return func(ctx context.Context, event *nostr.Event) error {
+		stored, err := getStoredEvent(event.ID, db)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			ReportError(err, "storage", map[string]string{"event": event.ID})
+		}
+		if err := del(ctx, event); err != nil {
+			return err
+		}
+		if stored != nil {
+			if err := AddStorageUsage(stored.PubKey, stored.Kind, -1, -int64(len(stored.String())), db); err != nil {
+				ReportError(err, "storage", map[string]string{"event": event.ID})
+			}
+		}
+		return nil
+	}
+}
+
+// getStoredEvent returns the event with id as it's stored, in the database
+// or cold storage, or sql.ErrNoRows.
+func getStoredEvent(id string, db Database) (*nostr.Event, error) {
+	events, err := QueryStoredEvents(`SELECT id, pubkey, created_at, kind, tags, content, sig FROM event WHERE id = ?`, []any{id}, db)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return events[0], nil
+}
+
+// AddStorageUsage adds events and bytes, negative when they're deleted, to
+// what pubkey stores of kind.
+func AddStorageUsage(pubkey string, kind int, events int64, bytes int64, db Database) error {
+	if _, err := db.DB.Exec(
+		`INSERT INTO storage_usage (pubkey, kind, events, bytes) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (pubkey, kind) DO UPDATE SET events = storage_usage.events + excluded.events, bytes = storage_usage.bytes + excluded.bytes`,
+		pubkey, kind, events, bytes,
+	); err != nil {
+		return err
+	}
+	if events < 0 {
+		_, err := db.DB.Exec(`DELETE FROM storage_usage WHERE pubkey = ? AND kind = ? AND events <= 0`, pubkey, kind)
+		return err
+	}
+	return nil
+}
+
+// GetStorageUsage returns what pubkey stores, across kinds.
+func GetStorageUsage(pubkey string, db Database) StorageUsage {
+	usage := StorageUsage{PubKey: pubkey}
+	err := db.DB.QueryRow(`SELECT COALESCE(SUM(events), 0), COALESCE(SUM(bytes), 0) FROM storage_usage WHERE pubkey = ?`, pubkey).
+		Scan(&usage.Events, &usage.Bytes)
+	if err != nil {
+		ReportError(err, "storage", map[string]string{"pubkey": pubkey})
+	}
+	return usage
+}
+
+// GetStorageBreakdown lists the largest users of storage, or, by "kind",
+// the largest kinds, biggest first. With pubkey set, it's that pubkey's
+// kinds.
+func GetStorageBreakdown(by string, pubkey string, limit int, db Database) ([]StorageUsage, error) {
+	query := `SELECT pubkey, SUM(events), SUM(bytes) FROM storage_usage GROUP BY pubkey ORDER BY SUM(bytes) DESC LIMIT ?`
+	args := []any{limit}
+	switch {
+	case pubkey != "":
+		query = `SELECT kind, events, bytes FROM storage_usage WHERE pubkey = ? ORDER BY bytes DESC LIMIT ?`
+		args = []any{pubkey, limit}
+	case by == "kind":
+		query = `SELECT kind, SUM(events), SUM(bytes) FROM storage_usage GROUP BY kind ORDER BY SUM(bytes) DESC LIMIT ?`
+	}
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []StorageUsage{}
+	for rows.Next() {
+		entry := StorageUsage{PubKey: pubkey}
+		if pubkey != "" || by == "kind" {
+			entry.Kind = new(int)
+			err = rows.Scan(entry.Kind, &entry.Events, &entry.Bytes)
+		} else {
+			err = rows.Scan(&entry.PubKey, &entry.Events, &entry.Bytes)
+		}
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, entry)
+	}
+	return usage, rows.Err()
+}
+
+// RebuildStorageUsage recounts storage usage from the stored events, cold
+// storage's included, for databases written to before it was tracked or by
+// tools that bypass the relay. Events stored while it runs may be counted twice or not at all.
+func RebuildStorageUsage(db Database) error {
+	type key struct {
+		pubkey string
+		kind   int
+	}
+	totals := make(map[key]*StorageUsage)
+
+	for _, store := range EventDatabases(db) {
+		rows, err := store.DB.Query(`SELECT id, pubkey, created_at, kind, tags, content, sig FROM event`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var event nostr.Event
+			var timestamp int64
+			if err := rows.Scan(&event.ID, &event.PubKey, &timestamp, &event.Kind, &event.Tags, &event.Content, &event.Sig); err != nil {
+				rows.Close()
+				return err
+			}
+			event.CreatedAt = nostr.Timestamp(timestamp)
+
+			k := key{event.PubKey, event.Kind}
+			if totals[k] == nil {
+				totals[k] = &StorageUsage{}
+			}
+			totals[k].Events++
+			totals[k].Bytes += int64(len(event.String()))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM storage_usage`); err != nil {
+		return err
+	}
+	for k, usage := range totals {
+		if _, err := tx.Exec(`INSERT INTO storage_usage (pubkey, kind, events, bytes) VALUES (?, ?, ?, ?)`, k.pubkey, k.kind, usage.Events, usage.Bytes); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// EnsureStorageUsage counts the stored events when storage usage was never
+// tracked on this database.
+func EnsureStorageUsage(db Database) error {
+	var tracked, stored bool
+	if err := db.DB.Get(&tracked, `SELECT EXISTS (SELECT 1 FROM storage_usage)`); err != nil {
+		return err
+	}
+	if err := db.DB.Get(&stored, `SELECT EXISTS (SELECT 1 FROM event)`); err != nil {
+		return err
+	}
+	if tracked || !stored {
+		return nil
+	}
+	log.Printf("counting storage usage of the stored events")
+	return RebuildStorageUsage(db)
+}
+
+// RequireStorageQuota rejects events that would take their author past
+// quota bytes stored. Replacing an event counts the new one before the old
+// one is gone, so a full account can't update its profile either until it
+// deletes something. Pubkeys exempt from billing, the relay's and the bot's
+// among them, have no quota.
+func RequireStorageQuota(quota int64, db Database) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if IsBillingExempt(event.PubKey) {
+			return false, ""
+		}
+		if usage := GetStorageUsage(event.PubKey, db); usage.Bytes+int64(len(event.String())) > quota {
+			storageQuotaRejections.Inc()
+			return true, fmt.Sprintf("blocked: you store %s of your %s quota, delete some events to make room", formatBytes(usage.Bytes), formatBytes(quota))
+		}
+		return false, ""
+	}
+}
+
+func formatBytes(bytes int64) string {
+	switch {
+	case bytes >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(bytes)/(1<<30))
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+	case bytes >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", bytes)
+}
+
+func HandleAdminStorage(w http.ResponseWriter, r *http.Request, db Database) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 50
+	}
+	var pubkey string
+	if value := r.URL.Query().Get("pubkey"); value != "" {
+		if pubkey, err = ParsePubKey(value); err != nil {
+			WriteJSONError(w, http.StatusBadRequest, "invalid pubkey")
+			return
+		}
+	}
+
+	usage, err := GetStorageBreakdown(r.URL.Query().Get("by"), pubkey, limit, db)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, usage)
+}
+
+// RunStorageUsage prints the storage breakdown, recounting it first with
+// -rebuild.
+func RunStorageUsage(args []string, db Database) {
+	flags := flag.NewFlagSet("storage", flag.ExitOnError)
+	by := flags.String("by", "pubkey", "break down by pubkey or kind")
+	pubkey := flags.String("pubkey", "", "break down this pubkey's storage by kind")
+	limit := flags.Int("limit", 20, "how many rows to show")
+	rebuild := flags.Bool("rebuild", false, "recount storage usage from the stored events first")
+	flags.Parse(args)
+
+	if *rebuild {
+		if err := RebuildStorageUsage(db); err != nil {
+			log.Fatalf("Failed to rebuild storage usage: %v", err)
+		}
+	}
+	if *pubkey != "" {
+		var err error
+		if *pubkey, err = ParsePubKey(*pubkey); err != nil {
+			log.Fatalf("Invalid pubkey: %v", err)
+		}
+	}
+	usage, err := GetStorageBreakdown(*by, *pubkey, *limit, db)
+	if err != nil {
+		log.Fatalf("Failed to get storage usage: %v", err)
+	}
+	for _, entry := range usage {
+		subject := entry.PubKey
+		if entry.Kind != nil {
+			subject = "kind " + strconv.Itoa(*entry.Kind)
+		}
+		fmt.Printf("%-64s  %8d events  %s\n", subject, entry.Events, formatBytes(entry.Bytes))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	supervisorMinBackoff = time.Second
+	supervisorMaxBackoff = 5 * time.Minute
+)
+
+var goroutineRestarts = NewCounter("ppe_goroutine_restarts_total", "Background goroutines restarted after panicking or exiting.")
+
+// Supervise runs fn in its own goroutine and restarts it whenever it panics
+// or returns, waiting longer between each restart. The backoff resets once fn
+// has stayed up for longer than the maximum backoff.
+func Supervise(name string, fn func()) {
+	go func() {
+		backoff := supervisorMinBackoff
+		for {
+			started := time.Now()
+			runSupervised(name, fn)
+
+			if time.Since(started) > supervisorMaxBackoff {
+				backoff = supervisorMinBackoff
+			}
+			goroutineRestarts.Inc()
+			fmt.Printf("Restarting %s in %v\n", name, backoff)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, supervisorMaxBackoff)
+		}
+	}()
+}
+
+func runSupervised(name string, fn func()) {
+	defer RecoverPanic(name, nil)
+	fn()
+}
+
+// RecoverPanic reports a panic instead of letting it crash the process. It
+// must be deferred directly, e.g. `defer RecoverPanic("bot", nil)`.
+func RecoverPanic(component string, details map[string]string) {
+	if recovered := recover(); recovered != nil {
+		ReportPanic(recovered, component, details)
+	}
+}
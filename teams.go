@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"net/http"
+	"strings"
+)
+
+var teamSchema = Schema{
+	Tables: []string{"team_member"},
+	DDLs: []string{
+		`CREATE TABLE IF NOT EXISTS team_member (
+       pubkey text NOT NULL PRIMARY KEY,
+       owner text NOT NULL,
+       accepted boolean NOT NULL,
+       added_at bigint NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS teammemberowneridx ON team_member(owner)`,
+	},
+}
+
+// A team is an owner pubkey whose balance pays for the events of its
+// members, so an organization can fund several staff keys from one top-up.
+// Members' own credits stay on their own balance and are only drawn on again
+// once they leave the team. Owners can only invite members, who have to
+// accept with "team join" before their billing moves; the operator can add
+// members directly.
+type TeamMember struct {
+	PubKey   string          `json:"pubkey"`
+	Owner    string          `json:"owner"`
+	Accepted bool            `json:"accepted"`
+	AddedAt  nostr.Timestamp `json:"added_at"`
+}
+
+var teamMembersAdded = NewCounter("ppe_team_members_added_total", "Pubkeys added to a team.")
+
+// GetBillingPubKey is the pubkey whose balance pays for pubkey's events: its
+// team owner, whoever gave it an allowance that isn't used up yet, the
+// account of its pool while that has a balance, or itself.
+func GetBillingPubKey(pubkey string, db Database) string {
+	payer, _ := ResolveBilling(pubkey, db)
+	return payer
+}
+
+// ResolveBilling is GetBillingPubKey, also returning the allowance when
+// that's what pays.
+func ResolveBilling(pubkey string, db Database) (string, *Allowance) {
+	if owner := GetTeamOwner(pubkey, db); owner != "" {
+		return owner, nil
+	}
+	if allowance := GetAllowance(pubkey, db); allowance != nil {
+		return allowance.Owner, allowance
+	}
+	if name := GetMemberPool(pubkey, db); name != "" && GetLedgerBalanceMsat(PoolAccount(name), db) > 0 {
+		return PoolAccount(name), nil
+	}
+	return pubkey, nil
+}
+
+// GetTeamOwner returns the owner of the team pubkey is on, or "".
+func GetTeamOwner(pubkey string, db Database) string {
+	var owner string
+	err := db.DB.QueryRow(`SELECT owner FROM team_member WHERE pubkey = ? AND accepted`, pubkey).Scan(&owner)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		ReportError(err, "teams", map[string]string{"pubkey": pubkey})
+	}
+	return owner
+}
+
+// AddTeamMember adds member to owner's team, or only invites them unless
+// accepted is set.
+func AddTeamMember(owner string, member string, accepted bool, db Database) error {
+	if owner == member {
+		return errors.New("you can't add yourself")
+	}
+	if GetTeamOwner(owner, db) != "" {
+		return errors.New("members of a team can't have members of their own")
+	}
+	var count int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM team_member WHERE owner = ? AND accepted`, member).Scan(&count)
+	if count > 0 {
+		return errors.New("that pubkey already funds a team")
+	}
+
+	// a pending invitation can be replaced by another one, an accepted
+	// membership only by the same owner
+	result, err := db.DB.Exec(
+		`INSERT INTO team_member (pubkey, owner, accepted, added_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (pubkey) DO UPDATE SET owner = excluded.owner, accepted = excluded.accepted OR team_member.accepted, added_at = excluded.added_at
+		 WHERE NOT team_member.accepted OR team_member.owner = excluded.owner`,
+		member, owner, accepted, NowTimestamp(),
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("that pubkey is already on another team")
+	}
+	if accepted {
+		teamMembersAdded.Inc()
+	}
+	return nil
+}
+
+// JoinTeam accepts owner's invitation.
+func JoinTeam(member string, owner string, db Database) error {
+	var count int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM team_member WHERE owner = ? AND accepted`, member).Scan(&count)
+	if count > 0 {
+		return errors.New("you already fund a team of your own")
+	}
+	result, err := db.DB.Exec(`UPDATE team_member SET accepted = true WHERE pubkey = ? AND owner = ?`, member, owner)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("you weren't invited to that team")
+	}
+	teamMembersAdded.Inc()
+	return nil
+}
+
+func RemoveTeamMember(owner string, member string, db Database) error {
+	result, err := db.DB.Exec(`DELETE FROM team_member WHERE pubkey = ? AND owner = ?`, member, owner)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("that pubkey isn't on your team")
+	}
+	return nil
+}
+
+func GetTeamMembers(owner string, db Database) ([]TeamMember, error) {
+	rows, err := db.DB.Query(`SELECT pubkey, owner, accepted, added_at FROM team_member WHERE owner = ? ORDER BY added_at`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []TeamMember
+	for rows.Next() {
+		var member TeamMember
+		if err := rows.Scan(&member.PubKey, &member.Owner, &member.Accepted, &member.AddedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// HandleTeamCommand answers "team", "team add <npub>", "team remove <npub>",
+// "team join <npub>" and "team leave".
+func HandleTeamCommand(pubkey string, args []string, db Database) string {
+	if len(args) == 0 {
+		if owner := GetTeamOwner(pubkey, db); owner != "" {
+			npub, _ := nip19.EncodePublicKey(owner)
+			return fmt.Sprintf("Your events are paid for by nostr:%s. Send \"team leave\" to pay for them yourself again.", npub)
+		}
+		members, err := GetTeamMembers(pubkey, db)
+		if err != nil {
+			ReportError(err, "teams", map[string]string{"pubkey": pubkey})
+			return "Couldn't look up your team, try again later."
+		}
+		if len(members) == 0 {
+			return "You don't have a team. Add someone with team add <npub> and your balance pays for their events."
+		}
+		var npubs []string
+		for _, member := range members {
+			npub, _ := nip19.EncodePublicKey(member.PubKey)
+			if !member.Accepted {
+				npub += " (invited)"
+			}
+			npubs = append(npubs, "nostr:"+npub)
+		}
+		return fmt.Sprintf("Your balance pays for %s.", strings.Join(npubs, ", "))
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "leave":
+		owner := GetTeamOwner(pubkey, db)
+		if owner == "" {
+			return "You're not on a team."
+		}
+		if err := RemoveTeamMember(owner, pubkey, db); err != nil {
+			return fmt.Sprintf("Couldn't leave the team: %v.", err)
+		}
+		return "You left the team, your events are paid from your own balance again."
+	case "add", "remove", "join":
+		action := strings.ToLower(args[0])
+		if len(args) != 2 {
+			return fmt.Sprintf("Usage: team %s <npub>", action)
+		}
+		other, err := ParsePubKey(strings.TrimPrefix(args[1], "nostr:"))
+		if err != nil {
+			return fmt.Sprintf("Invalid pubkey: %v.", err)
+		}
+		switch action {
+		case "add":
+			err = AddTeamMember(pubkey, other, false, db)
+		case "remove":
+			err = RemoveTeamMember(pubkey, other, db)
+		case "join":
+			err = JoinTeam(pubkey, other, db)
+		}
+		if err != nil {
+			return fmt.Sprintf("Couldn't %s %s: %v.", action, args[1], err)
+		}
+		switch action {
+		case "add":
+			npub, _ := nip19.EncodePublicKey(pubkey)
+			return fmt.Sprintf("Invited %s. Once they send \"team join %s\", your balance pays for their events.", args[1], npub)
+		case "join":
+			return fmt.Sprintf("You joined the team, %s now pays for your events.", args[1])
+		}
+		return fmt.Sprintf("Removed %s from your team.", args[1])
+	}
+	return "Usage: team [add|remove|join <npub>|leave]"
+}
+
+// HandleAdminTeams serves /admin/teams: GET ?owner=<pubkey> lists a team's
+// members, POST and DELETE with {"owner", "member"} change them.
+func HandleAdminTeams(w http.ResponseWriter, r *http.Request, db Database) {
+	switch r.Method {
+	case http.MethodGet:
+		owner, err := ParsePubKey(r.URL.Query().Get("owner"))
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid owner: %v", err))
+			return
+		}
+		members, err := GetTeamMembers(owner, db)
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]any{
+			"owner":        owner,
+			"balance_sats": GetRemainingUserBalance(owner, db),
+			"members":      members,
+		})
+	case http.MethodPost, http.MethodDelete:
+		var request struct {
+			Owner  string `json:"owner"`
+			Member string `json:"member"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteJSONError(w, http.StatusBadRequest, "invalid json body")
+			return
+		}
+		owner, err := ParsePubKey(request.Owner)
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid owner: %v", err))
+			return
+		}
+		member, err := ParsePubKey(request.Member)
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid member: %v", err))
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			err = AddTeamMember(owner, member, true, db)
+		} else {
+			err = RemoveTeamMember(owner, member, db)
+		}
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]string{"owner": owner, "member": member})
+	default:
+		WriteJSONError(w, http.StatusMethodNotAllowed, "use GET, POST or DELETE")
+	}
+}
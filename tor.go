@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// hiddenServiceIP stands in for the address of connections arriving through
+// a hidden service listener, which all come from the local Tor or I2P
+// daemon.
+const hiddenServiceIP = "hidden-service"
+
+var (
+	hiddenServiceListeners []string
+	hiddenServiceAddresses []string
+)
+
+// ConfigureHiddenServices reads HIDDEN_SERVICE_LISTEN, local addresses to
+// also serve the relay on for a Tor HiddenServicePort or an I2P server
+// tunnel to point at, and HIDDEN_SERVICE_ADDRESSES, the .onion and .i2p
+// hostnames to advertise. SOCKS_PROXY (e.g. socks5h://127.0.0.1:9050) sends
+// the relay's own HTTP requests, LNURL and NIP-05 lookups among them,
+// through Tor.
+//
+// go-nostr dials upstream relays itself without a way to pass it a dialer,
+// so the pool and the bot only go through the proxy when the whole process
+// is run under torsocks.
+func ConfigureHiddenServices() error {
+	hiddenServiceListeners = GetEnvList("HIDDEN_SERVICE_LISTEN", nil)
+	hiddenServiceAddresses = GetEnvList("HIDDEN_SERVICE_ADDRESSES", nil)
+
+	value := GetEnvDefault("SOCKS_PROXY", "")
+	if value == "" {
+		return nil
+	}
+	proxy, err := url.Parse(value)
+	if err != nil || (proxy.Scheme != "socks5" && proxy.Scheme != "socks5h") {
+		return fmt.Errorf("SOCKS_PROXY must be a socks5:// or socks5h:// URL, got %q", value)
+	}
+	http.DefaultTransport.(*http.Transport).Proxy = http.ProxyURL(proxy)
+	return nil
+}
+
+// StartHiddenServices serves handler on every HIDDEN_SERVICE_LISTEN address.
+func StartHiddenServices(handler http.Handler) {
+	for _, address := range hiddenServiceListeners {
+		Supervise("hidden service on "+address, func() {
+			if err := http.ListenAndServe(address, ServeHiddenService(handler)); err != nil {
+				ReportError(err, "tor", map[string]string{"address": address})
+			}
+		})
+	}
+}
+
+// ServeHiddenService marks requests as coming from the hidden service. Their
+// remote address is the local daemon's, and any X-Forwarded-For is made up
+// by the client, so IP rate limits don't apply to them; the per-pubkey
+// limits still do.
+//
+// NIP-42 AUTH is checked against the address the relay was first reached
+// at, which should be the clearnet one, so clients that only know the
+// hidden service can't authenticate.
+func ServeHiddenService(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("X-Forwarded-For")
+		r.RemoteAddr = hiddenServiceIP + ":0"
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// onionLocation is the Onion-Location header value pointing Tor Browser
+// users at the .onion address, if one is advertised.
+func onionLocation() string {
+	for _, address := range hiddenServiceAddresses {
+		if strings.HasSuffix(address, ".onion") {
+			return "http://" + address + "/"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PublicStats are the aggregate numbers anyone can see at /stats to judge
+// the relay before paying for it. Nothing in them identifies a user.
+type PublicStats struct {
+	Events           int64   `json:"events"`
+	EventsLastDay    int64   `json:"events_last_day"`
+	Users            int64   `json:"users"`
+	PayingUsers      int64   `json:"paying_users"`
+	AveragePriceMsat int64   `json:"average_price_msat"`
+	UptimeSeconds    int64   `json:"uptime_seconds"`
+	StartedAt        int64   `json:"started_at"`
+	DryRun           bool    `json:"dry_run,omitempty"`
+	UptimeDays       float64 `json:"-"`
+}
+
+// publicStatsTTL keeps /stats from counting the whole event table on every
+// request.
+const publicStatsTTL = time.Minute
+
+var (
+	startedAt = time.Now()
+
+	publicStats        PublicStats
+	publicStatsUpdated time.Time
+	publicStatsMutex   sync.Mutex
+)
+
+// GetPublicStats computes the stats, or returns them from the last minute.
+// The average price is over events charged in the last 30 days.
+func GetPublicStats(db Database) (PublicStats, error) {
+	publicStatsMutex.Lock()
+	defer publicStatsMutex.Unlock()
+
+	if time.Since(publicStatsUpdated) > publicStatsTTL {
+		var stats PublicStats
+		now := time.Now()
+		queries := []struct {
+			query string
+			args  []any
+			dest  []any
+		}{
+			{`SELECT COUNT(*), COUNT(DISTINCT pubkey) FROM event`, nil, []any{&stats.Events, &stats.Users}},
+			{`SELECT COUNT(*) FROM event WHERE created_at >= ?`, []any{now.Add(-24 * time.Hour).Unix()}, []any{&stats.EventsLastDay}},
+			{`SELECT COUNT(DISTINCT pubkey) FROM zap_credit`, nil, []any{&stats.PayingUsers}},
+			{`SELECT COALESCE(CAST(AVG(amount_msat) AS bigint), 0) FROM debit WHERE id LIKE 'event:%' AND amount_msat > 0 AND created_at >= ?`,
+				[]any{now.AddDate(0, 0, -30).Unix()}, []any{&stats.AveragePriceMsat}},
+		}
+		for _, q := range queries {
+			if err := db.DB.QueryRow(q.query, q.args...).Scan(q.dest...); err != nil {
+				return stats, err
+			}
+		}
+		stats.StartedAt = startedAt.Unix()
+		stats.DryRun = dryRun
+
+		publicStats = stats
+		publicStatsUpdated = now
+	}
+
+	stats := publicStats
+	stats.UptimeSeconds = int64(time.Since(startedAt).Seconds())
+	stats.UptimeDays = time.Since(startedAt).Hours() / 24
+	return stats, nil
+}
+
+var publicStatsPage = template.Must(template.New("stats").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}} stats</title>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<table>
+<tr><td>Events stored</td><td>{{.Stats.Events}}</td></tr>
+<tr><td>Events in the last day</td><td>{{.Stats.EventsLastDay}}</td></tr>
+<tr><td>Users</td><td>{{.Stats.Users}}</td></tr>
+<tr><td>Paying users</td><td>{{.Stats.PayingUsers}}</td></tr>
+<tr><td>Average price per event</td><td>{{.Stats.AveragePriceMsat}} msat</td></tr>
+<tr><td>Up for</td><td>{{printf "%.1f" .Stats.UptimeDays}} days</td></tr>
+</table>
+<p><a href="/stats?format=json">JSON</a></p>
+</body>
+</html>
+`))
+
+// HandlePublicStats serves /stats as HTML to browsers and as JSON otherwise
+// (or with ?format=json).
+func HandlePublicStats(w http.ResponseWriter, r *http.Request, db Database) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	stats, err := GetPublicStats(db)
+	if err != nil {
+		ReportError(err, "stats", nil)
+		WriteJSONError(w, http.StatusInternalServerError, "stats are unavailable")
+		return
+	}
+
+	if r.URL.Query().Get("format") != "json" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		publicStatsPage.Execute(w, map[string]any{"Name": relay.Info.Name, "Stats": stats})
+		return
+	}
+	WriteJSON(w, http.StatusOK, stats)
+}
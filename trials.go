@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip05"
+	"github.com/nbd-wtf/go-nostr/nip13"
+	"slices"
+	"sync"
+	"time"
+)
+
+type TrialConfig struct {
+	Credits       int64
+	Methods       []string
+	PowDifficulty int
+	MaxPerDomain  int
+	DepositSats   int64
+	Recheck       time.Duration
+}
+
+var (
+	trialsGranted = NewCounter("ppe_trials_granted_total", "Trial credits granted to newly verified pubkeys.")
+
+	// trialChecks are when pubkeys were last checked upstream for a trial,
+	// so one that didn't qualify isn't checked again on every event, and at
+	// most maxTrialChecks run at a time.
+	trialChecks       = make(map[string]time.Time)
+	trialChecksMutex  sync.Mutex
+	trialChecksPrune  time.Time
+	trialChecksActive int
+	maxTrialChecks    = 8
+)
+
+// GrantTrialCredits is a RejectEvent policy that never rejects: when a pubkey
+// that never had a trial shows up, it checks the configured verification
+// methods in order and credits the trial to the first one that passes.
+//
+// Methods are "pow" (the event itself carries enough NIP-13 work), "nip05"
+// (the profile's NIP-05 resolves back to the pubkey, with a cap on trials per
+// domain) and "deposit" (the pubkey already zapped at least the deposit; it
+// stays on their balance, so the deposit is effectively refunded as credits).
+// Proof of work is checked on the spot, so the balance check further down
+// the chain already sees the trial. The others need lookups upstream and run
+// in the background, at most once per TRIAL_RECHECK for a pubkey that
+// doesn't qualify, the trial being there for its next event.
+func GrantTrialCredits(config TrialConfig, db Database) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if HasTrialCredits(event.PubKey, db) {
+			return false, ""
+		}
+		if slices.Contains(config.Methods, "pow") && nip13.Difficulty(event.ID) >= config.PowDifficulty {
+			if err := RecordTrialCredits(event.PubKey, "pow", "", config.Credits, db); err != nil {
+				ReportError(err, "trials", map[string]string{"pubkey": event.PubKey, "method": "pow"})
+			}
+			return false, ""
+		}
+		if startTrialCheck(event.PubKey, config.Recheck) {
+			go checkTrialUpstream(event.PubKey, config, db)
+		}
+		return false, ""
+	}
+}
+
+// startTrialCheck reports whether pubkey is due a check upstream, noting
+// that it's being checked.
+func startTrialCheck(pubkey string, recheck time.Duration) bool {
+	now := time.Now()
+	trialChecksMutex.Lock()
+	defer trialChecksMutex.Unlock()
+	if now.Sub(trialChecksPrune) > recheck {
+		for checked, at := range trialChecks {
+			if now.Sub(at) >= recheck {
+				delete(trialChecks, checked)
+			}
+		}
+		trialChecksPrune = now
+	}
+	if at, ok := trialChecks[pubkey]; (ok && now.Sub(at) < recheck) || trialChecksActive >= maxTrialChecks {
+		return false
+	}
+	trialChecks[pubkey] = now
+	trialChecksActive++
+	return true
+}
+
+// checkTrialUpstream runs the verification methods needing lookups
+// upstream, crediting the trial to the first that passes.
+func checkTrialUpstream(pubkey string, config TrialConfig, db Database) {
+	defer func() {
+		trialChecksMutex.Lock()
+		trialChecksActive--
+		trialChecksMutex.Unlock()
+	}()
+
+	for _, method := range config.Methods {
+		domain := ""
+		verified := false
+
+		switch method {
+		case "nip05":
+			domain, verified = VerifyNIP05(pubkey)
+			verified = verified && CountTrialsForDomain(domain, db) < config.MaxPerDomain
+		case "deposit":
+			verified = GetZapsTotalFromUser(pubkey, db) >= config.DepositSats
+		}
+
+		if verified {
+			if err := RecordTrialCredits(pubkey, method, domain, config.Credits, db); err != nil {
+				ReportError(err, "trials", map[string]string{"pubkey": pubkey, "method": method})
+			}
+			return
+		}
+	}
+}
+
+// VerifyNIP05 checks the pubkey's latest upstream profile for a NIP-05
+// identifier that points back at it, returning the identifier's domain.
+func VerifyNIP05(pubkey string) (domain string, verified bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var profile *nostr.Event
+	for event := range pool.SubManyEose(ctx, relays, []nostr.Filter{{Kinds: []int{nostr.KindProfileMetadata}, Authors: []string{pubkey}}}) {
+		if profile == nil || event.CreatedAt > profile.CreatedAt {
+			profile = event.Event
+		}
+	}
+	if profile == nil {
+		return "", false
+	}
+
+	var metadata struct {
+		NIP05 string `json:"nip05"`
+	}
+	if err := json.Unmarshal([]byte(profile.Content), &metadata); err != nil || metadata.NIP05 == "" {
+		return "", false
+	}
+
+	_, domain, err := nip05.ParseIdentifier(metadata.NIP05)
+	if err != nil {
+		return "", false
+	}
+	pointer, err := nip05.QueryIdentifier(ctx, metadata.NIP05)
+	if err != nil || pointer == nil || pointer.PublicKey != pubkey {
+		return "", false
+	}
+	return domain, true
+}
+
+func HasTrialCredits(pubkey string, db Database) bool {
+	var count int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM trial_credit WHERE pubkey = ?`, pubkey).Scan(&count)
+	return count > 0
+}
+
+func CountTrialsForDomain(domain string, db Database) int {
+	var count int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM trial_credit WHERE domain = ?`, domain).Scan(&count)
+	return count
+}
+
+func RecordTrialCredits(pubkey string, method string, domain string, sats int64, db Database) error {
+	granted, err := GetLedger(db).CreditTrial(pubkey, method, domain, sats*1000)
+	if err != nil {
+		return err
+	}
+	if granted {
+		trialsGranted.Inc()
+	}
+	return nil
+}
+
+func GetTrialConfig() TrialConfig {
+	config := TrialConfig{
+		Credits:       int64(GetEnvInt("TRIAL_CREDITS", 0)),
+		Methods:       GetEnvList("TRIAL_VERIFICATION", []string{"pow", "nip05", "deposit"}),
+		PowDifficulty: GetEnvInt("TRIAL_POW_DIFFICULTY", 20),
+		MaxPerDomain:  GetEnvInt("TRIAL_MAX_PER_DOMAIN", 5),
+		DepositSats:   int64(GetEnvInt("TRIAL_DEPOSIT", 21)),
+		Recheck:       GetEnvDuration("TRIAL_RECHECK", time.Hour),
+	}
+	config.Methods = slices.DeleteFunc(config.Methods, func(method string) bool {
+		return method != "pow" && method != "nip05" && method != "deposit"
+	})
+	return config
+}
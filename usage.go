@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type usageKey struct {
+	day    string
+	pubkey string
+	ip     string
+}
+
+type usageTotals struct {
+	Events int64 `json:"events"`
+	Bytes  int64 `json:"bytes"`
+}
+
+type ReadUsage struct {
+	Subject string `json:"subject"`
+	usageTotals
+}
+
+var (
+	pendingUsage      = make(map[usageKey]*usageTotals)
+	pendingUsageMutex sync.Mutex
+
+	eventsServed = NewCounter("ppe_events_served_total", "Events sent to clients in response to REQs.")
+	bytesServed  = NewCounter("ppe_bytes_served_total", "Bytes of event JSON sent to clients in response to REQs.")
+)
+
+// TrackReadUsage wraps a QueryEvents handler so every event served is
+// attributed to the requesting connection's hashed IP and authenticated
+// pubkey.
+// Totals are kept in memory and flushed to the ledger by FlushReadUsage.
+func TrackReadUsage(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		results, err := query(ctx, filter)
+		if err != nil || khatru.GetConnection(ctx) == nil {
+			return results, err
+		}
+
+		key := usageKey{
+			day:    time.Now().UTC().Format("2006-01-02"),
+			pubkey: khatru.GetAuthed(ctx),
+			ip:     HashIP(khatru.GetIP(ctx)),
+		}
+
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+
+			var events, bytes int64
+			for event := range results {
+				events++
+				bytes += int64(len(event.String()))
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					for range results {
+					}
+					return
+				}
+			}
+			if events == 0 {
+				return
+			}
+
+			eventsServed.Add(events)
+			bytesServed.Add(bytes)
+
+			pendingUsageMutex.Lock()
+			totals, ok := pendingUsage[key]
+			if !ok {
+				totals = &usageTotals{}
+				pendingUsage[key] = totals
+			}
+			totals.Events += events
+			totals.Bytes += bytes
+			pendingUsageMutex.Unlock()
+		}()
+		return ch, nil
+	}
+}
+
+func RunReadUsageFlusher(db Database) {
+	for {
+		time.Sleep(time.Minute)
+		FlushReadUsage(db)
+	}
+}
+
+func FlushReadUsage(db Database) {
+	pendingUsageMutex.Lock()
+	usage := pendingUsage
+	pendingUsage = make(map[usageKey]*usageTotals)
+	pendingUsageMutex.Unlock()
+
+	for key, totals := range usage {
+		_, err := db.DB.Exec(
+			`INSERT INTO read_usage (day, pubkey, ip, events, bytes) VALUES (?, ?, ?, ?, ?)
+			 ON CONFLICT(day, pubkey, ip) DO UPDATE SET events = read_usage.events + excluded.events, bytes = read_usage.bytes + excluded.bytes`,
+			key.day, key.pubkey, key.ip, totals.Events, totals.Bytes,
+		)
+		if err != nil {
+			ReportError(err, "usage", map[string]string{"day": key.day})
+		}
+	}
+}
+
+// GetTopReaders sums read usage over the last days, grouped by "pubkey" or
+// "ip", heaviest readers first.
+func GetTopReaders(by string, days int, limit int, db Database) ([]ReadUsage, error) {
+	column := "ip"
+	if by == "pubkey" {
+		column = "pubkey"
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Format("2006-01-02")
+
+	var usage []ReadUsage
+	rows, err := db.DB.Query(fmt.Sprintf(
+		`SELECT %s, SUM(events), SUM(bytes) FROM read_usage WHERE day >= ? GROUP BY %s ORDER BY SUM(bytes) DESC LIMIT ?`,
+		column, column,
+	), since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry ReadUsage
+		if err := rows.Scan(&entry.Subject, &entry.Events, &entry.Bytes); err != nil {
+			return nil, err
+		}
+		usage = append(usage, entry)
+	}
+	return usage, rows.Err()
+}
+
+func HandleAdminUsage(w http.ResponseWriter, r *http.Request, db Database) {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days < 1 {
+		days = 1
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 50
+	}
+
+	// include what hasn't been flushed yet
+	FlushReadUsage(db)
+
+	usage, err := GetTopReaders(r.URL.Query().Get("by"), days, limit, db)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, usage)
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"errors"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func GetEnv(key string) string {
@@ -15,11 +19,77 @@ func GetEnv(key string) string {
 	return value
 }
 
+// ValueFromTag returns the value of the event's first key tag. Tags without
+// a value don't count, as upstream events can have any tags at all.
 func ValueFromTag(event *nostr.Event, key string) (*string, error) {
 	for _, tag := range event.Tags {
-		if tag[0] == key {
+		if len(tag) >= 2 && tag[0] == key {
 			return &tag[1], nil
 		}
 	}
 	return nil, errors.New("tag not found")
 }
+
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Environment variable %s is not a valid duration: %v", key, err)
+	}
+	return duration
+}
+
+func GetEnvInt(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Environment variable %s is not a valid number: %v", key, err)
+	}
+	return number
+}
+
+func GetEnvDefault(key string, fallback string) string {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	return value
+}
+
+// ParsePubKey accepts either a hex public key or an npub.
+func ParsePubKey(value string) (string, error) {
+	if strings.HasPrefix(value, "npub1") {
+		prefix, decoded, err := nip19.Decode(value)
+		if err != nil {
+			return "", err
+		} else if prefix != "npub" {
+			return "", errors.New("not an npub")
+		}
+		return decoded.(string), nil
+	}
+	if !nostr.IsValidPublicKey(value) {
+		return "", errors.New("invalid public key")
+	}
+	return value, nil
+}
+
+func GetEnvList(key string, fallback []string) []string {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
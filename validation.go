@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventValidation is what ValidateEvent holds events to before anything
+// else looks at them, billing included: a valid pubkey, a correct id and
+// signature, a created_at no more than FutureSkew ahead or before
+// MinCreatedAt, and well formed tags, no more than MaxTags of them.
+type EventValidation struct {
+	FutureSkew   time.Duration
+	MinCreatedAt nostr.Timestamp
+	MaxTags      int
+}
+
+// validationChecks are the checks events go through, in order, by the name
+// failures are counted under.
+var validationChecks = []string{"pubkey", "id", "signature", "created_at", "tags"}
+
+var (
+	eventsValidated   = NewCounter("ppe_events_validated_total", "Events that passed validation.")
+	validationFailure = NewCounterVec("ppe_event_validation_failures_total", "Events rejected by validation, by the check they failed.", "check")
+)
+
+// GetEventValidation reads EVENT_FUTURE_SKEW, EVENT_MIN_CREATED_AT, a date
+// (YYYY-MM-DD) or unix timestamp before which nostr events can't have been
+// made, and EVENT_MAX_TAGS.
+func GetEventValidation() EventValidation {
+	validation := EventValidation{
+		FutureSkew: GetEnvDuration("EVENT_FUTURE_SKEW", 15*time.Minute),
+		MaxTags:    GetEnvInt("EVENT_MAX_TAGS", 2000),
+	}
+	value := GetEnvDefault("EVENT_MIN_CREATED_AT", "2020-01-01")
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		validation.MinCreatedAt = nostr.Timestamp(date.Unix())
+	} else if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		validation.MinCreatedAt = nostr.Timestamp(unix)
+	} else {
+		panic(fmt.Sprintf("EVENT_MIN_CREATED_AT must be a date or a unix timestamp, got %q", value))
+	}
+	return validation
+}
+
+// ValidateEvent is a RejectEvent policy running the validation checks,
+// rejecting events with the first one they fail.
+func ValidateEvent(v EventValidation) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		for _, check := range validationChecks {
+			if err := v.check(check, event); err != nil {
+				validationFailure.Inc(check)
+				return true, RejectInvalid + ": " + err.Error()
+			}
+		}
+		eventsValidated.Inc()
+		return false, ""
+	}
+}
+
+func (v EventValidation) check(check string, event *nostr.Event) error {
+	switch check {
+	case "pubkey":
+		if !nostr.IsValidPublicKey(event.PubKey) {
+			return errors.New("pubkey must be 64 lowercase hex characters")
+		}
+	case "id":
+		if event.GetID() != event.ID {
+			return errors.New("id is computed incorrectly")
+		}
+	case "signature":
+		if ok, _ := event.CheckSignature(); !ok {
+			return errors.New("signature is invalid")
+		}
+	case "created_at":
+		if limit := NowTimestamp() + nostr.Timestamp(v.FutureSkew.Seconds()); event.CreatedAt > limit {
+			return fmt.Errorf("created_at is more than %v in the future", v.FutureSkew)
+		}
+		if event.CreatedAt < v.MinCreatedAt {
+			return fmt.Errorf("created_at is before %s", v.MinCreatedAt.Time().UTC().Format("2006-01-02"))
+		}
+	case "tags":
+		if len(event.Tags) > v.MaxTags {
+			return fmt.Errorf("event has %d tags, can't have more than %d", len(event.Tags), v.MaxTags)
+		}
+		for i, tag := range event.Tags {
+			if err := validateTag(tag); err != nil {
+				return fmt.Errorf("tag %d: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateTag checks a tag has a name and, for the tags NIP-01 defines,
+// that its value is what they point at.
+func validateTag(tag nostr.Tag) error {
+	if len(tag) == 0 || tag[0] == "" {
+		return errors.New("tags must have a name")
+	}
+	if len(tag) < 2 {
+		return nil
+	}
+	switch tag[0] {
+	case "e":
+		if !nostr.IsValid32ByteHex(tag[1]) {
+			return errors.New("e tags must name an event id in hex")
+		}
+	case "p":
+		if !nostr.IsValidPublicKey(tag[1]) {
+			return errors.New("p tags must name a pubkey in hex")
+		}
+	case "a":
+		parts := strings.SplitN(tag[1], ":", 3)
+		if len(parts) != 3 || !nostr.IsValidPublicKey(parts[1]) {
+			return errors.New("a tags must be <kind>:<pubkey>:<d tag>")
+		}
+		if _, err := strconv.ParseUint(parts[0], 10, 16); err != nil {
+			return errors.New("a tags must be <kind>:<pubkey>:<d tag>")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"time"
+)
+
+var (
+	zapsMissing = NewCounter("ppe_zaps_missing_total", "Credited zap receipts found missing from upstream relays.")
+	zapsInvalid = NewCounter("ppe_zaps_invalid_total", "Credited zap receipts that failed settlement verification.")
+	zapsRevoked = NewCounter("ppe_zaps_revoked_total", "Zap credits clawed back by an operator.")
+)
+
+type StaleCredit struct {
+	ID           string
+	PubKey       string
+	AmountMsat   int64
+	MissingSince int64
+	Problem      string
+}
+
+func RunZapVerifier(db Database) {
+	interval := GetEnvDuration("ZAP_VERIFY_INTERVAL", 24*time.Hour)
+
+	for {
+		time.Sleep(interval)
+		VerifyZapCredits(db)
+	}
+}
+
+// VerifyZapCredits re-fetches every credited zap receipt from the upstream
+// relays. Receipts that can no longer be found, or whose invoice doesn't match
+// the receipt's settlement proof, are flagged for review; flagged credits keep
+// counting towards the balance until an operator claws them back.
+func VerifyZapCredits(db Database) {
+	var ids []string
+	err := db.DB.Select(&ids, `SELECT id FROM zap_credit WHERE id NOT IN (SELECT id FROM zap_revocation)`)
+	if err != nil {
+		ReportError(err, "verifier", nil)
+		return
+	}
+
+	ctx := context.Background()
+	now := nostr.Now()
+
+	for start := 0; start < len(ids); start += 500 {
+		batch := ids[start:min(start+500, len(ids))]
+
+		found := make(map[string]*nostr.Event)
+		for event := range pool.SubManyEose(ctx, relays, []nostr.Filter{{IDs: batch}}) {
+			found[event.ID] = event.Event
+		}
+
+		for _, id := range batch {
+			event, ok := found[id]
+			if !ok {
+				zapsMissing.Inc()
+				db.DB.Exec(
+					`INSERT INTO zap_check (id, checked_at, missing_since, problem) VALUES (?, ?, ?, 'missing from upstream relays')
+					 ON CONFLICT(id) DO UPDATE SET checked_at = excluded.checked_at, missing_since = COALESCE(zap_check.missing_since, excluded.missing_since), problem = excluded.problem`,
+					id, now, now,
+				)
+				continue
+			}
+
+			problem := ""
+			if _, err := GetZapVerifier().Verify(event); err != nil {
+				zapsInvalid.Inc()
+				problem = err.Error()
+			}
+			db.DB.Exec(
+				`INSERT INTO zap_check (id, checked_at, missing_since, problem) VALUES (?, ?, NULL, ?)
+				 ON CONFLICT(id) DO UPDATE SET checked_at = excluded.checked_at, missing_since = NULL, problem = excluded.problem`,
+				id, now, problem,
+			)
+		}
+	}
+
+	fmt.Printf("verified %d zap credits\n", len(ids))
+}
+
+func GetStaleCredits(db Database) ([]StaleCredit, error) {
+	var credits []StaleCredit
+	rows, err := db.DB.Query(
+		`SELECT c.id, c.pubkey, c.amount_msat, COALESCE(k.missing_since, 0), k.problem
+		 FROM zap_credit c JOIN zap_check k ON k.id = c.id
+		 WHERE k.problem != '' AND c.id NOT IN (SELECT id FROM zap_revocation)
+		 ORDER BY c.created_at`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var credit StaleCredit
+		if err := rows.Scan(&credit.ID, &credit.PubKey, &credit.AmountMsat, &credit.MissingSince, &credit.Problem); err != nil {
+			return nil, err
+		}
+		credits = append(credits, credit)
+	}
+	return credits, rows.Err()
+}
+
+func RevokeZapCredit(id string, reason string, db Database) error {
+	revoked, err := GetLedger(db).RevokeZap(id, reason)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return fmt.Errorf("no active credit with id %s", id)
+	}
+	zapsRevoked.Inc()
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"os"
+	"sync"
+	"time"
+)
+
+// PolicyModule is policy logic compiled to WebAssembly, for community
+// policies an operator would rather not run as a native plugin: a module
+// only sees what the host API hands it, in a memory of its own, with no
+// filesystem, network or clock beyond WASI's stubs.
+//
+// A module exports
+//
+//	alloc(size i32) i32                 memory for the host to write input to
+//	reject(ptr i32, len i32) i64        0 to accept, or ptr<<32 | len of a message to reject with
+//	price(ptr i32, len i32) i64         the price in msat, or a negative number to keep it
+//
+// defining reject, price or both. The input is a JSON object with the event,
+// its author, the author's account (as in PolicyScript) and, for price, the
+// msat it would cost. Modules can import from "ppe"
+//
+//	balance(ptr i32, len i32) i64       the recorded balance of a hex pubkey, or -1
+//	log(ptr i32, len i32)               print a message
+//
+// Every call gets a fresh instance, cut off after Timeout.
+type PolicyModule struct {
+	Path    string
+	Timeout time.Duration
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	reject   bool
+	price    bool
+}
+
+// ModulePricer charges what the modules' price functions make of Inner's
+// price, each getting the one before's. A module that fails leaves the
+// price as it was.
+type ModulePricer struct {
+	Modules []*PolicyModule
+	Inner   Pricer
+}
+
+// policyInput is what WASM modules and the HTTP policy hook are told about
+// an event.
+type policyInput struct {
+	Event   *nostr.Event  `json:"event"`
+	Author  string        `json:"author"`
+	Account policyAccount `json:"account"`
+	Msat    *int64        `json:"msat,omitempty"`
+}
+
+type policyAccount struct {
+	PubKey            string `json:"pubkey"`
+	BalanceMsat       int64  `json:"balance_msat"`
+	StoredEvents      int64  `json:"stored_events"`
+	StoredBytes       int64  `json:"stored_bytes"`
+	AccountAgeDays    int64  `json:"account_age_days"`
+	LifetimeSpendMsat int64  `json:"lifetime_spend_msat"`
+}
+
+func newPolicyAccount(account BillingAccount) policyAccount {
+	return policyAccount{
+		PubKey:            account.PubKey,
+		BalanceMsat:       account.BalanceMsat,
+		StoredEvents:      account.StoredEvents,
+		StoredBytes:       account.StoredBytes,
+		AccountAgeDays:    account.AccountAgeDays,
+		LifetimeSpendMsat: account.LifetimeSpendMsat,
+	}
+}
+
+// moduleDatabaseKey carries the database to the balance host function. Price
+// calls don't have one, and already get the author's balance.
+type moduleDatabaseKey struct{}
+
+var (
+	policyModules     []*PolicyModule
+	policyModulesOnce sync.Once
+
+	moduleErrors = NewCounter("ppe_policy_module_errors_total", "Policy module calls that failed, trapped or ran out of time.")
+)
+
+// GetPolicyModules reads POLICY_MODULES, the paths of .wasm files,
+// MODULE_TIMEOUT and MODULE_MEMORY_MB, the most memory each instance can
+// grow to. They're compiled once; modules that don't compile or lack alloc
+// stop the relay from starting.
+func GetPolicyModules() []*PolicyModule {
+	policyModulesOnce.Do(func() {
+		paths := GetEnvList("POLICY_MODULES", nil)
+		if len(paths) == 0 {
+			return
+		}
+		ctx := context.Background()
+		config := wazero.NewRuntimeConfig().
+			WithCloseOnContextDone(true).
+			WithMemoryLimitPages(uint32(GetEnvInt("MODULE_MEMORY_MB", 16) * 16))
+		runtime := wazero.NewRuntimeWithConfig(ctx, config)
+		wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+		_, err := runtime.NewHostModuleBuilder("ppe").
+			NewFunctionBuilder().WithFunc(moduleBalance).Export("balance").
+			NewFunctionBuilder().WithFunc(moduleLog).Export("log").
+			Instantiate(ctx)
+		if err != nil {
+			panic(err)
+		}
+
+		timeout := GetEnvDuration("MODULE_TIMEOUT", 50*time.Millisecond)
+		for _, path := range paths {
+			module, err := loadPolicyModule(ctx, runtime, path, timeout)
+			if err != nil {
+				panic(fmt.Errorf("POLICY_MODULES: %s: %w", path, err))
+			}
+			policyModules = append(policyModules, module)
+		}
+	})
+	return policyModules
+}
+
+func loadPolicyModule(ctx context.Context, runtime wazero.Runtime, path string, timeout time.Duration) (*PolicyModule, error) {
+	binary, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := runtime.CompileModule(ctx, binary)
+	if err != nil {
+		return nil, err
+	}
+	exports := compiled.ExportedFunctions()
+	module := &PolicyModule{Path: path, Timeout: timeout, runtime: runtime, compiled: compiled}
+	_, module.reject = exports["reject"]
+	_, module.price = exports["price"]
+	if _, ok := exports["alloc"]; !ok {
+		return nil, errors.New("doesn't export alloc")
+	}
+	if !module.reject && !module.price {
+		return nil, errors.New("exports neither reject nor price")
+	}
+	return module, nil
+}
+
+// call runs function on a fresh instance with input in its memory, handing
+// the instance and the result to read before the instance is closed.
+func (m *PolicyModule) call(ctx context.Context, function string, input policyInput, read func(module api.Module, result uint64) error) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	module, err := m.runtime.InstantiateModule(ctx, m.compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return err
+	}
+	defer module.Close(context.Background())
+
+	encoded, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	allocated, err := module.ExportedFunction("alloc").Call(ctx, uint64(len(encoded)))
+	if err != nil {
+		return fmt.Errorf("alloc: %w", err)
+	}
+	ptr := uint32(allocated[0])
+	if !module.Memory().Write(ptr, encoded) {
+		return errors.New("alloc returned memory out of range")
+	}
+
+	results, err := module.ExportedFunction(function).Call(ctx, uint64(ptr), uint64(len(encoded)))
+	if err != nil {
+		return fmt.Errorf("%s: %w", function, err)
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("%s must return an i64", function)
+	}
+	return read(module, results[0])
+}
+
+// RejectWithModule is a RejectEvent policy calling the module's reject
+// function. The account's balance is as recorded, without looking upstream
+// for new zaps first. A module that fails lets the event through.
+func RejectWithModule(m *PolicyModule, db Database) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		author := GetEventAuthor(event)
+		input := policyInput{Event: event, Author: author, Account: newPolicyAccount(GetRecordedBillingAccount(author, db))}
+
+		err := m.call(context.WithValue(context.Background(), moduleDatabaseKey{}, db), "reject", input, func(module api.Module, result uint64) error {
+			if result == 0 {
+				return nil
+			}
+			reject = true
+			message, ok := module.Memory().Read(uint32(result>>32), uint32(result))
+			if !ok {
+				return errors.New("reject returned a message out of range")
+			}
+			msg = string(message)
+			return nil
+		})
+		if err != nil {
+			moduleErrors.Inc()
+			ReportError(err, "wasm", map[string]string{"module": m.Path, "event": event.ID})
+			return false, ""
+		}
+		if reject && msg == "" {
+			msg = RejectBlocked + ": rejected by policy"
+		}
+		return reject, msg
+	}
+}
+
+func (p ModulePricer) Price(event *nostr.Event, account BillingAccount) (int64, error) {
+	price, err := p.Inner.Price(event, account)
+	if err != nil {
+		return 0, err
+	}
+	for _, module := range p.Modules {
+		if !module.price {
+			continue
+		}
+		msat := price
+		input := policyInput{Event: event, Author: account.PubKey, Msat: &msat, Account: newPolicyAccount(account)}
+		err := module.call(context.Background(), "price", input, func(_ api.Module, result uint64) error {
+			if value := int64(result); value >= 0 {
+				price = value
+			}
+			return nil
+		})
+		if err != nil {
+			moduleErrors.Inc()
+			ReportError(err, "wasm", map[string]string{"module": module.Path, "event": event.ID})
+		}
+	}
+	return price, nil
+}
+
+func moduleBalance(ctx context.Context, module api.Module, ptr uint32, length uint32) int64 {
+	db, ok := ctx.Value(moduleDatabaseKey{}).(Database)
+	if !ok {
+		return -1
+	}
+	pubkey, ok := module.Memory().Read(ptr, length)
+	if !ok || !nostr.IsValidPublicKey(string(pubkey)) {
+		return -1
+	}
+	return GetLedgerBalanceMsat(GetBillingPubKey(string(pubkey), db), db)
+}
+
+func moduleLog(ctx context.Context, module api.Module, ptr uint32, length uint32) {
+	if message, ok := module.Memory().Read(ptr, length); ok {
+		fmt.Printf("wasm module: %s\n", message)
+	}
+}
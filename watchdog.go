@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// emergencyPruneBatch is how many events one emergency prune looks at of
+// each sort.
+const emergencyPruneBatch = 1000
+
+var (
+	// storageFull is set while free disk space or the database size is past
+	// its threshold, and new events are refused
+	storageFull atomic.Bool
+
+	storageBytes      = NewGaugeVec("ppe_storage_bytes", "Free disk space next to the database and the database's size.", "kind")
+	storageFullEvents = NewCounter("ppe_storage_full_total", "Times free disk space or the database size crossed its threshold.")
+	emergencyPruned   = NewCounter("ppe_emergency_pruned_events_total", "Expired and unpaid events deleted to free space.")
+)
+
+// ConfigureStorageWatchdog checks every minute that the disk holding
+// DISK_WATCH_PATH has DISK_MIN_FREE_MB left and that the database is under
+// DATABASE_MAX_SIZE_MB (0 for no limit). Past either, events are refused and
+// the operator is DMed until there's room again; with
+// DISK_EMERGENCY_PRUNE=true expired and unpaid events are deleted too.
+func ConfigureStorageWatchdog(db Database) {
+	path := GetEnvDefault("DISK_WATCH_PATH", "./db")
+	minFree := int64(GetEnvInt("DISK_MIN_FREE_MB", 500)) << 20
+	maxSize := int64(GetEnvInt("DATABASE_MAX_SIZE_MB", 0)) << 20
+	prune := GetEnvDefault("DISK_EMERGENCY_PRUNE", "") == "true"
+	if minFree <= 0 && maxSize <= 0 {
+		return
+	}
+
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if storageFull.Load() {
+			return true, "error: this relay is out of storage space, try again later"
+		}
+		return false, ""
+	})
+	Supervise("storage watchdog", func() { RunStorageWatchdog(path, minFree, maxSize, prune, db) })
+}
+
+func RunStorageWatchdog(path string, minFree int64, maxSize int64, prune bool, db Database) {
+	for {
+		CheckStorage(path, minFree, maxSize, prune, db)
+		time.Sleep(time.Minute)
+	}
+}
+
+func CheckStorage(path string, minFree int64, maxSize int64, prune bool, db Database) {
+	var problem string
+	if free, err := FreeDiskBytes(path); err != nil {
+		ReportError(err, "watchdog", map[string]string{"path": path})
+	} else {
+		storageBytes.Set("disk_free", free)
+		if minFree > 0 && free < minFree {
+			problem = fmt.Sprintf("only %d MB of disk space left", free>>20)
+		}
+	}
+	if size, err := DatabaseSizeBytes(db); err != nil {
+		ReportError(err, "watchdog", nil)
+	} else {
+		storageBytes.Set("database", size)
+		if maxSize > 0 && size > maxSize {
+			problem = fmt.Sprintf("the database is %d MB, over its %d MB limit", size>>20, maxSize>>20)
+		}
+	}
+
+	if problem == "" {
+		if storageFull.Swap(false) {
+			notifyOperator("Storage is back under its thresholds: "+relay.Info.Name+" accepts events again.", db)
+		}
+		return
+	}
+
+	if !storageFull.Swap(true) {
+		storageFullEvents.Inc()
+		ReportError(fmt.Errorf("refusing events: %s", problem), "watchdog", nil)
+		notifyOperator(fmt.Sprintf("%s is refusing new events: %s.", relay.Info.Name, problem), db)
+	}
+	if prune {
+		if deleted, err := EmergencyPrune(db); err != nil {
+			ReportError(err, "watchdog", nil)
+		} else if deleted > 0 {
+			fmt.Printf("emergency prune deleted %d events\n", deleted)
+		}
+	}
+}
+
+func notifyOperator(message string, db Database) {
+	if botPubkey == "" || relay.Info.PubKey == "" {
+		return
+	}
+	if err := SendDirectMessage(relay.Info.PubKey, message, db); err != nil {
+		ReportError(err, "watchdog", nil)
+	}
+}
+
+func FreeDiskBytes(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+func DatabaseSizeBytes(db Database) (int64, error) {
+	var size int64
+	if db.DB.DriverName() == "sqlite3" {
+		err := db.DB.Get(&size, `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`)
+		return size, err
+	}
+	err := db.DB.Get(&size, `SELECT pg_database_size(current_database())`)
+	return size, err
+}
+
+// EmergencyPrune deletes events whose NIP-40 expiration passed and events
+// that were never charged for from authors who've stopped paying, through
+// the relay's DeleteEvent handlers so the ledger stays right. Pinned events
+// are kept.
+func EmergencyPrune(db Database) (int, error) {
+	var ids []string
+
+	var expiring []struct {
+		ID   string     `db:"id"`
+		Tags nostr.Tags `db:"tags"`
+	}
+	err := db.DB.Select(&expiring, `SELECT id, tags FROM event WHERE CAST(tags AS text) LIKE '%"expiration"%' AND `+notPinned+` LIMIT ?`, emergencyPruneBatch)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	for _, event := range expiring {
+		if tag := event.Tags.GetFirst([]string{"expiration", ""}); tag != nil && len(*tag) >= 2 {
+			if expiration, err := strconv.ParseInt((*tag)[1], 10, 64); err == nil && expiration < now {
+				ids = append(ids, event.ID)
+			}
+		}
+	}
+
+	var unpaid []struct {
+		ID     string `db:"id"`
+		PubKey string `db:"pubkey"`
+	}
+	err = db.DB.Select(&unpaid, `SELECT id, pubkey FROM event WHERE NOT EXISTS (SELECT 1 FROM debit WHERE debit.id = 'event:' || event.id) AND `+notPinned+` LIMIT ?`, emergencyPruneBatch)
+	if err != nil {
+		return 0, err
+	}
+	paying := make(map[string]bool)
+	for _, event := range unpaid {
+		if event.PubKey == relay.Info.PubKey || event.PubKey == botPubkey {
+			continue
+		}
+		if _, ok := paying[event.PubKey]; !ok {
+			paying[event.PubKey] = IsPayingCustomer(event.PubKey, db)
+		}
+		if !paying[event.PubKey] {
+			ids = append(ids, event.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	result, err := PurgeEvents(PurgeCriteria{IDs: ids}, db, func(ctx context.Context, event *nostr.Event) error {
+		for _, del := range relay.DeleteEvent {
+			if err := del(ctx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	emergencyPruned.Add(int64(result.Deleted))
+	return result.Deleted, err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	webhookAttempts = 3
+	// webhookMaxRetries is how many failed deliveries can wait for a retry at
+	// once; past that they're given up on.
+	webhookMaxRetries = 1000
+)
+
+const (
+	WebhookPaymentReceived  = "payment.received"
+	WebhookNewUser          = "user.created"
+	WebhookBalanceExhausted = "balance.exhausted"
+	WebhookEventRejected    = "event.rejected"
+	WebhookEscrowHeld       = "escrow.held"
+)
+
+// webhookDelivery is one payload on its way to one URL.
+type webhookDelivery struct {
+	url     string
+	kind    string
+	body    []byte
+	attempt int
+}
+
+type WebhookPayload struct {
+	Type      string          `json:"type"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+	Data      any             `json:"data"`
+}
+
+var (
+	webhookURLs   []string
+	webhookSecret string
+	webhookTypes  []string
+	webhookQueue  = make(chan WebhookPayload, 1000)
+
+	// webhookRetries holds deliveries whose backoff is over, counted in
+	// webhookRetriesPending from when they're scheduled, so the channel never
+	// fills.
+	webhookRetries        = make(chan webhookDelivery, webhookMaxRetries)
+	webhookRetriesPending atomic.Int64
+
+	webhooksDelivered = NewCounter("ppe_webhooks_delivered_total", "Webhook deliveries acknowledged with a 2xx.")
+	webhooksFailed    = NewCounter("ppe_webhooks_failed_total", "Webhook deliveries that failed after all retries.")
+	webhooksDropped   = NewCounter("ppe_webhooks_dropped_total", "Webhooks dropped because the delivery queue was full.")
+)
+
+// ConfigureWebhooks reads WEBHOOK_URLS, WEBHOOK_SECRET and WEBHOOK_EVENTS
+// (which defaults to every type) and starts the delivery worker.
+func ConfigureWebhooks() {
+	webhookURLs = GetEnvList("WEBHOOK_URLS", nil)
+	if len(webhookURLs) == 0 {
+		return
+	}
+	webhookSecret = GetEnv("WEBHOOK_SECRET")
+	webhookTypes = GetEnvList("WEBHOOK_EVENTS", []string{WebhookPaymentReceived, WebhookNewUser, WebhookBalanceExhausted, WebhookEventRejected, WebhookEscrowHeld})
+
+	Supervise("webhook dispatcher", RunWebhookDispatcher)
+	Supervise("webhook retrier", RunWebhookRetrier)
+}
+
+func WebhookEnabled(kind string) bool {
+	return len(webhookURLs) > 0 && slices.Contains(webhookTypes, kind)
+}
+
+// FireWebhook queues a notification without blocking the caller. It's a no-op
+// when webhooks aren't configured or the type wasn't subscribed to.
+func FireWebhook(kind string, data any) {
+	if !WebhookEnabled(kind) {
+		return
+	}
+
+	select {
+	case webhookQueue <- WebhookPayload{Type: kind, CreatedAt: nostr.Now(), Data: data}:
+	default:
+		webhooksDropped.Inc()
+	}
+}
+
+// NotifyBalanceExhausted fires balance.exhausted when a debit takes
+// pubkey's balance from positive to nothing, rather than on every event
+// saved while it stays there.
+func NotifyBalanceExhausted(pubkey string, beforeMsat int64, afterMsat int64) {
+	if beforeMsat > 0 && afterMsat <= 0 {
+		FireWebhook(WebhookBalanceExhausted, map[string]any{"pubkey": pubkey})
+	}
+}
+
+// RunWebhookDispatcher makes the first delivery attempt of each payload,
+// leaving failures to RunWebhookRetrier so a slow endpoint's backoff doesn't
+// hold up everything queued behind it.
+func RunWebhookDispatcher() {
+	for payload := range webhookQueue {
+		body, _ := json.Marshal(payload)
+		for _, url := range webhookURLs {
+			delivery := webhookDelivery{url: url, kind: payload.Type, body: body, attempt: 1}
+			if !DeliverWebhook(delivery.url, delivery.kind, delivery.body) {
+				retryWebhook(delivery)
+			}
+		}
+	}
+}
+
+func RunWebhookRetrier() {
+	for delivery := range webhookRetries {
+		webhookRetriesPending.Add(-1)
+		if !DeliverWebhook(delivery.url, delivery.kind, delivery.body) {
+			retryWebhook(delivery)
+		}
+	}
+}
+
+// retryWebhook queues a failed delivery for another attempt after 1s, then
+// 4s, giving up after webhookAttempts or when too many are waiting.
+func retryWebhook(delivery webhookDelivery) {
+	if delivery.attempt >= webhookAttempts {
+		webhooksFailed.Inc()
+		return
+	}
+	if webhookRetriesPending.Add(1) > webhookMaxRetries {
+		webhookRetriesPending.Add(-1)
+		webhooksFailed.Inc()
+		return
+	}
+	backoff := time.Second << (2 * (delivery.attempt - 1))
+	delivery.attempt++
+	time.AfterFunc(backoff, func() { webhookRetries <- delivery })
+}
+
+// DeliverWebhook POSTs the body signed with HMAC-SHA256 of the shared secret
+// in X-PPE-Signature. It returns false when the attempt failed and is worth
+// retrying.
+func DeliverWebhook(url string, kind string, body []byte) bool {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Error creating webhook request: %v\n", err)
+		return true
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-PPE-Event", kind)
+	request.Header.Set("X-PPE-Signature", signature)
+
+	response, err := httpClient.Do(request)
+	if err == nil {
+		response.Body.Close()
+		if response.StatusCode < 300 {
+			webhooksDelivered.Inc()
+			return true
+		}
+		err = fmt.Errorf("status %s", response.Status)
+	}
+	fmt.Printf("webhook %s to %s failed: %v\n", kind, url, err)
+	return false
+}
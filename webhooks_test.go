@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestBalanceExhaustedFiresOnCrossingZero(t *testing.T) {
+	webhookURLs, webhookTypes = []string{"http://127.0.0.1:0"}, []string{WebhookBalanceExhausted}
+	t.Cleanup(func() { webhookURLs, webhookTypes = nil, nil })
+
+	NotifyBalanceExhausted("alice", 5000, 1000)
+	NotifyBalanceExhausted("alice", 1000, 0)
+	NotifyBalanceExhausted("alice", 0, -1000)
+	NotifyBalanceExhausted("alice", -1000, -2000)
+
+	if len(webhookQueue) != 1 {
+		t.Fatalf("%d webhooks queued, expected one for crossing zero", len(webhookQueue))
+	}
+	if payload := <-webhookQueue; payload.Type != WebhookBalanceExhausted {
+		t.Fatalf("queued %s", payload.Type)
+	}
+}
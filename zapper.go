@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"sync"
+	"time"
+)
+
+// A zap receipt is only as good as whoever signed it: its invoice and
+// preimage could come from any node, so only receipts signed by the
+// nostrPubkey of the lightning address paid (NIP-57 appendix F) are
+// credited. That's ZAPPER_PUBKEYS when set, otherwise the nostrPubkey of
+// LIGHTNING_ADDRESS or, for relays topped up by zapping the bot, of the
+// lud16 in the bot's profile. Looked up ones are refreshed every
+// zapperRefresh, keeping the last known on failure.
+var (
+	zapperPubkeys   []string
+	zapperCheckedAt time.Time
+	zapperLock      sync.Mutex
+
+	zapperRefresh = time.Hour
+
+	zapsWrongSigner = NewCounter("ppe_zaps_wrong_signer_total", "Zap receipts not credited for being signed by someone other than the zapper.")
+)
+
+// GetZapperPubkeys returns the pubkeys allowed to sign zap receipts, nil
+// while there's no knowing.
+func GetZapperPubkeys() []string {
+	if pubkeys := GetEnvList("ZAPPER_PUBKEYS", nil); len(pubkeys) > 0 {
+		return pubkeys
+	}
+
+	zapperLock.Lock()
+	defer zapperLock.Unlock()
+	if zapperPubkeys != nil && time.Since(zapperCheckedAt) < zapperRefresh {
+		return zapperPubkeys
+	}
+	zapperCheckedAt = time.Now()
+
+	address := GetEnvDefault("LIGHTNING_ADDRESS", "")
+	if address == "" {
+		address = getBotLightningAddress()
+	}
+	if address == "" {
+		return zapperPubkeys
+	}
+	params, err := (&LNURLPayBackend{Address: address, Client: httpClient}).PayParams()
+	if err != nil || !nostr.IsValidPublicKey(params.NostrPubkey) {
+		if err == nil {
+			err = errors.New("lightning address has no valid nostrPubkey")
+		}
+		ReportError(err, "zapper", map[string]string{"address": address})
+		return zapperPubkeys
+	}
+	zapperPubkeys = []string{params.NostrPubkey}
+	return zapperPubkeys
+}
+
+// getBotLightningAddress is the lud16 of the bot's latest profile upstream.
+func getBotLightningAddress() string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var latest *nostr.Event
+	for event := range pool.SubManyEose(ctx, relays, []nostr.Filter{{Kinds: []int{0}, Authors: []string{botPubkey}, Limit: 1}}) {
+		if latest == nil || event.CreatedAt > latest.CreatedAt {
+			latest = event.Event
+		}
+	}
+	if latest == nil {
+		return ""
+	}
+	var profile struct {
+		LUD16 string `json:"lud16"`
+	}
+	json.Unmarshal([]byte(latest.Content), &profile)
+	return profile.LUD16
+}